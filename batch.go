@@ -14,7 +14,10 @@ type BatchWithFlusher struct {
 	db    corestore.KVStoreWithBatch // This is only used to create new batch
 	batch corestore.Batch            // Batched writing buffer.
 
-	flushThreshold int // The threshold to flush the batch to disk.
+	flushThreshold int  // The threshold to flush the batch to disk.
+	reserved       int  // The number of bytes expected to be written, see Reserve.
+	pending        int  // The number of key / value bytes written to the current batch.
+	held           bool // The flushes are deferred to the next Write, see holdFlushes.
 }
 
 var _ corestore.Batch = (*BatchWithFlusher)(nil)
@@ -56,13 +59,14 @@ func (b *BatchWithFlusher) Set(key, value []byte) error {
 	if err != nil {
 		return err
 	}
-	if batchSizeAfter > b.flushThreshold {
+	if batchSizeAfter > b.flushThreshold && !b.held {
 		b.mtx.Unlock()
 		if err := b.Write(); err != nil {
 			return err
 		}
 		b.mtx.Lock()
 	}
+	b.pending += len(key) + len(value)
 	return b.batch.Set(key, value)
 }
 
@@ -78,16 +82,64 @@ func (b *BatchWithFlusher) Delete(key []byte) error {
 	if err != nil {
 		return err
 	}
-	if batchSizeAfter > b.flushThreshold {
+	if batchSizeAfter > b.flushThreshold && !b.held {
 		b.mtx.Unlock()
 		if err := b.Write(); err != nil {
 			return err
 		}
 		b.mtx.Lock()
 	}
+	b.pending += len(key)
 	return b.batch.Delete(key)
 }
 
+// Reserve hints the number of bytes which are expected to be written before the data is
+// committed. If nothing was written to the current batch yet, it is re-allocated to fit the
+// expected size (capped at flushThreshold), and the batches created by intermediate flushes
+// are sized to the remaining part of the reservation, which avoids growing the batch buffer
+// repeatedly as well as over-allocating it for small commits.
+func (b *BatchWithFlusher) Reserve(size int) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if size <= 0 || b.pending > 0 {
+		return nil
+	}
+	b.reserved = size
+	if size >= b.flushThreshold {
+		// the current batch is already allocated with the maximum size
+		return nil
+	}
+	if err := b.batch.Close(); err != nil {
+		return err
+	}
+	b.batch = b.db.NewBatchWithSize(b.nextBatchSize())
+	return nil
+}
+
+// nextBatchSize consumes the written bytes from the reservation and returns the size of the
+// next batch to be allocated. It must be called with the lock held.
+func (b *BatchWithFlusher) nextBatchSize() int {
+	b.reserved -= b.pending
+	b.pending = 0
+	if b.reserved <= 0 {
+		b.reserved = 0
+		return b.flushThreshold
+	}
+	if b.reserved < b.flushThreshold {
+		return b.reserved
+	}
+	return b.flushThreshold
+}
+
+// holdFlushes defers the flushes of the batch to the next Write when held is true, so that
+// nothing is written until then, and lets the batch flush again otherwise.
+func (b *BatchWithFlusher) holdFlushes(held bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.held = held
+}
+
 func (b *BatchWithFlusher) Write() error {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
@@ -98,7 +150,7 @@ func (b *BatchWithFlusher) Write() error {
 	if err := b.batch.Close(); err != nil {
 		return err
 	}
-	b.batch = b.db.NewBatchWithSize(b.flushThreshold)
+	b.batch = b.db.NewBatchWithSize(b.nextBatchSize())
 	return nil
 }
 
@@ -112,7 +164,7 @@ func (b *BatchWithFlusher) WriteSync() error {
 	if err := b.batch.Close(); err != nil {
 		return err
 	}
-	b.batch = b.db.NewBatchWithSize(b.flushThreshold)
+	b.batch = b.db.NewBatchWithSize(b.nextBatchSize())
 	return nil
 }
 
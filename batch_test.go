@@ -63,3 +63,72 @@ func testBatchWithFlusher(t *testing.T) {
 		keyNonce++
 	}
 }
+
+func TestBatchWithFlusherReserve(t *testing.T) {
+	dir := t.TempDir()
+	var dbs []*dbm.GoLevelDB
+	for i, reserve := range []int{0, 10000 * 300, 10000 * 10} {
+		name := fmt.Sprintf("test_reserve_%d", i)
+		db, err := dbm.NewGoLevelDB(name, dir)
+		require.NoError(t, err)
+		defer cleanupDBDir(dir, name)
+		dbs = append(dbs, db)
+
+		batchWithFlusher := NewBatchWithFlusher(db, DefaultOptions().FlushThreshold)
+		require.NoError(t, batchWithFlusher.Reserve(reserve))
+		for keyNonce := uint16(0); keyNonce < 300; keyNonce++ {
+			require.NoError(t, batchWithFlusher.Set(makeKey(keyNonce), bytesArrayOfSize10KB[:]))
+		}
+		require.NoError(t, batchWithFlusher.Delete(makeKey(7)))
+		require.NoError(t, batchWithFlusher.Write())
+		// the reservation is released once it has been consumed
+		require.Zero(t, batchWithFlusher.reserved)
+	}
+
+	for _, db := range dbs[1:] {
+		expected, err := dbs[0].Iterator(nil, nil)
+		require.NoError(t, err)
+		actual, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		for ; expected.Valid(); expected.Next() {
+			require.True(t, actual.Valid())
+			require.Equal(t, expected.Key(), actual.Key())
+			require.Equal(t, expected.Value(), actual.Value())
+			actual.Next()
+		}
+		require.False(t, actual.Valid())
+		expected.Close()
+		actual.Close()
+	}
+}
+
+func BenchmarkBatchWithFlusherReserve(b *testing.B) {
+	name := fmt.Sprintf("bench_%x", randstr(12))
+	dir := b.TempDir()
+	db, err := dbm.NewGoLevelDB(name, dir)
+	require.NoError(b, err)
+	defer cleanupDBDir(dir, name)
+
+	value := make([]byte, 100)
+	// a commit of 1000 entries, larger than the default flush threshold
+	commit := func(batch *BatchWithFlusher, reserve bool) {
+		if reserve {
+			require.NoError(b, batch.Reserve(1000*(2+len(value))))
+		}
+		for keyNonce := uint16(0); keyNonce < 1000; keyNonce++ {
+			require.NoError(b, batch.Set(makeKey(keyNonce), value))
+		}
+		require.NoError(b, batch.Write())
+	}
+
+	for _, reserve := range []bool{false, true} {
+		b.Run(fmt.Sprintf("reserve=%v", reserve), func(b *testing.B) {
+			batch := NewBatchWithFlusher(db, DefaultOptions().FlushThreshold)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				commit(batch, reserve)
+			}
+		})
+	}
+}
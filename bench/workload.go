@@ -0,0 +1,115 @@
+// Package bench provides deterministic workloads and drivers to benchmark IAVL trees, so that
+// the results of different setups and machines can be compared.
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/cosmos/iavl"
+)
+
+// GenerateWorkload returns numKeys pairs of distinct random keys of keyLen bytes and random values
+// of valueLen bytes, in generation order. The same seed always returns the same workload. It
+// panics if keyLen bytes cannot hold numKeys distinct keys.
+func GenerateWorkload(seed int64, numKeys, keyLen, valueLen int) []iavl.KVPair {
+	if keyLen < 8 && numKeys > 1<<(8*keyLen) {
+		panic(fmt.Sprintf("cannot generate %d distinct keys of %d bytes", numKeys, keyLen))
+	}
+	r := rand.New(rand.NewSource(seed))
+	pairs := make([]iavl.KVPair, 0, numKeys)
+	seen := make(map[string]struct{}, numKeys)
+	for len(pairs) < numKeys {
+		key := randBytes(r, keyLen)
+		if _, ok := seen[string(key)]; ok {
+			continue
+		}
+		seen[string(key)] = struct{}{}
+		pairs = append(pairs, iavl.KVPair{Key: key, Value: randBytes(r, valueLen)})
+	}
+	return pairs
+}
+
+func randBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	_, _ = r.Read(b) // never fails
+	return b
+}
+
+// Mix sets the relative weights of the operations run by Run.
+type Mix struct {
+	Sets     int
+	Gets     int
+	Iterates int
+}
+
+// Stats counts the operations run by Run.
+type Stats struct {
+	Sets     int
+	Gets     int
+	Hits     int // Gets returning a value
+	Iterates int
+	Iterated int // pairs visited by Iterates
+}
+
+// Load sets all the pairs of workload in tree and saves a version every commitEvery pairs, or only
+// once at the end if commitEvery is not positive.
+func Load(tree *iavl.MutableTree, workload []iavl.KVPair, commitEvery int) error {
+	for i, pair := range workload {
+		if _, err := tree.Set(pair.Key, pair.Value); err != nil {
+			return fmt.Errorf("setting pair %d: %w", i, err)
+		}
+		if commitEvery > 0 && (i+1)%commitEvery == 0 {
+			if _, _, err := tree.SaveVersion(); err != nil {
+				return err
+			}
+		}
+	}
+	if commitEvery <= 0 || len(workload)%commitEvery != 0 {
+		if _, _, err := tree.SaveVersion(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run runs ops operations on tree, chosen at random according to mix with the given seed:
+// Sets overwrite the value of a workload key, Gets read a workload key and Iterates scan up to
+// iterateLen pairs from a workload key. The same seed, workload and tree contents always run the
+// same operations. The changes are not saved.
+func Run(tree *iavl.MutableTree, workload []iavl.KVPair, mix Mix, ops, iterateLen int, seed int64) (Stats, error) {
+	var stats Stats
+	total := mix.Sets + mix.Gets + mix.Iterates
+	if total <= 0 || len(workload) == 0 {
+		return stats, fmt.Errorf("invalid mix %+v for %d keys", mix, len(workload))
+	}
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < ops; i++ {
+		pair := workload[r.Intn(len(workload))]
+		switch op := r.Intn(total); {
+		case op < mix.Sets:
+			if _, err := tree.Set(pair.Key, randBytes(r, len(pair.Value))); err != nil {
+				return stats, err
+			}
+			stats.Sets++
+		case op < mix.Sets+mix.Gets:
+			value, err := tree.Get(pair.Key)
+			if err != nil {
+				return stats, err
+			}
+			stats.Gets++
+			if value != nil {
+				stats.Hits++
+			}
+		default:
+			n := 0
+			tree.IterateRange(pair.Key, nil, true, func(_, _ []byte) bool {
+				n++
+				return n >= iterateLen
+			})
+			stats.Iterates++
+			stats.Iterated += n
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,95 @@
+package bench
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/cosmos/iavl"
+	dbm "github.com/cosmos/iavl/db"
+)
+
+func TestGenerateWorkload(t *testing.T) {
+	workload := GenerateWorkload(42, 1000, 4, 16)
+	require.Len(t, workload, 1000)
+	require.Equal(t, workload, GenerateWorkload(42, 1000, 4, 16))
+	require.NotEqual(t, workload, GenerateWorkload(43, 1000, 4, 16))
+
+	seen := make(map[string]struct{})
+	for _, pair := range workload {
+		require.Len(t, pair.Key, 4)
+		require.Len(t, pair.Value, 16)
+		seen[string(pair.Key)] = struct{}{}
+	}
+	require.Len(t, seen, 1000, "keys must be distinct")
+
+	require.Len(t, GenerateWorkload(1, 256, 1, 0), 256)
+	require.Panics(t, func() { GenerateWorkload(1, 257, 1, 0) })
+}
+
+func TestLoadAndRun(t *testing.T) {
+	workload := GenerateWorkload(7, 500, 8, 32)
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger())
+	require.NoError(t, Load(tree, workload, 100))
+	require.EqualValues(t, 5, tree.Version())
+
+	for _, pair := range workload {
+		value, err := tree.Get(pair.Key)
+		require.NoError(t, err)
+		require.Equal(t, pair.Value, value)
+	}
+	sorted := append([]iavl.KVPair(nil), workload...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0 })
+	i := 0
+	_, err := tree.Iterate(func(key, value []byte) bool {
+		require.Equal(t, sorted[i].Key, key)
+		require.Equal(t, sorted[i].Value, value)
+		i++
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(workload), i)
+
+	mix := Mix{Sets: 1, Gets: 2, Iterates: 1}
+	stats, err := Run(tree, workload, mix, 1000, 10, 3)
+	require.NoError(t, err)
+	require.Equal(t, 1000, stats.Sets+stats.Gets+stats.Iterates)
+	require.Positive(t, stats.Sets)
+	require.Positive(t, stats.Iterates)
+	require.Equal(t, stats.Gets, stats.Hits, "all workload keys are in the tree")
+	require.LessOrEqual(t, stats.Iterated, 10*stats.Iterates)
+	require.Positive(t, stats.Iterated)
+
+	// the same seed runs the same operations on the same contents
+	other := iavl.NewMutableTree(dbm.NewMemDB(), 0, false, iavl.NewNopLogger())
+	require.NoError(t, Load(other, workload, 0))
+	require.EqualValues(t, 1, other.Version())
+	otherStats, err := Run(other, workload, mix, 1000, 10, 3)
+	require.NoError(t, err)
+	require.Equal(t, stats, otherStats)
+	require.Equal(t, contents(t, tree), contents(t, other))
+
+	_, err = Run(tree, workload, Mix{}, 1, 1, 1)
+	require.Error(t, err)
+}
+
+func contents(t *testing.T, tree *iavl.MutableTree) []iavl.KVPair {
+	var pairs []iavl.KVPair
+	_, err := tree.Iterate(func(key, value []byte) bool {
+		pairs = append(pairs, iavl.KVPair{Key: bytes.Clone(key), Value: bytes.Clone(value)})
+		return false
+	})
+	require.NoError(t, err)
+	return pairs
+}
+
+func BenchmarkRun(b *testing.B) {
+	workload := GenerateWorkload(1, 10000, 16, 64)
+	tree := iavl.NewMutableTree(dbm.NewMemDB(), 10000, false, iavl.NewNopLogger())
+	require.NoError(b, Load(tree, workload, 1000))
+	b.ResetTimer()
+	_, err := Run(tree, workload, Mix{Sets: 1, Gets: 8, Iterates: 1}, b.N, 10, 1)
+	require.NoError(b, err)
+}
@@ -0,0 +1,135 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// sortedBuildNode is a node of the tree built by BuildFromSorted, before it is imported.
+type sortedBuildNode struct {
+	left, right *sortedBuildNode
+	height      int8
+	pair        int // the index of the pair of a leaf
+}
+
+// BuildFromSorted builds the tree of version from pairs, whose keys must be strictly ascending,
+// and makes it the saved version, like Import. The tree has the same shape and root hash as the
+// one obtained by setting the pairs in order on an empty tree and saving it as version, but it is
+// built in linear time: ascending Sets only rebalance the right spine of the tree, which is
+// tracked without descending from the root. The tree must be empty.
+func (tree *MutableTree) BuildFromSorted(version int64, pairs []KVPair) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	for i, pair := range pairs {
+		if pair.Delete {
+			return fmt.Errorf("%w: pair %d is a deletion", ErrInvalidInputs, i)
+		}
+		if pair.Value == nil {
+			return fmt.Errorf("pair %d: attempt to store nil value at key '%s'", i, pair.Key)
+		}
+		if i > 0 && bytes.Compare(pairs[i-1].Key, pair.Key) >= 0 {
+			return fmt.Errorf("%w: key %X of pair %d is not greater than the previous key", ErrInvalidInputs, pair.Key, i)
+		}
+		if err := tree.validateKey(pair.Key); err != nil {
+			return fmt.Errorf("pair %d: %w", i, err)
+		}
+	}
+
+	importer, err := tree.Import(version)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+	if len(pairs) > 0 {
+		root := buildSortedTree(len(pairs))
+		if _, err := importer.addSortedTree(root, version, pairs); err != nil {
+			return err
+		}
+	}
+	return importer.Commit()
+}
+
+// buildSortedTree returns the shape of the tree of n ascending Sets, applying the rotations of
+// MutableTree.balance along the right spine, from the new leaf up to the first node whose height
+// is unchanged.
+func buildSortedTree(n int) *sortedBuildNode {
+	height := func(node *sortedBuildNode) int8 {
+		if node.left == nil {
+			return 0
+		}
+		return maxInt8(node.left.height, node.right.height) + 1
+	}
+	rotateLeft := func(node *sortedBuildNode) *sortedBuildNode {
+		right := node.right
+		node.right = right.left
+		right.left = node
+		node.height = height(node)
+		right.height = height(right)
+		return right
+	}
+	rotateRight := func(node *sortedBuildNode) *sortedBuildNode {
+		left := node.left
+		node.left = left.right
+		left.right = node
+		node.height = height(node)
+		left.height = height(left)
+		return left
+	}
+
+	root := &sortedBuildNode{pair: 0}
+	// spine holds the right spine, from the root to the rightmost leaf
+	spine := []*sortedBuildNode{root}
+	for i := 1; i < n; i++ {
+		last := len(spine) - 1
+		// the new inner node replaces the rightmost leaf, whose height it starts from
+		inner := &sortedBuildNode{left: spine[last], right: &sortedBuildNode{pair: i}}
+		spine[last] = inner
+		spine = append(spine, inner.right)
+		for j := last; j >= 0; j-- {
+			node := spine[j]
+			prevHeight := node.height
+			node.height = height(node)
+			if node.left.height-node.right.height < -1 {
+				if node.right.left.height > node.right.right.height {
+					// the former left child of the right child becomes the parent of the right
+					// child, which stays on the spine
+					node.right = rotateRight(node.right)
+				} else {
+					// the right child replaces node on the spine
+					spine = append(spine[:j+1], spine[j+2:]...)
+				}
+				node = rotateLeft(node)
+				spine[j] = node
+			}
+			if j > 0 {
+				spine[j-1].right = node
+			}
+			if node.height == prevHeight {
+				break
+			}
+		}
+	}
+	return spine[0]
+}
+
+// addSortedTree adds the subtree of node in post-order, and returns the index of its leftmost
+// pair, whose key is the key of the parent of a right subtree.
+func (i *Importer) addSortedTree(node *sortedBuildNode, version int64, pairs []KVPair) (int, error) {
+	if node.left == nil {
+		pair := pairs[node.pair]
+		return node.pair, i.Add(&ExportNode{Key: pair.Key, Value: pair.Value, Version: version, Height: 0})
+	}
+	first, err := i.addSortedTree(node.left, version, pairs)
+	if err != nil {
+		return 0, err
+	}
+	rightFirst, err := i.addSortedTree(node.right, version, pairs)
+	if err != nil {
+		return 0, err
+	}
+	return first, i.Add(&ExportNode{Key: pairs[rightFirst].Key, Version: version, Height: node.height})
+}
@@ -32,6 +32,10 @@ type Cache interface {
 
 	// Len returns the cache length.
 	Len() int
+
+	// Trim removes the least recently used nodes until the total size of the remaining ones, as
+	// returned by size, is at most targetBytes, and returns that total.
+	Trim(targetBytes int64, size func(Node) int64) int64
 }
 
 // lruCache is an LRU cache implementation.
@@ -103,6 +107,17 @@ func (c *lruCache) Remove(key []byte) Node {
 	return nil
 }
 
+func (c *lruCache) Trim(targetBytes int64, size func(Node) int64) int64 {
+	var total int64
+	for e := c.ll.Front(); e != nil; e = e.Next() {
+		total += size(e.Value.(Node))
+	}
+	for total > targetBytes && c.ll.Len() > 0 {
+		total -= size(c.remove(c.ll.Back()))
+	}
+	return total
+}
+
 func (c *lruCache) remove(e *list.Element) Node {
 	removed := c.ll.Remove(e).(Node)
 	delete(c.dict, ibytes.UnsafeBytesToStr(removed.GetKey()))
@@ -307,3 +307,25 @@ func randBytes(length int) []byte {
 	rand.Read(key) //nolint:errcheck
 	return key
 }
+
+func Test_Cache_Trim(t *testing.T) {
+	size := func(n cache.Node) int64 {
+		return int64(len(n.GetKey()))
+	}
+	c := cache.New(len(testNodes))
+	for _, n := range testNodes {
+		require.Nil(t, c.Add(n))
+	}
+	require.EqualValues(t, 3*len(testNodes[0].GetKey()), c.Trim(100, size))
+	require.Equal(t, 3, c.Len())
+
+	// the least recently used nodes are removed first
+	require.NotNil(t, c.Get(testNodes[0].GetKey()))
+	require.EqualValues(t, 2*len(testNodes[0].GetKey()), c.Trim(int64(2*len(testNodes[0].GetKey())+1), size))
+	require.True(t, c.Has(testNodes[0].GetKey()))
+	require.False(t, c.Has(testNodes[1].GetKey()))
+	require.True(t, c.Has(testNodes[2].GetKey()))
+
+	require.Zero(t, c.Trim(0, size))
+	require.Zero(t, c.Len())
+}
@@ -0,0 +1,81 @@
+package iavl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+)
+
+// A canonical node stream holds a record for each node of a tree, in ascending order of the node
+// hashes. A record is the 32-byte hash of the node, the height, size and version of the node as
+// zigzag varints, and the length-prefixed key, where lengths are uvarints. It is followed by the
+// length-prefixed value for a leaf, and by the 32-byte hashes of the left and right children for
+// an inner node. The empty tree has an empty stream.
+
+// CanonicalNodeStream writes the canonical node stream of the tree to w, which only depends on
+// the contents of the tree and the versions of its nodes, unlike the storage or the export order,
+// so that implementations can compare its hash. The whole stream is held in memory.
+func (t *ImmutableTree) CanonicalNodeStream(w io.Writer) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	if t.noHash() {
+		return ErrHashingDisabled
+	}
+	if t.root == nil {
+		return nil
+	}
+	t.Hash()
+
+	var records [][]byte
+	var walk func(node *Node) error
+	walk = func(node *Node) error {
+		version := t.version + 1
+		if node.nodeKey != nil {
+			version = node.nodeKey.version
+		}
+		record := append([]byte{}, node.hash...)
+		record = binary.AppendVarint(record, int64(node.subtreeHeight))
+		record = binary.AppendVarint(record, node.size)
+		record = binary.AppendVarint(record, version)
+		record = binary.AppendUvarint(record, uint64(len(node.key)))
+		record = append(record, node.key...)
+		if node.isLeaf() {
+			record = binary.AppendUvarint(record, uint64(len(node.value)))
+			record = append(record, node.value...)
+			records = append(records, record)
+			return nil
+		}
+
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		record = append(record, leftNode.hash...)
+		record = append(record, rightNode.hash...)
+		records = append(records, record)
+		if err := walk(leftNode); err != nil {
+			return err
+		}
+		return walk(rightNode)
+	}
+	if err := walk(t.root); err != nil {
+		return err
+	}
+
+	// the records start with the hashes
+	sort.Slice(records, func(i, j int) bool {
+		return bytes.Compare(records[i][:hashSize], records[j][:hashSize]) < 0
+	})
+	for _, record := range records {
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package iavl
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// A change set stream holds a record for each operation of a change set, in order. A record is
+// the operation type byte followed by the length-prefixed key, and by the length-prefixed value
+// for a Set, where lengths are uvarints.
+const (
+	changeSetStreamSet    byte = 1
+	changeSetStreamRemove byte = 2
+)
+
+// ErrInvalidChangeSetStream is returned when a serialized change set is malformed.
+var ErrInvalidChangeSetStream = errors.New("invalid change set stream")
+
+// WriteChangeSetStream serializes the pairs of cs to w, which can be applied to a tree with
+// MutableTree.ApplyChangeSetStream.
+func WriteChangeSetStream(w io.Writer, cs *ChangeSet) error {
+	bw := bufio.NewWriter(w)
+	for _, pair := range cs.Pairs {
+		op := changeSetStreamSet
+		if pair.Delete {
+			op = changeSetStreamRemove
+		}
+		if err := bw.WriteByte(op); err != nil {
+			return fmt.Errorf("writing operation, %w", err)
+		}
+		if err := encoding.EncodeBytes(bw, pair.Key); err != nil {
+			return fmt.Errorf("writing key, %w", err)
+		}
+		if !pair.Delete {
+			if err := encoding.EncodeBytes(bw, pair.Value); err != nil {
+				return fmt.Errorf("writing value, %w", err)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// ApplyChangeSetStream reads the operations serialized by WriteChangeSetStream from r and applies
+// them to the working tree as they are read, in order, until the end of the stream. It returns
+// the number of operations applied, which were applied even if an error is returned. Removing a
+// missing key is not an error. No version is saved.
+func (tree *MutableTree) ApplyChangeSetStream(r io.Reader) (int, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	if tree.prepared {
+		return 0, ErrCommitPrepared
+	}
+	br := bufio.NewReader(r)
+	applied := 0
+	for {
+		op, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return applied, nil
+		}
+		if err != nil {
+			return applied, fmt.Errorf("%w: operation %d: %w", ErrInvalidChangeSetStream, applied, err)
+		}
+		if op != changeSetStreamSet && op != changeSetStreamRemove {
+			return applied, fmt.Errorf("%w: operation %d: unknown type %d", ErrInvalidChangeSetStream, applied, op)
+		}
+		key, err := readStreamBytes(br)
+		if err != nil {
+			return applied, fmt.Errorf("%w: operation %d: reading key, %w", ErrInvalidChangeSetStream, applied, err)
+		}
+
+		if op == changeSetStreamRemove {
+			if _, _, err := tree.Remove(key); err != nil {
+				return applied, err
+			}
+		} else {
+			value, err := readStreamBytes(br)
+			if err != nil {
+				return applied, fmt.Errorf("%w: operation %d: reading value, %w", ErrInvalidChangeSetStream, applied, err)
+			}
+			if _, err := tree.Set(key, value); err != nil {
+				return applied, err
+			}
+		}
+		applied++
+	}
+}
@@ -0,0 +1,140 @@
+package iavl
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCommitPrepared is returned when the tree is saved or modified, or anything else is written
+// to disk, while a commit prepared with PrepareCommit is neither committed nor aborted.
+var ErrCommitPrepared = errors.New("a prepared commit is pending")
+
+// CommitHandle is a version prepared with MutableTree.PrepareCommit, which is made visible by
+// Commit or discarded by Abort. Only one of them can be called, once.
+type CommitHandle interface {
+	// Version returns the prepared version.
+	Version() int64
+	// Commit writes the prepared version to disk, like SaveVersion, and returns its hash.
+	Commit() ([]byte, int64, error)
+	// Abort discards the prepared version and resets the working tree to the last saved
+	// version, like Rollback.
+	Abort() error
+}
+
+type preparedCommit struct {
+	tree     *MutableTree
+	version  int64
+	resolved bool
+
+	// the state changed by stageVersion, restored by Abort
+	newNodes          uint32
+	firstVersion      int64
+	initialVersionSet bool
+	legacyRoot        bool
+}
+
+var _ CommitHandle = (*preparedCommit)(nil)
+
+// PrepareCommit writes the working tree to the batch as the next version, like SaveVersion, but
+// does not commit it, so that it can be committed along with another store. The version is not
+// visible until CommitHandle.Commit is called, and the batch is not flushed to disk before, even
+// beyond Options.FlushThreshold. Until the handle is resolved, the methods which modify the tree
+// or write to disk, e.g. DeleteVersionsTo or LoadVersion, return ErrCommitPrepared.
+// AsyncPruning is not supported, nor preparing a version which already exists.
+func (tree *MutableTree) PrepareCommit() (CommitHandle, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if tree.prepared {
+		return nil, ErrCommitPrepared
+	}
+	if tree.ndb.opts.AsyncPruning {
+		return nil, errors.New("cannot prepare a commit with AsyncPruning")
+	}
+	version := tree.WorkingVersion()
+	if tree.VersionExists(version) {
+		return nil, fmt.Errorf("version %d already exists", version)
+	}
+	if err := tree.preCommit(version); err != nil {
+		return nil, err
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	handle := &preparedCommit{
+		tree:              tree,
+		version:           version,
+		newNodes:          countUnsavedNodes(tree.root),
+		firstVersion:      firstVersion,
+		initialVersionSet: tree.initialVersionSet,
+		legacyRoot:        tree.root != nil && tree.root.isLegacy,
+	}
+	tree.initialVersionSet = false
+	tree.ndb.holdFlushes(true)
+	if err := tree.stageVersion(version); err != nil {
+		handle.discard()
+		return nil, err
+	}
+	tree.prepared = true
+	return handle, nil
+}
+
+func (c *preparedCommit) Version() int64 {
+	return c.version
+}
+
+func (c *preparedCommit) Commit() ([]byte, int64, error) {
+	if c.resolved {
+		return nil, c.version, errors.New("prepared commit is already resolved")
+	}
+	c.resolved = true
+	c.tree.prepared = false
+	c.tree.ndb.holdFlushes(false)
+	return c.tree.finishVersion(c.version)
+}
+
+func (c *preparedCommit) Abort() error {
+	if c.resolved {
+		return errors.New("prepared commit is already resolved")
+	}
+	c.resolved = true
+	c.tree.prepared = false
+	c.discard()
+	if c.tree.ndb.opts.WAL != nil {
+		// the change set of the version is not replayed by RecoverFromWAL
+		return writeWALRecord(c.tree.ndb.opts.WAL, walRecordAbort, c.version, nil)
+	}
+	return nil
+}
+
+// discard drops the writes of stageVersion, along with the nodes it cached, and restores the tree
+// to its last saved version.
+func (c *preparedCommit) discard() {
+	tree := c.tree
+	ndb := tree.ndb
+	ndb.mtx.Lock()
+	ndb.discardBatches()
+	// saveNewNodes numbers the new nodes of the version from 1
+	for nonce := uint32(1); nonce <= c.newNodes; nonce++ {
+		ndb.nodeCache.Remove((&NodeKey{version: c.version, nonce: nonce}).GetKey())
+	}
+	ndb.mtx.Unlock()
+	ndb.resetFirstVersion(c.firstVersion)
+
+	if c.legacyRoot {
+		tree.root.isLegacy = true
+	}
+	tree.Rollback()
+	tree.initialVersionSet = c.initialVersionSet
+}
+
+// countUnsavedNodes returns the number of nodes of the subtree of node without a node key, which
+// saveNewNodes writes.
+func countUnsavedNodes(node *Node) uint32 {
+	if node == nil || node.nodeKey != nil {
+		return 0
+	}
+	return 1 + countUnsavedNodes(node.leftNode) + countUnsavedNodes(node.rightNode)
+}
@@ -0,0 +1,75 @@
+package iavl
+
+import (
+	"context"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// contextCheckInterval is the number of pairs a ContextIterator yields between checks of its
+// context.
+const contextCheckInterval = 64
+
+// ContextIterator yields the pairs of another iterator until a context is done, after which it is
+// invalid and its error is the error of the context. The context is checked when the iterator is
+// created and every contextCheckInterval pairs, so that a long iteration is bounded without
+// checking it on every pair. It is created by ImmutableTree.IteratorWithContext.
+type ContextIterator struct {
+	ctx    context.Context
+	source corestore.Iterator
+	count  int
+	err    error
+}
+
+var _ corestore.Iterator = (*ContextIterator)(nil)
+
+// NewContextIterator returns an iterator over the pairs of source until ctx is done. The source
+// iterator must not be used by the caller anymore, and is closed by Close.
+func NewContextIterator(ctx context.Context, source corestore.Iterator) *ContextIterator {
+	return &ContextIterator{ctx: ctx, source: source, err: ctx.Err()}
+}
+
+// Domain implements dbm.Iterator.
+func (iter *ContextIterator) Domain() ([]byte, []byte) {
+	return iter.source.Domain()
+}
+
+// Valid implements dbm.Iterator.
+func (iter *ContextIterator) Valid() bool {
+	return iter.err == nil && iter.source.Valid()
+}
+
+// Key implements dbm.Iterator
+func (iter *ContextIterator) Key() []byte {
+	return iter.source.Key()
+}
+
+// Value implements dbm.Iterator
+func (iter *ContextIterator) Value() []byte {
+	return iter.source.Value()
+}
+
+// Next implements dbm.Iterator
+func (iter *ContextIterator) Next() {
+	if !iter.Valid() {
+		return
+	}
+	iter.source.Next()
+	iter.count++
+	if iter.count%contextCheckInterval == 0 {
+		iter.err = iter.ctx.Err()
+	}
+}
+
+// Close implements dbm.Iterator
+func (iter *ContextIterator) Close() error {
+	return iter.source.Close()
+}
+
+// Error implements dbm.Iterator
+func (iter *ContextIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	return iter.source.Error()
+}
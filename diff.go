@@ -2,6 +2,7 @@ package iavl
 
 import (
 	"bytes"
+	"sort"
 
 	"github.com/cosmos/iavl/proto"
 )
@@ -11,6 +12,28 @@ type (
 	ChangeSet = proto.ChangeSet
 )
 
+// NewKVPair returns a pair setting key to value.
+func NewKVPair(key, value []byte) *KVPair {
+	return &KVPair{Key: key, Value: value}
+}
+
+// NewDeleteKVPair returns a pair deleting key.
+func NewDeleteKVPair(key []byte) *KVPair {
+	return &KVPair{Key: key, Delete: true}
+}
+
+// KVPairsFromMap returns the pairs setting the entries of kvs, sorted by key.
+func KVPairsFromMap(kvs map[string][]byte) []*KVPair {
+	pairs := make([]*KVPair, 0, len(kvs))
+	for k, v := range kvs {
+		pairs = append(pairs, NewKVPair([]byte(k), v))
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0
+	})
+	return pairs
+}
+
 // KVPairReceiver is callback parameter of method `extractStateChanges` to receive stream of `KVPair`s.
 type KVPairReceiver func(pair *KVPair) error
 
@@ -127,7 +150,7 @@ func (ndb *nodeDB) extractStateChanges(prevVersion int64, prevRoot, root []byte,
 	// and compare them with newLeaves to generate `KVPair` stream.
 	for prevIter.Valid() {
 		node := prevIter.GetNode()
-		shared := sharedNode != nil && (node == sharedNode || bytes.Equal(node.hash, sharedNode.hash))
+		shared := sharedNode != nil && (node == sharedNode || isSameNode(node, sharedNode))
 		// skip sub-tree of shared nodes
 		prevIter.Next(shared)
 		if shared {
@@ -150,3 +173,84 @@ func (ndb *nodeDB) extractStateChanges(prevVersion int64, prevRoot, root []byte,
 	}
 	return prevIter.Error()
 }
+
+// TreesEqual returns true if the trees a and b have the same root hash, so the same keys, values
+// and node versions, e.g. a tree and its copy in another database. Otherwise it reports the first
+// key whose leaf differs, or which is in only one of the trees, found by comparing the trees in
+// key order while skipping their subtrees with the same hash. firstDiffKey is nil if the leaves
+// are the same and only the inner nodes differ. Both trees must compute hashes.
+func TreesEqual(a, b *ImmutableTree) (equal bool, firstDiffKey []byte, err error) {
+	if a.noHash() || b.noHash() {
+		return false, nil, ErrHashingDisabled
+	}
+	if bytes.Equal(a.Hash(), b.Hash()) {
+		return true, nil, nil
+	}
+
+	// the stacks hold the subtrees of the leaves which are not compared yet, the next on top
+	type stack struct {
+		tree  *ImmutableTree
+		nodes []*Node
+	}
+	newStack := func(t *ImmutableTree) *stack {
+		s := &stack{tree: t}
+		if t.root != nil {
+			s.nodes = append(s.nodes, t.root)
+		}
+		return s
+	}
+	top := func(s *stack) *Node { return s.nodes[len(s.nodes)-1] }
+	expand := func(s *stack) error {
+		node := top(s)
+		s.nodes = s.nodes[:len(s.nodes)-1]
+		rightNode, err := node.getRightNode(s.tree)
+		if err != nil {
+			return err
+		}
+		leftNode, err := node.getLeftNode(s.tree)
+		if err != nil {
+			return err
+		}
+		s.nodes = append(s.nodes, rightNode, leftNode)
+		return nil
+	}
+	firstKey := func(s *stack) ([]byte, error) {
+		for !top(s).isLeaf() {
+			if err := expand(s); err != nil {
+				return nil, err
+			}
+		}
+		return top(s).key, nil
+	}
+
+	sa, sb := newStack(a), newStack(b)
+	for len(sa.nodes) > 0 && len(sb.nodes) > 0 {
+		na, nb := top(sa), top(sb)
+		switch {
+		case bytes.Equal(na.hash, nb.hash):
+			sa.nodes = sa.nodes[:len(sa.nodes)-1]
+			sb.nodes = sb.nodes[:len(sb.nodes)-1]
+		case na.isLeaf() && nb.isLeaf():
+			if bytes.Compare(na.key, nb.key) <= 0 {
+				return false, na.key, nil
+			}
+			return false, nb.key, nil
+		case na.subtreeHeight >= nb.subtreeHeight:
+			if err := expand(sa); err != nil {
+				return false, nil, err
+			}
+		default:
+			if err := expand(sb); err != nil {
+				return false, nil, err
+			}
+		}
+	}
+	// the remaining keys are in only one of the trees
+	switch {
+	case len(sa.nodes) > 0:
+		firstDiffKey, err = firstKey(sa)
+	case len(sb.nodes) > 0:
+		firstDiffKey, err = firstKey(sb)
+	}
+	return false, firstDiffKey, err
+}
@@ -100,3 +100,79 @@ func genChangeSets(r *rand.Rand, n int) []*ChangeSet {
 	}
 	return changeSets
 }
+
+func TestKVPairHelpers(t *testing.T) {
+	pair := NewKVPair([]byte("key"), []byte("value"))
+	require.Equal(t, &KVPair{Key: []byte("key"), Value: []byte("value")}, pair)
+	require.Equal(t, &KVPair{Key: []byte("key"), Delete: true}, NewDeleteKVPair([]byte("key")))
+
+	// the zero values are kept as is
+	require.Equal(t, &KVPair{}, NewKVPair(nil, nil))
+	var nilPair *KVPair
+	require.Nil(t, nilPair.GetKey())
+	require.Nil(t, nilPair.GetValue())
+	require.False(t, nilPair.GetDelete())
+
+	pairs := KVPairsFromMap(map[string][]byte{"b": {2}, "a": {1}, "": {}})
+	require.Equal(t, []*KVPair{NewKVPair([]byte{}, []byte{}), NewKVPair([]byte("a"), []byte{1}), NewKVPair([]byte("b"), []byte{2})}, pairs)
+	require.Empty(t, KVPairsFromMap(nil))
+}
+
+func TestTreesEqual(t *testing.T) {
+	levelDB, err := dbm.NewGoLevelDB("trees_equal", t.TempDir())
+	require.NoError(t, err)
+	defer levelDB.Close()
+	build := func(db dbm.DB, n int, updates map[int]string) *ImmutableTree {
+		tree := NewMutableTree(db, 0, false, NewNopLogger())
+		for i := 0; i < n; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("value"))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		for i, value := range updates {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(value))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		return tree.ImmutableTree
+	}
+
+	tree := build(dbm.NewMemDB(), 200, map[int]string{42: "updated"})
+	equal, diffKey, err := TreesEqual(tree, build(levelDB, 200, map[int]string{42: "updated"}))
+	require.NoError(t, err)
+	require.True(t, equal)
+	require.Nil(t, diffKey)
+
+	// a different value, and the same value set at a different version
+	for _, pair := range [][2]*ImmutableTree{
+		{tree, build(dbm.NewMemDB(), 200, map[int]string{42: "other"})},
+		{build(dbm.NewMemDB(), 200, map[int]string{42: "value"}), build(dbm.NewMemDB(), 200, nil)},
+	} {
+		equal, diffKey, err = TreesEqual(pair[0], pair[1])
+		require.NoError(t, err)
+		require.False(t, equal)
+		require.Equal(t, []byte("key042"), diffKey)
+	}
+
+	// a missing key, and more keys, in either order
+	for _, n := range []int{150, 201} {
+		other := build(dbm.NewMemDB(), n, map[int]string{42: "updated"})
+		for _, pair := range [][2]*ImmutableTree{{tree, other}, {other, tree}} {
+			equal, diffKey, err = TreesEqual(pair[0], pair[1])
+			require.NoError(t, err)
+			require.False(t, equal)
+			require.Equal(t, []byte(fmt.Sprintf("key%03d", min(n, 200))), diffKey)
+		}
+	}
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	equal, diffKey, err = TreesEqual(empty.ImmutableTree, tree)
+	require.NoError(t, err)
+	require.False(t, equal)
+	require.Equal(t, []byte("key000"), diffKey)
+	equal, _, err = TreesEqual(empty.ImmutableTree, NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).ImmutableTree)
+	require.NoError(t, err)
+	require.True(t, equal)
+}
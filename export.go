@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
 )
 
 // exportBufferSize is the number of nodes to buffer in the exporter. It improves throughput by
@@ -11,12 +13,26 @@ import (
 // especially since callers may export several IAVL stores in parallel (e.g. the Cosmos SDK).
 const exportBufferSize = 32
 
+// progressInterval is the number of nodes between the calls of the progress callbacks of exports
+// and imports.
+const progressInterval = 1000
+
 // ErrorExportDone is returned by Exporter.Next() when all items have been exported.
 var ErrorExportDone = errors.New("export is complete")
 
 // ErrNotInitalizedTree when chains introduce a store without initializing data
 var ErrNotInitalizedTree = errors.New("iavl/export newExporter failed to create")
 
+// TraversalOrder is the order in which an Exporter returns the nodes of the tree.
+type TraversalOrder int
+
+const (
+	// PostOrder is the depth-first post-order (LRN) of Export, where children precede their parent.
+	PostOrder TraversalOrder = iota
+	// PreOrder is the depth-first pre-order (NLR), starting from the root.
+	PreOrder
+)
+
 // ExportNode contains exported node data.
 type ExportNode struct {
 	Key     []byte
@@ -34,10 +50,37 @@ type Exporter struct {
 	tree   *ImmutableTree
 	ch     chan *ExportNode
 	cancel context.CancelFunc
+
+	progress func(done int64)
+	exported int64
+	err      error // the error which stopped the export, set before ch is closed
 }
 
 // NewExporter creates a new Exporter. Callers must call Close() when done.
 func newExporter(tree *ImmutableTree) (*Exporter, error) {
+	return newOrderedExporter(tree, PostOrder)
+}
+
+// newOrderedExporter creates a new Exporter of the nodes in the given order. Callers must call
+// Close() when done.
+func newOrderedExporter(tree *ImmutableTree, order TraversalOrder) (*Exporter, error) {
+	if order != PostOrder && order != PreOrder {
+		return nil, fmt.Errorf("%w: unknown traversal order %d", ErrInvalidInputs, order)
+	}
+	return startExporter(tree, func(e *Exporter, ctx context.Context) {
+		e.export(ctx, order)
+	})
+}
+
+// newPrefixExporter creates a new Exporter of the leaves with the given key prefix. Callers must
+// call Close() when done.
+func newPrefixExporter(tree *ImmutableTree, prefix []byte) (*Exporter, error) {
+	return startExporter(tree, func(e *Exporter, ctx context.Context) {
+		e.exportPrefix(ctx, prefix)
+	})
+}
+
+func startExporter(tree *ImmutableTree, export func(*Exporter, context.Context)) (*Exporter, error) {
 	if tree == nil {
 		return nil, fmt.Errorf("tree is nil: %w", ErrNotInitalizedTree)
 	}
@@ -54,14 +97,14 @@ func newExporter(tree *ImmutableTree) (*Exporter, error) {
 	}
 
 	tree.ndb.incrVersionReaders(tree.version)
-	go exporter.export(ctx)
+	go export(exporter, ctx)
 
 	return exporter, nil
 }
 
 // export exports nodes
-func (e *Exporter) export(ctx context.Context) {
-	e.tree.root.traversePost(e.tree, true, func(node *Node) bool {
+func (e *Exporter) export(ctx context.Context, order TraversalOrder) {
+	e.tree.root.traverseInRange(e.tree, nil, nil, true, false, order == PostOrder, func(node *Node) bool {
 		exportNode := &ExportNode{
 			Key:     node.key,
 			Value:   node.value,
@@ -79,11 +122,110 @@ func (e *Exporter) export(ctx context.Context) {
 	close(e.ch)
 }
 
-// Next fetches the next exported node, or returns ExportDone when done.
+// exportPrefix exports the leaves with the given key prefix as a balanced tree of their own. The
+// inner nodes are rebuilt over the leaves: each one takes the leftmost key of its right subtree
+// and the greatest version of its children, and the leaves are split evenly between the
+// children so that their heights differ by at most one.
+func (e *Exporter) exportPrefix(ctx context.Context, prefix []byte) {
+	defer close(e.ch)
+	if e.tree.root == nil {
+		return
+	}
+
+	var end []byte
+	if len(prefix) > 0 {
+		end = ibytes.CpIncr(prefix)
+	}
+	// count the leaves from their indexes up front, to split them while streaming
+	startIdx, _, err := e.tree.GetWithIndex(prefix)
+	if err != nil {
+		e.err = err
+		return
+	}
+	endIdx := e.tree.Size()
+	if end != nil {
+		if endIdx, _, err = e.tree.GetWithIndex(end); err != nil {
+			e.err = err
+			return
+		}
+	}
+
+	leaves := e.tree.root.newTraversal(e.tree, prefix, end, true, false, false)
+	nextLeaf := func() *Node {
+		for {
+			node, err := leaves.next()
+			if err != nil {
+				e.err = err
+				return nil
+			}
+			if node == nil {
+				e.err = fmt.Errorf("expected %d leaves with prefix %X, found fewer", endIdx-startIdx, prefix)
+				return nil
+			}
+			if node.isLeaf() {
+				return node
+			}
+		}
+	}
+	send := func(node *ExportNode) bool {
+		select {
+		case e.ch <- node:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// build exports the subtree of the next n leaves, and returns its root.
+	var build func(n int64) (root *ExportNode, minKey []byte, ok bool)
+	build = func(n int64) (*ExportNode, []byte, bool) {
+		if n == 1 {
+			leaf := nextLeaf()
+			if leaf == nil {
+				return nil, nil, false
+			}
+			node := &ExportNode{Key: leaf.key, Value: leaf.value, Version: leaf.nodeKey.version}
+			return node, leaf.key, send(node)
+		}
+		left, minKey, ok := build(n - n/2)
+		if !ok {
+			return nil, nil, false
+		}
+		right, rightMinKey, ok := build(n / 2)
+		if !ok {
+			return nil, nil, false
+		}
+		node := &ExportNode{
+			Key:     rightMinKey,
+			Version: max(left.Version, right.Version),
+			Height:  maxInt8(left.Height, right.Height) + 1,
+		}
+		return node, minKey, send(node)
+	}
+	if endIdx > startIdx {
+		build(endIdx - startIdx)
+	}
+}
+
+// Next fetches the next exported node, or returns ExportDone when done, or the error which
+// stopped the export.
 func (e *Exporter) Next() (*ExportNode, error) {
 	if exportNode, ok := <-e.ch; ok {
+		e.exported++
+		if e.progress != nil && e.exported%progressInterval == 0 {
+			e.progress(e.exported)
+		}
 		return exportNode, nil
 	}
+	if e.err != nil {
+		return nil, e.err
+	}
+	if e.progress != nil {
+		if e.exported == 0 || e.exported%progressInterval != 0 {
+			e.progress(e.exported)
+		}
+		e.progress = nil
+	}
 	return nil, ErrorExportDone
 }
 
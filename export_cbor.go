@@ -0,0 +1,249 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The CBOR export format (RFC 8949) encodes each node as a 4-element array of the key as a byte
+// string, the value as a byte string for leaf nodes and null for inner nodes, the version as an
+// integer and the height as an unsigned integer. A stream is the concatenation of the nodes in
+// export order, i.e. a CBOR sequence (RFC 8742). Lengths and integers use their shortest form,
+// and indefinite-length items are not accepted.
+const (
+	cborMajorUint  = 0
+	cborMajorNint  = 1
+	cborMajorBytes = 2
+	cborMajorArray = 4
+	cborNull       = 0xf6
+
+	cborNodeFields = 4
+)
+
+// MarshalCBOR encodes the node as a CBOR array of key, value, version and height.
+func (node *ExportNode) MarshalCBOR() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeCBORNode(&buf, node); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalCBOR decodes a node encoded by MarshalCBOR. data must hold exactly one node.
+func (node *ExportNode) UnmarshalCBOR(data []byte) error {
+	r := bufio.NewReader(bytes.NewReader(data))
+	decoded, err := readCBORNode(r)
+	if errors.Is(err, ErrorExportDone) {
+		return fmt.Errorf("%w: empty CBOR node", ErrInvalidExportStream)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := r.Peek(1); !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w: trailing bytes after CBOR node", ErrInvalidExportStream)
+	}
+	*node = *decoded
+	return nil
+}
+
+// ExportCBOR writes the nodes returned by exporter to w as a CBOR sequence until ErrorExportDone
+// is returned, and returns the number of nodes written. The stream can be imported with
+// NewCBORImporter.
+func ExportCBOR(w io.Writer, exporter NodeExporter) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var count int64
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := writeCBORNode(bw, node); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, bw.Flush()
+}
+
+// CBORImporter imports a stream written by ExportCBOR into a tree.
+type CBORImporter struct {
+	*Importer
+	r *bufio.Reader
+}
+
+// NewCBORImporter returns an importer of the CBOR stream r into tree, with the same requirements
+// as MutableTree.Import. The caller must call Close() when done.
+func NewCBORImporter(tree *MutableTree, version int64, r io.Reader) (*CBORImporter, error) {
+	importer, err := tree.Import(version)
+	if err != nil {
+		return nil, err
+	}
+	return &CBORImporter{Importer: importer, r: bufio.NewReader(r)}, nil
+}
+
+// Import adds all the nodes of the stream and returns the number of nodes added. The import must
+// then be committed with Commit or CommitExpecting.
+func (i *CBORImporter) Import() (int64, error) {
+	var count int64
+	for {
+		node, err := readCBORNode(i.r)
+		if errors.Is(err, ErrorExportDone) {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("node %d: %w", count, err)
+		}
+		if err := i.Add(node); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+func writeCBORNode(w io.Writer, node *ExportNode) error {
+	if node.Height < 0 {
+		return fmt.Errorf("invalid height %d", node.Height)
+	}
+	buf := make([]byte, 0, 32+len(node.Key)+len(node.Value))
+	buf = appendCBORHead(buf, cborMajorArray, cborNodeFields)
+	buf = appendCBORHead(buf, cborMajorBytes, uint64(len(node.Key)))
+	buf = append(buf, node.Key...)
+	if node.Height == 0 {
+		buf = appendCBORHead(buf, cborMajorBytes, uint64(len(node.Value)))
+		buf = append(buf, node.Value...)
+	} else {
+		buf = append(buf, cborNull)
+	}
+	if node.Version >= 0 {
+		buf = appendCBORHead(buf, cborMajorUint, uint64(node.Version))
+	} else {
+		buf = appendCBORHead(buf, cborMajorNint, uint64(-1-node.Version))
+	}
+	buf = appendCBORHead(buf, cborMajorUint, uint64(node.Height))
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendCBORHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(buf, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(buf, major|27), n)
+	}
+}
+
+// readCBORNode reads a node written by writeCBORNode, or returns ErrorExportDone at the end of
+// the stream.
+func readCBORNode(r *bufio.Reader) (*ExportNode, error) {
+	if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+		return nil, ErrorExportDone
+	}
+	major, n, err := readCBORHead(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading node, %w", ErrInvalidExportStream, err)
+	}
+	if major != cborMajorArray || n != cborNodeFields {
+		return nil, fmt.Errorf("%w: expected an array of %d fields", ErrInvalidExportStream, cborNodeFields)
+	}
+
+	node := &ExportNode{}
+	if node.Key, err = readCBORBytes(r); err != nil {
+		return nil, fmt.Errorf("%w: reading key, %w", ErrInvalidExportStream, err)
+	}
+	isNull := false
+	if b, err := r.Peek(1); err == nil && b[0] == cborNull {
+		isNull = true
+		_, _ = r.ReadByte()
+	} else if node.Value, err = readCBORBytes(r); err != nil {
+		return nil, fmt.Errorf("%w: reading value, %w", ErrInvalidExportStream, err)
+	}
+
+	major, n, err = readCBORHead(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading version, %w", ErrInvalidExportStream, err)
+	}
+	switch {
+	case n > math.MaxInt64:
+		return nil, fmt.Errorf("%w: version out of range", ErrInvalidExportStream)
+	case major == cborMajorUint:
+		node.Version = int64(n)
+	case major == cborMajorNint:
+		node.Version = -1 - int64(n)
+	default:
+		return nil, fmt.Errorf("%w: version is not an integer", ErrInvalidExportStream)
+	}
+
+	major, n, err = readCBORHead(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading height, %w", ErrInvalidExportStream, err)
+	}
+	if major != cborMajorUint || n > math.MaxInt8 {
+		return nil, fmt.Errorf("%w: invalid height", ErrInvalidExportStream)
+	}
+	node.Height = int8(n)
+
+	if isNull != (node.Height > 0) {
+		return nil, fmt.Errorf("%w: value must be null exactly for inner nodes", ErrInvalidExportStream)
+	}
+	return node, nil
+}
+
+func readCBORHead(r *bufio.Reader) (major byte, n uint64, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+	major, info := b>>5, b&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info <= 27:
+		size = 1 << (info - 24)
+	default:
+		return 0, 0, fmt.Errorf("unsupported additional information %d", info)
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[8-size:]); err != nil {
+		return 0, 0, unexpectedEOF(err)
+	}
+	return major, binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func readCBORBytes(r *bufio.Reader) ([]byte, error) {
+	major, n, err := readCBORHead(r)
+	if err != nil {
+		return nil, err
+	}
+	if major != cborMajorBytes {
+		return nil, errors.New("expected a byte string")
+	}
+	if n > math.MaxInt64 {
+		return nil, fmt.Errorf("invalid length %d", n)
+	}
+	// Copy incrementally like ExportReader, so that a corrupt length fails on the missing data.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if buf.Len() == 0 {
+		return []byte{}, nil
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,78 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// ErrInvalidKVStream is returned by MutableTree.LoadKV when a key/value dump is malformed.
+var ErrInvalidKVStream = errors.New("invalid key/value stream")
+
+// ExportKV writes the keys and values of the tree to w in ascending key order, as a
+// length-prefixed key followed by a length-prefixed value for each key, where lengths are
+// uvarints, and returns the number of pairs written. The node structure is not included, see
+// Export for a dump from which the same tree can be imported.
+func (t *ImmutableTree) ExportKV(w io.Writer) (int64, error) {
+	if t.isClosed() {
+		return 0, ErrClosed
+	}
+	bw := bufio.NewWriter(w)
+	var count int64
+	var werr error
+	if _, err := t.Iterate(func(key, value []byte) bool {
+		if werr = encoding.EncodeBytes(bw, key); werr != nil {
+			werr = fmt.Errorf("writing key, %w", werr)
+			return true
+		}
+		if werr = encoding.EncodeBytes(bw, value); werr != nil {
+			werr = fmt.Errorf("writing value, %w", werr)
+			return true
+		}
+		count++
+		return false
+	}); err != nil {
+		return count, err
+	}
+	if werr != nil {
+		return count, werr
+	}
+	return count, bw.Flush()
+}
+
+// LoadKV builds the tree of version from the pairs written by ExportKV, which must be in strictly
+// ascending key order, with BuildFromSorted. The hash of the tree is the one of setting the pairs
+// in order, which generally differs from the hash of the exported tree. The pairs are held in
+// memory, and the tree must be empty.
+func (tree *MutableTree) LoadKV(version int64, r io.Reader) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	br := bufio.NewReader(r)
+	var pairs []KVPair
+	for {
+		if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+			break
+		}
+		key, err := readStreamBytes(br)
+		if err != nil {
+			return fmt.Errorf("%w: pair %d: reading key, %w", ErrInvalidKVStream, len(pairs), err)
+		}
+		value, err := readStreamBytes(br)
+		if err != nil {
+			return fmt.Errorf("%w: pair %d: reading value, %w", ErrInvalidKVStream, len(pairs), err)
+		}
+		if n := len(pairs); n > 0 && bytes.Compare(pairs[n-1].Key, key) >= 0 {
+			return fmt.Errorf("%w: pair %d: key %X is not greater than previous key %X", ErrInvalidKVStream, n, key, pairs[n-1].Key)
+		}
+		pairs = append(pairs, KVPair{Key: key, Value: value})
+	}
+	return tree.BuildFromSorted(version, pairs)
+}
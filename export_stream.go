@@ -0,0 +1,237 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// ErrInvalidExportStream is returned when a serialized export is malformed or does not describe
+// a valid tree.
+var ErrInvalidExportStream = errors.New("invalid export stream")
+
+// WriteExport serializes the nodes returned by exporter to w until ErrorExportDone is returned,
+// and returns the number of nodes written. Each node is encoded as its height and version as
+// varints followed by its length-prefixed key, and its length-prefixed value for leaf nodes.
+// The stream can be read back with NewExportReader.
+func WriteExport(w io.Writer, exporter NodeExporter) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var count int64
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		if err := writeExportNode(bw, node); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, bw.Flush()
+}
+
+func writeExportNode(w *bufio.Writer, node *ExportNode) error {
+	if err := encoding.EncodeVarint(w, int64(node.Height)); err != nil {
+		return fmt.Errorf("writing height, %w", err)
+	}
+	if err := encoding.EncodeVarint(w, node.Version); err != nil {
+		return fmt.Errorf("writing version, %w", err)
+	}
+	if err := encoding.EncodeBytes(w, node.Key); err != nil {
+		return fmt.Errorf("writing key, %w", err)
+	}
+	if node.Height == 0 {
+		if err := encoding.EncodeBytes(w, node.Value); err != nil {
+			return fmt.Errorf("writing value, %w", err)
+		}
+	}
+	return nil
+}
+
+// ExportReader reads the nodes serialized by WriteExport. It implements NodeExporter, so the
+// nodes can be passed straight to an Importer.
+type ExportReader struct {
+	r *bufio.Reader
+}
+
+var _ NodeExporter = (*ExportReader)(nil)
+
+// NewExportReader returns an ExportReader reading from r.
+func NewExportReader(r io.Reader) *ExportReader {
+	return &ExportReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next node of the stream, or ErrorExportDone at the end of the stream.
+func (e *ExportReader) Next() (*ExportNode, error) {
+	height, err := binary.ReadVarint(e.r)
+	if errors.Is(err, io.EOF) {
+		return nil, ErrorExportDone
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading height, %w", ErrInvalidExportStream, err)
+	}
+	if height < 0 || height > math.MaxInt8 {
+		return nil, fmt.Errorf("%w: invalid height %d", ErrInvalidExportStream, height)
+	}
+	version, err := binary.ReadVarint(e.r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading version, %w", ErrInvalidExportStream, unexpectedEOF(err))
+	}
+	key, err := e.readBytes()
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading key, %w", ErrInvalidExportStream, err)
+	}
+	node := &ExportNode{Key: key, Version: version, Height: int8(height)}
+	if height == 0 {
+		if node.Value, err = e.readBytes(); err != nil {
+			return nil, fmt.Errorf("%w: reading value, %w", ErrInvalidExportStream, err)
+		}
+	}
+	return node, nil
+}
+
+func (e *ExportReader) readBytes() ([]byte, error) {
+	return readStreamBytes(e.r)
+}
+
+// readStreamBytes reads a length-prefixed byte slice, and returns io.ErrUnexpectedEOF if it is
+// truncated.
+func readStreamBytes(r *bufio.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if size > math.MaxInt64 {
+		return nil, fmt.Errorf("invalid length %d", size)
+	}
+	// Copy incrementally instead of allocating the announced size up front, so that a corrupt
+	// length fails on the missing data instead of on memory.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if buf.Len() == 0 {
+		return []byte{}, nil
+	}
+	return buf.Bytes(), nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ValidateExportStream reads a stream written by WriteExport and checks that it is a valid
+// depth-first post-order export of a balanced tree, without writing anything to a database.
+// It returns the number of nodes and the root hash of the tree the stream would import into.
+// Only the unresolved nodes along the current path are kept in memory.
+func ValidateExportStream(r io.Reader) (nodeCount int64, rootHash []byte, err error) {
+	reader := NewExportReader(r)
+
+	type pending struct {
+		node   *Node
+		minKey []byte // the leftmost leaf key of the subtree
+	}
+	var (
+		stack   []pending
+		lastKey []byte
+	)
+	for {
+		exportNode, err := reader.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return nodeCount, nil, err
+		}
+
+		node := &Node{
+			key:           exportNode.Key,
+			value:         exportNode.Value,
+			subtreeHeight: exportNode.Height,
+			nodeKey:       &NodeKey{version: exportNode.Version},
+		}
+		minKey := node.key
+		if node.subtreeHeight == 0 {
+			if lastKey != nil && bytes.Compare(node.key, lastKey) <= 0 {
+				return nodeCount, nil, fmt.Errorf("%w: node %d: leaf key %X is not greater than previous key %X",
+					ErrInvalidExportStream, nodeCount, node.key, lastKey)
+			}
+			lastKey = node.key
+			node.size = 1
+		} else {
+			if len(stack) < 2 {
+				return nodeCount, nil, fmt.Errorf("%w: node %d: inner node without two children", ErrInvalidExportStream, nodeCount)
+			}
+			left, right := stack[len(stack)-2], stack[len(stack)-1]
+			leftHeight, rightHeight := left.node.subtreeHeight, right.node.subtreeHeight
+			if node.subtreeHeight != maxInt8(leftHeight, rightHeight)+1 || leftHeight-rightHeight > 1 || rightHeight-leftHeight > 1 {
+				return nodeCount, nil, fmt.Errorf("%w: node %d: height %d is inconsistent with children heights %d and %d",
+					ErrInvalidExportStream, nodeCount, node.subtreeHeight, leftHeight, rightHeight)
+			}
+			if !bytes.Equal(node.key, right.minKey) {
+				return nodeCount, nil, fmt.Errorf("%w: node %d: key %X does not match the leftmost key %X of the right subtree",
+					ErrInvalidExportStream, nodeCount, node.key, right.minKey)
+			}
+			if node.nodeKey.version < left.node.nodeKey.version || node.nodeKey.version < right.node.nodeKey.version {
+				return nodeCount, nil, fmt.Errorf("%w: node %d: version %d is older than its children",
+					ErrInvalidExportStream, nodeCount, node.nodeKey.version)
+			}
+			node.leftNode, node.rightNode = left.node, right.node
+			node.size = left.node.size + right.node.size
+			minKey = left.minKey
+			stack = stack[:len(stack)-2]
+		}
+		if err := node.validate(); err != nil {
+			return nodeCount, nil, fmt.Errorf("%w: node %d: %w", ErrInvalidExportStream, nodeCount, err)
+		}
+		node._hash(node.nodeKey.version)
+		// the children are hashed and no longer needed
+		node.leftNode, node.rightNode = nil, nil
+
+		stack = append(stack, pending{node: node, minKey: minKey})
+		nodeCount++
+	}
+
+	switch len(stack) {
+	case 0:
+		return 0, sha256.New().Sum(nil), nil
+	case 1:
+		return nodeCount, stack[0].node.hash, nil
+	default:
+		return nodeCount, nil, fmt.Errorf("%w: stream ended with %d unresolved subtrees", ErrInvalidExportStream, len(stack))
+	}
+}
+
+// ErrExportRootMismatch is returned by VerifyExport when the stream does not reconstruct the
+// expected root.
+var ErrExportRootMismatch = errors.New("export root hash does not match expected hash")
+
+// VerifyExport reads a stream written by WriteExport and checks that it reconstructs a valid tree
+// with the root hash expectedRoot, without writing anything to a database. It complements
+// Importer.CommitExpecting for snapshots that are not imported yet.
+func VerifyExport(r io.Reader, expectedRoot []byte) error {
+	if expectedRoot == nil {
+		return errors.New("expected root hash is nil")
+	}
+	_, rootHash, err := ValidateExportStream(r)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(rootHash, expectedRoot) {
+		return fmt.Errorf("%w: expected %X, got %X", ErrExportRootMismatch, expectedRoot, rootHash)
+	}
+	return nil
+}
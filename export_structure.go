@@ -0,0 +1,161 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A structure export holds a record for each node of a tree, in the order of Export, which is the
+// record of the height and version of the node as zigzag varints and the uvarint-length-prefixed
+// key, followed by the 32-byte SHA-256 hash of the value for a leaf, and by the 32-byte hash of
+// the node. The empty tree has an empty export.
+
+// ErrStructureMismatch is returned by CompareStructureExports when the exports differ.
+var ErrStructureMismatch = errors.New("structure exports differ")
+
+// structureRecord is a node of a structure export, with a nil valueHash for an inner node.
+type structureRecord struct {
+	height    int64
+	version   int64
+	key       []byte
+	valueHash []byte
+	hash      []byte
+}
+
+// ExportStructure writes the structure export of the tree to w, which holds the keys and hashes
+// of its nodes but only the hashes of the values, to compare the trees of several nodes without
+// their values, see CompareStructureExports.
+func (t *ImmutableTree) ExportStructure(w io.Writer) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	if t.noHash() {
+		return ErrHashingDisabled
+	}
+	if t.root == nil {
+		return nil
+	}
+	t.Hash()
+
+	var record []byte
+	var walk func(node *Node) error
+	walk = func(node *Node) error {
+		if !node.isLeaf() {
+			leftNode, err := node.getLeftNode(t)
+			if err != nil {
+				return err
+			}
+			if err := walk(leftNode); err != nil {
+				return err
+			}
+			rightNode, err := node.getRightNode(t)
+			if err != nil {
+				return err
+			}
+			if err := walk(rightNode); err != nil {
+				return err
+			}
+		}
+
+		version := t.version + 1
+		if node.nodeKey != nil {
+			version = node.nodeKey.version
+		}
+		record = binary.AppendVarint(record[:0], int64(node.subtreeHeight))
+		record = binary.AppendVarint(record, version)
+		record = binary.AppendUvarint(record, uint64(len(node.key)))
+		record = append(record, node.key...)
+		if node.isLeaf() {
+			valueHash := sha256.Sum256(node.value)
+			record = append(record, valueHash[:]...)
+		}
+		record = append(record, node.hash...)
+		_, err := w.Write(record)
+		return err
+	}
+	return walk(t.root)
+}
+
+// CompareStructureExports reads two structure exports written by ExportStructure, and returns
+// ErrStructureMismatch with the first differing record if they are not identical.
+func CompareStructureExports(a, b io.Reader) error {
+	ra, rb := bufio.NewReader(a), bufio.NewReader(b)
+	for i := 0; ; i++ {
+		recordA, errA := readStructureRecord(ra)
+		recordB, errB := readStructureRecord(rb)
+		switch {
+		case errA == io.EOF && errB == io.EOF:
+			return nil
+		case errA != nil && errA != io.EOF:
+			return errA
+		case errB != nil && errB != io.EOF:
+			return errB
+		case errA == io.EOF:
+			return fmt.Errorf("%w: record %d with key %X is only in the second export", ErrStructureMismatch, i, recordB.key)
+		case errB == io.EOF:
+			return fmt.Errorf("%w: record %d with key %X is only in the first export", ErrStructureMismatch, i, recordA.key)
+		}
+
+		switch {
+		case !bytes.Equal(recordA.key, recordB.key):
+			return fmt.Errorf("%w: record %d has key %X and %X", ErrStructureMismatch, i, recordA.key, recordB.key)
+		case recordA.height != recordB.height:
+			return fmt.Errorf("%w: record %d with key %X has height %d and %d", ErrStructureMismatch, i, recordA.key, recordA.height, recordB.height)
+		case recordA.version != recordB.version:
+			return fmt.Errorf("%w: record %d with key %X has version %d and %d", ErrStructureMismatch, i, recordA.key, recordA.version, recordB.version)
+		case !bytes.Equal(recordA.valueHash, recordB.valueHash):
+			return fmt.Errorf("%w: record %d with key %X has value hash %X and %X", ErrStructureMismatch, i, recordA.key, recordA.valueHash, recordB.valueHash)
+		case !bytes.Equal(recordA.hash, recordB.hash):
+			return fmt.Errorf("%w: record %d with key %X has hash %X and %X", ErrStructureMismatch, i, recordA.key, recordA.hash, recordB.hash)
+		}
+	}
+}
+
+// readStructureRecord reads a record of a structure export, returning io.EOF at the end of the
+// export.
+func readStructureRecord(r *bufio.Reader) (*structureRecord, error) {
+	record := &structureRecord{}
+	var err error
+	if record.height, err = binary.ReadVarint(r); err != nil {
+		return nil, err
+	}
+	truncated := func(err error) error {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("reading structure record: %w", err)
+	}
+	if record.version, err = binary.ReadVarint(r); err != nil {
+		return nil, truncated(err)
+	}
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, truncated(err)
+	}
+	if keyLen > math.MaxInt64 {
+		return nil, fmt.Errorf("reading structure record: invalid key length %d", keyLen)
+	}
+	// the key is read as it arrives, so that a corrupted length does not allocate it at once
+	var key bytes.Buffer
+	if _, err := io.CopyN(&key, r, int64(keyLen)); err != nil {
+		return nil, truncated(err)
+	}
+	record.key = key.Bytes()
+	if record.height == 0 {
+		record.valueHash = make([]byte, hashSize)
+		if _, err := io.ReadFull(r, record.valueHash); err != nil {
+			return nil, truncated(err)
+		}
+	}
+	record.hash = make([]byte, hashSize)
+	if _, err := io.ReadFull(r, record.hash); err != nil {
+		return nil, truncated(err)
+	}
+	return record, nil
+}
@@ -1,15 +1,21 @@
 package iavl
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"math"
 	"math/rand"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/internal/encoding"
 )
 
 // setupExportTreeBasic sets up a basic tree with a handful of
@@ -357,6 +363,164 @@ func TestExporter_DeleteVersionErrors(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// sliceExporter exports a fixed list of nodes.
+type sliceExporter []*ExportNode
+
+func (e *sliceExporter) Next() (*ExportNode, error) {
+	if len(*e) == 0 {
+		return nil, ErrorExportDone
+	}
+	node := (*e)[0]
+	*e = (*e)[1:]
+	return node, nil
+}
+
+func TestWriteExport_Import(t *testing.T) {
+	testcases := map[string]*ImmutableTree{
+		"empty tree": NewImmutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()),
+		"basic tree": setupExportTreeBasic(t),
+		"sized tree": setupExportTreeSized(t, 4096),
+	}
+	for desc, tree := range testcases {
+		t.Run(desc, func(t *testing.T) {
+			exporter, err := tree.Export()
+			require.NoError(t, err)
+			defer exporter.Close()
+
+			var buf bytes.Buffer
+			count, err := WriteExport(&buf, exporter)
+			require.NoError(t, err)
+
+			nodeCount, rootHash, err := ValidateExportStream(bytes.NewReader(buf.Bytes()))
+			require.NoError(t, err)
+			require.Equal(t, count, nodeCount)
+			require.Equal(t, tree.Hash(), rootHash)
+			if tree.root != nil {
+				require.EqualValues(t, tree.nodeSize(), nodeCount)
+			}
+
+			newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+			importer, err := newTree.Import(tree.Version())
+			require.NoError(t, err)
+			defer importer.Close()
+			reader := NewExportReader(&buf)
+			for {
+				node, err := reader.Next()
+				if errors.Is(err, ErrorExportDone) {
+					break
+				}
+				require.NoError(t, err)
+				require.NoError(t, importer.Add(node))
+			}
+			require.NoError(t, importer.Commit())
+			require.Equal(t, tree.Hash(), newTree.Hash())
+		})
+	}
+}
+
+func TestVerifyExport(t *testing.T) {
+	tree := setupExportTreeSized(t, 1024)
+	exporter, err := tree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	var buf bytes.Buffer
+	_, err = WriteExport(&buf, exporter)
+	require.NoError(t, err)
+	stream := buf.Bytes()
+
+	require.NoError(t, VerifyExport(bytes.NewReader(stream), tree.Hash()))
+
+	otherRoot := setupExportTreeBasic(t).Hash()
+	err = VerifyExport(bytes.NewReader(stream), otherRoot)
+	require.ErrorIs(t, err, ErrExportRootMismatch)
+
+	require.Error(t, VerifyExport(bytes.NewReader(stream), nil))
+
+	for _, size := range []int{1, len(stream) / 3, len(stream) / 2, len(stream) - 1} {
+		err := VerifyExport(bytes.NewReader(stream[:size]), tree.Hash())
+		require.ErrorIs(t, err, ErrInvalidExportStream, "truncated to %d bytes", size)
+	}
+}
+
+func TestValidateExportStream_Invalid(t *testing.T) {
+	valid := func() []*ExportNode {
+		return []*ExportNode{
+			{Key: []byte("a"), Value: []byte{1}, Version: 1, Height: 0},
+			{Key: []byte("b"), Value: []byte{2}, Version: 2, Height: 0},
+			{Key: []byte("b"), Value: nil, Version: 2, Height: 1},
+			{Key: []byte("c"), Value: []byte{3}, Version: 2, Height: 0},
+			{Key: []byte("c"), Value: nil, Version: 2, Height: 2},
+		}
+	}
+	encode := func(nodes []*ExportNode) []byte {
+		var buf bytes.Buffer
+		exporter := sliceExporter(nodes)
+		_, err := WriteExport(&buf, &exporter)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	count, _, err := ValidateExportStream(bytes.NewReader(encode(valid())))
+	require.NoError(t, err)
+	require.EqualValues(t, 5, count)
+
+	testcases := map[string]func() []byte{
+		"truncated": func() []byte {
+			bz := encode(valid())
+			return bz[:len(bz)-1]
+		},
+		"inner node first": func() []byte {
+			nodes := valid()
+			return encode(append([]*ExportNode{nodes[2]}, nodes...))
+		},
+		"unresolved subtrees": func() []byte {
+			return encode(valid()[:4])
+		},
+		"unordered leaves": func() []byte {
+			nodes := valid()
+			nodes[0].Key, nodes[1].Key = nodes[1].Key, nodes[0].Key
+			return encode(nodes)
+		},
+		"wrong height": func() []byte {
+			nodes := valid()
+			nodes[4].Height = 3
+			return encode(nodes)
+		},
+		"wrong inner key": func() []byte {
+			nodes := valid()
+			nodes[2].Key = []byte("a")
+			return encode(nodes)
+		},
+		"parent older than child": func() []byte {
+			nodes := valid()
+			nodes[2].Version = 1
+			return encode(nodes)
+		},
+		"zero version": func() []byte {
+			nodes := valid()
+			nodes[0].Version = 0
+			return encode(nodes)
+		},
+		"unbalanced": func() []byte {
+			return encode([]*ExportNode{
+				{Key: []byte("a"), Value: []byte{1}, Version: 1, Height: 0},
+				{Key: []byte("b"), Value: []byte{2}, Version: 1, Height: 0},
+				{Key: []byte("c"), Value: []byte{3}, Version: 1, Height: 0},
+				{Key: []byte("c"), Value: nil, Version: 1, Height: 1},
+				{Key: []byte("b"), Value: nil, Version: 1, Height: 2},
+				{Key: []byte("d"), Value: []byte{4}, Version: 1, Height: 0},
+				{Key: []byte("d"), Value: nil, Version: 1, Height: 3},
+			})
+		},
+	}
+	for desc, stream := range testcases {
+		t.Run(desc, func(t *testing.T) {
+			_, _, err := ValidateExportStream(bytes.NewReader(stream()))
+			require.ErrorIs(t, err, ErrInvalidExportStream)
+		})
+	}
+}
+
 func BenchmarkExport(b *testing.B) {
 	b.StopTimer()
 	tree := setupExportTreeSized(b, 4096)
@@ -375,3 +539,783 @@ func BenchmarkExport(b *testing.B) {
 		exporter.Close()
 	}
 }
+
+func TestExportNode_CBOR(t *testing.T) {
+	nodes := []*ExportNode{
+		{Key: []byte("a"), Value: []byte{1}, Version: 1, Height: 0},
+		{Key: []byte("key"), Version: 1 << 40, Height: 12},
+		{Key: bytes.Repeat([]byte{7}, 300), Value: []byte{}, Version: -3, Height: 0},
+		{Key: []byte{}, Value: bytes.Repeat([]byte{9}, 70000), Version: math.MaxInt64, Height: 0},
+		{Key: []byte("min"), Value: []byte("v"), Version: math.MinInt64, Height: 0},
+	}
+	for _, node := range nodes {
+		data, err := node.MarshalCBOR()
+		require.NoError(t, err)
+		decoded := &ExportNode{}
+		require.NoError(t, decoded.UnmarshalCBOR(data))
+		require.Equal(t, node, decoded)
+	}
+
+	// pin the byte layout of a leaf and an inner node
+	data, err := (&ExportNode{Key: []byte("a"), Value: []byte{1}, Version: 1, Height: 0}).MarshalCBOR()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x84, 0x41, 'a', 0x41, 0x01, 0x01, 0x00}, data)
+	data, err = (&ExportNode{Key: []byte("b"), Version: 300, Height: 2}).MarshalCBOR()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x84, 0x41, 'b', 0xf6, 0x19, 0x01, 0x2c, 0x02}, data)
+
+	for name, data := range map[string][]byte{
+		"empty":             {},
+		"not an array":      {0x41, 'a'},
+		"wrong field count": {0x83, 0x41, 'a', 0x41, 0x01, 0x01},
+		"leaf with null":    {0x84, 0x41, 'a', 0xf6, 0x01, 0x00},
+		"inner with value":  {0x84, 0x41, 'a', 0x41, 0x01, 0x01, 0x01},
+		"text key":          {0x84, 0x61, 'a', 0x41, 0x01, 0x01, 0x00},
+		"truncated":         {0x84, 0x41, 'a', 0x45, 0x01},
+		"trailing bytes":    {0x84, 0x41, 'a', 0x41, 0x01, 0x01, 0x00, 0x00},
+		"height too large":  {0x84, 0x41, 'a', 0xf6, 0x01, 0x18, 0x80},
+		"indefinite length": {0x84, 0x5f, 0x41, 'a', 0xff, 0x41, 0x01, 0x01, 0x00},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := (&ExportNode{}).UnmarshalCBOR(data)
+			require.ErrorIs(t, err, ErrInvalidExportStream)
+		})
+	}
+}
+
+func TestExportCBOR_Golden(t *testing.T) {
+	itree := setupExportTreeBasic(t)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	var buf bytes.Buffer
+	count, err := ExportCBOR(&buf, exporter)
+	require.NoError(t, err)
+	require.EqualValues(t, 11, count)
+
+	golden, err := os.ReadFile("testdata/export_basic.cbor")
+	require.NoError(t, err)
+	require.Equal(t, golden, buf.Bytes())
+}
+
+func TestExportCBOR_Import(t *testing.T) {
+	itree := setupExportTreeSized(t, 4096)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	var buf bytes.Buffer
+	count, err := ExportCBOR(&buf, exporter)
+	require.NoError(t, err)
+
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	importer, err := NewCBORImporter(newTree, itree.Version(), &buf)
+	require.NoError(t, err)
+	defer importer.Close()
+	imported, err := importer.Import()
+	require.NoError(t, err)
+	require.Equal(t, count, imported)
+	require.NoError(t, importer.CommitExpecting(itree.Hash()))
+
+	require.Equal(t, itree.Size(), newTree.Size())
+	_, err = itree.Iterate(func(key, value []byte) bool {
+		actual, err := newTree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, actual)
+		return false
+	})
+	require.NoError(t, err)
+}
+
+func TestExporter_ExportPrefix(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	expected := make(map[string]string)
+	for v := 0; v < 4; v++ {
+		for i := 0; i < 300; i++ {
+			prefix := []string{"a/", "b/", "c/"}[(i+v)%3]
+			key := fmt.Sprintf("%s%04d", prefix, (i*37+v*11)%500)
+			value := fmt.Sprintf("value%d-%d", v, i)
+			_, err := tree.Set([]byte(key), []byte(value))
+			require.NoError(t, err)
+			if prefix == "b/" {
+				expected[key] = value
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	itree, err := tree.GetImmutable(tree.Version())
+	require.NoError(t, err)
+
+	exportPrefix := func(prefix []byte) []byte {
+		exporter, err := itree.ExportPrefix(prefix)
+		require.NoError(t, err)
+		defer exporter.Close()
+		var buf bytes.Buffer
+		_, err = WriteExport(&buf, exporter)
+		require.NoError(t, err)
+		return buf.Bytes()
+	}
+
+	stream := exportPrefix([]byte("b/"))
+	nodeCount, rootHash, err := ValidateExportStream(bytes.NewReader(stream))
+	require.NoError(t, err)
+	require.EqualValues(t, 2*len(expected)-1, nodeCount)
+
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, newTree.importExport(itree.Version(), NewExportReader(bytes.NewReader(stream)), rootHash))
+	require.EqualValues(t, len(expected), newTree.Size())
+	_, err = newTree.Iterate(func(key, value []byte) bool {
+		require.Equal(t, expected[string(key)], string(value), "key %s", key)
+		return false
+	})
+	require.NoError(t, err)
+
+	// leaves keep their versions
+	leaves := func(tree *ImmutableTree) []string {
+		var leaves []string
+		tree.IterateRangeInclusive([]byte("b/"), []byte("b0"), true, func(key, value []byte, version int64) bool {
+			leaves = append(leaves, fmt.Sprintf("%s=%s@%d", key, value, version))
+			return false
+		})
+		return leaves
+	}
+	require.Len(t, leaves(itree), len(expected))
+	require.Equal(t, leaves(itree), leaves(newTree.ImmutableTree))
+
+	require.Empty(t, exportPrefix([]byte("d/")))
+	full, _, err := ValidateExportStream(bytes.NewReader(exportPrefix(nil)))
+	require.NoError(t, err)
+	require.EqualValues(t, 2*itree.Size()-1, full)
+
+	// a node which cannot be read fails the export instead of ending it
+	db := dbm.NewMemDB()
+	broken := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 10; i++ {
+		_, err := broken.Set([]byte(fmt.Sprintf("b/%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = broken.SaveVersion()
+	require.NoError(t, err)
+	itree, err = broken.GetImmutable(1)
+	require.NoError(t, err)
+	require.NoError(t, db.Delete(nodeKeyFormat.Key((&NodeKey{version: 1, nonce: 2}).GetKey())))
+	exporter, err := itree.ExportPrefix([]byte("b/"))
+	require.NoError(t, err)
+	defer exporter.Close()
+	_, err = exporter.Next()
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrorExportDone)
+}
+
+func TestExporter_Progress(t *testing.T) {
+	itree := setupExportTreeSized(t, 4096)
+	var exportProgress []int64
+	exporter, err := itree.ExportWithProgress(func(done int64) {
+		exportProgress = append(exportProgress, done)
+	})
+	require.NoError(t, err)
+	defer exporter.Close()
+
+	newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var importProgress []int64
+	importer, err := newTree.ImportWithProgress(itree.Version(), func(done int64) {
+		importProgress = append(importProgress, done)
+	})
+	require.NoError(t, err)
+	defer importer.Close()
+
+	var count int64
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+		count++
+	}
+	_, err = exporter.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+	require.Len(t, importProgress, int(count/progressInterval))
+	require.NoError(t, importer.CommitExpecting(itree.Hash()))
+
+	require.EqualValues(t, 2*itree.Size()-1, count)
+	for _, progress := range [][]int64{exportProgress, importProgress} {
+		require.Len(t, progress, int(count/progressInterval)+1)
+		for i, done := range progress[:len(progress)-1] {
+			require.EqualValues(t, (i+1)*progressInterval, done)
+		}
+		require.Equal(t, count, progress[len(progress)-1])
+	}
+
+	// an empty export ends at 0
+	exportProgress = nil
+	exporter, err = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).ImmutableTree.ExportWithProgress(func(done int64) {
+		exportProgress = append(exportProgress, done)
+	})
+	require.NoError(t, err)
+	defer exporter.Close()
+	_, err = exporter.Next()
+	require.ErrorIs(t, err, ErrorExportDone)
+	require.Equal(t, []int64{0}, exportProgress)
+}
+
+func TestExportVersions(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for v := 1; v <= 5; v++ {
+		for i := 0; i < 200; i++ {
+			if i%(v+1) != 0 {
+				continue
+			}
+			key := []byte(fmt.Sprintf("key%03d", i))
+			var err error
+			if v == 3 && i%4 == 0 {
+				_, _, err = tree.Remove(key)
+			} else {
+				_, err = tree.Set(key, []byte(fmt.Sprintf("%d-%d", v, i)))
+			}
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// the original store was pruned, so the oldest root of the range is a reformatted one
+	require.NoError(t, tree.DeleteVersionsTo(1))
+
+	var buf bytes.Buffer
+	require.NoError(t, tree.ExportVersions(2, 4, &buf))
+	stream := buf.Bytes()
+
+	db := dbm.NewMemDB()
+	imported := NewMutableTree(db, 0, false, NewNopLogger())
+	require.NoError(t, imported.ImportVersions(bytes.NewReader(stream)))
+	require.EqualValues(t, 4, imported.Version())
+	require.Equal(t, []int{2, 3, 4}, imported.AvailableVersions())
+	require.False(t, imported.VersionExists(1))
+	require.False(t, imported.VersionExists(5))
+
+	// the versions load with the same roots and contents, and share their nodes
+	distinct := make(map[string]struct{})
+	for v := int64(2); v <= 4; v++ {
+		expected, err := tree.GetImmutable(v)
+		require.NoError(t, err)
+		actual, err := imported.GetImmutable(v)
+		require.NoError(t, err)
+		require.Equal(t, expected.Hash(), actual.Hash(), "version %d", v)
+		require.Equal(t, expected.Size(), actual.Size())
+		_, err = expected.Iterate(func(key, value []byte) bool {
+			actualValue, err := actual.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, value, actualValue)
+			return false
+		})
+		require.NoError(t, err)
+
+		rootKey, err := tree.ndb.GetRoot(v)
+		require.NoError(t, err)
+		itr, err := NewNodeIterator(rootKey, tree.ndb)
+		require.NoError(t, err)
+		for ; itr.Valid(); itr.Next(false) {
+			distinct[string(itr.GetNode().hash)] = struct{}{}
+		}
+		require.NoError(t, itr.Error())
+	}
+	stored := 0
+	require.NoError(t, imported.ndb.traversePrefix(nodeKeyFormat.Prefix(), func(_, value []byte) error {
+		if len(value) > 0 && value[0] != nodeKeyFormat.Prefix()[0] {
+			stored++
+		}
+		return nil
+	}))
+	require.Equal(t, len(distinct), stored)
+
+	// the imported store can be reopened and extended
+	imported = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := imported.Load()
+	require.NoError(t, err)
+	_, err = imported.Set([]byte("new"), []byte("value"))
+	require.NoError(t, err)
+	_, version, err := imported.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, version)
+
+	// a corrupt stream is rejected and leaves the tree empty
+	corrupt := bytes.Clone(stream)
+	corrupt[len(corrupt)/2] ^= 0xff
+	db = dbm.NewMemDB()
+	imported = NewMutableTree(db, 0, false, NewNopLogger())
+	require.Error(t, imported.ImportVersions(bytes.NewReader(corrupt)))
+	require.False(t, imported.VersionExists(2))
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.False(t, itr.Valid())
+	require.NoError(t, itr.Close())
+	require.Error(t, imported.ImportVersions(bytes.NewReader(stream[:len(stream)-1])))
+	require.NoError(t, imported.ImportVersions(bytes.NewReader(stream)))
+	require.Equal(t, []int{2, 3, 4}, imported.AvailableVersions())
+
+	require.ErrorIs(t, tree.ExportVersions(1, 3, &buf), ErrVersionDoesNotExist)
+	require.ErrorIs(t, tree.ExportVersions(3, 2, &buf), ErrInvalidInputs)
+}
+
+func TestExporter_ExportOrdered(t *testing.T) {
+	exportAll := func(t *testing.T, tree *ImmutableTree, order TraversalOrder) []*ExportNode {
+		exporter, err := tree.ExportOrdered(order)
+		require.NoError(t, err)
+		defer exporter.Close()
+		var nodes []*ExportNode
+		for {
+			node, err := exporter.Next()
+			if errors.Is(err, ErrorExportDone) {
+				return nodes
+			}
+			require.NoError(t, err)
+			nodes = append(nodes, node)
+		}
+	}
+
+	// the basic tree of TestExporter, root first
+	assert.Equal(t, []*ExportNode{
+		{Key: []byte("d"), Value: nil, Version: 3, Height: 3},
+		{Key: []byte("b"), Value: nil, Version: 3, Height: 2},
+		{Key: []byte("abc"), Value: nil, Version: 3, Height: 1},
+		{Key: []byte("a"), Value: []byte{1}, Version: 1, Height: 0},
+		{Key: []byte("abc"), Value: []byte{6}, Version: 3, Height: 0},
+		{Key: []byte("c"), Value: nil, Version: 3, Height: 1},
+		{Key: []byte("b"), Value: []byte{2}, Version: 3, Height: 0},
+		{Key: []byte("c"), Value: []byte{3}, Version: 3, Height: 0},
+		{Key: []byte("e"), Value: nil, Version: 3, Height: 1},
+		{Key: []byte("d"), Value: []byte{4}, Version: 2, Height: 0},
+		{Key: []byte("e"), Value: []byte{5}, Version: 3, Height: 0},
+	}, exportAll(t, setupExportTreeBasic(t), PreOrder))
+
+	_, err := setupExportTreeBasic(t).ExportOrdered(TraversalOrder(2))
+	require.ErrorIs(t, err, ErrInvalidInputs)
+
+	for desc, tree := range map[string]*ImmutableTree{
+		"empty tree": NewImmutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()),
+		"basic tree": setupExportTreeBasic(t),
+		"sized tree": setupExportTreeSized(t, 1000),
+	} {
+		for _, order := range []TraversalOrder{PostOrder, PreOrder} {
+			newTree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+			importer, err := newTree.Import(tree.Version())
+			require.NoError(t, err)
+			for _, node := range exportAll(t, tree, order) {
+				require.NoError(t, importer.Add(node), "%s, order %d", desc, order)
+			}
+			require.NoError(t, importer.Commit(), "%s, order %d", desc, order)
+			require.Equal(t, tree.Hash(), newTree.Hash(), "%s, order %d", desc, order)
+			require.Equal(t, tree.Size(), newTree.Size(), "%s, order %d", desc, order)
+		}
+	}
+
+	// mixing the orders is an error
+	tree := setupExportTreeBasic(t)
+	preOrder, postOrder := exportAll(t, tree, PreOrder), exportAll(t, tree, PostOrder)
+	for _, nodes := range [][]*ExportNode{
+		append(preOrder[:1:1], postOrder...),
+		append(preOrder, preOrder[len(preOrder)-1]),
+		preOrder[:len(preOrder)-1],
+	} {
+		importer, err := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).Import(tree.Version())
+		require.NoError(t, err)
+		for _, node := range nodes {
+			if err = importer.Add(node); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = importer.Commit()
+		}
+		require.Error(t, err)
+		importer.Close()
+	}
+}
+
+func TestMutableTree_NodeBlobs(t *testing.T) {
+	source := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for v := 0; v < 4; v++ {
+		// version 3 has no changes, so that its root is the root of version 2
+		for i := 0; i < 100 && v != 2; i++ {
+			_, err := source.Set([]byte(fmt.Sprintf("key-%03d", (i*7+v*31)%150)), []byte{byte(v), byte(i)})
+			require.NoError(t, err)
+		}
+		_, _, err := source.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	db := dbm.NewMemDB()
+	dest := NewMutableTree(db, 0, false, NewNopLogger())
+	synced := map[string]bool{}
+	for version := int64(2); version <= 4; version++ {
+		blobs, err := source.NodeBlobs(version)
+		require.NoError(t, err)
+		root, err := source.GetImmutable(version)
+		require.NoError(t, err)
+		require.Contains(t, blobs, string(root.Hash()))
+
+		// only the missing nodes are put
+		put := 0
+		for hash, blob := range blobs {
+			if !synced[hash] {
+				require.NoError(t, dest.PutNodeBlob([]byte(hash), blob))
+				synced[hash] = true
+				put++
+			}
+		}
+		if version == 3 {
+			require.Zero(t, put)
+		}
+		require.NoError(t, dest.CommitNodeBlobs(version, blobs[string(root.Hash())]))
+
+		loaded := NewMutableTree(db, 0, false, NewNopLogger())
+		_, err = loaded.LoadVersion(version)
+		require.NoError(t, err)
+		require.Equal(t, root.Hash(), loaded.Hash())
+		_, err = root.Iterate(func(key, value []byte) bool {
+			got, err := loaded.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, value, got)
+			return false
+		})
+		require.NoError(t, err)
+	}
+	require.False(t, NewMutableTree(db, 0, false, NewNopLogger()).VersionExists(1))
+
+	// a blob must match its hash
+	blobs, err := source.NodeBlobs(1)
+	require.NoError(t, err)
+	for hash, blob := range blobs {
+		wrongHash := bytes.Clone([]byte(hash))
+		wrongHash[0] ^= 1
+		require.ErrorIs(t, dest.PutNodeBlob(wrongHash, blob), ErrNodeBlobHashMismatch)
+	}
+
+	// an inner node which does not match its children is rejected on commit
+	root, err := source.GetImmutable(1)
+	require.NoError(t, err)
+	forged := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for hash, blob := range blobs {
+		if hash == string(root.Hash()) {
+			node, err := MakeNode(blob[:nodeBlobKeySize], blob[nodeBlobKeySize:])
+			require.NoError(t, err)
+			node.size++
+			var buf bytes.Buffer
+			buf.Write(node.GetKey())
+			require.NoError(t, node.writeBytes(&buf))
+			blob = buf.Bytes()
+		}
+		require.NoError(t, forged.PutNodeBlob([]byte(hash), blob))
+	}
+	err = forged.CommitNodeBlobs(1, blobs[string(root.Hash())])
+	require.ErrorIs(t, err, ErrNodeBlobHashMismatch)
+	require.False(t, forged.VersionExists(1))
+}
+
+func TestImmutableTree_CanonicalNodeStream(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}} {
+		_, err := tree.Set([]byte(kv[0]), []byte(kv[1]))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("22"))
+	require.NoError(t, err)
+
+	// the records of the nodes, in ascending order of their hashes
+	golden := strings.Join([]string{
+		"0f89e2f10d4cbe5b7c27188d00ac56458f3b7b682decc80a866b70e721cbf9af" + "0002040162" + "023232",
+		"2de087ae4493e1758ed8d20422e2dc08a8b97beaa2250c130381350ef62e65d8" + "0002020163" + "0133",
+		"bbe33cd0a785b97b9fb1f964aa71159dacd9e0ade84df7403dc0f9dc24818404" + "0002020161" + "0131",
+		"c990c619132491076d667276333ffd72e33914a111339ce8ec0df826c22ef424" + "0406040162" +
+			"bbe33cd0a785b97b9fb1f964aa71159dacd9e0ade84df7403dc0f9dc24818404" +
+			"d437c7267229c0ca25a28311916b3ab121cb16fa94407bfdda7613a7a2b74176",
+		"d437c7267229c0ca25a28311916b3ab121cb16fa94407bfdda7613a7a2b74176" + "0204040163" +
+			"0f89e2f10d4cbe5b7c27188d00ac56458f3b7b682decc80a866b70e721cbf9af" +
+			"2de087ae4493e1758ed8d20422e2dc08a8b97beaa2250c130381350ef62e65d8",
+	}, "")
+
+	// the working tree and the saved version have the same stream
+	var buf bytes.Buffer
+	require.NoError(t, tree.ImmutableTree.CanonicalNodeStream(&buf))
+	require.Equal(t, golden, hex.EncodeToString(buf.Bytes()))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	saved, err := tree.GetImmutable(2)
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, saved.CanonicalNodeStream(&buf))
+	require.Equal(t, golden, hex.EncodeToString(buf.Bytes()))
+
+	buf.Reset()
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, empty.ImmutableTree.CanonicalNodeStream(&buf))
+	require.Zero(t, buf.Len())
+}
+
+func TestImmutableTree_ExportStructure(t *testing.T) {
+	build := func(changed string) *ImmutableTree {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key_%02d", i)
+			value := bytes.Repeat([]byte{byte(i)}, 1000)
+			if key == changed {
+				value[0]++
+			}
+			_, err := tree.Set([]byte(key), value)
+			require.NoError(t, err)
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		return itree
+	}
+	export := func(tree *ImmutableTree) []byte {
+		var buf bytes.Buffer
+		require.NoError(t, tree.ExportStructure(&buf))
+		return buf.Bytes()
+	}
+
+	a, b := export(build("")), export(build(""))
+	require.Equal(t, a, b)
+	require.NoError(t, CompareStructureExports(bytes.NewReader(a), bytes.NewReader(b)))
+	// the values are replaced by their hashes
+	require.Less(t, len(a), 50*1000/5)
+
+	c := export(build("key_17"))
+	require.Equal(t, len(a), len(c))
+	err := CompareStructureExports(bytes.NewReader(a), bytes.NewReader(c))
+	require.ErrorIs(t, err, ErrStructureMismatch)
+	require.Contains(t, err.Error(), fmt.Sprintf("%X", "key_17"))
+
+	err = CompareStructureExports(bytes.NewReader(a[:len(a)-40]), bytes.NewReader(a))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrStructureMismatch)
+	err = CompareStructureExports(bytes.NewReader(nil), bytes.NewReader(a))
+	require.ErrorIs(t, err, ErrStructureMismatch)
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.Empty(t, export(empty.ImmutableTree))
+}
+
+func TestExportKV_LoadKV(t *testing.T) {
+	itree := setupExportTreeRandom(t)
+	var buf bytes.Buffer
+	count, err := itree.ExportKV(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, itree.Size(), count)
+	dump := buf.Bytes()
+
+	load := func(t *testing.T, dump []byte) *MutableTree {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		require.NoError(t, tree.LoadKV(itree.Version(), bytes.NewReader(dump)))
+		require.Equal(t, itree.Version(), tree.Version())
+		return tree
+	}
+	tree := load(t, dump)
+	require.EqualValues(t, count, tree.Size())
+	// the loaded tree is the one of setting the pairs in order
+	sequential := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), InitialVersionOption(uint64(itree.Version())))
+	_, err = itree.Iterate(func(key, value []byte) bool {
+		loaded, err := tree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, loaded)
+		_, err = sequential.Set(key, value)
+		require.NoError(t, err)
+		return false
+	})
+	require.NoError(t, err)
+	hash, _, err := sequential.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.Hash())
+
+	// reloading the dump of the loaded tree leads to the same tree
+	buf.Reset()
+	_, err = tree.ExportKV(&buf)
+	require.NoError(t, err)
+	require.Equal(t, dump, buf.Bytes())
+	require.Equal(t, tree.Hash(), load(t, buf.Bytes()).Hash())
+
+	// the loaded tree can be updated like any other
+	_, err = tree.Set([]byte("new"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	empty := load(t, nil)
+	require.Nil(t, empty.root)
+
+	var unsorted bytes.Buffer
+	unsorted.Write([]byte{1, 'b', 1, 'b', 1, 'a', 1, 'a'})
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.ErrorIs(t, tree.LoadKV(1, &unsorted), ErrInvalidKVStream)
+	require.ErrorIs(t, tree.LoadKV(1, bytes.NewReader(dump[:len(dump)-1])), ErrInvalidKVStream)
+}
+
+func TestExportFastIndex_ImportFastIndex(t *testing.T) {
+	source := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for v := 0; v < 4; v++ {
+		for i := 0; i < 100; i++ {
+			_, err := source.Set([]byte(fmt.Sprintf("key%03d", (i*7+v)%150)), []byte(fmt.Sprintf("value%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := source.Remove([]byte(fmt.Sprintf("key%03d", v)))
+		require.NoError(t, err)
+		_, _, err = source.SaveVersion()
+		require.NoError(t, err)
+	}
+	var buf bytes.Buffer
+	count, err := source.ExportFastIndex(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, source.Size(), count)
+	index := buf.Bytes()
+
+	// the receiver has the tree but no fast index
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	exporter, err := source.ImmutableTree.Export()
+	require.NoError(t, err)
+	defer exporter.Close()
+	importer, err := tree.Import(source.Version())
+	require.NoError(t, err)
+	defer importer.Close()
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, importer.Add(node))
+	}
+	require.NoError(t, importer.Commit())
+	_, err = tree.ExportFastIndex(&buf)
+	require.Error(t, err)
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.False(t, enabled)
+
+	require.ErrorIs(t, tree.ImportFastIndex(bytes.NewReader(index[:len(index)-1])), ErrInvalidFastIndexStream)
+	require.EqualValues(t, 0, fastNodeCount(t, tree))
+	require.NoError(t, tree.ImportFastIndex(bytes.NewReader(index)))
+	enabled, err = tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	require.EqualValues(t, count, fastNodeCount(t, tree))
+
+	// the fast reads match the reads from the tree
+	checkReads := func(t *testing.T, tree *MutableTree) {
+		itr := NewIterator(nil, nil, true, tree.ImmutableTree)
+		defer itr.Close()
+		fastItr, err := tree.ImmutableTree.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		defer fastItr.Close()
+		require.IsType(t, &FastIterator{}, fastItr)
+		for ; itr.Valid(); itr.Next() {
+			require.True(t, fastItr.Valid())
+			require.Equal(t, itr.Key(), fastItr.Key())
+			require.Equal(t, itr.Value(), fastItr.Value())
+			value, err := tree.Get(itr.Key())
+			require.NoError(t, err)
+			require.Equal(t, itr.Value(), value)
+			fastItr.Next()
+		}
+		require.False(t, fastItr.Valid())
+	}
+	checkReads(t, tree)
+
+	// the imported index is maintained, and found up to date when the tree is reopened
+	_, err = tree.Set([]byte("new"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reopened.Load()
+	require.NoError(t, err)
+	upgradeable, err := reopened.IsUpgradeable()
+	require.NoError(t, err)
+	require.False(t, upgradeable)
+	checkReads(t, reopened)
+
+	// the index of another version or tree is rejected
+	require.ErrorIs(t, reopened.ImportFastIndex(bytes.NewReader(index)), ErrInvalidFastIndexStream)
+	other := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	for v := 0; v < 4; v++ {
+		_, err := other.Set([]byte("key"), []byte(fmt.Sprintf("value%d", v)))
+		require.NoError(t, err)
+		_, _, err = other.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.ErrorIs(t, other.ImportFastIndex(bytes.NewReader(index)), ErrInvalidFastIndexStream)
+}
+
+func TestImportFastIndex_Validation(t *testing.T) {
+	// the flushes of the tiny batches are held until the stream is checked
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), FlushThresholdOption(1))
+	for v := 1; v <= 3; v++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%d", v)), []byte(fmt.Sprintf("value%d", v)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	type record struct {
+		key     string
+		version int64
+		value   string
+	}
+	stream := func(records ...record) *bytes.Buffer {
+		var buf bytes.Buffer
+		require.NoError(t, encoding.EncodeVarint(&buf, tree.Version()))
+		require.NoError(t, encoding.EncodeBytes(&buf, tree.Hash()))
+		for _, r := range records {
+			require.NoError(t, encoding.EncodeBytes(&buf, []byte(r.key)))
+			require.NoError(t, encoding.EncodeVarint(&buf, r.version))
+			require.NoError(t, encoding.EncodeBytes(&buf, []byte(r.value)))
+		}
+		return &buf
+	}
+	valid := []record{{"key1", 1, "value1"}, {"key2", 2, "value2"}, {"key3", 3, "value3"}}
+
+	for name, records := range map[string][]record{
+		"wrong value":    {valid[0], {"key2", 2, "forged"}, valid[2]},
+		"unknown key":    {valid[0], {"key2a", 2, "value2"}, valid[2]},
+		"out of order":   {valid[1], valid[0], valid[2]},
+		"stale version":  {valid[0], {"key2", 1, "value2"}, valid[2]},
+		"future version": {valid[0], valid[1], {"key3", 4, "value3"}},
+		"missing key":    {valid[0], valid[2]},
+		"extra key":      {valid[0], valid[1], valid[2], {"key4", 3, "value4"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.ErrorIs(t, tree.ImportFastIndex(stream(records...)), ErrInvalidFastIndexStream)
+			// the index was left as it was
+			require.EqualValues(t, 3, fastNodeCount(t, tree))
+			for _, r := range valid {
+				node, err := tree.ndb.GetFastNode([]byte(r.key))
+				require.NoError(t, err)
+				require.Equal(t, []byte(r.value), node.GetValue())
+			}
+		})
+	}
+
+	// the version of a key may be later than the version of its leaf, as after a migration
+	require.NoError(t, tree.ImportFastIndex(stream(valid[0], valid[1], record{"key3", 3, "value3"})))
+	require.NoError(t, tree.ImportFastIndex(stream(record{"key1", 3, "value1"}, valid[1], valid[2])))
+	node, err := tree.ndb.GetFastNode([]byte("key1"))
+	require.NoError(t, err)
+	require.EqualValues(t, 3, node.GetVersionLastUpdatedAt())
+}
+
+func fastNodeCount(t *testing.T, tree *MutableTree) int64 {
+	var count int64
+	require.NoError(t, tree.ndb.traverseFastNodes(func(_, _ []byte) error {
+		count++
+		return nil
+	}))
+	return count
+}
@@ -0,0 +1,320 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// A version range stream starts with versionsStreamMagic and the first and last versions as
+// varints, followed by the records of each version in ascending order: the nodes of the version
+// which are not shared with the previous one, all of them for the first version, in post-order,
+// and then the version record. A node record holds the node key and the length-prefixed node as
+// stored in the database. A version record holds the version as a varint and the length-prefixed
+// root node key and root hash, both empty for an empty version.
+const (
+	versionsStreamMagic = "IAVLVRS1"
+
+	versionsRecordNode    byte = 1
+	versionsRecordVersion byte = 2
+)
+
+// ExportVersions writes the versions fromVersion to toVersion to w as a single stream, which
+// ImportVersions rebuilds into a store holding all of them. Each node is written once, along with
+// the first version of the range it belongs to, so the nodes shared between versions are shared
+// in the imported store too. All the versions of the range must exist, and must not be stored in
+// the legacy format.
+func (tree *MutableTree) ExportVersions(fromVersion, toVersion int64, w io.Writer) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.noHash() {
+		return ErrHashingDisabled
+	}
+	if fromVersion < 1 || fromVersion > toVersion {
+		return fmt.Errorf("%w: invalid version range [%d, %d]", ErrInvalidInputs, fromVersion, toVersion)
+	}
+	for version := fromVersion; version <= toVersion; version++ {
+		if !tree.VersionExists(version) {
+			return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+		}
+	}
+	for version := fromVersion; version <= toVersion; version++ {
+		tree.ndb.incrVersionReaders(version)
+		defer tree.ndb.decrVersionReaders(version)
+	}
+
+	bw := bufio.NewWriter(w)
+	header := binary.AppendVarint([]byte(versionsStreamMagic), fromVersion)
+	header = binary.AppendVarint(header, toVersion)
+	if _, err := bw.Write(header); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for version := fromVersion; version <= toVersion; version++ {
+		rootKey, err := tree.ndb.GetRoot(version)
+		if err != nil {
+			return err
+		}
+		var rootHash []byte
+		if rootKey != nil {
+			if len(rootKey) == hashSize {
+				return fmt.Errorf("version %d is stored in the legacy format", version)
+			}
+			root, err := tree.ndb.GetNode(rootKey)
+			if err != nil {
+				return err
+			}
+			rootHash = root.hash
+			if err := tree.exportVersionNodes(bw, &buf, root, fromVersion, version); err != nil {
+				return err
+			}
+		}
+
+		record := binary.AppendVarint([]byte{versionsRecordVersion}, version)
+		if _, err := bw.Write(record); err != nil {
+			return err
+		}
+		if err := encoding.EncodeBytes(bw, rootKey); err != nil {
+			return err
+		}
+		if err := encoding.EncodeBytes(bw, rootHash); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// exportVersionNodes writes the nodes of the subtree of node which are not shared with the
+// previous version of the stream, in post-order so that the children precede their parents.
+func (tree *MutableTree) exportVersionNodes(w *bufio.Writer, buf *bytes.Buffer, node *Node, fromVersion, version int64) error {
+	if version > fromVersion && node.nodeKey.version < version {
+		// the older nodes are shared with the previous version of the stream
+		return nil
+	}
+	if node.isLegacy || len(node.leftNodeKey) == hashSize || len(node.rightNodeKey) == hashSize {
+		return fmt.Errorf("node %v of version %d references the legacy format", node.nodeKey, version)
+	}
+	if !node.isLeaf() {
+		for _, nk := range [][]byte{node.leftNodeKey, node.rightNodeKey} {
+			child, err := tree.ndb.GetNode(nk)
+			if err != nil {
+				return err
+			}
+			if err := tree.exportVersionNodes(w, buf, child, fromVersion, version); err != nil {
+				return err
+			}
+		}
+	}
+	buf.Reset()
+	if err := node.writeBytes(buf); err != nil {
+		return err
+	}
+	if err := w.WriteByte(versionsRecordNode); err != nil {
+		return err
+	}
+	if _, err := w.Write(node.GetKey()); err != nil {
+		return err
+	}
+	return encoding.EncodeBytes(w, buf.Bytes())
+}
+
+// ImportVersions imports a stream written by ExportVersions into an empty tree, and loads its last
+// version. The hash of every node is recomputed from its contents and children, and the root hash
+// of every version is checked against the stream, so callers only need to compare the root hashes
+// with trusted ones. It keeps the hashes of the imported nodes in memory. On error, the imported
+// nodes are removed and the tree is left empty.
+func (tree *MutableTree) ImportVersions(r io.Reader) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if latestVersion > 0 {
+		return fmt.Errorf("found database at version %d, must be 0", latestVersion)
+	}
+	if !tree.IsEmpty() {
+		return errors.New("tree must be empty")
+	}
+
+	toVersion, err := tree.importVersions(bufio.NewReader(r))
+	if err != nil {
+		if rollbackErr := tree.rollbackImportVersions(toVersion); rollbackErr != nil {
+			return fmt.Errorf("%w, and rolling back the import: %w", err, rollbackErr)
+		}
+		return err
+	}
+	tree.ndb.resetLatestVersion(toVersion)
+	_, err = tree.LoadVersion(toVersion)
+	return err
+}
+
+// importVersions writes the stream of r to the batch and returns its last version.
+func (tree *MutableTree) importVersions(r *bufio.Reader) (int64, error) {
+	magic := make([]byte, len(versionsStreamMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != versionsStreamMagic {
+		return 0, fmt.Errorf("%w: not a version range stream", ErrInvalidExportStream)
+	}
+	fromVersion, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: reading first version, %w", ErrInvalidExportStream, unexpectedEOF(err))
+	}
+	toVersion, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: reading last version, %w", ErrInvalidExportStream, unexpectedEOF(err))
+	}
+	if fromVersion < 1 || fromVersion > toVersion {
+		return 0, fmt.Errorf("%w: invalid version range [%d, %d]", ErrInvalidExportStream, fromVersion, toVersion)
+	}
+
+	reader := &ExportReader{r: r}
+	hashes := make(map[string][]byte)
+	hashOf := func(nk []byte) ([]byte, bool) {
+		hash, ok := hashes[string(nk)]
+		return hash, ok
+	}
+	nextVersion := fromVersion
+	for {
+		recordType, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return toVersion, err
+		}
+		switch recordType {
+		case versionsRecordNode:
+			nk := make([]byte, int64Size+int32Size)
+			if _, err := io.ReadFull(r, nk); err != nil {
+				return toVersion, fmt.Errorf("%w: reading node key, %w", ErrInvalidExportStream, unexpectedEOF(err))
+			}
+			bz, err := reader.readBytes()
+			if err != nil {
+				return toVersion, fmt.Errorf("%w: reading node %v, %w", ErrInvalidExportStream, GetNodeKey(nk), err)
+			}
+			node, err := importVersionsNode(nk, bz, hashOf)
+			if err != nil {
+				return toVersion, fmt.Errorf("%w: node %v: %w", ErrInvalidExportStream, GetNodeKey(nk), err)
+			}
+			hashes[string(nk)] = node.hash
+			if node.isLeaf() && tree.ndb.opts.ValueTransform != nil {
+				var stored bytes.Buffer
+				if err := tree.ndb.writeNode(&stored, node); err != nil {
+					return toVersion, err
+				}
+				bz = stored.Bytes()
+			}
+			// the root of a version before the range is stored like a root reformatted by the
+			// pruning, so that the version is not mistaken for an existing one
+			storeKey := GetNodeKey(nk)
+			if storeKey.nonce == 1 && storeKey.version < fromVersion {
+				storeKey.nonce = 0
+			}
+			if err := tree.ndb.batch.Set(tree.ndb.nodeKey(storeKey.GetKey()), bz); err != nil {
+				return toVersion, err
+			}
+
+		case versionsRecordVersion:
+			version, err := binary.ReadVarint(r)
+			if err != nil {
+				return toVersion, fmt.Errorf("%w: reading version, %w", ErrInvalidExportStream, unexpectedEOF(err))
+			}
+			if version != nextVersion || version > toVersion {
+				return toVersion, fmt.Errorf("%w: expected version %d, got %d", ErrInvalidExportStream, nextVersion, version)
+			}
+			rootKey, err := reader.readBytes()
+			if err != nil {
+				return toVersion, fmt.Errorf("%w: reading root of version %d, %w", ErrInvalidExportStream, version, err)
+			}
+			expectedHash, err := reader.readBytes()
+			if err != nil {
+				return toVersion, fmt.Errorf("%w: reading root hash of version %d, %w", ErrInvalidExportStream, version, err)
+			}
+			if len(rootKey) == 0 {
+				err = tree.ndb.SaveEmptyRoot(version)
+			} else {
+				hash, ok := hashOf(rootKey)
+				if !ok {
+					return toVersion, fmt.Errorf("%w: missing root of version %d", ErrInvalidExportStream, version)
+				}
+				if !bytes.Equal(hash, expectedHash) {
+					return toVersion, fmt.Errorf("%w: version %d: expected %X, got %X", ErrImportHashMismatch, version, expectedHash, hash)
+				}
+				if rootNodeKey := GetNodeKey(rootKey); rootNodeKey.version != version || rootNodeKey.nonce != 1 {
+					err = tree.ndb.SaveRoot(version, rootNodeKey)
+				}
+			}
+			if err != nil {
+				return toVersion, err
+			}
+			nextVersion++
+
+		default:
+			return toVersion, fmt.Errorf("%w: unknown record type %d", ErrInvalidExportStream, recordType)
+		}
+	}
+	if nextVersion != toVersion+1 {
+		return toVersion, fmt.Errorf("%w: stream ended before version %d", ErrInvalidExportStream, nextVersion)
+	}
+	return toVersion, tree.ndb.Commit()
+}
+
+// importVersionsNode decodes a node of a version range stream, with its hash recomputed from its
+// contents and the hashes of its children.
+func importVersionsNode(nk, bz []byte, hashOf func(nk []byte) ([]byte, bool)) (*Node, error) {
+	node, err := MakeNode(nk, bz)
+	if err != nil {
+		return nil, err
+	}
+	if node.isLeaf() {
+		// MakeNode hashes the leaves
+		return node, nil
+	}
+	if len(node.leftNodeKey) == hashSize || len(node.rightNodeKey) == hashSize {
+		return nil, errors.New("legacy children are not supported")
+	}
+	leftHash, ok := hashOf(node.leftNodeKey)
+	if !ok {
+		return nil, fmt.Errorf("missing left child %v", GetNodeKey(node.leftNodeKey))
+	}
+	rightHash, ok := hashOf(node.rightNodeKey)
+	if !ok {
+		return nil, fmt.Errorf("missing right child %v", GetNodeKey(node.rightNodeKey))
+	}
+	storedHash := node.hash
+	node.hash = nil
+	node.leftNode, node.rightNode = &Node{hash: leftHash}, &Node{hash: rightHash}
+	hash := node._hash(node.nodeKey.version)
+	if storedHash != nil && !bytes.Equal(hash, storedHash) {
+		return nil, fmt.Errorf("stored hash %X does not match the computed hash %X", storedHash, hash)
+	}
+	return node, nil
+}
+
+// rollbackImportVersions discards the pending writes of ImportVersions and deletes the nodes and
+// roots already flushed to the database, which was empty when the import started.
+func (tree *MutableTree) rollbackImportVersions(toVersion int64) error {
+	ndb := tree.ndb
+	ndb.mtx.Lock()
+	ndb.discardBatches()
+	ndb.mtx.Unlock()
+
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	if err := ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(0), nodeKeyPrefixFormat.KeyInt64(toVersion+1), func(k, _ []byte) error {
+		return batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	return batch.WriteSync()
+}
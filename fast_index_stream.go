@@ -0,0 +1,208 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosmos/iavl/fastnode"
+	"github.com/cosmos/iavl/internal/encoding"
+)
+
+// ErrInvalidFastIndexStream is returned by MutableTree.ImportFastIndex when a fast index stream is
+// malformed or does not match the tree.
+var ErrInvalidFastIndexStream = errors.New("invalid fast index stream")
+
+// A fast index stream starts with the version of the index as a varint and the length-prefixed
+// root hash of the tree at that version, followed by a record for each fast node in ascending key
+// order: the length-prefixed key, then the version at which the key was last updated as a varint
+// and the length-prefixed value, where lengths are uvarints.
+
+// ExportFastIndex writes the fast index of the latest version to w, so that a receiver holding the
+// same version of the tree can import it with ImportFastIndex instead of rebuilding it, and returns
+// the number of fast nodes written. The index must be up to date.
+func (tree *MutableTree) ExportFastIndex(w io.Writer) (int64, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	shouldForce, err := tree.ndb.shouldForceFastStorageUpgrade()
+	if err != nil {
+		return 0, err
+	}
+	if !tree.ndb.hasUpgradedToFastStorage() || shouldForce || tree.fastIndexStale {
+		return 0, errors.New("the fast index is not up to date")
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	latest, err := tree.GetImmutable(latestVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := encoding.EncodeVarint(bw, latestVersion); err != nil {
+		return 0, fmt.Errorf("writing version, %w", err)
+	}
+	if err := encoding.EncodeBytes(bw, latest.Hash()); err != nil {
+		return 0, fmt.Errorf("writing root hash, %w", err)
+	}
+	var count int64
+	err = tree.ndb.traverseFastNodes(func(keyWithPrefix, v []byte) error {
+		node, err := tree.ndb.makeFastNode(keyWithPrefix[1:], v)
+		if err != nil {
+			return err
+		}
+		if err := encoding.EncodeBytes(bw, node.GetKey()); err != nil {
+			return fmt.Errorf("writing key, %w", err)
+		}
+		if err := node.WriteBytes(bw); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
+// ImportFastIndex replaces the fast index with the one written by ExportFastIndex, and makes the
+// tree read and maintain it, even if it skips the fast storage upgrade. The stream must be the
+// index of the latest version, with the same root hash, and each record is checked against the
+// leaf of the tree with the same position in key order: the keys and values must match, and the
+// version must be between the version of the leaf and the latest version. The writes are held in
+// the batch until the whole stream is checked, so on error they are discarded and the index is
+// left as it was. The tree must be loaded at the latest version, without uncommitted changes, and
+// must not be in write-only mode.
+func (tree *MutableTree) ImportFastIndex(r io.Reader) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	if tree.writeOnly {
+		return errors.New("cannot import the fast index in write-only mode")
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if tree.version != latestVersion {
+		return fmt.Errorf("the fast index must be imported at the latest version %d, loaded version %d", latestVersion, tree.version)
+	}
+	if tree.root != tree.lastSaved.root {
+		return errors.New("cannot import the fast index with uncommitted changes")
+	}
+
+	tree.ndb.holdFlushes(true)
+	if err := tree.importFastIndex(bufio.NewReader(r), latestVersion); err != nil {
+		tree.ndb.mtx.Lock()
+		tree.ndb.discardBatches()
+		tree.ndb.mtx.Unlock()
+		return err
+	}
+	tree.fastIndexStale = false
+	tree.setSkipFastStorageUpgrade(false)
+	return nil
+}
+
+func (tree *MutableTree) importFastIndex(r *bufio.Reader, latestVersion int64) error {
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return fmt.Errorf("%w: reading version, %w", ErrInvalidFastIndexStream, unexpectedEOF(err))
+	}
+	if version != latestVersion {
+		return fmt.Errorf("%w: the index of version %d cannot be imported at version %d", ErrInvalidFastIndexStream, version, latestVersion)
+	}
+	rootHash, err := readStreamBytes(r)
+	if err != nil {
+		return fmt.Errorf("%w: reading root hash, %w", ErrInvalidFastIndexStream, err)
+	}
+	if hash := tree.lastSaved.Hash(); !bytes.Equal(rootHash, hash) {
+		return fmt.Errorf("%w: root hash %X does not match the tree hash %X", ErrInvalidFastIndexStream, rootHash, hash)
+	}
+
+	// remove the stale fast nodes, as in MigrateFastStorage
+	fastItr := NewFastIterator(nil, nil, true, tree.ndb)
+	for ; fastItr.Valid(); fastItr.Next() {
+		if err := tree.ndb.DeleteFastNode(fastItr.Key()); err != nil {
+			fastItr.Close()
+			return err
+		}
+	}
+	if err := fastItr.Close(); err != nil {
+		return err
+	}
+	if err := tree.ndb.deleteFastMigrationCheckpoint(); err != nil {
+		return err
+	}
+
+	// the leaves of the tree in ascending key order
+	var leaves *traversal
+	if root := tree.lastSaved.root; root != nil {
+		leaves = root.newTraversal(tree.lastSaved, nil, nil, true, false, false)
+	}
+	nextLeaf := func() (*Node, error) {
+		for leaves != nil {
+			node, err := leaves.next()
+			if err != nil || node == nil || node.isLeaf() {
+				return node, err
+			}
+		}
+		return nil, nil
+	}
+
+	var count int64
+	for ; ; count++ {
+		if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+			break
+		}
+		key, err := readStreamBytes(r)
+		if err != nil {
+			return fmt.Errorf("%w: fast node %d: reading key, %w", ErrInvalidFastIndexStream, count, err)
+		}
+		updated, err := binary.ReadVarint(r)
+		if err != nil {
+			return fmt.Errorf("%w: fast node %d: reading version, %w", ErrInvalidFastIndexStream, count, unexpectedEOF(err))
+		}
+		value, err := readStreamBytes(r)
+		if err != nil {
+			return fmt.Errorf("%w: fast node %d: reading value, %w", ErrInvalidFastIndexStream, count, err)
+		}
+		leaf, err := nextLeaf()
+		if err != nil {
+			return err
+		}
+		switch {
+		case leaf == nil:
+			return fmt.Errorf("%w: fast node %d: key %X is after the last key of the tree", ErrInvalidFastIndexStream, count, key)
+		case !bytes.Equal(key, leaf.key):
+			return fmt.Errorf("%w: fast node %d: key %X does not match the key %X of the tree", ErrInvalidFastIndexStream, count, key, leaf.key)
+		case !bytes.Equal(value, leaf.value):
+			return fmt.Errorf("%w: fast node %d: the value of key %X does not match the tree", ErrInvalidFastIndexStream, count, key)
+		case updated < leaf.nodeKey.version || updated > latestVersion:
+			return fmt.Errorf("%w: fast node %d: invalid version %d of key %X, updated at version %d", ErrInvalidFastIndexStream, count, updated, key, leaf.nodeKey.version)
+		}
+		if err := tree.ndb.SaveFastNodeNoCache(fastnode.NewNode(key, value, updated)); err != nil {
+			return err
+		}
+	}
+	if leaf, err := nextLeaf(); err != nil {
+		return err
+	} else if leaf != nil {
+		return fmt.Errorf("%w: %d fast nodes for %d keys", ErrInvalidFastIndexStream, count, tree.lastSaved.Size())
+	}
+
+	if err := tree.ndb.SetFastStorageVersionToBatch(latestVersion); err != nil {
+		return err
+	}
+	tree.ndb.holdFlushes(false)
+	return tree.ndb.Commit()
+}
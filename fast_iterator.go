@@ -13,6 +13,7 @@ var errFastIteratorNilNdbGiven = errors.New("fast iterator must be created with
 // FastIterator is a dbm.Iterator for ImmutableTree
 // it iterates over the latest state via fast nodes,
 // taking advantage of keys being located in sequence in the underlying database.
+// It does not support Seek, see Iterator.Seek.
 type FastIterator struct {
 	start, end []byte
 
@@ -114,7 +115,7 @@ func (iter *FastIterator) Next() {
 
 	iter.valid = iter.valid && iter.fastIterator.Valid()
 	if iter.valid {
-		iter.nextFastNode, iter.err = fastnode.DeserializeNode(iter.fastIterator.Key()[1:], iter.fastIterator.Value())
+		iter.nextFastNode, iter.err = iter.ndb.makeFastNode(iter.fastIterator.Key()[1:], iter.fastIterator.Value())
 		iter.valid = iter.err == nil
 	}
 }
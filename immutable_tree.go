@@ -1,7 +1,13 @@
 package iavl
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"math/rand"
+	"sort"
 	"strings"
 
 	corestore "cosmossdk.io/core/store"
@@ -55,6 +61,9 @@ func (t *ImmutableTree) String() string {
 // RenderShape provides a nested tree shape, ident is prepended in each level
 // Returns an array of strings, one per line, to join with "\n" or display otherwise
 func (t *ImmutableTree) RenderShape(indent string, encoder NodeEncoder) ([]string, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
 	if encoder == nil {
 		encoder = defaultNodeEncoder
 	}
@@ -142,23 +151,299 @@ func (t *ImmutableTree) Height() int8 {
 
 // Has returns whether or not a key exists.
 func (t *ImmutableTree) Has(key []byte) (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
 	if t.root == nil {
 		return false, nil
 	}
 	return t.root.has(t, key)
 }
 
-// Hash returns the root hash.
+// HasWithContext is like Has, but returns ctx.Err() once ctx is done, which is checked before
+// reading each node of the tree.
+func (t *ImmutableTree) HasWithContext(ctx context.Context, key []byte) (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	if t.root == nil {
+		return false, nil
+	}
+	_, found, err := t.getFromTree(ctx, key)
+	return found, err
+}
+
+// HasBatch returns whether or not each of the given keys exists, in the input order. The keys
+// are sorted internally so that the tree is only descended once for the whole batch.
+func (t *ImmutableTree) HasBatch(keys [][]byte) ([]bool, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	result := make([]bool, len(keys))
+	if t.root == nil || len(keys) == 0 {
+		return result, nil
+	}
+	err := t.root.findBatch(t, keys, sortedOrder(keys), func(i int, leaf *Node) {
+		result[i] = bytes.Equal(leaf.key, keys[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetMany returns the values of the given keys in the input order, nil for the absent ones. Like
+// HasBatch, the tree is descended once for the whole batch, sharing the nodes of the common
+// paths. The values must not be modified, since they may point to data stored within IAVL.
+func (t *ImmutableTree) GetMany(keys [][]byte) ([][]byte, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	values := make([][]byte, len(keys))
+	if t.root == nil || len(keys) == 0 {
+		return values, nil
+	}
+	err := t.root.findBatch(t, keys, sortedOrder(keys), func(i int, leaf *Node) {
+		if bytes.Equal(leaf.key, keys[i]) {
+			values[i] = leaf.value
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// sortedOrder returns the indexes of keys in ascending order of the keys.
+func sortedOrder(keys [][]byte) []int {
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return bytes.Compare(keys[order[i]], keys[order[j]]) < 0
+	})
+	return order
+}
+
+// GetRangePage returns up to limit pairs with keys between start and end non-inclusive in
+// ascending order, and the key to pass as start to get the next page, or nil if there are no
+// more pairs. A limit of zero or less returns all the pairs. The keys and values are copies, as
+// they outlive the underlying iterator.
+func (t *ImmutableTree) GetRangePage(start, end []byte, limit int) (pairs []*KVPair, next []byte, err error) {
+	if t.isClosed() {
+		return nil, nil, ErrClosed
+	}
+	if t.root == nil {
+		return nil, nil, nil
+	}
+	itr, err := t.Iterator(start, end, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return getRangePage(itr, limit)
+}
+
+// GetRangePageWithContext is like GetRangePage, but returns ctx.Err() once ctx is done, which is
+// checked periodically during the iteration, see IteratorWithContext.
+func (t *ImmutableTree) GetRangePageWithContext(ctx context.Context, start, end []byte, limit int) (pairs []*KVPair, next []byte, err error) {
+	if t.isClosed() {
+		return nil, nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	if t.root == nil {
+		return nil, nil, nil
+	}
+	itr, err := t.IteratorWithContext(ctx, start, end, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return getRangePage(itr, limit)
+}
+
+func getRangePage(itr corestore.Iterator, limit int) (pairs []*KVPair, next []byte, err error) {
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if limit > 0 && len(pairs) == limit {
+			return pairs, bytes.Clone(itr.Key()), nil
+		}
+		pairs = append(pairs, NewKVPair(bytes.Clone(itr.Key()), bytes.Clone(itr.Value())))
+	}
+	return pairs, nil, itr.Error()
+}
+
+// Prev returns the key and value of the greatest key less than the given key, and false if there
+// is none. The returned key and value must not be modified, since they may point to data stored
+// within IAVL.
+func (t *ImmutableTree) Prev(key []byte) (k, v []byte, ok bool, err error) {
+	if t.isClosed() {
+		return nil, nil, false, ErrClosed
+	}
+	if t.root == nil {
+		return nil, nil, false, nil
+	}
+
+	// Turning right means the right subtree holds node.key < key, so the leaf at the end of
+	// the path is the predecessor unless every turn was to the left.
+	node := t.root
+	for !node.isLeaf() {
+		if bytes.Compare(key, node.key) <= 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if bytes.Compare(node.key, key) < 0 {
+		return node.key, node.value, true, nil
+	}
+	return nil, nil, false, nil
+}
+
+// Next returns the key and value of the smallest key greater than the given key, and false if
+// there is none. The returned key and value must not be modified, since they may point to data
+// stored within IAVL.
+func (t *ImmutableTree) Next(key []byte) (k, v []byte, ok bool, err error) {
+	if t.isClosed() {
+		return nil, nil, false, ErrClosed
+	}
+	if t.root == nil {
+		return nil, nil, false, nil
+	}
+
+	// If the leaf at the end of the path is not greater than key, the successor is the leftmost
+	// leaf of the right subtree of the last node where the path turned left.
+	var lastLeftTurn *Node
+	node := t.root
+	for !node.isLeaf() {
+		if bytes.Compare(key, node.key) < 0 {
+			lastLeftTurn = node
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	if bytes.Compare(node.key, key) > 0 {
+		return node.key, node.value, true, nil
+	}
+	if lastLeftTurn == nil {
+		return nil, nil, false, nil
+	}
+
+	node, err = lastLeftTurn.getRightNode(t)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for !node.isLeaf() {
+		if node, err = node.getLeftNode(t); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	return node.key, node.value, true, nil
+}
+
+// FirstKey returns the smallest key of the tree and its value, and false if the tree is empty.
+// It only descends the left spine of the tree. The returned key and value must not be modified,
+// since they may point to data stored within IAVL.
+func (t *ImmutableTree) FirstKey() (k, v []byte, ok bool, err error) {
+	if t.isClosed() {
+		return nil, nil, false, ErrClosed
+	}
+	return t.extremeKey(false)
+}
+
+// LastKey returns the greatest key of the tree and its value, and false if the tree is empty.
+// It only descends the right spine of the tree. The returned key and value must not be modified,
+// since they may point to data stored within IAVL.
+func (t *ImmutableTree) LastKey() (k, v []byte, ok bool, err error) {
+	if t.isClosed() {
+		return nil, nil, false, ErrClosed
+	}
+	return t.extremeKey(true)
+}
+
+func (t *ImmutableTree) extremeKey(last bool) (k, v []byte, ok bool, err error) {
+	if t.root == nil {
+		return nil, nil, false, nil
+	}
+	node := t.root
+	for !node.isLeaf() {
+		if last {
+			node, err = node.getRightNode(t)
+		} else {
+			node, err = node.getLeftNode(t)
+		}
+		if err != nil {
+			return nil, nil, false, err
+		}
+	}
+	return node.key, node.value, true, nil
+}
+
+// Hash returns the root hash, or nil with the NoHash option.
 func (t *ImmutableTree) Hash() []byte {
+	if t.noHash() {
+		return nil
+	}
 	return t.root.hashWithCount(t.version + 1)
 }
 
 // Export returns an iterator that exports tree nodes as ExportNodes. These nodes can be
 // imported with MutableTree.Import() to recreate an identical tree.
 func (t *ImmutableTree) Export() (*Exporter, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
 	return newExporter(t)
 }
 
+// ExportOrdered is like Export, but returns the nodes in the given order. MutableTree.Import()
+// accepts both orders, detected from the first node, but the nodes of an import must all be in
+// the same order: mixing them is an error. Callers must call Close() on the exporter when done.
+func (t *ImmutableTree) ExportOrdered(order TraversalOrder) (*Exporter, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	return newOrderedExporter(t, order)
+}
+
+// ExportWithProgress is like Export, but the exporter calls fn with the number of nodes exported
+// so far every 1000 nodes, and with the total once the export is complete. fn is called by
+// Exporter.Next(), in the goroutine of the caller. Callers must call Close() on the exporter when
+// done.
+func (t *ImmutableTree) ExportWithProgress(fn func(done int64)) (*Exporter, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	exporter, err := newExporter(t)
+	if err != nil {
+		return nil, err
+	}
+	exporter.progress = fn
+	return exporter, nil
+}
+
+// ExportPrefix returns an exporter of the leaves whose keys start with prefix, as a standalone
+// tree that can be imported with MutableTree.Import(). The leaves keep their versions, but the
+// inner nodes connecting them are rebuilt into a balanced tree, so the imported root hash differs
+// from the hash of the tree. Callers must call Close() on the exporter when done.
+func (t *ImmutableTree) ExportPrefix(prefix []byte) (*Exporter, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	return newPrefixExporter(t, prefix)
+}
+
 // GetWithIndex returns the index and value of the specified key if it exists, or nil and the next index
 // otherwise. The returned value must not be modified, since it may point to data stored within
 // IAVL.
@@ -166,17 +451,50 @@ func (t *ImmutableTree) Export() (*Exporter, error) {
 // The index is the index in the list of leaf nodes sorted lexicographically by key. The leftmost leaf has index 0.
 // It's neighbor has index 1 and so on.
 func (t *ImmutableTree) GetWithIndex(key []byte) (int64, []byte, error) {
+	if t.isClosed() {
+		return 0, nil, ErrClosed
+	}
 	if t.root == nil {
 		return 0, nil, nil
 	}
 	return t.root.get(t, key)
 }
 
+// GetInto is like Get, but copies the value into buf, which is grown only if it is too small, and
+// returns the resulting slice. Unlike with Get, the value does not alias the memory of the tree,
+// so buf can be reused across calls without allocating. found is false if the key does not exist.
+func (t *ImmutableTree) GetInto(key []byte, buf []byte) (value []byte, found bool, err error) {
+	if t.isClosed() {
+		return nil, false, ErrClosed
+	}
+	result, err := t.Get(key)
+	if err != nil || result == nil {
+		return nil, false, err
+	}
+	if buf == nil {
+		// keep the empty values non-nil, like Get
+		buf = []byte{}
+	}
+	return append(buf[:0], result...), true, nil
+}
+
 // Get returns the value of the specified key if it exists, or nil.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 // Get potentially employs a more performant strategy than GetWithIndex for retrieving the value.
 // If tree.skipFastStorageUpgrade is true, this will work almost the same as GetWithIndex.
 func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
+	return t.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext is like Get, but returns ctx.Err() once ctx is done, which is checked before
+// reading each node of the tree.
+func (t *ImmutableTree) GetWithContext(ctx context.Context, key []byte) ([]byte, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if t.root == nil {
 		return nil, nil
 	}
@@ -186,7 +504,7 @@ func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
 		// if call fails, fall back to the original IAVL logic in place.
 		fastNode, err := t.ndb.GetFastNode(key)
 		if err != nil {
-			_, result, err := t.root.get(t, key)
+			result, _, err := t.getFromTree(ctx, key)
 			return result, err
 		}
 
@@ -195,27 +513,111 @@ func (t *ImmutableTree) Get(key []byte) ([]byte, error) {
 			// then the regular node is not in the tree either because fast node
 			// represents live state.
 			if t.version == t.ndb.latestVersion {
-				return nil, nil
+				return t.checkFastGet(key, nil)
 			}
 
-			_, result, err := t.root.get(t, key)
+			result, _, err := t.getFromTree(ctx, key)
 			return result, err
 		}
 
 		if fastNode.GetVersionLastUpdatedAt() <= t.version {
-			return fastNode.GetValue(), nil
+			return t.checkFastGet(key, fastNode.GetValue())
 		}
 	}
 
 	// otherwise skipFastStorageUpgrade is true or
 	// the cached node was updated later than the current tree. In this case,
 	// we need to use the regular stategy for reading from the current tree to avoid staleness.
-	_, result, err := t.root.get(t, key)
+	result, _, err := t.getFromTree(ctx, key)
 	return result, err
 }
 
+// getFromTree descends the tree to the leaf of key, checking ctx before reading each node, and
+// returns its value and whether the key exists.
+func (t *ImmutableTree) getFromTree(ctx context.Context, key []byte) (value []byte, found bool, err error) {
+	node := t.root
+	for !node.isLeaf() {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
+		if bytes.Compare(key, node.key) < 0 {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if !bytes.Equal(node.key, key) {
+		return nil, false, nil
+	}
+	return node.value, true, nil
+}
+
+// GetValueOnly returns the value of key like Get, or nil if it does not exist, but reads it from
+// the tree, without the fast index, decoding only the key and value of the leaf. This avoids
+// hashing the leaf, which is most of the cost of reading a large value which is not cached.
+func (t *ImmutableTree) GetValueOnly(key []byte) ([]byte, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	if t.root == nil {
+		return nil, nil
+	}
+	node := t.root
+	for !node.isLeaf() {
+		child, childKey := node.rightNode, node.rightNodeKey
+		if bytes.Compare(key, node.key) < 0 {
+			child, childKey = node.leftNode, node.leftNodeKey
+		}
+		if child == nil && node.subtreeHeight == 1 {
+			value, found, err := t.ndb.getLeafValue(childKey, key)
+			if err != nil || !found {
+				return nil, err
+			}
+			return value, nil
+		}
+		if child == nil {
+			var err error
+			if child, err = t.ndb.GetNode(childKey); err != nil {
+				return nil, err
+			}
+		}
+		node = child
+	}
+	if !bytes.Equal(node.key, key) {
+		return nil, nil
+	}
+	return node.value, nil
+}
+
+// checkFastGet returns the value of key read from the fast index, after comparing it with the
+// value read from the tree for the fraction Options.FastIndexCheckRate of the reads. On mismatch,
+// Options.OnFastIndexMismatch is called and the value read from the tree is returned.
+func (t *ImmutableTree) checkFastGet(key, fastValue []byte) ([]byte, error) {
+	rate := t.ndb.opts.FastIndexCheckRate
+	if rate <= 0 || (rate < 1 && rand.Float64() >= rate) {
+		return fastValue, nil
+	}
+	_, value, err := t.root.get(t, key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(value, fastValue) || (value == nil) != (fastValue == nil) {
+		t.ndb.logger.Error("fast index mismatch", "key", key, "fast", fastValue, "value", value)
+		if t.ndb.opts.OnFastIndexMismatch != nil {
+			t.ndb.opts.OnFastIndexMismatch(key, fastValue, value)
+		}
+	}
+	return value, nil
+}
+
 // GetByIndex gets the key and value at the specified index.
 func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte, err error) {
+	if t.isClosed() {
+		return nil, nil, ErrClosed
+	}
 	if t.root == nil {
 		return nil, nil, nil
 	}
@@ -226,6 +628,9 @@ func (t *ImmutableTree) GetByIndex(index int64) (key []byte, value []byte, err e
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callback, false otherwise
 func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
 	if t.root == nil {
 		return false, nil
 	}
@@ -246,6 +651,9 @@ func (t *ImmutableTree) Iterate(fn func(key []byte, value []byte) bool) (bool, e
 
 // Iterator returns an iterator over the immutable tree.
 func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
 	if !t.skipFastStorageUpgrade {
 		isFastCacheEnabled, err := t.IsFastCacheEnabled()
 		if err != nil {
@@ -253,10 +661,46 @@ func (t *ImmutableTree) Iterator(start, end []byte, ascending bool) (corestore.I
 		}
 
 		if isFastCacheEnabled {
-			return NewFastIterator(start, end, ascending, t.ndb), nil
+			return t.ndb.limitIterators(func() corestore.Iterator {
+				return t.withPrefetch(NewFastIterator(start, end, ascending, t.ndb))
+			})
 		}
 	}
-	return NewIterator(start, end, ascending, t), nil
+	return t.ndb.limitIterators(func() corestore.Iterator {
+		return t.withPrefetch(NewIterator(start, end, ascending, t))
+	})
+}
+
+// IteratorWithContext returns an iterator like Iterator, which becomes invalid once ctx is done,
+// with ctx.Err() as its error, see ContextIterator.
+func (t *ImmutableTree) IteratorWithContext(ctx context.Context, start, end []byte, ascending bool) (corestore.Iterator, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	itr, err := t.Iterator(start, end, ascending)
+	if err != nil {
+		return nil, err
+	}
+	return NewContextIterator(ctx, itr), nil
+}
+
+// IterateLimited returns an iterator like Iterator, which becomes invalid after yielding limit
+// pairs. LimitedIterator.HasMore then reports whether the range holds more pairs.
+func (t *ImmutableTree) IterateLimited(start, end []byte, ascending bool, limit int) (*LimitedIterator, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("negative iterator limit %d", limit)
+	}
+	itr, err := t.Iterator(start, end, ascending)
+	if err != nil {
+		return nil, err
+	}
+	return NewLimitedIterator(itr, limit), nil
 }
 
 // IterateRange makes a callback for all nodes with key between start and end non-inclusive.
@@ -289,11 +733,147 @@ func (t *ImmutableTree) IterateRangeInclusive(start, end []byte, ascending bool,
 	})
 }
 
+// IterateValuesProjected iterates over the keys between start and end non-inclusive in ascending
+// order like Iterator, passing each value through project before calling fn, e.g. to keep only a
+// type prefix. Values are stored inline with the nodes, so this only avoids copying full values
+// into the caller. Returns true if stopped by fn, false otherwise.
+func (t *ImmutableTree) IterateValuesProjected(start, end []byte, project func(value []byte) []byte, fn func(key, value []byte) bool) (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
+	itr, err := t.Iterator(start, end, true)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		if fn(itr.Key(), project(itr.Value())) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
+// IterateStreaming iterates over the keys between start and end non-inclusive in ascending order
+// like Iterator, passing each value to fn as a reader, which is only valid until fn returns.
+// Values are stored inline with the nodes, so the readers read from the loaded values, but
+// callers do not depend on holding whole values. Returns true if stopped by fn, false otherwise.
+func (t *ImmutableTree) IterateStreaming(start, end []byte, fn func(key []byte, value io.Reader) bool) (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
+	itr, err := t.Iterator(start, end, true)
+	if err != nil {
+		return false, err
+	}
+	defer itr.Close()
+
+	var reader bytes.Reader
+	for ; itr.Valid(); itr.Next() {
+		reader.Reset(itr.Value())
+		if fn(itr.Key(), &reader) {
+			return true, nil
+		}
+	}
+	return false, itr.Error()
+}
+
+// WalkStructure calls fn with the hash, height, size and child hashes of each inner node in
+// pre-order, from the root and the left subtree before the right one, until fn returns false.
+// The values are not passed, but the leaves are still read for their hashes.
+func (t *ImmutableTree) WalkStructure(fn func(hash []byte, height int8, size int64, leftHash, rightHash []byte) bool) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	if t.noHash() {
+		return ErrHashingDisabled
+	}
+	if t.root == nil || t.root.isLeaf() {
+		return nil
+	}
+	t.Hash()
+
+	var walk func(node *Node) (bool, error)
+	walk = func(node *Node) (bool, error) {
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return false, err
+		}
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return false, err
+		}
+		if !fn(node.hash, node.subtreeHeight, node.size, leftNode.hash, rightNode.hash) {
+			return false, nil
+		}
+		for _, child := range []*Node{leftNode, rightNode} {
+			if child.isLeaf() {
+				continue
+			}
+			if ok, err := walk(child); !ok || err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	_, err := walk(t.root)
+	return err
+}
+
+// NodeHashes writes the 32-byte hash of each node of the tree to w, inner nodes and leaves, in
+// pre-order from the root and the left subtree before the right one, and returns the number of
+// hashes written. Trees with the same nodes write the same hashes in the same order.
+func (t *ImmutableTree) NodeHashes(w io.Writer) (int64, error) {
+	if t.isClosed() {
+		return 0, ErrClosed
+	}
+	if t.noHash() {
+		return 0, ErrHashingDisabled
+	}
+	if t.root == nil {
+		return 0, nil
+	}
+	t.Hash()
+
+	bw := bufio.NewWriter(w)
+	var count int64
+	var walk func(node *Node) error
+	walk = func(node *Node) error {
+		if _, err := bw.Write(node.hash); err != nil {
+			return err
+		}
+		count++
+		if node.isLeaf() {
+			return nil
+		}
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		if err := walk(leftNode); err != nil {
+			return err
+		}
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		return walk(rightNode)
+	}
+	if err := walk(t.root); err != nil {
+		return count, err
+	}
+	return count, bw.Flush()
+}
+
 // IsFastCacheEnabled returns true if fast cache is enabled, false otherwise.
 // For fast cache to be enabled, the following 2 conditions must be met:
 // 1. The tree is of the latest version.
 // 2. The underlying storage has been upgraded to fast cache
 func (t *ImmutableTree) IsFastCacheEnabled() (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
 	isLatestTreeVersion, err := t.isLatestTreeVersion()
 	if err != nil {
 		return false, err
@@ -320,6 +900,12 @@ func (t *ImmutableTree) clone() *ImmutableTree {
 	}
 }
 
+// isClosed reports whether the database of the tree was closed, by closing the MutableTree it
+// belongs to.
+func (t *ImmutableTree) isClosed() bool {
+	return t.ndb != nil && t.ndb.closed.Load()
+}
+
 // nodeSize is like Size, but includes inner nodes too.
 // used only for testing.
 func (t *ImmutableTree) nodeSize() int {
@@ -329,5 +915,8 @@ func (t *ImmutableTree) nodeSize() int {
 // TraverseStateChanges iterate the range of versions, compare each version to it's predecessor to extract the state changes of it.
 // endVersion is exclusive.
 func (t *ImmutableTree) TraverseStateChanges(startVersion, endVersion int64, fn func(version int64, changeSet *ChangeSet) error) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
 	return t.ndb.traverseStateChanges(startVersion, endVersion, fn)
 }
@@ -14,10 +14,15 @@ const maxBatchSize = 10000
 // ErrNoImport is returned when calling methods on a closed importer
 var ErrNoImport = errors.New("no import in progress")
 
+// ErrImportHashMismatch is returned by CommitExpecting when the imported tree does not match the
+// expected root hash
+var ErrImportHashMismatch = errors.New("imported root hash does not match expected hash")
+
 // Importer imports data into an empty MutableTree. It is created by MutableTree.Import(). Users
 // must call Close() when done.
 //
-// ExportNodes must be imported in the order returned by Exporter, i.e. depth-first post-order (LRN).
+// ExportNodes must be imported in the order returned by Exporter, i.e. depth-first post-order (LRN),
+// or in the depth-first pre-order (NLR) of ImmutableTree.ExportOrdered(PreOrder).
 //
 // Importer is not concurrency-safe, it is the caller's responsibility to ensure the tree is not
 // modified while performing an import.
@@ -29,6 +34,15 @@ type Importer struct {
 	stack     []*Node
 	nonces    []uint32
 
+	// preOrder is set when the first node is an inner node, i.e. the root of a pre-order export.
+	// The nodes are then added in post-order once their subtree is complete, and pending holds
+	// the inner nodes whose subtrees are not.
+	preOrder bool
+	pending  []pendingNode
+
+	progress func(done int64)
+	imported int64
+
 	// inflightCommit tracks a batch commit, if any.
 	inflightCommit <-chan error
 }
@@ -68,7 +82,7 @@ func (i *Importer) writeNode(node *Node) error {
 	buf.Reset()
 	defer bufPool.Put(buf)
 
-	if err := node.writeBytes(buf); err != nil {
+	if err := i.tree.ndb.writeNode(buf, node); err != nil {
 		return err
 	}
 
@@ -117,9 +131,17 @@ func (i *Importer) Close() {
 	i.tree = nil
 }
 
+// pendingNode is an inner node of a pre-order import, with the number of its children whose
+// subtrees are complete.
+type pendingNode struct {
+	node     *ExportNode
+	children int
+}
+
 // Add adds an ExportNode to the import. ExportNodes must be added in the order returned by
-// Exporter, i.e. depth-first post-order (LRN). Nodes are periodically flushed to the database,
-// but the imported version is not visible until Commit() is called.
+// Exporter, i.e. depth-first post-order (LRN), or in depth-first pre-order (NLR), which is
+// detected from the first node. Nodes are periodically flushed to the database, but the imported
+// version is not visible until Commit() is called.
 func (i *Importer) Add(exportNode *ExportNode) error {
 	if i.tree == nil {
 		return ErrNoImport
@@ -131,7 +153,46 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 		return fmt.Errorf("node version %v can't be greater than import version %v",
 			exportNode.Version, i.version)
 	}
+	// a post-order import starts with a leaf, and the stack is never empty afterwards
+	if len(i.stack) == 0 && len(i.pending) == 0 && exportNode.Height > 0 {
+		i.preOrder = true
+	}
+	if !i.preOrder {
+		return i.add(exportNode)
+	}
+
+	if len(i.pending) == 0 {
+		if len(i.stack) > 0 {
+			return errors.New("node added after the complete tree of a pre-order import")
+		}
+	} else if parent := i.pending[len(i.pending)-1].node; exportNode.Height >= parent.Height {
+		return fmt.Errorf("node of height %d cannot be a child of a node of height %d in a pre-order import",
+			exportNode.Height, parent.Height)
+	}
+	if exportNode.Height > 0 {
+		i.pending = append(i.pending, pendingNode{node: exportNode})
+		return nil
+	}
+	if err := i.add(exportNode); err != nil {
+		return err
+	}
+	// add the inner nodes whose subtrees are now complete
+	for len(i.pending) > 0 {
+		parent := &i.pending[len(i.pending)-1]
+		parent.children++
+		if parent.children < 2 {
+			return nil
+		}
+		i.pending = i.pending[:len(i.pending)-1]
+		if err := i.add(parent.node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
+// add adds an ExportNode in post-order.
+func (i *Importer) add(exportNode *ExportNode) error {
 	node := &Node{
 		key:           exportNode.Key,
 		value:         exportNode.Value,
@@ -182,6 +243,10 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 
 	i.stack = append(i.stack, node)
 
+	i.imported++
+	if i.progress != nil && i.imported%progressInterval == 0 {
+		i.progress(i.imported)
+	}
 	return nil
 }
 
@@ -189,9 +254,27 @@ func (i *Importer) Add(exportNode *ExportNode) error {
 // version visible, and updating the tree metadata. It can only be called once, and calls Close()
 // internally.
 func (i *Importer) Commit() error {
+	return i.commit(nil)
+}
+
+// CommitExpecting is like Commit, but first verifies that the root hash of the imported tree
+// equals expectedRoot. On mismatch it returns ErrImportHashMismatch, removes any nodes already
+// flushed to the database, and closes the importer without making the version visible.
+func (i *Importer) CommitExpecting(expectedRoot []byte) error {
+	if expectedRoot == nil {
+		return errors.New("expected root hash cannot be nil")
+	}
+	return i.commit(expectedRoot)
+}
+
+func (i *Importer) commit(expectedRoot []byte) error {
 	if i.tree == nil {
 		return ErrNoImport
 	}
+	if len(i.pending) > 0 {
+		return fmt.Errorf("invalid node structure, found %d incomplete subtrees when committing a pre-order import",
+			len(i.pending))
+	}
 
 	switch len(i.stack) {
 	case 0:
@@ -223,6 +306,19 @@ func (i *Importer) Commit() error {
 		return err
 	}
 
+	if expectedRoot != nil {
+		var root *Node
+		if len(i.stack) == 1 {
+			root = i.stack[0]
+		}
+		if rootHash := root.hashWithCount(i.version + 1); !bytes.Equal(rootHash, expectedRoot) {
+			if err := i.rollback(); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: expected %X, got %X", ErrImportHashMismatch, expectedRoot, rootHash)
+		}
+	}
+
 	err = i.batch.WriteSync()
 	if err != nil {
 		return err
@@ -233,7 +329,26 @@ func (i *Importer) Commit() error {
 	if err != nil {
 		return err
 	}
+	if i.progress != nil && (i.imported == 0 || i.imported%progressInterval != 0) {
+		i.progress(i.imported)
+	}
 
 	i.Close()
 	return nil
 }
+
+// rollback discards the pending batch and deletes the nodes already flushed to the database by
+// this import, then closes the importer. The database is known to be empty at import start.
+func (i *Importer) rollback() error {
+	ndb := i.tree.ndb
+	i.Close()
+
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	if err := ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(0), nodeKeyPrefixFormat.KeyInt64(i.version+1), func(k, _ []byte) error {
+		return batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	return batch.WriteSync()
+}
@@ -232,6 +232,62 @@ func TestImporter_Commit_Empty(t *testing.T) {
 	assert.EqualValues(t, 3, tree.Version())
 }
 
+func TestImporter_CommitExpecting(t *testing.T) {
+	// 6000 leaves produce more than maxBatchSize nodes, so some are flushed before commit.
+	source := setupExportTreeSized(t, 6000)
+
+	importTree := func(t *testing.T, db dbm.DB, expectedRoot []byte) (*MutableTree, error) {
+		exporter, err := source.Export()
+		require.NoError(t, err)
+		defer exporter.Close()
+
+		tree := NewMutableTree(db, 0, false, NewNopLogger())
+		importer, err := tree.Import(source.Version())
+		require.NoError(t, err)
+		defer importer.Close()
+		for {
+			node, err := exporter.Next()
+			if errors.Is(err, ErrorExportDone) {
+				break
+			}
+			require.NoError(t, err)
+			require.NoError(t, importer.Add(node))
+		}
+		return tree, importer.CommitExpecting(expectedRoot)
+	}
+
+	t.Run("correct hash", func(t *testing.T) {
+		tree, err := importTree(t, dbm.NewMemDB(), source.Hash())
+		require.NoError(t, err)
+		require.Equal(t, source.Hash(), tree.Hash())
+		require.Equal(t, source.Version(), tree.Version())
+	})
+
+	t.Run("incorrect hash", func(t *testing.T) {
+		db := dbm.NewMemDB()
+		_, err := importTree(t, db, []byte("not the root hash"))
+		require.ErrorIs(t, err, ErrImportHashMismatch)
+
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		require.False(t, itr.Valid(), "database should be empty after rollback")
+
+		tree := NewMutableTree(db, 0, false, NewNopLogger())
+		version, err := tree.Load()
+		require.NoError(t, err)
+		require.EqualValues(t, 0, version)
+	})
+
+	t.Run("empty tree", func(t *testing.T) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		importer, err := tree.Import(1)
+		require.NoError(t, err)
+		require.NoError(t, importer.CommitExpecting(tree.Hash()))
+		require.EqualValues(t, 1, tree.Version())
+	})
+}
+
 func BenchmarkImport(b *testing.B) {
 	benchmarkImport(b, 4096)
 }
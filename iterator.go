@@ -178,7 +178,9 @@ type Iterator struct {
 
 	err error
 
-	t *traversal
+	tree      *ImmutableTree
+	ascending bool
+	t         *traversal
 }
 
 var _ store.Iterator = (*Iterator)(nil)
@@ -186,8 +188,10 @@ var _ store.Iterator = (*Iterator)(nil)
 // Returns a new iterator over the immutable tree. If the tree is nil, the iterator will be invalid.
 func NewIterator(start, end []byte, ascending bool, tree *ImmutableTree) store.Iterator {
 	iter := &Iterator{
-		start: start,
-		end:   end,
+		start:     start,
+		end:       end,
+		tree:      tree,
+		ascending: ascending,
 	}
 
 	if tree == nil {
@@ -243,8 +247,58 @@ func (iter *Iterator) Next() {
 	iter.Next()
 }
 
+// Seek repositions the iterator to the first key >= key when ascending, or <= key when
+// descending, within the domain of the iterator, and reports whether such a key exists. Seeking
+// ahead in the iteration order continues the current traversal, skipping the subtrees before key,
+// while seeking back restarts it from the root.
+//
+// Only the tree iterator supports Seek: the FastIterator and UnsavedFastIterator returned by
+// Iterator when the fast storage is enabled, and the PrefetchIterator wrapping them with
+// Options.IteratorPrefetch, do not. To seek, create the iterator with NewIterator.
+func (iter *Iterator) Seek(key []byte) bool {
+	if iter.tree == nil {
+		return false
+	}
+	start, end, inclusive := iter.start, iter.end, false
+	if iter.ascending {
+		if end != nil && bytes.Compare(key, end) >= 0 {
+			iter.t, iter.valid = nil, false
+			return false
+		}
+		if start == nil || bytes.Compare(key, start) > 0 {
+			start = key
+		}
+	} else {
+		if start != nil && bytes.Compare(key, start) < 0 {
+			iter.t, iter.valid = nil, false
+			return false
+		}
+		if end == nil || bytes.Compare(key, end) < 0 {
+			end, inclusive = key, true
+		}
+	}
+
+	if iter.t != nil && iter.valid {
+		cmp := bytes.Compare(key, iter.key)
+		if cmp == 0 {
+			return true
+		}
+		if (cmp > 0) == iter.ascending {
+			// the keys yet to traverse are all after the current key
+			iter.t.start, iter.t.end, iter.t.inclusive = start, end, inclusive
+			iter.Next()
+			return iter.valid
+		}
+	}
+	iter.t = iter.tree.root.newTraversal(iter.tree, start, end, iter.ascending, inclusive, false)
+	iter.valid = true
+	iter.Next()
+	return iter.valid
+}
+
 // Close implements dbm.Iterator
 func (iter *Iterator) Close() error {
+	iter.tree = nil
 	iter.t = nil
 	iter.valid = false
 	return iter.err
@@ -1,10 +1,14 @@
 package iavl
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
+	"slices"
 	"sort"
 	"sync"
 	"testing"
+	"time"
 
 	corestore "cosmossdk.io/core/store"
 	"github.com/stretchr/testify/require"
@@ -381,3 +385,358 @@ func syncMapCount(m *sync.Map) int {
 	})
 	return count
 }
+
+func TestPrefetchIterator(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, skipFastStorageUpgrade, NewNopLogger())
+		for i := 0; i < 1000; i++ {
+			_, err := tree.Set([]byte{byte(i >> 8), byte(i)}, []byte{byte(rand.Intn(256))})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+
+		prefetched := NewMutableTree(db, 0, skipFastStorageUpgrade, NewNopLogger(), IteratorPrefetchOption(8))
+		_, err = prefetched.Load()
+		require.NoError(t, err)
+		// unsaved changes are yielded as well
+		for _, tr := range []*MutableTree{tree, prefetched} {
+			_, err = tr.Set([]byte{0, 5}, []byte("updated"))
+			require.NoError(t, err)
+			_, _, err = tr.Remove([]byte{0, 6})
+			require.NoError(t, err)
+		}
+
+		collect := func(tr *MutableTree, start, end []byte, ascending bool) [][2][]byte {
+			itr, err := tr.Iterator(start, end, ascending)
+			require.NoError(t, err)
+			defer itr.Close()
+			var pairs [][2][]byte
+			for ; itr.Valid(); itr.Next() {
+				pairs = append(pairs, [2][]byte{itr.Key(), itr.Value()})
+			}
+			require.NoError(t, itr.Error())
+			return pairs
+		}
+		for _, ascending := range []bool{true, false} {
+			for _, domain := range [][2][]byte{{nil, nil}, {{0, 3}, {2, 100}}, {{3, 0}, nil}} {
+				expected := collect(tree, domain[0], domain[1], ascending)
+				require.NotEmpty(t, expected)
+				require.Equal(t, expected, collect(prefetched, domain[0], domain[1], ascending))
+			}
+		}
+
+		itr, err := prefetched.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		require.IsType(t, &PrefetchIterator{}, itr)
+		require.True(t, itr.Valid())
+		require.NoError(t, itr.Close())
+		require.False(t, itr.Valid())
+		require.NoError(t, itr.Close())
+	}
+}
+
+func TestImmutableTree_IterateLimited(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+			require.NoError(t, err)
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+
+		for _, tc := range []struct {
+			start, end []byte
+			ascending  bool
+			limit      int
+			expected   []byte
+			hasMore    bool
+		}{
+			{nil, nil, true, 3, []byte{0, 1, 2}, true},
+			{nil, nil, false, 3, []byte{9, 8, 7}, true},
+			{[]byte{2}, []byte{5}, true, 3, []byte{2, 3, 4}, false},
+			{[]byte{2}, []byte{5}, true, 5, []byte{2, 3, 4}, false},
+			{[]byte{2}, nil, false, 20, []byte{9, 8, 7, 6, 5, 4, 3, 2}, false},
+			{nil, nil, true, 0, nil, true},
+			{[]byte{20}, nil, true, 0, nil, false},
+		} {
+			itr, err := itree.IterateLimited(tc.start, tc.end, tc.ascending, tc.limit)
+			require.NoError(t, err)
+			var keys []byte
+			for ; itr.Valid(); itr.Next() {
+				require.Equal(t, itr.Key(), itr.Value())
+				keys = append(keys, itr.Key()[0])
+			}
+			require.NoError(t, itr.Error())
+			require.Equal(t, tc.expected, keys)
+			require.Equal(t, tc.hasMore, itr.HasMore())
+			// the iterator stays invalid
+			itr.Next()
+			require.False(t, itr.Valid())
+			require.NoError(t, itr.Close())
+		}
+
+		_, err = itree.IterateLimited(nil, nil, true, -1)
+		require.Error(t, err)
+	}
+}
+
+func TestImmutableTree_MultiRangeIterator(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+		for i := 0; i < 30; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+			require.NoError(t, err)
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+
+		for _, tc := range []struct {
+			name     string
+			ranges   [][2][]byte
+			expected []byte
+		}{
+			{"disjoint", [][2][]byte{{{20}, {22}}, {{3}, {5}}, {{10}, {11}}}, []byte{3, 4, 10, 20, 21}},
+			{"adjacent", [][2][]byte{{{5}, {7}}, {{3}, {5}}, {{7}, {8}}}, []byte{3, 4, 5, 6, 7}},
+			{"overlapping", [][2][]byte{{{3}, {8}}, {{5}, {6}}, {{6}, {10}}, {{3}, {4}}}, []byte{3, 4, 5, 6, 7, 8, 9}},
+			{"unbounded", [][2][]byte{{{27}, nil}, {nil, {2}}, {{28}, {29}}, {{1}, {3}}}, []byte{0, 1, 2, 27, 28, 29}},
+			{"empty", [][2][]byte{{{4}, {4}}, {{40}, {50}}}, nil},
+			{"none", nil, nil},
+		} {
+			for _, ascending := range []bool{true, false} {
+				itr, err := itree.MultiRangeIterator(tc.ranges, ascending)
+				require.NoError(t, err)
+				var keys []byte
+				for ; itr.Valid(); itr.Next() {
+					require.Equal(t, itr.Key(), itr.Value())
+					keys = append(keys, itr.Key()[0])
+				}
+				require.NoError(t, itr.Error())
+				expected := append([]byte(nil), tc.expected...)
+				if !ascending {
+					slices.Reverse(expected)
+				}
+				require.Equal(t, expected, keys, "%s ascending %v", tc.name, ascending)
+				require.NoError(t, itr.Close())
+			}
+		}
+
+		itr, err := itree.MultiRangeIterator([][2][]byte{{{8}, {9}}, {{2}, {4}}}, true)
+		require.NoError(t, err)
+		start, end := itr.Domain()
+		require.Equal(t, []byte{2}, start)
+		require.Equal(t, []byte{9}, end)
+		require.NoError(t, itr.Close())
+		require.False(t, itr.Valid())
+
+		_, err = itree.MultiRangeIterator([][2][]byte{{{5}, {4}}}, true)
+		require.Error(t, err)
+	}
+}
+
+func TestImmutableTree_WithContext(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger())
+		for i := 0; i < 200; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+			require.NoError(t, err)
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+
+		ctx := context.Background()
+		value, err := itree.GetWithContext(ctx, []byte{7})
+		require.NoError(t, err)
+		require.Equal(t, []byte{7}, value)
+		has, err := itree.HasWithContext(ctx, []byte{7})
+		require.NoError(t, err)
+		require.True(t, has)
+		has, err = itree.HasWithContext(ctx, []byte{7, 0})
+		require.NoError(t, err)
+		require.False(t, has)
+		pairs, next, err := itree.GetRangePageWithContext(ctx, []byte{10}, nil, 5)
+		require.NoError(t, err)
+		require.Len(t, pairs, 5)
+		require.Equal(t, []byte{15}, next)
+
+		// an operation past its deadline fails
+		expired, cancel := context.WithDeadline(ctx, time.Now())
+		defer cancel()
+		_, err = itree.GetWithContext(expired, []byte{7})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		_, err = itree.HasWithContext(expired, []byte{7})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		_, _, err = itree.GetRangePageWithContext(expired, nil, nil, 0)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		_, err = itree.IteratorWithContext(expired, nil, nil, true)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// an iteration stops once its context is canceled
+		canceled, cancelIteration := context.WithCancel(ctx)
+		defer cancelIteration()
+		itr, err := itree.IteratorWithContext(canceled, nil, nil, true)
+		require.NoError(t, err)
+		var count int
+		for ; itr.Valid(); itr.Next() {
+			if count == 10 {
+				cancelIteration()
+			}
+			count++
+		}
+		require.ErrorIs(t, itr.Error(), context.Canceled)
+		require.Less(t, count, 10+contextCheckInterval+1)
+		require.NoError(t, itr.Close())
+	}
+}
+
+func TestMaxOpenIterators(t *testing.T) {
+	for _, skipFastStorageUpgrade := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, skipFastStorageUpgrade, NewNopLogger(), MaxOpenIteratorsOption(3))
+		for i := 0; i < 10; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+			require.NoError(t, err)
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+
+		// the iterators of the working tree and of its versions share the limit
+		itr1, err := tree.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		itr2, err := itree.Iterator(nil, nil, false)
+		require.NoError(t, err)
+		itr3, err := itree.IterateLimited(nil, nil, true, 2)
+		require.NoError(t, err)
+		_, err = tree.Iterator(nil, nil, true)
+		require.ErrorIs(t, err, ErrTooManyIterators)
+		_, err = itree.Iterate(func(_, _ []byte) bool { return false })
+		require.ErrorIs(t, err, ErrTooManyIterators)
+
+		require.NoError(t, itr2.Close())
+		// closing twice releases the iterator once
+		require.NoError(t, itr2.Close())
+		itr4, err := tree.Iterator(nil, nil, true)
+		require.NoError(t, err)
+		require.True(t, itr4.Valid())
+		_, err = tree.Iterator(nil, nil, true)
+		require.ErrorIs(t, err, ErrTooManyIterators)
+
+		for _, itr := range []corestore.Iterator{itr1, itr3, itr4} {
+			require.NoError(t, itr.Close())
+		}
+		stopped, err := itree.Iterate(func(_, _ []byte) bool { return false })
+		require.NoError(t, err)
+		require.False(t, stopped)
+	}
+}
+
+// latentDB is a MemDB adding latency to every read.
+type latentDB struct {
+	*dbm.MemDB
+	latency time.Duration
+}
+
+func (db *latentDB) Get(key []byte) ([]byte, error) {
+	time.Sleep(db.latency)
+	return db.MemDB.Get(key)
+}
+
+func BenchmarkPrefetchIterator(b *testing.B) {
+	db := &latentDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(b, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(b, err)
+	db.latency = 20 * time.Microsecond
+
+	for _, prefetch := range []int{0, 16} {
+		b.Run(fmt.Sprintf("prefetch=%d", prefetch), func(b *testing.B) {
+			tree := NewMutableTree(db, 0, true, NewNopLogger(), IteratorPrefetchOption(prefetch))
+			_, err := tree.Load()
+			require.NoError(b, err)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := tree.Iterate(func(_, _ []byte) bool {
+					// simulate the processing of the pair
+					time.Sleep(20 * time.Microsecond)
+					return false
+				})
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestIterator_Seek(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var keys []string
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("k%02d", i)
+		keys = append(keys, key)
+		_, err := tree.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	start, end := "k10", "k80"
+
+	// expected returns the remaining keys of the iteration after seeking to key
+	expected := func(key string, ascending bool) []string {
+		var remaining []string
+		for _, k := range keys {
+			if k < start || k >= end {
+				continue
+			}
+			if ascending && k >= key {
+				remaining = append(remaining, k)
+			} else if !ascending && k <= key {
+				remaining = append([]string{k}, remaining...)
+			}
+		}
+		return remaining
+	}
+
+	for _, ascending := range []bool{true, false} {
+		// seeks forward and backward within the bounds, before the start and past the end
+		for _, seeks := range [][]string{
+			{"k20", "k21", "k40", "k33", "k33", "k70"},
+			{"k00", "k10", "k79", "k80", "k99", "k50"},
+			{"k79", "k11", "k60", "k09", "k81", "k12"},
+		} {
+			itr := NewIterator([]byte(start), []byte(end), ascending, tree.ImmutableTree).(*Iterator)
+			for i, seek := range seeks {
+				remaining := expected(seek, ascending)
+				require.Equal(t, len(remaining) > 0, itr.Seek([]byte(seek)), "seek %s", seek)
+				require.Equal(t, len(remaining) > 0, itr.Valid())
+				if len(remaining) > 0 {
+					require.Equal(t, remaining[0], string(itr.Key()), "seek %s", seek)
+					require.Equal(t, remaining[0], string(itr.Value()))
+				}
+				if i == len(seeks)-1 {
+					var actual []string
+					for ; itr.Valid(); itr.Next() {
+						actual = append(actual, string(itr.Key()))
+					}
+					require.Equal(t, remaining, actual)
+				} else if len(remaining) > 1 {
+					itr.Next()
+					require.Equal(t, remaining[1], string(itr.Key()))
+				}
+			}
+			require.NoError(t, itr.Close())
+			require.False(t, itr.Seek([]byte("k20")))
+		}
+	}
+}
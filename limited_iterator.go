@@ -0,0 +1,67 @@
+package iavl
+
+import (
+	corestore "cosmossdk.io/core/store"
+)
+
+// LimitedIterator yields at most a fixed number of pairs of another iterator, and reports whether
+// the source had more pairs. It is created by ImmutableTree.IterateLimited.
+type LimitedIterator struct {
+	source corestore.Iterator
+	limit  int
+	count  int
+}
+
+var _ corestore.Iterator = (*LimitedIterator)(nil)
+
+// NewLimitedIterator returns an iterator over the first limit pairs of source. The source
+// iterator must not be used by the caller anymore, and is closed by Close.
+func NewLimitedIterator(source corestore.Iterator, limit int) *LimitedIterator {
+	return &LimitedIterator{source: source, limit: limit}
+}
+
+// HasMore returns true if the source has pairs beyond the limit. It is only meaningful once the
+// iterator is not valid anymore.
+func (iter *LimitedIterator) HasMore() bool {
+	return iter.count >= iter.limit && iter.source.Valid()
+}
+
+// Domain implements dbm.Iterator.
+func (iter *LimitedIterator) Domain() ([]byte, []byte) {
+	return iter.source.Domain()
+}
+
+// Valid implements dbm.Iterator.
+func (iter *LimitedIterator) Valid() bool {
+	return iter.count < iter.limit && iter.source.Valid()
+}
+
+// Key implements dbm.Iterator
+func (iter *LimitedIterator) Key() []byte {
+	return iter.source.Key()
+}
+
+// Value implements dbm.Iterator
+func (iter *LimitedIterator) Value() []byte {
+	return iter.source.Value()
+}
+
+// Next implements dbm.Iterator
+func (iter *LimitedIterator) Next() {
+	if !iter.Valid() {
+		return
+	}
+	iter.count++
+	// the source is advanced past the last pair, so that HasMore can check it
+	iter.source.Next()
+}
+
+// Close implements dbm.Iterator
+func (iter *LimitedIterator) Close() error {
+	return iter.source.Close()
+}
+
+// Error implements dbm.Iterator
+func (iter *LimitedIterator) Error() error {
+	return iter.source.Error()
+}
@@ -32,3 +32,51 @@ func (l *noopLogger) Info(string, ...any)  {}
 func (l *noopLogger) Warn(string, ...any)  {}
 func (l *noopLogger) Error(string, ...any) {}
 func (l *noopLogger) Debug(string, ...any) {}
+
+// Level is the minimum level of the messages logged by a logger returned by NewLeveledLogger.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	// LevelNone drops all the messages.
+	LevelNone
+)
+
+// NewLeveledLogger returns a logger passing the messages of level at least level to inner, and
+// dropping the others. With LevelDebug, the node and root writes are logged too, but not the
+// reads.
+func NewLeveledLogger(inner Logger, level Level) Logger {
+	return &leveledLogger{inner: inner, level: level}
+}
+
+type leveledLogger struct {
+	inner Logger
+	level Level
+}
+
+func (l *leveledLogger) Info(msg string, keyVals ...any) {
+	if l.level <= LevelInfo {
+		l.inner.Info(msg, keyVals...)
+	}
+}
+
+func (l *leveledLogger) Warn(msg string, keyVals ...any) {
+	if l.level <= LevelWarn {
+		l.inner.Warn(msg, keyVals...)
+	}
+}
+
+func (l *leveledLogger) Error(msg string, keyVals ...any) {
+	if l.level <= LevelError {
+		l.inner.Error(msg, keyVals...)
+	}
+}
+
+func (l *leveledLogger) Debug(msg string, keyVals ...any) {
+	if l.level <= LevelDebug {
+		l.inner.Debug(msg, keyVals...)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/stretchr/testify/require"
 
 	dbm "github.com/cosmos/iavl/db"
+	"github.com/cosmos/iavl/internal/encoding"
 	iavlrand "github.com/cosmos/iavl/internal/rand"
 )
 
@@ -329,3 +330,177 @@ func TestRandomSet(t *testing.T) {
 	err = tree.DeleteVersionsTo(int64(legacyVersion + postVersions - 1))
 	require.NoError(t, err)
 }
+
+// writeLegacyStore writes all the versions of tree to db in the legacy layout, with the nodes
+// addressed by hash, along with a legacy orphan.
+func writeLegacyStore(t *testing.T, tree *MutableTree, db dbm.DB) {
+	var writeNode func(nk []byte) []byte
+	writeNode = func(nk []byte) []byte {
+		node, err := tree.ndb.GetNode(nk)
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		require.NoError(t, encoding.EncodeVarint(&buf, int64(node.subtreeHeight)))
+		require.NoError(t, encoding.EncodeVarint(&buf, node.size))
+		require.NoError(t, encoding.EncodeVarint(&buf, node.nodeKey.version))
+		require.NoError(t, encoding.EncodeBytes(&buf, node.key))
+		if node.isLeaf() {
+			require.NoError(t, encoding.EncodeBytes(&buf, node.value))
+		} else {
+			require.NoError(t, encoding.EncodeBytes(&buf, writeNode(node.leftNodeKey)))
+			require.NoError(t, encoding.EncodeBytes(&buf, writeNode(node.rightNodeKey)))
+		}
+		require.NoError(t, db.Set(legacyNodeKeyFormat.Key(node.hash), buf.Bytes()))
+		return node.hash
+	}
+	for _, version := range tree.AvailableVersions() {
+		rootKey, err := tree.ndb.GetRoot(int64(version))
+		require.NoError(t, err)
+		rootHash := []byte{}
+		if rootKey != nil {
+			rootHash = writeNode(rootKey)
+		}
+		require.NoError(t, db.Set(legacyRootKeyFormat.Key(int64(version)), rootHash))
+	}
+	orphan := make([]byte, hashSize)
+	require.NoError(t, db.Set(legacyOrphanKeyFormat.Key(int64(1), int64(1), orphan), orphan))
+}
+
+func TestMigrateLegacyFormat(t *testing.T) {
+	// versions 1 to 5 with updates, removals, a version without changes and an empty version
+	src := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	for v := 1; v <= 5; v++ {
+		for i := 0; i < 30; i++ {
+			key := []byte(fmt.Sprintf("key%02d", i))
+			var err error
+			switch {
+			case v == 3:
+			case v == 4 || (v == 2 && i%3 == 0):
+				_, _, err = src.Remove(key)
+			case v == 2 && i%3 == 1, v != 2:
+				_, err = src.Set(key, []byte(fmt.Sprintf("%d-%d", v, i)))
+			}
+			require.NoError(t, err)
+		}
+		_, _, err := src.SaveVersion()
+		require.NoError(t, err)
+	}
+	db := dbm.NewMemDB()
+	writeLegacyStore(t, src, db)
+
+	// versions 6 and 7 are written by the lazy upgrade, on top of the legacy nodes
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key00"), []byte("6"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	contents := func(version int64) ([]byte, map[string]string) {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		kvs := make(map[string]string)
+		_, err = itree.Iterate(func(key, value []byte) bool {
+			kvs[string(key)] = string(value)
+			return false
+		})
+		require.NoError(t, err)
+		return itree.Hash(), kvs
+	}
+	hashes := make(map[int64][]byte)
+	expected := make(map[int64]map[string]string)
+	for v := int64(1); v <= 7; v++ {
+		hashes[v], expected[v] = contents(v)
+	}
+	require.Len(t, expected[3], 20)
+	require.Empty(t, expected[4])
+
+	require.NoError(t, tree.MigrateLegacyFormat())
+	for _, prefix := range [][]byte{legacyNodeKeyFormat.Prefix(), []byte(legacyOrphanKeyFormat.Prefix()), []byte(legacyRootKeyFormat.Prefix())} {
+		require.NoError(t, tree.ndb.traversePrefix(prefix, func(key, _ []byte) error {
+			return fmt.Errorf("legacy key %X left", key)
+		}))
+	}
+	marker, err := db.Get(metadataKeyFormat.Key([]byte(legacyMigrationKey)))
+	require.NoError(t, err)
+	require.Equal(t, "5", string(marker))
+	for v := int64(1); v <= 7; v++ {
+		hash, kvs := contents(v)
+		require.Equal(t, hashes[v], hash, "version %d", v)
+		require.Equal(t, expected[v], kvs, "version %d", v)
+	}
+	require.NoError(t, tree.ndb.traversePrefix(nodeKeyFormat.Prefix(), func(key, value []byte) error {
+		if len(value) == 0 {
+			return nil
+		}
+		if isRef, _ := isReferenceRoot(value); isRef {
+			return nil
+		}
+		node, err := MakeNode(key[1:], value)
+		require.NoError(t, err)
+		require.NotEqual(t, hashSize, len(node.leftNodeKey))
+		require.NotEqual(t, hashSize, len(node.rightNodeKey))
+		return nil
+	}))
+
+	// the migration is a no-op once done, and the migrated store can be reopened and pruned
+	require.NoError(t, tree.MigrateLegacyFormat())
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 7, version)
+	require.NoError(t, tree.DeleteVersionsTo(5))
+	for v := int64(6); v <= 7; v++ {
+		hash, kvs := contents(v)
+		require.Equal(t, hashes[v], hash, "version %d", v)
+		require.Equal(t, expected[v], kvs, "version %d", v)
+	}
+}
+
+func TestMigrateLegacyFormatResume(t *testing.T) {
+	src := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	for v := 1; v <= 3; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := src.Set([]byte(fmt.Sprintf("key%02d", i)), []byte(fmt.Sprintf("%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := src.SaveVersion()
+		require.NoError(t, err)
+	}
+	db := dbm.NewMemDB()
+	writeLegacyStore(t, src, db)
+
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+	hash := tree.Hash()
+
+	// interrupt the migration after the rewrite, with a part of the legacy nodes deleted
+	require.NoError(t, tree.ndb.rewriteLegacyFormat(3))
+	require.NoError(t, tree.ndb.Commit())
+	var legacyKeys [][]byte
+	require.NoError(t, tree.ndb.traversePrefix(legacyNodeKeyFormat.Prefix(), func(key, _ []byte) error {
+		legacyKeys = append(legacyKeys, key)
+		return nil
+	}))
+	for _, key := range legacyKeys[:10] {
+		require.NoError(t, db.Delete(key))
+	}
+
+	require.NoError(t, tree.MigrateLegacyFormat())
+	for _, prefix := range [][]byte{legacyNodeKeyFormat.Prefix(), []byte(legacyOrphanKeyFormat.Prefix()), []byte(legacyRootKeyFormat.Prefix())} {
+		require.NoError(t, tree.ndb.traversePrefix(prefix, func(key, _ []byte) error {
+			return fmt.Errorf("legacy key %X left", key)
+		}))
+	}
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, version)
+	require.Equal(t, hash, reloaded.Hash())
+	value, err := reloaded.Get([]byte("key07"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3-7"), value)
+}
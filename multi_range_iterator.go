@@ -0,0 +1,167 @@
+package iavl
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+// MultiRangeIterator yields the pairs of several key ranges of a tree in global key order, each
+// key once. It is created by ImmutableTree.MultiRangeIterator.
+type MultiRangeIterator struct {
+	tree      *ImmutableTree
+	ascending bool
+	// the disjoint ranges in the order of iteration, and the index of the next one to open
+	ranges [][2][]byte
+	next   int
+
+	source corestore.Iterator
+	err    error
+}
+
+var _ corestore.Iterator = (*MultiRangeIterator)(nil)
+
+// MultiRangeIterator returns an iterator over the keys in any of the [start, end) ranges, where
+// nil bounds are unbounded, in ascending or descending order. Overlapping and adjacent ranges
+// are merged, so that each key is yielded once. The ranges are iterated one after the other, with
+// a single iterator of the tree open at a time.
+func (t *ImmutableTree) MultiRangeIterator(ranges [][2][]byte, ascending bool) (*MultiRangeIterator, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	merged, err := mergeRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+	if !ascending {
+		for i, j := 0, len(merged)-1; i < j; i, j = i+1, j-1 {
+			merged[i], merged[j] = merged[j], merged[i]
+		}
+	}
+	iter := &MultiRangeIterator{tree: t, ascending: ascending, ranges: merged}
+	iter.advance()
+	if iter.err != nil {
+		return nil, iter.err
+	}
+	return iter, nil
+}
+
+// mergeRanges returns the union of the [start, end) ranges as disjoint ranges in ascending order,
+// without the empty ones.
+func mergeRanges(ranges [][2][]byte) ([][2][]byte, error) {
+	sorted := make([][2][]byte, 0, len(ranges))
+	for _, r := range ranges {
+		if r[0] != nil && r[1] != nil {
+			if cmp := bytes.Compare(r[0], r[1]); cmp > 0 {
+				return nil, fmt.Errorf("range start %X is after its end %X", r[0], r[1])
+			} else if cmp == 0 {
+				continue
+			}
+		}
+		sorted = append(sorted, r)
+	}
+	// a nil start is before every key
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i][0] == nil || sorted[j][0] == nil {
+			return sorted[i][0] == nil && sorted[j][0] != nil
+		}
+		return bytes.Compare(sorted[i][0], sorted[j][0]) < 0
+	})
+
+	var merged [][2][]byte
+	for _, r := range sorted {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if last[1] == nil {
+				break
+			}
+			if bytes.Compare(r[0], last[1]) <= 0 {
+				if r[1] == nil || bytes.Compare(r[1], last[1]) > 0 {
+					last[1] = r[1]
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+	return merged, nil
+}
+
+// advance opens the iterators of the next ranges until one is valid or none is left.
+func (iter *MultiRangeIterator) advance() {
+	for iter.err == nil && (iter.source == nil || !iter.source.Valid()) {
+		if iter.source != nil {
+			iter.err = iter.source.Error()
+			if err := iter.source.Close(); err != nil && iter.err == nil {
+				iter.err = err
+			}
+			iter.source = nil
+		}
+		if iter.err != nil || iter.next == len(iter.ranges) {
+			return
+		}
+		r := iter.ranges[iter.next]
+		iter.next++
+		iter.source, iter.err = iter.tree.Iterator(r[0], r[1], iter.ascending)
+	}
+}
+
+// Domain implements dbm.Iterator, and returns the bounds of the union of the ranges.
+func (iter *MultiRangeIterator) Domain() ([]byte, []byte) {
+	if len(iter.ranges) == 0 {
+		return nil, nil
+	}
+	first, last := iter.ranges[0], iter.ranges[len(iter.ranges)-1]
+	if !iter.ascending {
+		first, last = last, first
+	}
+	return first[0], last[1]
+}
+
+// Valid implements dbm.Iterator.
+func (iter *MultiRangeIterator) Valid() bool {
+	return iter.err == nil && iter.source != nil && iter.source.Valid()
+}
+
+// Key implements dbm.Iterator
+func (iter *MultiRangeIterator) Key() []byte {
+	return iter.source.Key()
+}
+
+// Value implements dbm.Iterator
+func (iter *MultiRangeIterator) Value() []byte {
+	return iter.source.Value()
+}
+
+// Next implements dbm.Iterator
+func (iter *MultiRangeIterator) Next() {
+	if !iter.Valid() {
+		return
+	}
+	iter.source.Next()
+	iter.advance()
+}
+
+// Close implements dbm.Iterator
+func (iter *MultiRangeIterator) Close() error {
+	iter.next = len(iter.ranges)
+	if iter.source == nil {
+		return nil
+	}
+	err := iter.source.Close()
+	iter.source = nil
+	return err
+}
+
+// Error implements dbm.Iterator
+func (iter *MultiRangeIterator) Error() error {
+	if iter.err != nil {
+		return iter.err
+	}
+	if iter.source != nil {
+		return iter.source.Error()
+	}
+	return nil
+}
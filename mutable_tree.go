@@ -2,13 +2,19 @@ package iavl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	corestore "cosmossdk.io/core/store"
 
+	dbm "github.com/cosmos/iavl/db"
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
 )
@@ -19,6 +25,35 @@ var (
 
 	// ErrKeyDoesNotExist is returned if a key does not exist.
 	ErrKeyDoesNotExist = errors.New("key does not exist")
+
+	// ErrClosed is returned when calling methods on a closed tree.
+	ErrClosed = errors.New("tree is closed")
+
+	// ErrInvalidKey is returned by Set and Remove if Options.KeyValidator rejects the key. It
+	// wraps the error of the validator.
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrVersionPruned is returned if a requested version has been pruned. It wraps
+	// ErrVersionDoesNotExist.
+	ErrVersionPruned = fmt.Errorf("%w: version has been pruned", ErrVersionDoesNotExist)
+
+	// ErrVersionRootMissing is returned if a version is referenced by the version index but its
+	// root node is missing from the database. It wraps ErrVersionDoesNotExist.
+	ErrVersionRootMissing = fmt.Errorf("%w: root node is missing", ErrVersionDoesNotExist)
+
+	// ErrVersionPinned is returned when deleting a version pinned with MutableTree.PinVersion.
+	ErrVersionPinned = errors.New("version is pinned")
+
+	// ErrTooManyIterators is returned when opening an iterator while Options.MaxOpenIterators
+	// iterators are open.
+	ErrTooManyIterators = errors.New("too many open iterators")
+
+	// ErrNodeSequenceNotTracked is returned by GetNodeSequence for a node whose version was not
+	// saved with Options.TrackNodeSequence.
+	ErrNodeSequenceNotTracked = errors.New("node sequence is not tracked")
+
+	// ErrNodeNotFound is returned by GetNodeSequence if no available version holds the node.
+	ErrNodeNotFound = errors.New("node not found")
 )
 
 type Option func(*Options)
@@ -41,6 +76,14 @@ type MutableTree struct {
 	ndb                      *nodeDB
 	skipFastStorageUpgrade   bool // If true, the tree will work like no fast storage and always not upgrade fast storage
 	initialVersionSet        bool
+	closed                   atomic.Bool
+	prepared                 bool             // a commit is prepared, see PrepareCommit
+	versionMeta              []byte           // the metadata blob of the version being saved, see SaveVersionWithMeta
+	writeOnly                bool             // the fast index is not maintained, see SetWriteOnlyMode
+	fastIndexStale           bool             // the fast index was not maintained, see RebuildFastIndex
+	shadow                   *shadowMap       // reference copy of the contents with Options.ShadowVerify
+	walOps                   []*KVPair        // operations of the working version with Options.WAL
+	nodeBlobs                map[string]*Node // nodes put with PutNodeBlob, checked by CommitNodeBlobs
 
 	mtx sync.Mutex
 }
@@ -55,7 +98,7 @@ func NewMutableTree(db corestore.KVStoreWithBatch, cacheSize int, skipFastStorag
 	ndb := newNodeDB(db, cacheSize, opts, lg)
 	head := &ImmutableTree{ndb: ndb, skipFastStorageUpgrade: skipFastStorageUpgrade}
 
-	return &MutableTree{
+	tree := &MutableTree{
 		logger:                   lg,
 		ImmutableTree:            head,
 		lastSaved:                head.clone(),
@@ -65,6 +108,74 @@ func NewMutableTree(db corestore.KVStoreWithBatch, cacheSize int, skipFastStorag
 		skipFastStorageUpgrade:   skipFastStorageUpgrade,
 		initialVersionSet:        opts.initialVersionSet,
 	}
+	if opts.ShadowVerify {
+		tree.shadow = newShadowMap()
+	}
+	return tree
+}
+
+// LoadTreesParallel opens a tree for each prefix of db and loads its latest version, loading up
+// to opts.LoadParallelism trees concurrently. The trees are opened like with NewMutableTree, with
+// opts.LoadCacheSize, opts.LoadSkipFastStorageUpgrade and opts.LoadLogger, and with opts on top
+// of DefaultOptions, and are keyed by string(prefix). opts.FastNodeDB, if set, is prefixed the
+// same way. The options which cannot be shared by the trees, opts.WAL and opts.CloseDB, are
+// rejected. All load errors are returned joined together, in which case all the trees are closed
+// and none is returned.
+func LoadTreesParallel(db corestore.KVStoreWithBatch, prefixes [][]byte, opts Options) (map[string]*MutableTree, error) {
+	if opts.WAL != nil {
+		return nil, errors.New("cannot load trees in parallel with a WAL, which would be shared by the trees")
+	}
+	if opts.CloseDB {
+		return nil, errors.New("cannot load trees in parallel with CloseDB, as the trees share the database")
+	}
+	parallelism := opts.LoadParallelism
+	if parallelism <= 0 {
+		parallelism = runtime.GOMAXPROCS(0)
+	}
+	lg := opts.LoadLogger
+	if lg == nil {
+		lg = NewNopLogger()
+	}
+	opts = withDefaultOptions(opts)
+
+	trees := make([]*MutableTree, len(prefixes))
+	errs := make([]error, len(prefixes))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, prefix := range prefixes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, prefix []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			treeOpts := opts
+			if opts.FastNodeDB != nil {
+				treeOpts.FastNodeDB = dbm.NewPrefixDB(opts.FastNodeDB, prefix)
+			}
+			trees[i] = NewMutableTree(dbm.NewPrefixDB(db, prefix), opts.LoadCacheSize, opts.LoadSkipFastStorageUpgrade, lg, func(o *Options) { *o = treeOpts })
+			if _, err := trees[i].Load(); err != nil {
+				errs[i] = fmt.Errorf("failed to load tree with prefix %X: %w", prefix, err)
+			}
+		}(i, prefix)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		// stop the pruning routines of the trees
+		for _, tree := range trees {
+			if closeErr := tree.Close(); closeErr != nil {
+				err = errors.Join(err, closeErr)
+			}
+		}
+		return nil, err
+	}
+	result := make(map[string]*MutableTree, len(prefixes))
+	for i, prefix := range prefixes {
+		result[string(prefix)] = trees[i]
+	}
+	return result, nil
 }
 
 // IsEmpty returns whether or not the tree has any keys. Only trees that are
@@ -75,12 +186,18 @@ func (tree *MutableTree) IsEmpty() bool {
 
 // GetLatestVersion returns the latest version of the tree.
 func (tree *MutableTree) GetLatestVersion() (int64, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
 	_, v, err := tree.ndb.getLatestVersion()
 	return v, err
 }
 
 // VersionExists returns whether or not a version exists.
 func (tree *MutableTree) VersionExists(version int64) bool {
+	if tree.closed.Load() {
+		return false
+	}
 	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
 	if err != nil {
 		return false
@@ -100,43 +217,424 @@ func (tree *MutableTree) VersionExists(version int64) bool {
 	if !found {
 		return false
 	}
+	if version > firstVersion && version < latestVersion {
+		if gaps, err := tree.ndb.hasVersionGaps(); err != nil || gaps {
+			has, err := tree.ndb.hasVersion(version)
+			return err == nil && has
+		}
+	}
 
 	return firstVersion <= version && version <= latestVersion
 }
 
 // AvailableVersions returns all available versions in ascending order
 func (tree *MutableTree) AvailableVersions() []int {
-	firstVersion, err := tree.ndb.getFirstVersion()
+	if tree.closed.Load() {
+		return nil
+	}
+	versions, err := tree.availableVersions()
 	if err != nil {
 		return nil
 	}
+	res := make([]int, 0, len(versions))
+	for _, version := range versions {
+		res = append(res, int(version))
+	}
+	return res
+}
+
+// VersionGaps returns the inclusive ranges of the missing versions between the first and the
+// latest available versions, in ascending order, left by PruneWithPolicy for instance.
+func (tree *MutableTree) VersionGaps() ([][2]int64, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	versions, err := tree.availableVersions()
+	if err != nil {
+		return nil, err
+	}
+	var gaps [][2]int64
+	for i := 1; i < len(versions); i++ {
+		if versions[i] > versions[i-1]+1 {
+			gaps = append(gaps, [2]int64{versions[i-1] + 1, versions[i] - 1})
+		}
+	}
+	return gaps, nil
+}
+
+func (tree *MutableTree) availableVersions() ([]int64, error) {
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, err
+	}
 	_, latestVersion, err := tree.ndb.getLatestVersion()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	res := make([]int, 0)
+	res := make([]int64, 0)
 	if legacyLatestVersion > firstVersion {
 		for version := firstVersion; version < legacyLatestVersion; version++ {
 			has, err := tree.ndb.hasLegacyVersion(version)
 			if err != nil {
-				return nil
+				return nil, err
 			}
 			if has {
-				res = append(res, int(version))
+				res = append(res, version)
 			}
 		}
 		firstVersion = legacyLatestVersion
 	}
 
+	gaps, err := tree.ndb.hasVersionGaps()
+	if err != nil {
+		return nil, err
+	}
 	for version := firstVersion; version <= latestVersion; version++ {
-		res = append(res, int(version))
+		if gaps && version > firstVersion && version < latestVersion {
+			has, err := tree.ndb.hasVersion(version)
+			if err != nil {
+				return nil, err
+			}
+			if !has {
+				continue
+			}
+		}
+		res = append(res, version)
 	}
-	return res
+	return res, nil
+}
+
+// RootHashes returns the root hashes of the available versions between fromVersion and toVersion
+// inclusive, keyed by version. Only the root node of each version is read, and versions which do
+// not exist (e.g. pruned ones) are skipped.
+func (tree *MutableTree) RootHashes(fromVersion, toVersion int64) (map[int64][]byte, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if tree.noHash() {
+		return nil, ErrHashingDisabled
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, err
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if fromVersion < firstVersion {
+		fromVersion = firstVersion
+	}
+	if toVersion > latestVersion {
+		toVersion = latestVersion
+	}
+
+	hashes := make(map[int64][]byte)
+	for version := fromVersion; version <= toVersion; version++ {
+		hash, err := tree.rootHash(version)
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hashes[version] = hash
+	}
+	return hashes, nil
+}
+
+// RangeDigest returns the SHA-256 digest of the versions between from and to inclusive, as the
+// 8-byte big-endian version followed by the root hash of each version in ascending order, so that
+// two nodes can confirm they hold the same history by comparing digests. All the versions of the
+// range must exist, and only their root nodes are read.
+func (tree *MutableTree) RangeDigest(from, to int64) ([]byte, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if tree.noHash() {
+		return nil, ErrHashingDisabled
+	}
+	if from > to {
+		return nil, fmt.Errorf("invalid version range [%d, %d]", from, to)
+	}
+	h := sha256.New()
+	var versionBz [int64Size]byte
+	for version := from; version <= to; version++ {
+		hash, err := tree.rootHash(version)
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(versionBz[:], uint64(version))
+		h.Write(versionBz[:])
+		h.Write(hash)
+	}
+	return h.Sum(nil), nil
+}
+
+// IsNoOpVersion returns true if the root hash of version equals the one of the previous version,
+// e.g. when no changes were saved. Only the two roots are read, and both versions must exist.
+func (tree *MutableTree) IsNoOpVersion(version int64) (bool, error) {
+	if tree.closed.Load() {
+		return false, ErrClosed
+	}
+	if tree.noHash() {
+		return false, ErrHashingDisabled
+	}
+	hash, err := tree.rootHash(version)
+	if err != nil {
+		return false, err
+	}
+	prevHash, err := tree.rootHash(version - 1)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(hash, prevHash), nil
+}
+
+// SharedSubtreeHashes returns the hashes of the maximal subtrees which the trees of versions v1
+// and v2 share, in pre-order of the later version, so that only the other nodes need to be
+// transferred between them. A node of the later version written at or before the earlier
+// version is shared, since nodes are never referenced again once orphaned.
+func (tree *MutableTree) SharedSubtreeHashes(v1, v2 int64) ([][]byte, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if tree.noHash() {
+		return nil, ErrHashingDisabled
+	}
+	if v1 > v2 {
+		v1, v2 = v2, v1
+	}
+	if _, err := tree.ndb.GetRoot(v1); err != nil {
+		return nil, err
+	}
+	rootKey, err := tree.ndb.GetRoot(v2)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := NewNodeIterator(rootKey, tree.ndb)
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes [][]byte
+	for iter.Valid() {
+		node := iter.GetNode()
+		shared := node.nodeKey.version <= v1
+		if shared {
+			hashes = append(hashes, node.hash)
+		}
+		iter.Next(shared)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// NodeReferenceCount returns the number of available versions whose tree holds the node with the
+// given hash. The trees of the versions are walked from their roots, and a subtree shared by
+// several versions is only read once.
+func (tree *MutableTree) NodeReferenceCount(hash []byte) (int, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	if tree.noHash() {
+		return 0, ErrHashingDisabled
+	}
+
+	// contains records whether the subtree of each visited node key holds the node
+	contains := make(map[string]bool)
+	var walk func(nk []byte) (bool, error)
+	walk = func(nk []byte) (bool, error) {
+		if found, ok := contains[string(nk)]; ok {
+			return found, nil
+		}
+		node, err := tree.ndb.GetNode(nk)
+		if err != nil {
+			return false, err
+		}
+		found := bytes.Equal(node.hash, hash)
+		if !found && !node.isLeaf() {
+			if found, err = walk(node.leftNodeKey); err != nil {
+				return false, err
+			}
+			if !found {
+				if found, err = walk(node.rightNodeKey); err != nil {
+					return false, err
+				}
+			}
+		}
+		contains[string(nk)] = found
+		return found, nil
+	}
+
+	count := 0
+	for _, version := range tree.AvailableVersions() {
+		rootKey, err := tree.ndb.GetRoot(int64(version))
+		if err != nil {
+			return 0, err
+		}
+		if rootKey == nil {
+			continue
+		}
+		found, err := walk(rootKey)
+		if err != nil {
+			return 0, err
+		}
+		if found {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// GetNodeSequence returns the sequence number of the node with the given hash, which numbers the
+// nodes saved with Options.TrackNodeSequence from 1 in the order they were created, across all
+// the versions. The nodes of a version are numbered in the order they were given node keys, the
+// root first. The trees of the available versions are walked from their roots until the node is
+// found, and a subtree shared by several versions is only read once.
+func (tree *MutableTree) GetNodeSequence(hash []byte) (int64, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	if tree.noHash() {
+		return 0, ErrHashingDisabled
+	}
+
+	visited := make(map[string]bool)
+	var find func(nk []byte) (*Node, error)
+	find = func(nk []byte) (*Node, error) {
+		if visited[string(nk)] {
+			return nil, nil
+		}
+		visited[string(nk)] = true
+		node, err := tree.ndb.GetNode(nk)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(node.hash, hash) {
+			return node, nil
+		}
+		if node.isLeaf() {
+			return nil, nil
+		}
+		for _, child := range [][]byte{node.leftNodeKey, node.rightNodeKey} {
+			if found, err := find(child); err != nil || found != nil {
+				return found, err
+			}
+		}
+		return nil, nil
+	}
+
+	versions, err := tree.availableVersions()
+	if err != nil {
+		return 0, err
+	}
+	// the recent nodes are more likely to be looked up
+	for i := len(versions) - 1; i >= 0; i-- {
+		rootKey, err := tree.ndb.GetRoot(versions[i])
+		if err != nil {
+			return 0, err
+		}
+		if rootKey == nil {
+			continue
+		}
+		node, err := find(rootKey)
+		if err != nil {
+			return 0, err
+		}
+		if node == nil {
+			continue
+		}
+		if node.isLegacy {
+			return 0, fmt.Errorf("%w: node %X is stored in the legacy format", ErrNodeSequenceNotTracked, hash)
+		}
+		return tree.ndb.getNodeSequence(node.nodeKey)
+	}
+	return 0, fmt.Errorf("%w: %X", ErrNodeNotFound, hash)
+}
+
+// rootHash reads the root hash of version from the database.
+func (tree *MutableTree) rootHash(version int64) ([]byte, error) {
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	var root *Node
+	if rootKey != nil {
+		root, err = tree.ndb.GetNode(rootKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return root.hashWithCount(version + 1), nil
+}
+
+// FirstNonEmptyVersion returns the earliest available version holding any key, or 0 if all the
+// available versions are empty. Only the root references of the versions are read.
+func (tree *MutableTree) FirstNonEmptyVersion() (int64, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return 0, err
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	for version := firstVersion; version <= latestVersion; version++ {
+		rootKey, err := tree.ndb.GetRoot(version)
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if rootKey != nil {
+			return version, nil
+		}
+	}
+	return 0, nil
+}
+
+// EmptiedVersion returns the version at which the tree became empty, i.e. the earliest of the
+// empty versions following the last non-empty available one, or 0 if the latest version is not
+// empty or no available version holds any key. Only the root references of the versions are read.
+func (tree *MutableTree) EmptiedVersion() (int64, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return 0, err
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	emptied := int64(0)
+	for version := latestVersion; version >= firstVersion && version > 0; version-- {
+		rootKey, err := tree.ndb.GetRoot(version)
+		if errors.Is(err, ErrVersionDoesNotExist) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if rootKey != nil {
+			return emptied, nil
+		}
+		emptied = version
+	}
+	return 0, nil
 }
 
 // Hash returns the hash of the latest saved version of the tree, as returned
@@ -145,8 +643,11 @@ func (tree *MutableTree) Hash() []byte {
 	return tree.lastSaved.Hash()
 }
 
-// WorkingHash returns the hash of the current working tree.
+// WorkingHash returns the hash of the current working tree, or nil with the NoHash option.
 func (tree *MutableTree) WorkingHash() []byte {
+	if tree.noHash() {
+		return nil
+	}
 	return tree.root.hashWithCount(tree.WorkingVersion())
 }
 
@@ -160,24 +661,125 @@ func (tree *MutableTree) WorkingVersion() int64 {
 
 // String returns a string representation of the tree.
 func (tree *MutableTree) String() (string, error) {
+	if tree.closed.Load() {
+		return "", ErrClosed
+	}
 	return tree.ndb.String()
 }
 
-// Set sets a key in the working tree. Nil values are invalid. The given
-// key/value byte slices must not be modified after this call, since they point
-// to slices stored within IAVL. It returns true when an existing value was
-// updated, while false means it was a new key.
+// Set sets a key in the working tree. A nil value is handled according to
+// Options.NilValueSemantics, and fails by default, while an empty value is
+// stored as is: the key is present, Get returns an empty non-nil slice and Has
+// returns true. The given key/value byte slices must not be modified
+// after this call, since they point to slices stored within IAVL. It returns
+// true when an existing value was updated, while false means it was a new key.
 func (tree *MutableTree) Set(key, value []byte) (updated bool, err error) {
+	if tree.closed.Load() {
+		return false, ErrClosed
+	}
+	if tree.prepared {
+		return false, ErrCommitPrepared
+	}
+	if err := tree.validateKey(key); err != nil {
+		return false, err
+	}
+	if value == nil {
+		switch tree.ndb.opts.NilValueSemantics {
+		case NilValueStoreEmpty:
+			value = []byte{}
+		case NilValueDelete:
+			_, removed, err := tree.Remove(key)
+			return removed, err
+		}
+	}
+	if tree.ndb.opts.SkipNoOpSets && value != nil {
+		existing, err := tree.get(key)
+		if err != nil {
+			return false, err
+		}
+		if existing != nil && bytes.Equal(existing, value) {
+			return true, nil
+		}
+	}
 	updated, err = tree.set(key, value)
 	if err != nil {
 		return false, err
 	}
+	if tree.shadow != nil {
+		tree.shadow.set(key, value)
+	}
+	tree.recordWALOp(NewKVPair(key, value))
 	return updated, nil
 }
 
+// validateKey checks key with Options.KeyValidator.
+func (tree *MutableTree) validateKey(key []byte) error {
+	if tree.ndb.opts.KeyValidator == nil {
+		return nil
+	}
+	if err := tree.ndb.opts.KeyValidator(key); err != nil {
+		return fmt.Errorf("%w %X: %w", ErrInvalidKey, key, err)
+	}
+	return nil
+}
+
+// SetBatch applies the pairs in order, removing the keys of the pairs marked Delete and setting
+// the others like Set. It stops at the first error, leaving the previous pairs applied.
+func (tree *MutableTree) SetBatch(pairs []*KVPair) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	for i, pair := range pairs {
+		if pair == nil {
+			return fmt.Errorf("pair %d is nil", i)
+		}
+		var err error
+		if pair.Delete {
+			_, _, err = tree.Remove(pair.Key)
+		} else {
+			_, err = tree.Set(pair.Key, pair.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("pair %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// GetRangePage is like ImmutableTree.GetRangePage over the working tree, including the unsaved
+// changes.
+func (tree *MutableTree) GetRangePage(start, end []byte, limit int) (pairs []*KVPair, next []byte, err error) {
+	if tree.closed.Load() {
+		return nil, nil, ErrClosed
+	}
+	if tree.root == nil {
+		return nil, nil, nil
+	}
+	itr, err := tree.Iterator(start, end, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	return getRangePage(itr, limit)
+}
+
 // Get returns the value of the specified key if it exists, or nil otherwise.
 // The returned value must not be modified, since it may point to data stored within IAVL.
 func (tree *MutableTree) Get(key []byte) ([]byte, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	value, err := tree.get(key)
+	if err != nil {
+		return nil, err
+	}
+	tree.verifyShadowGet(key, value)
+	return value, nil
+}
+
+func (tree *MutableTree) get(key []byte) ([]byte, error) {
 	if tree.root == nil {
 		return nil, nil
 	}
@@ -204,12 +806,32 @@ func (tree *MutableTree) Get(key []byte) ([]byte, error) {
 // Import can only be called on an empty tree. It is the callers responsibility that no other
 // modifications are made to the tree while importing.
 func (tree *MutableTree) Import(version int64) (*Importer, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if tree.prepared {
+		return nil, ErrCommitPrepared
+	}
 	return newImporter(tree, version)
 }
 
+// ImportWithProgress is like Import, but the importer calls fn with the number of nodes added so
+// far every 1000 nodes, and with the total once the import is committed.
+func (tree *MutableTree) ImportWithProgress(version int64, fn func(done int64)) (*Importer, error) {
+	importer, err := tree.Import(version)
+	if err != nil {
+		return nil, err
+	}
+	importer.progress = fn
+	return importer, nil
+}
+
 // Iterate iterates over all keys of the tree. The keys and values must not be modified,
 // since they may point to data stored within IAVL. Returns true if stopped by callnack, false otherwise
 func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stopped bool, err error) {
+	if tree.closed.Load() {
+		return false, ErrClosed
+	}
 	if tree.root == nil {
 		return false, nil
 	}
@@ -226,7 +848,7 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 		return tree.ImmutableTree.Iterate(fn)
 	}
 
-	itr := NewUnsavedFastIterator(nil, nil, true, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals)
+	itr := tree.withPrefetch(NewUnsavedFastIterator(nil, nil, true, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals))
 	defer itr.Close()
 	for ; itr.Valid(); itr.Next() {
 		if fn(itr.Key(), itr.Value()) {
@@ -239,6 +861,9 @@ func (tree *MutableTree) Iterate(fn func(key []byte, value []byte) bool) (stoppe
 // Iterator returns an iterator over the mutable tree.
 // CONTRACT: no updates are made to the tree while an iterator is active.
 func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (corestore.Iterator, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
 	if !tree.skipFastStorageUpgrade {
 		isFastCacheEnabled, err := tree.IsFastCacheEnabled()
 		if err != nil {
@@ -246,7 +871,9 @@ func (tree *MutableTree) Iterator(start, end []byte, ascending bool) (corestore.
 		}
 
 		if isFastCacheEnabled {
-			return NewUnsavedFastIterator(start, end, ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals), nil
+			return tree.ndb.limitIterators(func() corestore.Iterator {
+				return tree.withPrefetch(NewUnsavedFastIterator(start, end, ascending, tree.ndb, tree.unsavedFastNodeAdditions, tree.unsavedFastNodeRemovals))
+			})
 		}
 	}
 
@@ -341,6 +968,15 @@ func (tree *MutableTree) recursiveSetLeaf(node *Node, key []byte, value []byte)
 // Remove removes a key from the working tree. The given key byte slice should not be modified
 // after this call, since it may point to data stored inside IAVL.
 func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
+	if tree.closed.Load() {
+		return nil, false, ErrClosed
+	}
+	if tree.prepared {
+		return nil, false, ErrCommitPrepared
+	}
+	if err := tree.validateKey(key); err != nil {
+		return nil, false, err
+	}
 	if tree.root == nil {
 		return nil, false, nil
 	}
@@ -355,11 +991,45 @@ func (tree *MutableTree) Remove(key []byte) ([]byte, bool, error) {
 	if !tree.skipFastStorageUpgrade {
 		tree.addUnsavedRemoval(key)
 	}
+	if tree.shadow != nil {
+		tree.shadow.remove(key)
+	}
+	tree.recordWALOp(NewDeleteKVPair(key))
 
 	tree.root = newRoot
 	return value, true, nil
 }
 
+// Move moves the value of oldKey to newKey in the working tree, replacing any value of newKey,
+// like Remove followed by Set but reading the value while removing it. It returns false if oldKey
+// does not exist, and does nothing if both keys are equal.
+func (tree *MutableTree) Move(oldKey, newKey []byte) (moved bool, err error) {
+	if tree.closed.Load() {
+		return false, ErrClosed
+	}
+	if tree.prepared {
+		return false, ErrCommitPrepared
+	}
+	// check both keys before changing the tree
+	for _, key := range [][]byte{oldKey, newKey} {
+		if err := tree.validateKey(key); err != nil {
+			return false, err
+		}
+	}
+	if bytes.Equal(oldKey, newKey) {
+		return tree.Has(oldKey)
+	}
+
+	value, removed, err := tree.Remove(oldKey)
+	if err != nil || !removed {
+		return false, err
+	}
+	if _, err := tree.Set(newKey, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 // removes the node corresponding to the passed key and balances the tree.
 // It returns:
 // - the hash of the new node (or nil if the node is the one removed)
@@ -445,6 +1115,12 @@ func (tree *MutableTree) Load() (int64, error) {
 
 // Returns the version number of the specific version found
 func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	if tree.prepared {
+		return 0, ErrCommitPrepared
+	}
 	firstVersion, err := tree.ndb.getFirstVersion()
 	if err != nil {
 		return 0, err
@@ -497,6 +1173,9 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 	if rootNodeKey != nil {
 		iTree.root, err = tree.ndb.GetNode(rootNodeKey)
 		if err != nil {
+			if has, hasErr := tree.ndb.hasNode(rootNodeKey); hasErr == nil && !has {
+				return 0, fmt.Errorf("%w: version %d", ErrVersionRootMissing, targetVersion)
+			}
 			return 0, err
 		}
 	}
@@ -511,12 +1190,104 @@ func (tree *MutableTree) LoadVersion(targetVersion int64) (int64, error) {
 		}
 	}
 
+	if err := tree.resetShadow(); err != nil {
+		return 0, err
+	}
+	tree.walOps = nil
+
+	tree.logger.Info("loaded version", "version", targetVersion, "latest version", latestVersion)
 	return latestVersion, nil
 }
 
+// LoadVersionInfo loads the targetVersion like LoadVersion, and returns the loaded version, unlike
+// LoadVersion which returns the latest one, along with its root hash and number of keys, read
+// from the root node.
+func (tree *MutableTree) LoadVersionInfo(targetVersion int64) (version int64, rootHash []byte, size int64, err error) {
+	if _, err := tree.LoadVersion(targetVersion); err != nil {
+		return 0, nil, 0, err
+	}
+	return tree.version, tree.Hash(), tree.Size(), nil
+}
+
+// PruneDanglingVersions removes the versions whose root node is missing from the database from
+// the version index, and returns them. Loading such a version fails with ErrVersionRootMissing.
+// The other versions and their nodes are left untouched, which may leave gaps between versions.
+func (tree *MutableTree) PruneDanglingVersions() ([]int64, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if tree.prepared {
+		return nil, ErrCommitPrepared
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, err
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var dangling []int64
+	for version := firstVersion; version > 0 && version <= latestVersion; version++ {
+		missing, err := tree.ndb.isRootMissing(version)
+		if err != nil {
+			return nil, err
+		}
+		if missing {
+			dangling = append(dangling, version)
+		}
+	}
+	if len(dangling) == 0 {
+		return nil, nil
+	}
+	if err := tree.ndb.deleteDanglingVersions(dangling); err != nil {
+		return nil, err
+	}
+	return dangling, nil
+}
+
+// MigrateLegacyFormat rewrites the nodes and roots written by IAVL versions before v1, addressed
+// by hash, in the current format, and deletes the legacy nodes, roots and orphans, so that the
+// store no longer relies on the lazy upgrade of legacy nodes. The hashes of all the versions are
+// unchanged and the latest legacy version is recorded in the metadata. It is a no-op on a store
+// without legacy versions, so it can be run again after an interruption. The tree must not have
+// pending changes, and is reloaded at its version afterwards.
+func (tree *MutableTree) MigrateLegacyFormat() error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	if tree.root != tree.lastSaved.root {
+		return errors.New("cannot migrate the legacy format with uncommitted changes")
+	}
+	legacyLatestVersion, err := tree.ndb.migrateLegacyFormat()
+	if err != nil {
+		return fmt.Errorf("migrating the legacy format: %w", err)
+	}
+	if legacyLatestVersion == 0 {
+		return nil
+	}
+	tree.logger.Info("migrated the legacy format", "legacyLatestVersion", legacyLatestVersion)
+	if tree.version > 0 {
+		if _, err := tree.LoadVersion(tree.version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // LoadVersionForOverwriting attempts to load a tree at a previously committed
 // version, or the latest version below it. Any versions greater than targetVersion will be deleted.
 func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
 	if _, err := tree.LoadVersion(targetVersion); err != nil {
 		return err
 	}
@@ -546,6 +1317,9 @@ func (tree *MutableTree) LoadVersionForOverwriting(targetVersion int64) error {
 // An example of when an upgrade may be performed is when we are enaling fast storage for the first time or
 // need to overwrite fast nodes due to mismatch with live state.
 func (tree *MutableTree) IsUpgradeable() (bool, error) {
+	if tree.closed.Load() {
+		return false, ErrClosed
+	}
 	shouldForce, err := tree.ndb.shouldForceFastStorageUpgrade()
 	if err != nil {
 		return false, err
@@ -617,9 +1391,173 @@ func (tree *MutableTree) enableFastStorageAndCommit() error {
 	return tree.ndb.Commit()
 }
 
+// MigrateFastStorage builds the fast index of the latest version, like LoadVersion does for trees
+// which do not skip the fast storage upgrade, and does nothing if it is up to date. The progress
+// is recorded in the database every 1000 keys, and the migration resumes from it when called
+// again after an interruption, including the cancellation of ctx, for which ctx.Err() is
+// returned. onProgress, if not nil, is called with the number of keys migrated every 1000 keys
+// and at the end. The tree must be loaded at the latest version, without uncommitted changes.
+func (tree *MutableTree) MigrateFastStorage(ctx context.Context, onProgress func(doneKeys int64)) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	shouldForce, err := tree.ndb.shouldForceFastStorageUpgrade()
+	if err != nil {
+		return err
+	}
+	if tree.ndb.hasUpgradedToFastStorage() && !shouldForce {
+		return nil
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	if tree.version != latestVersion {
+		return fmt.Errorf("the fast storage must be migrated at the latest version %d, loaded version %d", latestVersion, tree.version)
+	}
+	if tree.root != tree.lastSaved.root {
+		return errors.New("cannot migrate the fast storage with uncommitted changes")
+	}
+
+	done, lastKey, resumed, err := tree.ndb.getFastMigrationCheckpoint(latestVersion)
+	if err != nil {
+		return err
+	}
+	var start []byte
+	if resumed {
+		start = append(bytes.Clone(lastKey), 0)
+	} else {
+		// remove the stale fast nodes, as in enableFastStorageAndCommitIfNotEnabled
+		fastItr := NewFastIterator(nil, nil, true, tree.ndb)
+		for ; fastItr.Valid(); fastItr.Next() {
+			if err := tree.ndb.DeleteFastNode(fastItr.Key()); err != nil {
+				fastItr.Close()
+				return err
+			}
+		}
+		if err := fastItr.Close(); err != nil {
+			return err
+		}
+	}
+
+	checkpoint := func() error {
+		if err := tree.ndb.setFastMigrationCheckpoint(latestVersion, done, lastKey); err != nil {
+			return err
+		}
+		return tree.ndb.Commit()
+	}
+	itr := NewIterator(start, nil, true, tree.ImmutableTree)
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		if err := ctx.Err(); err != nil {
+			if lastKey == nil {
+				// nothing is migrated, and the stale fast nodes are deleted again on the next call
+				tree.ndb.mtx.Lock()
+				tree.ndb.discardBatches()
+				tree.ndb.mtx.Unlock()
+				return err
+			}
+			if cpErr := checkpoint(); cpErr != nil {
+				return cpErr
+			}
+			return err
+		}
+		if err := tree.ndb.SaveFastNodeNoCache(fastnode.NewNode(itr.Key(), itr.Value(), tree.version)); err != nil {
+			return err
+		}
+		done++
+		lastKey = itr.Key()
+		if done%progressInterval == 0 {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+			if onProgress != nil {
+				onProgress(done)
+			}
+		}
+	}
+	if err := itr.Error(); err != nil {
+		return err
+	}
+
+	if err := tree.ndb.SetFastStorageVersionToBatch(latestVersion); err != nil {
+		return err
+	}
+	if err := tree.ndb.deleteFastMigrationCheckpoint(); err != nil {
+		return err
+	}
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+	if onProgress != nil && (done == 0 || done%progressInterval != 0) {
+		onProgress(done)
+	}
+	return nil
+}
+
+// SetWriteOnlyMode enables or disables the write-only mode, in which Set, Remove and SaveVersion
+// do not maintain the fast index, for bulk loads. Reads fall back to the tree, and keep doing so
+// once the mode is disabled, until RebuildFastIndex is called. A tree opened on the database
+// rebuilds the index when it is loaded, unless it skips the fast storage upgrade. The tree must
+// not have uncommitted changes.
+func (tree *MutableTree) SetWriteOnlyMode(enabled bool) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	if tree.root != tree.lastSaved.root {
+		return errors.New("cannot change the write-only mode with uncommitted changes")
+	}
+	tree.writeOnly = enabled
+	if enabled && !tree.skipFastStorageUpgrade {
+		tree.fastIndexStale = true
+		tree.setSkipFastStorageUpgrade(true)
+	}
+	return nil
+}
+
+// RebuildFastIndex rebuilds the fast index of the latest version, like MigrateFastStorage, after
+// it was not maintained in write-only mode, which must be disabled, and makes the reads use it
+// again. It does nothing if the index was maintained.
+func (tree *MutableTree) RebuildFastIndex() error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	if tree.writeOnly {
+		return errors.New("cannot rebuild the fast index in write-only mode")
+	}
+	if !tree.fastIndexStale {
+		return nil
+	}
+	tree.setSkipFastStorageUpgrade(false)
+	if err := tree.MigrateFastStorage(context.Background(), nil); err != nil {
+		tree.setSkipFastStorageUpgrade(true)
+		return err
+	}
+	tree.fastIndexStale = false
+	return nil
+}
+
+func (tree *MutableTree) setSkipFastStorageUpgrade(skip bool) {
+	tree.skipFastStorageUpgrade = skip
+	tree.ImmutableTree.skipFastStorageUpgrade = skip
+	tree.lastSaved.skipFastStorageUpgrade = skip
+}
+
 // GetImmutable loads an ImmutableTree at a given version for querying. The returned tree is
 // safe for concurrent access, provided the version is not deleted, e.g. via `DeleteVersion()`.
 func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
 	rootNodeKey, err := tree.ndb.GetRoot(version)
 	if err != nil {
 		return nil, err
@@ -641,9 +1579,53 @@ func (tree *MutableTree) GetImmutable(version int64) (*ImmutableTree, error) {
 	}, nil
 }
 
+// QueryVersion returns an immutable tree of the given committed version, or of the latest
+// committed version if version is 0. Versions older than the first available one, including
+// versions scheduled for async pruning, return ErrVersionPruned, and versions newer than the
+// latest one return ErrVersionDoesNotExist.
+func (tree *MutableTree) QueryVersion(version int64) (*ImmutableTree, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if version < 0 {
+		return nil, fmt.Errorf("invalid version %d", version)
+	}
+	found, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: no version has been committed", ErrVersionDoesNotExist)
+	}
+	if version == 0 {
+		version = latestVersion
+	}
+	if version > latestVersion {
+		return nil, fmt.Errorf("%w: version %d is newer than the latest version %d", ErrVersionDoesNotExist, version, latestVersion)
+	}
+
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return nil, err
+	}
+	tree.ndb.mtx.Lock()
+	if pruneVersion := tree.ndb.pruneVersion; pruneVersion >= firstVersion {
+		firstVersion = pruneVersion + 1
+	}
+	tree.ndb.mtx.Unlock()
+	if version < firstVersion {
+		return nil, fmt.Errorf("%w: version %d is older than the first available version %d", ErrVersionPruned, version, firstVersion)
+	}
+
+	return tree.GetImmutable(version)
+}
+
 // Rollback resets the working tree to the latest saved version, discarding
 // any unsaved modifications.
 func (tree *MutableTree) Rollback() {
+	if tree.closed.Load() {
+		return
+	}
 	if tree.version > 0 {
 		tree.ImmutableTree = tree.lastSaved.clone()
 	} else {
@@ -657,11 +1639,18 @@ func (tree *MutableTree) Rollback() {
 		tree.unsavedFastNodeAdditions = &sync.Map{}
 		tree.unsavedFastNodeRemovals = &sync.Map{}
 	}
+	if tree.shadow != nil {
+		tree.shadow.rollback()
+	}
+	tree.walOps = nil
 }
 
 // GetVersioned gets the value at the specified key and version. The returned value must not be
 // modified, since it may point to data stored within IAVL.
 func (tree *MutableTree) GetVersioned(key []byte, version int64) ([]byte, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
 	if tree.VersionExists(version) {
 		if !tree.skipFastStorageUpgrade {
 			isFastCacheEnabled, err := tree.IsFastCacheEnabled()
@@ -707,7 +1696,16 @@ func (tree *MutableTree) UnsetCommitting() {
 // SaveVersion saves a new tree version to disk, based on the current state of
 // the tree. Returns the hash and new version number.
 func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
+	if tree.closed.Load() {
+		return nil, 0, ErrClosed
+	}
+	if tree.prepared {
+		return nil, 0, ErrCommitPrepared
+	}
 	version := tree.WorkingVersion()
+	if err := tree.preCommit(version); err != nil {
+		return nil, version, err
+	}
 	tree.initialVersionSet = false
 
 	if tree.VersionExists(version) {
@@ -727,35 +1725,116 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 
 		newHash := tree.WorkingHash()
 
-		if (existingRoot == nil && tree.root == nil) || (existingRoot != nil && bytes.Equal(existingRoot.hash, newHash)) { // TODO with WorkingHash
+		same := existingRoot != nil && bytes.Equal(existingRoot.hash, newHash)
+		if tree.noHash() {
+			// without hashes, only the unchanged saved root is known to be identical
+			same = existingRoot != nil && tree.root != nil && tree.root.nodeKey != nil && bytes.Equal(tree.root.GetKey(), existingNodeKey)
+		}
+		if (existingRoot == nil && tree.root == nil) || same { // TODO with WorkingHash
 			tree.version = version
 			tree.root = existingRoot
 			tree.ImmutableTree = tree.clone()
 			tree.lastSaved = tree.clone()
+			if tree.shadow != nil {
+				tree.shadow.commit()
+			}
+			tree.walOps = nil
 			return newHash, version, nil
 		}
 
-		return nil, version, fmt.Errorf("version %d was already saved to different hash from %X (existing nodeKey %d)", version, newHash, existingNodeKey)
+		return nil, version, fmt.Errorf("version %d was already saved to different hash from %X (existing nodeKey %d)", version, newHash, existingNodeKey)
+	}
+
+	if err := tree.stageVersion(version); err != nil {
+		return nil, version, err
+	}
+	return tree.finishVersion(version)
+}
+
+// preCommit calls Options.PreCommit with the pending changes of version.
+func (tree *MutableTree) preCommit(version int64) error {
+	if tree.ndb.opts.PreCommit == nil {
+		return nil
+	}
+	cs, err := tree.PendingChanges()
+	if err != nil {
+		return err
+	}
+	if err := tree.ndb.opts.PreCommit(cs); err != nil {
+		return fmt.Errorf("version %d rejected by the pre-commit hook: %w", version, err)
+	}
+	return nil
+}
+
+// SaveVersionWithMeta saves a new tree version like SaveVersion, along with an opaque metadata
+// blob, which is read back with VersionMeta and deleted with the version. Saving a version which
+// already exists with the same hash does not update its metadata.
+func (tree *MutableTree) SaveVersionWithMeta(meta []byte) ([]byte, int64, error) {
+	if tree.closed.Load() {
+		return nil, 0, ErrClosed
+	}
+	if meta == nil {
+		meta = []byte{}
+	}
+	tree.versionMeta = meta
+	defer func() { tree.versionMeta = nil }()
+	return tree.SaveVersion()
+}
+
+// VersionMeta returns the metadata blob saved with the version by SaveVersionWithMeta, or nil if
+// the version was saved without one.
+func (tree *MutableTree) VersionMeta(version int64) ([]byte, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if !tree.VersionExists(version) {
+		return nil, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	return tree.ndb.getVersionMeta(version)
+}
+
+// stageVersion writes the new version to the batch, which is committed by finishVersion.
+func (tree *MutableTree) stageVersion(version int64) error {
+	tree.logger.Debug("SAVE TREE", "version", version)
+
+	if tree.ndb.opts.WAL != nil {
+		if err := tree.writeWALChangeSet(version); err != nil {
+			return err
+		}
+	}
+
+	if err := tree.ndb.reserveBatch(tree.workingSetSize()); err != nil {
+		return err
 	}
 
-	tree.logger.Debug("SAVE TREE", "version", version)
+	if tree.versionMeta != nil {
+		if err := tree.ndb.SaveVersionMeta(version, tree.versionMeta); err != nil {
+			return err
+		}
+	}
+	if tree.ndb.opts.TrackNodeSequence {
+		if err := tree.ndb.saveNodeSequence(version, countUnsavedNodes(tree.root)); err != nil {
+			return err
+		}
+	}
 
 	// save new fast nodes
 	if !tree.skipFastStorageUpgrade {
 		if err := tree.saveFastNodeVersion(version); err != nil {
-			return nil, version, err
+			return err
 		}
 	}
 	// save new nodes
+	var newNodes []*Node
 	if tree.root == nil {
 		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
-			return nil, 0, err
+			return err
 		}
 	} else {
 		if tree.root.nodeKey != nil {
 			// it means there are no updated nodes
 			if err := tree.ndb.SaveRoot(version, tree.root.nodeKey); err != nil {
-				return nil, 0, err
+				return err
 			}
 			// it means the reference node is a legacy node
 			if tree.root.isLegacy {
@@ -763,20 +1842,64 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 				// which ensures the reference node is not a legacy node
 				tree.root.isLegacy = false
 				if err := tree.ndb.SaveNode(tree.root); err != nil {
-					return nil, 0, fmt.Errorf("failed to save the reference legacy node: %w", err)
+					return fmt.Errorf("failed to save the reference legacy node: %w", err)
 				}
 			}
 		} else {
-			if err := tree.saveNewNodes(version); err != nil {
-				return nil, 0, err
+			var err error
+			if newNodes, err = tree.saveNewNodes(version); err != nil {
+				return err
 			}
 		}
 	}
 
+	// prune the versions which are no longer retained in the same batch, reading the new version
+	// from the batch for the orphans of the previous one.
+	keepRecent := tree.ndb.opts.KeepRecentVersions
+	if (keepRecent > 0 && !tree.ndb.opts.AsyncPruning) || tree.ndb.opts.Pruner != nil {
+		var rootKey []byte
+		if tree.root != nil {
+			rootKey = tree.root.GetKey()
+		}
+		tree.ndb.stageVersion(version, rootKey, newNodes)
+		err := tree.pruneStagedVersion(version)
+		tree.ndb.stageVersion(0, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneStagedVersion deletes the versions which are no longer retained by KeepRecentVersions and
+// Options.Pruner once version is saved, to the batch of version.
+func (tree *MutableTree) pruneStagedVersion(version int64) error {
+	if keepRecent := tree.ndb.opts.KeepRecentVersions; keepRecent > 0 && !tree.ndb.opts.AsyncPruning {
+		if err := tree.pruneRecentVersions(version - keepRecent); err != nil {
+			return err
+		}
+	}
+	if pruner := tree.ndb.opts.Pruner; pruner != nil {
+		if versions := pruner.ShouldPrune(version); len(versions) > 0 {
+			return tree.pruneVersions(versions)
+		}
+	}
+	return nil
+}
+
+// finishVersion commits the batch written by stageVersion and makes the version the saved one.
+func (tree *MutableTree) finishVersion(version int64) ([]byte, int64, error) {
 	if err := tree.ndb.Commit(); err != nil {
+		if errors.Is(err, errFastIndexAhead) && !tree.skipFastStorageUpgrade {
+			// the fast index holds the changes of the failed version, so the reads fall back to
+			// the tree, like in write-only mode, until RebuildFastIndex or the next load
+			tree.fastIndexStale = true
+			tree.setSkipFastStorageUpgrade(true)
+			tree.unsavedFastNodeAdditions = &sync.Map{}
+			tree.unsavedFastNodeRemovals = &sync.Map{}
+		}
 		return nil, version, err
 	}
-
 	tree.ndb.resetLatestVersion(version)
 	tree.version = version
 
@@ -787,10 +1910,183 @@ func (tree *MutableTree) SaveVersion() ([]byte, int64, error) {
 		tree.unsavedFastNodeAdditions = &sync.Map{}
 		tree.unsavedFastNodeRemovals = &sync.Map{}
 	}
+	if tree.ndb.opts.WAL != nil {
+		tree.walOps = nil
+		// the version is saved, and RecoverFromWAL completes it without the record
+		if err := writeWALRecord(tree.ndb.opts.WAL, walRecordCommit, version, nil); err != nil {
+			tree.ndb.backgroundError("failed to write the WAL completion record", err)
+		}
+	}
+	if tree.shadow != nil {
+		tree.shadow.commit()
+		// the version is saved, so a failed iteration is only reported
+		if err := tree.verifyShadowIteration(); err != nil {
+			tree.ndb.backgroundError("failed to verify the shadow iteration", err)
+		}
+	}
+
+	// the version is saved, so a failed scheduling of the async pruning is only reported
+	if keepRecent := tree.ndb.opts.KeepRecentVersions; keepRecent > 0 && tree.ndb.opts.AsyncPruning {
+		if err := tree.pruneRecentVersions(version - keepRecent); err != nil {
+			tree.ndb.backgroundError("failed to schedule the pruning of the recent versions", err)
+		}
+	}
 
+	tree.logger.Debug("saved version", "version", version, "hash", tree.Hash())
 	return tree.Hash(), version, nil
 }
 
+// pruneRecentVersions deletes the versions up to toVersion for Options.KeepRecentVersions. The
+// deletions are written to the batch, or scheduled with async pruning.
+func (tree *MutableTree) pruneRecentVersions(toVersion int64) error {
+	if toVersion < 1 {
+		return nil
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	if toVersion < firstVersion {
+		return nil
+	}
+	// the pinned versions and the following ones are pruned once unpinned
+	if pinned := tree.ndb.firstPinnedVersion(firstVersion, toVersion); pinned != 0 {
+		toVersion = pinned - 1
+		if toVersion < firstVersion {
+			return nil
+		}
+	}
+	return tree.ndb.DeleteVersionsTo(toVersion)
+}
+
+// workingSetSize estimates the number of bytes SaveVersion writes to the batch for the unsaved
+// fast nodes and the new nodes of the working tree.
+func (tree *MutableTree) workingSetSize() int {
+	size := 0
+	if !tree.skipFastStorageUpgrade {
+		tree.unsavedFastNodeAdditions.Range(func(k, v interface{}) bool {
+			size += 1 + len(k.(string)) + v.(*fastnode.Node).EncodedSize()
+			return true
+		})
+		tree.unsavedFastNodeRemovals.Range(func(k, _ interface{}) bool {
+			size += 1 + len(k.(string))
+			return true
+		})
+	}
+
+	var countNewNodes func(*Node)
+	countNewNodes = func(node *Node) {
+		if node == nil || node.nodeKey != nil {
+			return
+		}
+		size += nodeKeyFormat.Length() + node.encodedSize()
+		if !node.isLeaf() {
+			// the hash and the child node keys are assigned while saving
+			size += hashSize + 2*(int64Size+int32Size)
+			countNewNodes(node.leftNode)
+			countNewNodes(node.rightNode)
+		}
+	}
+	countNewNodes(tree.root)
+
+	return size
+}
+
+// PendingCommitSize returns the number of entries the next SaveVersion writes for the working
+// tree, and their size with their database keys: the new nodes, or the root reference of a
+// version without new nodes, and the fast node additions and removals. The metadata and the
+// deletions of the pruning are not counted. Unlike the estimate used to size the batch, each new
+// node is encoded as it will be saved.
+func (tree *MutableTree) PendingCommitSize() (nodeCount int, size int, err error) {
+	if tree.closed.Load() {
+		return 0, 0, ErrClosed
+	}
+	if !tree.skipFastStorageUpgrade {
+		var buf bytes.Buffer
+		tree.unsavedFastNodeAdditions.Range(func(k, v interface{}) bool {
+			node := v.(*fastnode.Node)
+			if tree.ndb.opts.ValueTransform != nil {
+				node = fastnode.NewNode(node.GetKey(), tree.ndb.opts.ValueTransform.Encode(node.GetKey(), node.GetValue()), node.GetVersionLastUpdatedAt())
+			}
+			buf.Reset()
+			if err = node.WriteBytes(&buf); err != nil {
+				return false
+			}
+			nodeCount++
+			size += len(tree.ndb.fastNodeKey([]byte(k.(string)))) + buf.Len()
+			return true
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+		tree.unsavedFastNodeRemovals.Range(func(k, _ interface{}) bool {
+			nodeCount++
+			size += len(tree.ndb.fastNodeKey([]byte(k.(string))))
+			return true
+		})
+	}
+
+	rootKeySize := len(nodeKeyFormat.Key(GetRootKey(tree.WorkingVersion())))
+	switch {
+	case tree.root == nil:
+		return nodeCount + 1, size + rootKeySize, nil
+	case tree.root.nodeKey != nil:
+		// a legacy root is saved again in the new format along with the reference
+		nodeCount++
+		size += 2 * rootKeySize
+		if tree.root.isLegacy {
+			stored := *tree.root
+			stored.isLegacy = false
+			var buf bytes.Buffer
+			if err := tree.ndb.writeNode(&buf, &stored); err != nil {
+				return 0, 0, err
+			}
+			nodeCount++
+			size += len(tree.ndb.nodeKey(stored.GetKey())) + buf.Len()
+		}
+		return nodeCount, size, nil
+	}
+
+	// the new nodes are numbered like saveNewNodes does
+	version := tree.WorkingVersion()
+	nonce := uint32(0)
+	var buf bytes.Buffer
+	var countNewNodes func(node *Node) ([]byte, error)
+	countNewNodes = func(node *Node) ([]byte, error) {
+		if node.nodeKey != nil {
+			return node.GetKey(), nil
+		}
+		nonce++
+		nk := &NodeKey{version: version, nonce: nonce}
+		stored := *node
+		if !node.isLeaf() {
+			var err error
+			if stored.leftNodeKey, err = countNewNodes(node.leftNode); err != nil {
+				return nil, err
+			}
+			if stored.rightNodeKey, err = countNewNodes(node.rightNode); err != nil {
+				return nil, err
+			}
+			// the hash is computed while saving
+			stored.hash = nil
+			if !tree.noHash() {
+				stored.hash = make([]byte, hashSize)
+			}
+		}
+		buf.Reset()
+		if err := tree.ndb.writeNode(&buf, &stored); err != nil {
+			return nil, err
+		}
+		nodeCount++
+		size += len(tree.ndb.nodeKey(nk.GetKey())) + buf.Len()
+		return nk.GetKey(), nil
+	}
+	if _, err := countNewNodes(tree.root); err != nil {
+		return 0, 0, err
+	}
+	return nodeCount, size, nil
+}
+
 func (tree *MutableTree) saveFastNodeVersion(latestVersion int64) error {
 	if err := tree.saveFastNodeAdditions(); err != nil {
 		return err
@@ -879,6 +2175,12 @@ func (tree *MutableTree) SetInitialVersion(version uint64) {
 // DeleteVersionsTo removes versions upto the given version from the MutableTree.
 // It will not block the SaveVersion() call, instead it will be queued and executed deferred.
 func (tree *MutableTree) DeleteVersionsTo(toVersion int64) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
 	if err := tree.ndb.DeleteVersionsTo(toVersion); err != nil {
 		return err
 	}
@@ -886,9 +2188,135 @@ func (tree *MutableTree) DeleteVersionsTo(toVersion int64) error {
 	return tree.ndb.Commit()
 }
 
+// PauseBackground pauses the async pruning, e.g. while the node is under heavy query load, until
+// ResumeBackground is called. The versions deleted with DeleteVersionsTo meanwhile are kept
+// queued, and Close still prunes them. The batches are only flushed by the foreground writes and
+// by the pruning, which is stopped too. It returns once a pruning in progress is done, and does
+// nothing without AsyncPruning.
+func (tree *MutableTree) PauseBackground() {
+	if tree.closed.Load() {
+		return
+	}
+	tree.ndb.pauseBackground(true)
+}
+
+// ResumeBackground resumes the async pruning paused by PauseBackground, which prunes the queued
+// versions.
+func (tree *MutableTree) ResumeBackground() {
+	if tree.closed.Load() {
+		return
+	}
+	tree.ndb.pauseBackground(false)
+}
+
+// PruneWithPolicy deletes the versions for which keep returns false, except for the latest one,
+// and commits the deletions at once. The deletion of a version keeps the nodes shared with the
+// previous and next remaining versions, which may leave gaps between the versions. Legacy
+// versions are kept.
+func (tree *MutableTree) PruneWithPolicy(keep func(version int64) bool) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	ndb := tree.ndb
+	if ndb.opts.AsyncPruning {
+		return errors.New("cannot prune with a policy with AsyncPruning")
+	}
+	firstVersion, err := ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	_, latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+
+	var versions []int64
+	version := firstVersion
+	if legacyLatestVersion >= firstVersion {
+		version = legacyLatestVersion + 1
+	}
+	for version > 0 && version < latestVersion {
+		if !keep(version) {
+			versions = append(versions, version)
+		}
+		if version, err = ndb.firstVersionFrom(version+1, latestVersion); err != nil {
+			return err
+		}
+	}
+	if err := ndb.deleteVersionsKeepingNeighbours(versions); err != nil {
+		return err
+	}
+	return ndb.Commit()
+}
+
+// CollapseHistory deletes all the versions except keepVersions and the latest one, which must be
+// available, with PruneWithPolicy. The nodes of the deleted versions which are still part of a
+// kept version are kept, so that the kept versions load with their original roots.
+func (tree *MutableTree) CollapseHistory(keepVersions []int64) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	keep := make(map[int64]bool, len(keepVersions))
+	for _, version := range keepVersions {
+		if !tree.VersionExists(version) {
+			return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+		}
+		keep[version] = true
+	}
+	return tree.PruneWithPolicy(func(version int64) bool {
+		return keep[version]
+	})
+}
+
+// PinVersion prevents the deletion of version until UnpinVersion is called: the pruning by
+// KeepRecentVersions, PruneWithPolicy and Options.Pruner skip it, while DeleteVersionsTo and
+// DeleteVersionsFrom fail with ErrVersionPinned. Pins are not persisted.
+func (tree *MutableTree) PinVersion(version int64) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if !tree.VersionExists(version) {
+		return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	tree.ndb.mtx.Lock()
+	defer tree.ndb.mtx.Unlock()
+	if tree.ndb.pruneVersion >= version {
+		return fmt.Errorf("%w: version %d is scheduled for pruning", ErrVersionPruned, version)
+	}
+	tree.ndb.pinnedVersions[version] = true
+	return nil
+}
+
+// UnpinVersion allows the deletion of a version pinned with PinVersion again. The versions which
+// KeepRecentVersions kept because of the pin are deleted by the next SaveVersion.
+func (tree *MutableTree) UnpinVersion(version int64) {
+	if tree.closed.Load() {
+		return
+	}
+	tree.ndb.mtx.Lock()
+	defer tree.ndb.mtx.Unlock()
+	delete(tree.ndb.pinnedVersions, version)
+}
+
 // DeleteVersionsFrom removes from the given version upwards from the MutableTree.
 // It will not block the SaveVersion() call, instead it will be queued and executed deferred.
 func (tree *MutableTree) DeleteVersionsFrom(fromVersion int64) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
 	if err := tree.ndb.DeleteVersionsFrom(fromVersion); err != nil {
 		return err
 	}
@@ -896,6 +2324,101 @@ func (tree *MutableTree) DeleteVersionsFrom(fromVersion int64) error {
 	return tree.ndb.Commit()
 }
 
+// TrimCaches evicts the least recently used nodes of the node caches until their estimated memory
+// size is at most targetBytes, e.g. on memory pressure, and returns the remaining size. The evicted
+// nodes are read from the database again when needed.
+func (tree *MutableTree) TrimCaches(targetBytes int64) int64 {
+	if tree.closed.Load() {
+		return 0
+	}
+	return tree.ndb.trimCaches(targetBytes)
+}
+
+// PrunableStats returns the number of nodes, and their encoded size with their database keys,
+// which are only referenced by versions that are not retained and would be deleted by pruning
+// them. The last Options.KeepRecentVersions versions are retained, or only the latest one if
+// unset, along with the pinned versions and the following ones, which pruning skips until they
+// are unpinned. Nothing is deleted.
+func (tree *MutableTree) PrunableStats() (nodes int64, size int64, err error) {
+	if tree.closed.Load() {
+		return 0, 0, ErrClosed
+	}
+	_, latestVersion, err := tree.ndb.getLatestVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	keepRecent := tree.ndb.opts.KeepRecentVersions
+	if keepRecent < 1 {
+		keepRecent = 1
+	}
+	firstVersion, err := tree.ndb.getFirstVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	toVersion := latestVersion - keepRecent
+	if pinned := tree.ndb.firstPinnedVersion(firstVersion, toVersion); pinned != 0 {
+		toVersion = pinned - 1
+	}
+
+	// the orphans of each version are the nodes which deleteVersion removes
+	var buf bytes.Buffer
+	cache := newRootkeyCache()
+	for version := firstVersion; version <= toVersion; version++ {
+		err := tree.ndb.traverseOrphansWithRootkeyCache(cache, version, version+1, func(orphan *Node) error {
+			nodes++
+			if orphan.isLegacy {
+				size += int64(len(tree.ndb.legacyNodeKey(orphan.hash)))
+			} else {
+				size += int64(len(tree.ndb.nodeKey(orphan.GetKey())))
+			}
+			buf.Reset()
+			if err := tree.ndb.writeNode(&buf, orphan); err != nil {
+				return err
+			}
+			size += int64(buf.Len())
+			return nil
+		})
+		if err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
+			return 0, 0, err
+		}
+	}
+	return nodes, size, nil
+}
+
+// IncrementalExportSize returns the number of nodes first written by the given version, which are
+// the nodes whose node keys hold the version, and their stored size with their database keys,
+// e.g. to size incremental backups. Nodes already deleted by pruning are not counted. The
+// version must not be stored in the legacy format.
+func (tree *MutableTree) IncrementalExportSize(version int64) (nodes int64, size int64, err error) {
+	if tree.closed.Load() {
+		return 0, 0, ErrClosed
+	}
+	if !tree.VersionExists(version) {
+		return 0, 0, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion()
+	if err != nil {
+		return 0, 0, err
+	}
+	if version <= legacyLatestVersion {
+		return 0, 0, fmt.Errorf("version %d is stored in the legacy format", version)
+	}
+
+	err = tree.ndb.traversePrefix(nodeKeyPrefixFormat.KeyInt64(version), func(k, v []byte) error {
+		// an unchanged root is saved as a reference to the root of an earlier version
+		if isRef, _ := isReferenceRoot(v); isRef {
+			return nil
+		}
+		nodes++
+		size += int64(len(k) + len(v))
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return nodes, size, nil
+}
+
 // Rotate right and return the new node and orphan.
 func (tree *MutableTree) rotateRight(node *Node) (*Node, error) {
 	var err error
@@ -1029,10 +2552,10 @@ func (tree *MutableTree) balance(node *Node) (newSelf *Node, err error) {
 	return node, nil
 }
 
-// saveNewNodes save new created nodes by the changes of the working tree.
+// saveNewNodes save new created nodes by the changes of the working tree, and returns them.
 // NOTE: This function clears leftNode/rigthNode recursively and
 // calls _hash() on the given node.
-func (tree *MutableTree) saveNewNodes(version int64) error {
+func (tree *MutableTree) saveNewNodes(version int64) ([]*Node, error) {
 	nonce := uint32(0)
 	newNodes := make([]*Node, 0)
 	var recursiveAssignKey func(*Node) ([]byte, error)
@@ -1059,29 +2582,199 @@ func (tree *MutableTree) saveNewNodes(version int64) error {
 			}
 		}
 
-		node._hash(version)
+		if !tree.noHash() {
+			node._hash(version)
+		}
 		newNodes = append(newNodes, node)
 
 		return node.nodeKey.GetKey(), nil
 	}
 
 	if _, err := recursiveAssignKey(tree.root); err != nil {
-		return err
+		return nil, err
 	}
 
+	if tree.ndb.opts.OnHashCollision != nil {
+		// check all the nodes before writing any of them
+		for _, node := range newNodes {
+			if err := tree.ndb.checkNodeCollision(node); err != nil {
+				return nil, err
+			}
+		}
+	}
 	for _, node := range newNodes {
 		if err := tree.ndb.SaveNode(node); err != nil {
-			return err
+			return nil, err
 		}
 		node.leftNode, node.rightNode = nil, nil
 	}
 
-	return nil
+	return newNodes, nil
+}
+
+// PendingChanges returns the net changes of the working tree relative to the last saved version,
+// ordered by key. Keys that were set and later removed, or set back to their saved value, are
+// omitted. The result can be replayed on the last saved version with SaveChangeSet.
+func (tree *MutableTree) PendingChanges() (ChangeSet, error) {
+	if tree.closed.Load() {
+		return ChangeSet{}, ErrClosed
+	}
+	// Walk the new nodes of the working tree, recording the new leaves and the persisted
+	// subtrees they still reference.
+	shared := make(map[string]struct{})
+	var newLeaves []*Node
+	var collectNew func(node *Node) error
+	collectNew = func(node *Node) error {
+		if node.nodeKey != nil {
+			shared[string(node.GetKey())] = struct{}{}
+			return nil
+		}
+		if node.isLeaf() {
+			newLeaves = append(newLeaves, node)
+			return nil
+		}
+		leftNode, err := node.getLeftNode(tree.ImmutableTree)
+		if err != nil {
+			return err
+		}
+		if err := collectNew(leftNode); err != nil {
+			return err
+		}
+		rightNode, err := node.getRightNode(tree.ImmutableTree)
+		if err != nil {
+			return err
+		}
+		return collectNew(rightNode)
+	}
+	if tree.root != nil {
+		if err := collectNew(tree.root); err != nil {
+			return ChangeSet{}, err
+		}
+	}
+
+	// Any leaf of the last saved tree outside the shared subtrees is no longer referenced.
+	var orphanedLeaves []*Node
+	var collectOrphaned func(node *Node) error
+	collectOrphaned = func(node *Node) error {
+		if _, ok := shared[string(node.GetKey())]; ok {
+			return nil
+		}
+		if node.isLeaf() {
+			orphanedLeaves = append(orphanedLeaves, node)
+			return nil
+		}
+		leftNode, err := node.getLeftNode(tree.lastSaved)
+		if err != nil {
+			return err
+		}
+		if err := collectOrphaned(leftNode); err != nil {
+			return err
+		}
+		rightNode, err := node.getRightNode(tree.lastSaved)
+		if err != nil {
+			return err
+		}
+		return collectOrphaned(rightNode)
+	}
+	if tree.lastSaved.root != nil {
+		if err := collectOrphaned(tree.lastSaved.root); err != nil {
+			return ChangeSet{}, err
+		}
+	}
+
+	// Both leaf lists are sorted by key, merge them into the change set.
+	var cs ChangeSet
+	for len(newLeaves) > 0 || len(orphanedLeaves) > 0 {
+		switch {
+		case len(orphanedLeaves) == 0 || (len(newLeaves) > 0 && bytes.Compare(newLeaves[0].key, orphanedLeaves[0].key) < 0):
+			cs.Pairs = append(cs.Pairs, &KVPair{Key: newLeaves[0].key, Value: newLeaves[0].value})
+			newLeaves = newLeaves[1:]
+		case len(newLeaves) == 0 || bytes.Compare(newLeaves[0].key, orphanedLeaves[0].key) > 0:
+			cs.Pairs = append(cs.Pairs, &KVPair{Key: orphanedLeaves[0].key, Delete: true})
+			orphanedLeaves = orphanedLeaves[1:]
+		default:
+			if !bytes.Equal(newLeaves[0].value, orphanedLeaves[0].value) {
+				cs.Pairs = append(cs.Pairs, &KVPair{Key: newLeaves[0].key, Value: newLeaves[0].value})
+			}
+			newLeaves = newLeaves[1:]
+			orphanedLeaves = orphanedLeaves[1:]
+		}
+	}
+	return cs, nil
+}
+
+// Defragment rewrites the nodes of the given version with consecutive node keys and deletes the
+// versions before it, so that nothing but the nodes of the version and of the later versions
+// remain on disk. The root hashes are unchanged, and the later versions are kept, with their
+// references to the rewritten nodes updated. The store is updated in a single batch, so that a
+// failure leaves it unchanged, which holds the whole version in memory. The metadata saved with
+// the remaining versions is kept, while the node sequences of the version and the deleted ones are
+// dropped. The legacy format must be migrated first, see MigrateLegacyFormat. It is an offline
+// maintenance operation: the tree must not have unsaved changes nor be used meanwhile.
+func (tree *MutableTree) Defragment(targetVersion int64) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	if tree.root != tree.lastSaved.root {
+		return errors.New("cannot defragment with uncommitted changes")
+	}
+	if !tree.VersionExists(targetVersion) {
+		return fmt.Errorf("%w: %d", ErrVersionDoesNotExist, targetVersion)
+	}
+	if legacyLatestVersion, err := tree.ndb.getLegacyLatestVersion(); err != nil {
+		return err
+	} else if legacyLatestVersion > 0 {
+		return fmt.Errorf("cannot defragment the legacy versions up to %d, see MigrateLegacyFormat", legacyLatestVersion)
+	}
+	if pinned := tree.ndb.firstPinnedVersion(0, targetVersion-1); pinned != 0 {
+		return fmt.Errorf("cannot delete the pinned version %d", pinned)
+	}
+
+	if err := tree.ndb.defragmentVersion(targetVersion); err != nil {
+		return fmt.Errorf("failed to defragment version %d: %w", targetVersion, err)
+	}
+	version := tree.version
+	tree.ImmutableTree = &ImmutableTree{ndb: tree.ndb, skipFastStorageUpgrade: tree.skipFastStorageUpgrade}
+	tree.lastSaved = tree.ImmutableTree.clone()
+	_, err := tree.LoadVersion(version)
+	return err
+}
+
+// importExport imports the nodes of exporter as version, which must have the root hash rootHash.
+func (tree *MutableTree) importExport(version int64, exporter NodeExporter, rootHash []byte) error {
+	importer, err := tree.Import(version)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+
+	for {
+		node, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := importer.Add(node); err != nil {
+			return err
+		}
+	}
+	return importer.CommitExpecting(rootHash)
 }
 
 // SaveChangeSet saves a ChangeSet to the tree.
 // It is used to replay a ChangeSet as a new version.
 func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	if tree.prepared {
+		return 0, ErrCommitPrepared
+	}
 	// if the tree has uncommitted changes, return error
 	if tree.root != nil && tree.root.nodeKey == nil {
 		return 0, errors.New("cannot save changeset with uncommitted changes")
@@ -1105,12 +2798,61 @@ func (tree *MutableTree) SaveChangeSet(cs *ChangeSet) (int64, error) {
 	return version, err
 }
 
-// Close closes the tree.
+// ReplaceAll replaces the contents of the tree with the pairs of cs and saves them as a new
+// version, with the same result as removing all the keys and then applying cs. The tree of the
+// new version is built from scratch instead of removing the keys one by one, and the previous
+// versions are kept. The tree must not have uncommitted changes. On error, no version is saved
+// and the working tree is rolled back.
+func (tree *MutableTree) ReplaceAll(cs ChangeSet) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	if tree.root != tree.lastSaved.root {
+		return errors.New("cannot replace the contents with uncommitted changes")
+	}
+	if tree.root != nil {
+		// the removed keys must still be tracked by the fast index, the shadow copy and the WAL
+		if _, err := tree.ImmutableTree.Iterate(func(key, _ []byte) bool {
+			key = bytes.Clone(key)
+			if !tree.skipFastStorageUpgrade {
+				tree.addUnsavedRemoval(key)
+			}
+			if tree.shadow != nil {
+				tree.shadow.remove(key)
+			}
+			tree.recordWALOp(NewDeleteKVPair(key))
+			return false
+		}); err != nil {
+			tree.Rollback()
+			return err
+		}
+	}
+	tree.root = nil
+
+	if err := tree.SetBatch(cs.Pairs); err != nil {
+		tree.Rollback()
+		return err
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		tree.Rollback()
+		return err
+	}
+	return nil
+}
+
+// Close closes the tree. It waits for pending async pruning, flushes it to disk and releases the
+// resources of the tree, closing the database if Options.CloseDB is set. Further calls to methods
+// which return an error return ErrClosed, on the tree and on the immutable trees of its versions.
+// It is safe to call multiple times, and concurrently with the other methods.
 func (tree *MutableTree) Close() error {
 	tree.mtx.Lock()
 	defer tree.mtx.Unlock()
 
-	tree.ImmutableTree = nil
-	tree.lastSaved = nil
+	if tree.closed.Swap(true) {
+		return nil
+	}
 	return tree.ndb.Close()
 }
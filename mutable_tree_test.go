@@ -2,14 +2,23 @@ package iavl
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
 	"runtime"
 	"sort"
 	"strconv"
 	"sync"
 	"testing"
+	"time"
 
+	corestore "cosmossdk.io/core/store"
+	ics23 "github.com/cosmos/ics23/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	gomock "go.uber.org/mock/gomock"
@@ -349,6 +358,24 @@ func BenchmarkMutableTree_Set(b *testing.B) {
 	}
 }
 
+func BenchmarkMutableTree_SaveVersion_NoHash(b *testing.B) {
+	for _, noHash := range []bool{false, true} {
+		b.Run(fmt.Sprintf("noHash=%v", noHash), func(b *testing.B) {
+			tree := NewMutableTree(dbm.NewMemDB(), 1000000, true, NewNopLogger(), NoHashOption(noHash))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < 1000; j++ {
+					_, err := tree.Set(iavlrand.RandBytes(10), iavlrand.RandBytes(32))
+					require.NoError(b, err)
+				}
+				_, _, err := tree.SaveVersion()
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
 func prepareTree(t *testing.T) *MutableTree {
 	mdb := dbm.NewMemDB()
 	tree := NewMutableTree(mdb, 1000, false, NewNopLogger())
@@ -1245,6 +1272,88 @@ func TestUpgradeStorageToFast_Delete_Stale_Success(t *testing.T) {
 	}
 }
 
+func TestMutableTree_MigrateFastStorage(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for i := 0; i < 2*progressInterval+500; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%05d", i)), []byte(fmt.Sprintf("val_%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// cancel before the first checkpoint, which leaves nothing in the batch
+	require.NoError(t, tree.ndb.SaveFastNodeNoCache(fastnode.NewNode([]byte("stale"), []byte("value"), version)))
+	require.NoError(t, tree.ndb.Commit())
+	tree = NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, tree.MigrateFastStorage(ctx, nil), context.Canceled)
+	require.NoError(t, tree.ndb.Commit())
+	has, err := db.Has(tree.ndb.fastNodeKey([]byte("stale")))
+	require.NoError(t, err)
+	require.True(t, has)
+	_, _, ok, err := tree.ndb.getFastMigrationCheckpoint(version)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// cancel after the first checkpoint
+	tree = NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	var progress []int64
+	err = tree.MigrateFastStorage(ctx, func(done int64) {
+		progress = append(progress, done)
+		cancel()
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, []int64{progressInterval}, progress)
+	done, _, ok, err := tree.ndb.getFastMigrationCheckpoint(version)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.GreaterOrEqual(t, done, int64(progressInterval))
+	require.False(t, tree.ndb.hasUpgradedToFastStorage())
+
+	// resume from the checkpoint
+	tree = NewMutableTree(db, 0, true, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	progress = nil
+	require.NoError(t, tree.MigrateFastStorage(context.Background(), func(done int64) {
+		progress = append(progress, done)
+	}))
+	require.Equal(t, []int64{2 * progressInterval, 2*progressInterval + 500}, progress)
+	_, _, ok, err = tree.ndb.getFastMigrationCheckpoint(version)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	require.NoError(t, tree.MigrateFastStorage(context.Background(), nil))
+
+	itr := NewFastIterator(nil, nil, true, tree.ndb)
+	defer itr.Close()
+	count := 0
+	_, err = tree.ImmutableTree.Iterate(func(key, value []byte) bool {
+		require.True(t, itr.Valid())
+		require.Equal(t, key, itr.Key())
+		require.Equal(t, value, itr.Value())
+		itr.Next()
+		count++
+		return false
+	})
+	require.NoError(t, err)
+	require.False(t, itr.Valid())
+	require.Equal(t, 2*progressInterval+500, count)
+}
+
 func setupTreeAndMirror(t *testing.T, numEntries int, skipFastStorageUpgrade bool) (*MutableTree, [][]string) {
 	db := dbm.NewMemDB()
 
@@ -1482,6 +1591,111 @@ func TestMutableTreeClose(t *testing.T) {
 	require.NoError(t, tree.Close())
 }
 
+// closeCountingDB is a MemDB counting the calls to Close.
+type closeCountingDB struct {
+	*dbm.MemDB
+	closes int
+}
+
+func (db *closeCountingDB) Close() error {
+	db.closes++
+	return db.MemDB.Close()
+}
+
+func TestMutableTreeClose_ErrClosed(t *testing.T) {
+	db := &closeCountingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), CloseDBOption(true))
+
+	_, err := tree.Set([]byte("hello"), []byte("world"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	require.NoError(t, tree.Close())
+	require.NoError(t, tree.Close())
+	require.Equal(t, 1, db.closes)
+
+	_, err = tree.Set([]byte("hello"), []byte("again"))
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = tree.Get([]byte("hello"))
+	require.ErrorIs(t, err, ErrClosed)
+	_, _, err = tree.Remove([]byte("hello"))
+	require.ErrorIs(t, err, ErrClosed)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = tree.GetImmutable(1)
+	require.ErrorIs(t, err, ErrClosed)
+	_, err = tree.Load()
+	require.ErrorIs(t, err, ErrClosed)
+
+	// the db is left open by default
+	shared := &closeCountingDB{MemDB: dbm.NewMemDB()}
+	require.NoError(t, NewMutableTree(shared, 0, false, NewNopLogger()).Close())
+	require.Zero(t, shared.closes)
+}
+
+func TestMutableTreeClose_PromotedMethods(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("hello"), []byte("world"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	require.NoError(t, tree.Close())
+
+	// the methods of the working tree and of the saved versions fail instead of finding nothing
+	for _, imm := range []*ImmutableTree{tree.ImmutableTree, itree} {
+		_, err = imm.Has([]byte("hello"))
+		require.ErrorIs(t, err, ErrClosed)
+		_, _, err = imm.GetWithIndex([]byte("hello"))
+		require.ErrorIs(t, err, ErrClosed)
+		_, err = imm.GetProof([]byte("hello"))
+		require.ErrorIs(t, err, ErrClosed)
+		_, err = imm.Iterator(nil, nil, true)
+		require.ErrorIs(t, err, ErrClosed)
+		_, err = imm.Export()
+		require.ErrorIs(t, err, ErrClosed)
+		_, _, _, err = imm.FirstKey()
+		require.ErrorIs(t, err, ErrClosed)
+	}
+	_, err = tree.Has([]byte("hello"))
+	require.ErrorIs(t, err, ErrClosed)
+	_, _, err = tree.GetWithIndex([]byte("hello"))
+	require.ErrorIs(t, err, ErrClosed)
+
+	require.False(t, tree.VersionExists(1))
+	require.Nil(t, tree.AvailableVersions())
+	require.Zero(t, tree.TrimCaches(0))
+	tree.Rollback()
+	tree.UnpinVersion(1)
+	tree.PauseBackground()
+	tree.ResumeBackground()
+}
+
+func TestMutableTreeClose_AsyncPruning(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), AsyncPruningOption(true))
+	for v := 1; v <= 5; v++ {
+		_, err := tree.Set([]byte("key"), []byte(strconv.Itoa(v)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// the pruning is pending when the tree is closed
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	require.NoError(t, tree.Close())
+
+	reopened := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reopened.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 5, version)
+	require.Equal(t, []int{4, 5}, reopened.AvailableVersions())
+	require.NoError(t, reopened.Close())
+}
+
 func TestReferenceRootPruning(t *testing.T) {
 	memDB := dbm.NewMemDB()
 	tree := NewMutableTree(memDB, 0, true, NewNopLogger())
@@ -1518,3 +1732,2807 @@ func TestMutableTree_InitialVersionZero(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int64(0), version)
 }
+
+func TestSaveVersionReservedBatch(t *testing.T) {
+	// the persisted state must not depend on the batch reservation,
+	// whether the commit fits into a single batch or not.
+	var hashes [][]byte
+	for _, flushThreshold := range []int{DefaultOptions().FlushThreshold, 1000} {
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), FlushThresholdOption(flushThreshold))
+		for i := 0; i < 2000; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%d", i)))
+			require.NoError(t, err)
+		}
+		require.Greater(t, tree.workingSetSize(), 2000*len("key00000value0000"))
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+
+		reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+		_, err = reloaded.Load()
+		require.NoError(t, err)
+		require.Equal(t, hash, reloaded.Hash())
+		for i := 0; i < 2000; i++ {
+			value, err := reloaded.Get([]byte(fmt.Sprintf("key%05d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("value%d", i)), value)
+		}
+	}
+	require.Equal(t, hashes[0], hashes[1])
+}
+
+func TestMutableTree_RootHashes(t *testing.T) {
+	tree := setupMutableTree(false)
+
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			// a version without changes refers to the previous root
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			continue
+		}
+		for j := 0; j < 50; j++ {
+			_, err := tree.Set(iavlrand.RandBytes(10), iavlrand.RandBytes(10))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(3))
+
+	hashes, err := tree.RootHashes(0, 100)
+	require.NoError(t, err)
+	require.Len(t, hashes, 7)
+	for version := int64(4); version <= 10; version++ {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, itree.Hash(), hashes[version], "version %d", version)
+	}
+	require.Equal(t, hashes[5], hashes[6])
+
+	hashes, err = tree.RootHashes(6, 7)
+	require.NoError(t, err)
+	require.Len(t, hashes, 2)
+	require.Contains(t, hashes, int64(6))
+	require.Contains(t, hashes, int64(7))
+
+	// an empty root has the hash of the empty tree
+	emptyTree := setupMutableTree(false)
+	_, _, err = emptyTree.SaveVersion()
+	require.NoError(t, err)
+	hashes, err = emptyTree.RootHashes(1, 1)
+	require.NoError(t, err)
+	require.Equal(t, map[int64][]byte{1: emptyTree.Hash()}, hashes)
+}
+
+func TestMutableTree_RangeDigest(t *testing.T) {
+	build := func(t *testing.T, changed int) *MutableTree {
+		tree := setupMutableTree(false)
+		for v := 1; v <= 6; v++ {
+			for i := 0; i < 20; i++ {
+				value := fmt.Sprintf("value%d-%d", v, i)
+				if v == changed && i == 0 {
+					value = "changed"
+				}
+				_, err := tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte(value))
+				require.NoError(t, err)
+			}
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		return tree
+	}
+	tree, same := build(t, 0), build(t, 0)
+	digest, err := tree.RangeDigest(2, 5)
+	require.NoError(t, err)
+	require.Len(t, digest, sha256.Size)
+	sameDigest, err := same.RangeDigest(2, 5)
+	require.NoError(t, err)
+	require.Equal(t, digest, sameDigest)
+
+	// a single differing version changes the digests of the ranges holding it only
+	other := build(t, 4)
+	otherDigest, err := other.RangeDigest(2, 5)
+	require.NoError(t, err)
+	require.NotEqual(t, digest, otherDigest)
+	otherDigest, err = other.RangeDigest(2, 3)
+	require.NoError(t, err)
+	sameDigest, err = tree.RangeDigest(2, 3)
+	require.NoError(t, err)
+	require.Equal(t, sameDigest, otherDigest)
+
+	// the digest depends on the range
+	sameDigest, err = tree.RangeDigest(2, 4)
+	require.NoError(t, err)
+	require.NotEqual(t, digest, sameDigest)
+
+	_, err = tree.RangeDigest(5, 2)
+	require.Error(t, err)
+	_, err = tree.RangeDigest(5, 7)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	_, err = tree.RangeDigest(2, 5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_IsNoOpVersion(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	save := func() {
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// 1: empty, 2: no changes, 3: changes, 4: no changes, 5: a set of the same value,
+	// which rewrites the leaf at the new version, 6: a removal
+	save()
+	save()
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	save()
+	save()
+	_, err = tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	save()
+	_, _, err = tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	save()
+
+	for version, expected := range map[int64]bool{2: true, 3: false, 4: true, 5: false, 6: false} {
+		noOp, err := tree.IsNoOpVersion(version)
+		require.NoError(t, err)
+		require.Equal(t, expected, noOp, "version %d", version)
+	}
+
+	// the previous version must exist
+	_, err = tree.IsNoOpVersion(1)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	_, err = tree.IsNoOpVersion(7)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	_, err = tree.IsNoOpVersion(3)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	noOp, err := tree.IsNoOpVersion(4)
+	require.NoError(t, err)
+	require.True(t, noOp)
+}
+
+func TestMutableTree_SharedSubtreeHashes(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("val_%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key_042"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// all the subtrees off the path to the updated key are shared
+	var expected [][]byte
+	for _, version := range []int64{2, 3} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		_, siblings, err := itree.GetMerklePath([]byte("key_042"))
+		require.NoError(t, err)
+		hashes := make([][]byte, 0, len(siblings))
+		// the siblings are ordered from the leaf, and the left ones come first in pre-order
+		for i := len(siblings) - 1; i >= 0; i-- {
+			if siblings[i].Left {
+				hashes = append(hashes, siblings[i].Hash)
+			}
+		}
+		for i := 0; i < len(siblings); i++ {
+			if !siblings[i].Left {
+				hashes = append(hashes, siblings[i].Hash)
+			}
+		}
+		if expected == nil {
+			expected = hashes
+		}
+		require.Equal(t, expected, hashes)
+	}
+	for _, versions := range [][2]int64{{2, 3}, {3, 2}, {1, 3}} {
+		hashes, err := tree.SharedSubtreeHashes(versions[0], versions[1])
+		require.NoError(t, err)
+		require.Equal(t, expected, hashes)
+	}
+
+	// unchanged versions share the whole tree
+	hashes, err := tree.SharedSubtreeHashes(1, 2)
+	require.NoError(t, err)
+	roots, err := tree.RootHashes(2, 2)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{roots[2]}, hashes)
+
+	_, err = tree.SharedSubtreeHashes(1, 4)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_EmptyTransitions(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	check := func(firstNonEmpty, emptied int64) {
+		t.Helper()
+		version, err := tree.FirstNonEmptyVersion()
+		require.NoError(t, err)
+		require.Equal(t, firstNonEmpty, version)
+		version, err = tree.EmptiedVersion()
+		require.NoError(t, err)
+		require.Equal(t, emptied, version)
+	}
+	check(0, 0)
+
+	// versions 1 and 2 are empty
+	for i := 0; i < 2; i++ {
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	check(0, 0)
+
+	// versions 3 and 4 hold keys
+	for i := 0; i < 2; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{1})
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	check(3, 0)
+
+	// versions 5 and 6 are empty again
+	for i := 0; i < 2; i++ {
+		_, _, err := tree.Remove([]byte{byte(i)})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	check(3, 5)
+
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	check(4, 5)
+	require.NoError(t, tree.DeleteVersionsTo(4))
+	check(0, 0)
+}
+
+func TestMutableTree_PendingChanges(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+
+	cs, err := tree.PendingChanges()
+	require.NoError(t, err)
+	require.Empty(t, cs.Pairs)
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		_, err := tree.Set([]byte(k), []byte("v1"))
+		require.NoError(t, err)
+	}
+	cs, err = tree.PendingChanges()
+	require.NoError(t, err)
+	require.Len(t, cs.Pairs, 5)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	cs, err = tree.PendingChanges()
+	require.NoError(t, err)
+	require.Empty(t, cs.Pairs)
+
+	ops := []struct {
+		key, value string // empty value removes the key
+	}{
+		{"x", "v2"}, // set a new key, then remove it
+		{"c", "v2"}, // update an existing key
+		{"x", ""},
+		{"a", ""},   // remove an existing key
+		{"b", "v2"}, // update then set back to the saved value
+		{"b", "v1"},
+		{"e", ""}, // remove then set again with a new value
+		{"e", "v3"},
+		{"f", "v2"}, // new key
+	}
+	for _, op := range ops {
+		if op.value == "" {
+			_, _, err = tree.Remove([]byte(op.key))
+		} else {
+			_, err = tree.Set([]byte(op.key), []byte(op.value))
+		}
+		require.NoError(t, err)
+	}
+
+	cs, err = tree.PendingChanges()
+	require.NoError(t, err)
+	require.Equal(t, []*KVPair{
+		{Key: []byte("a"), Delete: true},
+		{Key: []byte("c"), Value: []byte("v2")},
+		{Key: []byte("e"), Value: []byte("v3")},
+		{Key: []byte("f"), Value: []byte("v2")},
+	}, cs.Pairs)
+
+	// Replaying the pending changes on the saved version yields the same contents.
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	replay := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		_, err := replay.Set([]byte(k), []byte("v1"))
+		require.NoError(t, err)
+	}
+	_, _, err = replay.SaveVersion()
+	require.NoError(t, err)
+	_, err = replay.SaveChangeSet(&cs)
+	require.NoError(t, err)
+	require.Equal(t, tree.Size(), replay.Size())
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		replayed, err := replay.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, value, replayed)
+		return false
+	})
+	require.NoError(t, err)
+}
+
+func TestLoadTreesParallel(t *testing.T) {
+	db := dbm.NewMemDB()
+	prefixes := [][]byte{[]byte("s/k:acc/"), []byte("s/k:bank/"), []byte("s/k:gov/"), []byte("s/k:staking/"), []byte("s/k:empty/")}
+	for i, prefix := range prefixes[:len(prefixes)-1] {
+		tree := NewMutableTree(dbm.NewPrefixDB(db, prefix), 0, false, NewNopLogger())
+		for v := 0; v <= i; v++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", v)), []byte(fmt.Sprintf("value-%d", v)))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+
+	trees, err := LoadTreesParallel(db, prefixes, Options{LoadParallelism: 2, LoadCacheSize: 100})
+	require.NoError(t, err)
+	require.Len(t, trees, len(prefixes))
+	for _, prefix := range prefixes {
+		sequential := NewMutableTree(dbm.NewPrefixDB(db, prefix), 0, false, NewNopLogger())
+		version, err := sequential.Load()
+		require.NoError(t, err)
+
+		tree := trees[string(prefix)]
+		require.NotNil(t, tree)
+		require.Equal(t, version, tree.Version())
+		require.Equal(t, sequential.Hash(), tree.Hash())
+		require.False(t, tree.skipFastStorageUpgrade)
+		require.Equal(t, DefaultOptions().FlushThreshold, tree.ndb.opts.FlushThreshold)
+	}
+	// the nodes read from the tree are cached
+	staking := trees["s/k:staking/"]
+	itr := NewIterator(nil, nil, true, staking.ImmutableTree)
+	keys := 0
+	for ; itr.Valid(); itr.Next() {
+		keys++
+	}
+	require.NoError(t, itr.Close())
+	require.EqualValues(t, staking.Size(), keys)
+	require.Equal(t, int(2*staking.Size()-1), staking.ndb.nodeCache.Len())
+
+	// the trees skip the fast storage upgrade and cache nothing if asked to
+	trees, err = LoadTreesParallel(db, prefixes, Options{LoadSkipFastStorageUpgrade: true})
+	require.NoError(t, err)
+	staking = trees["s/k:staking/"]
+	require.True(t, staking.skipFastStorageUpgrade)
+	value, err := staking.Get([]byte("key-3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-3"), value)
+	require.Zero(t, staking.ndb.nodeCache.Len())
+
+	// Loading fails if any tree fails to load, and the loaded trees are closed.
+	goroutines := runtime.NumGoroutine()
+	_, err = LoadTreesParallel(db, prefixes, Options{InitialVersion: 10, AsyncPruning: true})
+	require.Error(t, err)
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), goroutines)
+
+	// the options which cannot be shared by the trees are rejected
+	_, err = LoadTreesParallel(db, prefixes, Options{WAL: &bytes.Buffer{}})
+	require.Error(t, err)
+	_, err = LoadTreesParallel(db, prefixes, Options{CloseDB: true})
+	require.Error(t, err)
+}
+
+// failingBatchDB is a MemDB whose batches fail to write while fail is set, and which counts the
+// written batches.
+type failingBatchDB struct {
+	*dbm.MemDB
+	fail   bool
+	writes int
+}
+
+func (db *failingBatchDB) NewBatch() corestore.Batch {
+	return &failingBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+func (db *failingBatchDB) NewBatchWithSize(size int) corestore.Batch {
+	return &failingBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type failingBatch struct {
+	corestore.Batch
+	db *failingBatchDB
+}
+
+func (b *failingBatch) Write() error {
+	if b.db.fail {
+		return errors.New("batch write failed")
+	}
+	b.db.writes++
+	return b.Batch.Write()
+}
+
+func (b *failingBatch) WriteSync() error {
+	return b.Write()
+}
+
+func TestMutableTree_FastNodeDB(t *testing.T) {
+	db := dbm.NewMemDB()
+	fastDB := &failingBatchDB{MemDB: dbm.NewMemDB()}
+
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), FastNodeDBOption(fastDB))
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key-%d", i)), []byte(fmt.Sprintf("value-%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// The fast index and the storage version only live in the fast node db.
+	countPrefix := func(db corestore.KVStoreWithBatch, prefix byte) int {
+		itr, err := db.Iterator([]byte{prefix}, []byte{prefix + 1})
+		require.NoError(t, err)
+		defer itr.Close()
+		count := 0
+		for ; itr.Valid(); itr.Next() {
+			count++
+		}
+		return count
+	}
+	require.Zero(t, countPrefix(db, 'f'))
+	require.Zero(t, countPrefix(db, 'm'))
+	require.Equal(t, 10, countPrefix(fastDB, 'f'))
+	require.Equal(t, 1, countPrefix(fastDB, 'm'))
+
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	value, err := tree.Get([]byte("key-3"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-3"), value)
+
+	// A failed fast node db commit rolls back the whole SaveVersion.
+	hash := tree.Hash()
+	fastDB.fail = true
+	_, err = tree.Set([]byte("key-3"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("key-4"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	tree.Rollback()
+	fastDB.fail = false
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), FastNodeDBOption(fastDB))
+	loadedVersion, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, version, loadedVersion)
+	require.Equal(t, hash, reloaded.Hash())
+	isUpgradeable, err := reloaded.IsUpgradeable()
+	require.NoError(t, err)
+	require.False(t, isUpgradeable)
+	for _, key := range []string{"key-3", "key-4"} {
+		fastNode, err := reloaded.ndb.GetFastNode([]byte(key))
+		require.NoError(t, err)
+		require.NotNil(t, fastNode)
+		require.Equal(t, version, fastNode.GetVersionLastUpdatedAt())
+	}
+
+	// An out of sync fast node db is rebuilt on load.
+	emptyFastDB := dbm.NewMemDB()
+	rebuilt := NewMutableTree(db, 0, false, NewNopLogger(), FastNodeDBOption(emptyFastDB))
+	_, err = rebuilt.Load()
+	require.NoError(t, err)
+	require.Equal(t, 10, countPrefix(emptyFastDB, 'f'))
+	value, err = rebuilt.Get([]byte("key-4"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-4"), value)
+}
+
+func TestMutableTree_FastNodeDBMainBatchFails(t *testing.T) {
+	db := &failingBatchDB{MemDB: dbm.NewMemDB()}
+	fastDB := dbm.NewMemDB()
+
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), FastNodeDBOption(fastDB))
+	_, err := tree.Set([]byte("key"), []byte("value-1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("gone"), []byte("x"))
+	require.NoError(t, err)
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the fast node db is written ahead of the tree when the tree batch fails
+	db.fail = true
+	_, err = tree.Set([]byte("key"), []byte("value-2"))
+	require.NoError(t, err)
+	_, _, err = tree.Remove([]byte("gone"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("other"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	tree.Rollback()
+	db.fail = false
+	require.Equal(t, version, tree.Version())
+
+	// the running tree reads around it, including the keys removed by the failed version
+	value, err := tree.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-1"), value)
+	value, err = tree.Get([]byte("gone"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("x"), value)
+	_, value, err = tree.GetWithIndex([]byte("gone"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("x"), value)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	value, err = itree.Get([]byte("gone"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("x"), value)
+	value, err = tree.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	itr, err := tree.Iterator(nil, nil, true)
+	require.NoError(t, err)
+	var keys []string
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, []string{"gone", "key"}, keys)
+
+	// and it is rebuilt on load
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger(), FastNodeDBOption(fastDB))
+	loadedVersion, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, version, loadedVersion)
+	require.Equal(t, hash, reloaded.Hash())
+	isUpgradeable, err := reloaded.IsUpgradeable()
+	require.NoError(t, err)
+	require.False(t, isUpgradeable)
+	fastNode, err := reloaded.ndb.GetFastNode([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value-1"), fastNode.GetValue())
+	require.Equal(t, version, fastNode.GetVersionLastUpdatedAt())
+	fastNode, err = reloaded.ndb.GetFastNode([]byte("other"))
+	require.NoError(t, err)
+	require.Nil(t, fastNode)
+}
+
+func TestMutableTree_QueryVersion(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.QueryVersion(0)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	for i := 1; i <= 5; i++ {
+		_, err := tree.Set([]byte("key"), []byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	// unsaved changes are not visible
+	_, err = tree.Set([]byte("key"), []byte("working"))
+	require.NoError(t, err)
+
+	latest, err := tree.QueryVersion(0)
+	require.NoError(t, err)
+	require.EqualValues(t, 5, latest.Version())
+	value, err := latest.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("5"), value)
+
+	historical, err := tree.QueryVersion(3)
+	require.NoError(t, err)
+	require.EqualValues(t, 3, historical.Version())
+	value, err = historical.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), value)
+
+	_, err = tree.QueryVersion(2)
+	require.ErrorIs(t, err, ErrVersionPruned)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	_, err = tree.QueryVersion(6)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.NotErrorIs(t, err, ErrVersionPruned)
+
+	_, err = tree.QueryVersion(-1)
+	require.Error(t, err)
+}
+
+func TestMutableTree_KeepRecentVersions(t *testing.T) {
+	for _, keepRecent := range []int64{1, 3} {
+		t.Run(fmt.Sprintf("keep %d", keepRecent), func(t *testing.T) {
+			db := dbm.NewMemDB()
+			tree := NewMutableTree(db, 0, false, NewNopLogger(), KeepRecentVersionsOption(keepRecent))
+			for v := int64(1); v <= 20; v++ {
+				for i := 0; i < 10; i++ {
+					_, err := tree.Set([]byte(fmt.Sprintf("key-%d", (int(v)*7+i)%30)), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+					require.NoError(t, err)
+				}
+				_, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+
+				// fewer than N versions are never pruned
+				expected := make([]int, 0, keepRecent)
+				for retained := maxInt64(1, v-keepRecent+1); retained <= v; retained++ {
+					expected = append(expected, int(retained))
+				}
+				require.Equal(t, expected, tree.AvailableVersions())
+			}
+
+			for _, version := range tree.AvailableVersions() {
+				itree, err := tree.GetImmutable(int64(version))
+				require.NoError(t, err)
+				key := []byte("key-0")
+				value, err := itree.Get(key)
+				require.NoError(t, err)
+				proof, err := itree.GetMembershipProof(key)
+				require.NoError(t, err)
+				ok, err := itree.VerifyMembership(proof, key)
+				require.NoError(t, err)
+				require.True(t, ok)
+				require.NotNil(t, value)
+			}
+
+			// the pruned nodes are removed from the db
+			reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+			_, err := reloaded.Load()
+			require.NoError(t, err)
+			nodes, err := reloaded.ndb.nodes()
+			require.NoError(t, err)
+			reachable := make(map[string]bool)
+			for _, version := range reloaded.AvailableVersions() {
+				itree, err := reloaded.GetImmutable(int64(version))
+				require.NoError(t, err)
+				itree.root.traverse(itree, true, func(node *Node) bool {
+					reachable[string(node.GetKey())] = true
+					return false
+				})
+			}
+			require.Equal(t, len(reachable), len(nodes))
+		})
+	}
+
+	// zero keeps all versions
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), KeepRecentVersionsOption(0))
+	for v := 1; v <= 5; v++ {
+		_, err := tree.Set([]byte("key"), []byte(strconv.Itoa(v)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Equal(t, []int{1, 2, 3, 4, 5}, tree.AvailableVersions())
+}
+
+func TestMutableTree_KeepRecentVersionsSingleBatch(t *testing.T) {
+	db := &failingBatchDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), KeepRecentVersionsOption(1))
+	for v := 1; v <= 4; v++ {
+		if v != 3 { // version 3 references the root of version 2
+			_, err := tree.Set([]byte(fmt.Sprintf("key-%d", v)), []byte(strconv.Itoa(v)))
+			require.NoError(t, err)
+		}
+		writes := db.writes
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		// the version and the pruning of the previous one are written at once
+		require.Equal(t, writes+1, db.writes)
+		require.Equal(t, []int{v}, tree.AvailableVersions())
+	}
+
+	// a failed save leaves the previous version in place
+	db.fail = true
+	_, err := tree.Set([]byte("key-5"), []byte("5"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	db.fail = false
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 4, version)
+	require.Equal(t, []int{4}, reloaded.AvailableVersions())
+	for v := 1; v <= 4; v++ {
+		value, err := reloaded.Get([]byte(fmt.Sprintf("key-%d", v)))
+		require.NoError(t, err)
+		if v == 3 {
+			require.Nil(t, value)
+		} else {
+			require.Equal(t, []byte(strconv.Itoa(v)), value)
+		}
+	}
+}
+
+func TestMutableTree_Defragment(t *testing.T) {
+	for _, target := range []int64{10, 6} {
+		t.Run(fmt.Sprintf("version %d", target), func(t *testing.T) {
+			db := dbm.NewMemDB()
+			tree := NewMutableTree(db, 0, false, NewNopLogger())
+			r := rand.New(rand.NewSource(int64(target)))
+			hashes := make(map[int64][]byte)
+			expected := make(map[int64]map[string]string)
+			for v := int64(1); v <= 10; v++ {
+				for i := 0; i < 50; i++ {
+					key := fmt.Sprintf("key-%03d", r.Intn(200))
+					if r.Intn(4) == 0 {
+						_, _, err := tree.Remove([]byte(key))
+						require.NoError(t, err)
+					} else {
+						_, err := tree.Set([]byte(key), []byte(fmt.Sprintf("value-%d-%d", v, i)))
+						require.NoError(t, err)
+					}
+				}
+				hash, _, err := tree.SaveVersion()
+				require.NoError(t, err)
+				hashes[v] = hash
+				expected[v] = make(map[string]string)
+				_, err = tree.Iterate(func(key, value []byte) bool {
+					expected[v][string(key)] = string(value)
+					return false
+				})
+				require.NoError(t, err)
+			}
+			nodesBefore, err := tree.ndb.nodes()
+			require.NoError(t, err)
+
+			require.NoError(t, tree.Defragment(target))
+			require.Equal(t, hashes[10], tree.Hash())
+			require.Equal(t, int64(10), tree.Version())
+			var versions []int
+			for v := int(target); v <= 10; v++ {
+				versions = append(versions, v)
+			}
+			require.Equal(t, versions, tree.AvailableVersions())
+
+			// the nodes of the earlier versions are deleted, and those of the target version
+			// are numbered consecutively
+			nodes, err := tree.ndb.nodes()
+			require.NoError(t, err)
+			require.Less(t, len(nodes), len(nodesBefore))
+			itree, err := tree.GetImmutable(target)
+			require.NoError(t, err)
+			if target == 10 {
+				require.Equal(t, itree.nodeSize(), len(nodes))
+			}
+			nonces := make(map[int64][]uint32)
+			for _, node := range nodes {
+				if node.nodeKey.version < target {
+					nonces[node.nodeKey.version] = append(nonces[node.nodeKey.version], node.nodeKey.nonce)
+				}
+			}
+			for version, ns := range nonces {
+				sort.Slice(ns, func(i, j int) bool { return ns[i] < ns[j] })
+				for i, nonce := range ns {
+					require.Equal(t, uint32(i+2), nonce, "version %d", version)
+				}
+			}
+
+			reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+			version, err := reloaded.Load()
+			require.NoError(t, err)
+			require.Equal(t, int64(10), version)
+			for v := target; v <= 10; v++ {
+				itree, err := reloaded.GetImmutable(v)
+				require.NoError(t, err)
+				require.Equal(t, hashes[v], itree.Hash(), "version %d", v)
+				require.EqualValues(t, len(expected[v]), itree.Size())
+				for key, value := range expected[v] {
+					actual, err := itree.Get([]byte(key))
+					require.NoError(t, err)
+					require.Equal(t, value, string(actual))
+				}
+			}
+
+			// the tree keeps working after defragmenting
+			_, err = tree.Set([]byte("new"), []byte("value"))
+			require.NoError(t, err)
+			_, version, err = tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, int64(11), version)
+			require.NoError(t, tree.DeleteVersionsTo(10))
+		})
+	}
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key"), []byte("unsaved"))
+	require.NoError(t, err)
+	require.Error(t, tree.Defragment(1))
+
+	// a failed rewrite leaves the store unchanged, and a version without changes keeps the root
+	// of the version before it
+	db := &failingBatchDB{MemDB: dbm.NewMemDB()}
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	for version := 1; version <= 4; version++ {
+		if version != 3 {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%d", version)), []byte("value"))
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersionWithMeta([]byte{byte(version)})
+		require.NoError(t, err)
+	}
+	hash := tree.Hash()
+	require.Error(t, tree.Defragment(5))
+	db.fail = true
+	require.Error(t, tree.Defragment(3))
+	db.fail = false
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(4), version)
+	require.Equal(t, hash, reloaded.Hash())
+	require.Equal(t, []int{1, 2, 3, 4}, reloaded.AvailableVersions())
+
+	itree, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	hash3 := itree.Hash()
+	require.NoError(t, tree.Defragment(3))
+	require.Equal(t, []int{3, 4}, tree.AvailableVersions())
+	require.Equal(t, hash, tree.Hash())
+	itree, err = tree.GetImmutable(3)
+	require.NoError(t, err)
+	require.Equal(t, hash3, itree.Hash())
+	value, err := itree.Get([]byte("key1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	for version := int64(3); version <= 4; version++ {
+		meta, err := tree.VersionMeta(version)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(version)}, meta)
+	}
+	// defragmenting again is a no-op
+	require.NoError(t, tree.Defragment(3))
+	require.Equal(t, hash, tree.Hash())
+}
+
+// corruptingDB is a MemDB returning corrupt for the reads of key.
+type corruptingDB struct {
+	*dbm.MemDB
+	key     []byte
+	corrupt []byte
+}
+
+func (db *corruptingDB) Get(key []byte) ([]byte, error) {
+	if db.corrupt != nil && bytes.Equal(key, db.key) {
+		return db.corrupt, nil
+	}
+	return db.MemDB.Get(key)
+}
+
+func TestMutableTree_ShadowVerify(t *testing.T) {
+	type mismatch struct{ key, expected, actual string }
+	var mismatches []mismatch
+	onMismatch := OnShadowMismatchOption(func(key, expected, actual []byte) {
+		mismatches = append(mismatches, mismatch{string(key), string(expected), string(actual)})
+	})
+
+	db := &corruptingDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), ShadowVerifyOption(0), onMismatch)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, _, err = tree.Remove([]byte("key1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("key2"), []byte("changed"))
+	require.NoError(t, err)
+	tree.Rollback()
+	_, err = tree.Set([]byte("key3"), []byte("changed"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+	}
+	require.Empty(t, mismatches)
+
+	// break the fast node of key5 and read it from a freshly loaded tree
+	var buf bytes.Buffer
+	require.NoError(t, fastnode.NewNode([]byte("key5"), []byte("corrupt"), 1).WriteBytes(&buf))
+	db.key = fastKeyFormat.KeyBytes([]byte("key5"))
+	db.corrupt = buf.Bytes()
+
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), ShadowVerifyOption(0), onMismatch)
+	_, err = tree.Load()
+	require.NoError(t, err)
+	value, err := tree.Get([]byte("key5"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("corrupt"), value)
+	require.Equal(t, []mismatch{{"key5", "value5", "corrupt"}}, mismatches)
+}
+
+func TestMutableTree_FastIndexCheck(t *testing.T) {
+	type mismatch struct{ key, fastValue, value string }
+	var mismatches []mismatch
+	check := func(rate float64) Option {
+		return FastIndexCheckOption(rate, func(key, fastValue, value []byte) {
+			mismatches = append(mismatches, mismatch{string(key), string(fastValue), string(value)})
+		})
+	}
+
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), check(1))
+	for i := 0; i < 10; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := tree.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+	}
+	require.Empty(t, mismatches)
+
+	// break the fast node of key5 and drop the one of key7
+	var buf bytes.Buffer
+	require.NoError(t, fastnode.NewNode([]byte("key5"), []byte("corrupt"), 1).WriteBytes(&buf))
+	require.NoError(t, db.Set(fastKeyFormat.KeyBytes([]byte("key5")), buf.Bytes()))
+	require.NoError(t, db.Delete(fastKeyFormat.KeyBytes([]byte("key7"))))
+
+	read := func(t *testing.T, opt Option) (string, string) {
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), opt)
+		_, err := tree.Load()
+		require.NoError(t, err)
+		corrupt, err := tree.Get([]byte("key5"))
+		require.NoError(t, err)
+		missing, err := tree.Get([]byte("key7"))
+		require.NoError(t, err)
+		return string(corrupt), string(missing)
+	}
+	corrupt, missing := read(t, check(0))
+	require.Equal(t, "corrupt", corrupt)
+	require.Empty(t, missing)
+	require.Empty(t, mismatches)
+
+	// the values of the tree are returned on mismatch
+	corrupt, missing = read(t, check(1))
+	require.Equal(t, "value5", corrupt)
+	require.Equal(t, "value7", missing)
+	require.Equal(t, []mismatch{{"key5", "corrupt", "value5"}, {"key7", "", "value7"}}, mismatches)
+}
+
+func TestMutableTree_NoHash(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), NoHashOption(true))
+	for v := 0; v < 5; v++ {
+		for i := 0; i < 50; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key%03d", v)))
+		require.NoError(t, err)
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.Nil(t, hash)
+	}
+	require.NoError(t, tree.DeleteVersionsTo(3))
+
+	_, err := tree.RootHashes(4, 5)
+	require.ErrorIs(t, err, ErrHashingDisabled)
+	_, err = tree.GetVersionedProof([]byte("key010"), 5)
+	require.ErrorIs(t, err, ErrHashingDisabled)
+
+	// reload to read the nodes written without hashes
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), NoHashOption(true))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Nil(t, tree.Hash())
+	require.Nil(t, tree.WorkingHash())
+
+	// the orphans are found without hashes
+	nodes, err := tree.ndb.nodes()
+	require.NoError(t, err)
+	reachable := make(map[string]bool)
+	for _, version := range []int64{4, 5} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		itree.root.traverse(itree, true, func(node *Node) bool {
+			reachable[string(node.GetKey())] = true
+			return false
+		})
+	}
+	require.Equal(t, len(reachable), len(nodes))
+
+	for _, version := range []int64{4, 5} {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Nil(t, itree.Hash())
+		_, err = itree.GetMembershipProof([]byte("key010"))
+		require.ErrorIs(t, err, ErrHashingDisabled)
+		_, err = itree.GetNonMembershipProof([]byte("key000"))
+		require.ErrorIs(t, err, ErrHashingDisabled)
+
+		// version v sets all keys and removes key v-1
+		var keys []string
+		_, err = itree.Iterate(func(key, value []byte) bool {
+			i := len(keys)
+			if i >= int(version-1) {
+				i++
+			}
+			require.Equal(t, fmt.Sprintf("key%03d", i), string(key))
+			require.Equal(t, fmt.Sprintf("value%d-%d", version-1, i), string(value))
+			keys = append(keys, string(key))
+			return false
+		})
+		require.NoError(t, err)
+		require.Len(t, keys, 49)
+	}
+	value, err := tree.Get([]byte("key049"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value4-49"), value)
+}
+
+func TestMutableTree_PruneDanglingVersions(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// version 2 is unchanged and references the root of version 1
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("b"), []byte("2"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	// only the root node of version 1 is lost, the leaves are still used by version 3
+	require.NoError(t, db.Delete(nodeKeyFormat.Key(GetRootKey(1))))
+
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = tree.LoadVersion(2)
+	require.ErrorIs(t, err, ErrVersionRootMissing)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	dangling, err := tree.PruneDanglingVersions()
+	require.NoError(t, err)
+	require.Equal(t, []int64{2}, dangling)
+	dangling, err = tree.PruneDanglingVersions()
+	require.NoError(t, err)
+	require.Empty(t, dangling)
+
+	_, err = tree.LoadVersion(2)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.NotErrorIs(t, err, ErrVersionRootMissing)
+	latest, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 3, latest)
+	itr := NewIterator(nil, nil, true, tree.ImmutableTree)
+	defer itr.Close()
+	var pairs []string
+	for ; itr.Valid(); itr.Next() {
+		pairs = append(pairs, string(itr.Key())+"="+string(itr.Value()))
+	}
+	require.NoError(t, itr.Error())
+	require.Equal(t, []string{"a=1", "b=2"}, pairs)
+}
+
+func TestMutableTree_SetBatch_GetRangePage(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	pairs, next, err := tree.GetRangePage(nil, nil, 10)
+	require.NoError(t, err)
+	require.Empty(t, pairs)
+	require.Nil(t, next)
+
+	require.NoError(t, tree.SetBatch(nil))
+	kvs := make(map[string][]byte)
+	for i := 0; i < 25; i++ {
+		kvs[fmt.Sprintf("key%02d", i)] = []byte{byte(i)}
+	}
+	require.NoError(t, tree.SetBatch(KVPairsFromMap(kvs)))
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// unsaved changes are paged as well
+	require.NoError(t, tree.SetBatch([]*KVPair{NewDeleteKVPair([]byte("key03")), NewKVPair([]byte("key04"), []byte("new"))}))
+	delete(kvs, "key03")
+	kvs["key04"] = []byte("new")
+
+	var all []*KVPair
+	var start []byte
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		pairs, next, err := tree.GetRangePage(start, nil, 10)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(pairs), 10)
+		all = append(all, pairs...)
+		if next == nil {
+			break
+		}
+		start = next
+	}
+	require.Equal(t, KVPairsFromMap(kvs), all)
+
+	pairs, next, err = tree.GetRangePage([]byte("key10"), []byte("key13"), 0)
+	require.NoError(t, err)
+	require.Nil(t, next)
+	require.Equal(t, []*KVPair{NewKVPair([]byte("key10"), []byte{10}), NewKVPair([]byte("key11"), []byte{11}), NewKVPair([]byte("key12"), []byte{12})}, pairs)
+
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	pairs, next, err = itree.GetRangePage([]byte("key03"), nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, []*KVPair{NewKVPair([]byte("key03"), []byte{3}), NewKVPair([]byte("key04"), []byte{4})}, pairs)
+	require.Equal(t, []byte("key05"), next)
+
+	err = tree.SetBatch([]*KVPair{NewKVPair([]byte("x"), []byte{1}), NewKVPair([]byte("y"), nil), nil})
+	require.ErrorContains(t, err, "pair 1")
+	value, err := tree.Get([]byte("x"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+	require.ErrorContains(t, tree.SetBatch([]*KVPair{nil}), "pair 0 is nil")
+}
+
+func TestMutableTree_RecoverFromWAL(t *testing.T) {
+	apply := func(tree *MutableTree, v int) {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%d", (i*7+v)%30)), []byte(fmt.Sprintf("value%d-%d", v, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key%d", v)))
+		require.NoError(t, err)
+	}
+
+	// the hashes of the versions without crash
+	reference := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var hashes [][]byte
+	for v := 1; v <= 3; v++ {
+		apply(reference, v)
+		hash, _, err := reference.SaveVersion()
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+
+	wal, err := os.CreateTemp(t.TempDir(), "wal")
+	require.NoError(t, err)
+	defer wal.Close()
+	db := &failingBatchDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), WALOption(wal))
+	apply(tree, 1)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// crash after writing version 2 to the WAL, before its nodes are committed
+	apply(tree, 2)
+	db.fail = true
+	_, _, err = tree.SaveVersion()
+	require.Error(t, err)
+	// and tear a record of the last write
+	_, err = wal.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	require.NoError(t, err)
+
+	_, err = wal.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	tree = NewMutableTree(db.MemDB, 0, false, NewNopLogger(), WALOption(wal))
+	latest, err := tree.Load()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, latest)
+	recovered, err := tree.RecoverFromWAL()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, recovered)
+	require.Equal(t, hashes[1], tree.Hash())
+
+	apply(tree, 3)
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, hashes[2], hash)
+
+	// the torn record was removed, so the records appended after it are read back
+	_, err = wal.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	tree = NewMutableTree(db.MemDB, 0, false, NewNopLogger(), WALOption(wal))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	recovered, err = tree.RecoverFromWAL()
+	require.NoError(t, err)
+	require.Zero(t, recovered)
+	require.Equal(t, hashes[2], tree.Hash())
+}
+
+// commitFailingWAL is a WAL whose completion records fail to be written.
+type commitFailingWAL struct {
+	bytes.Buffer
+}
+
+func (w *commitFailingWAL) Write(p []byte) (int, error) {
+	if len(p) > walHeaderSize && p[walHeaderSize] == walRecordCommit {
+		return 0, errors.New("WAL write failed")
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestMutableTree_WALCommitRecordFails(t *testing.T) {
+	var reported error
+	wal := &commitFailingWAL{}
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), WALOption(wal), OnBackgroundErrorOption(func(err error) { reported = err }))
+	_, err := tree.Set([]byte("key"), []byte("value"))
+	require.NoError(t, err)
+
+	// the version is saved without the completion record
+	hash, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 1, version)
+	require.Error(t, reported)
+	require.EqualValues(t, 1, tree.Version())
+	_, err = tree.Set([]byte("key"), []byte("value2"))
+	require.NoError(t, err)
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.EqualValues(t, 2, version)
+
+	// and the recovery completes the saved versions
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), WALOption(&wal.Buffer))
+	_, err = tree.LoadVersion(1)
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.Hash())
+	recovered, err := tree.RecoverFromWAL()
+	require.NoError(t, err)
+	require.Zero(t, recovered)
+}
+
+func TestMutableTree_KeyValidator(t *testing.T) {
+	errControlByte := errors.New("control byte")
+	validator := func(key []byte) error {
+		for _, b := range key {
+			if b < 0x20 || b == 0x7f {
+				return errControlByte
+			}
+		}
+		return nil
+	}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), KeyValidatorOption(validator))
+	_, err := tree.Set([]byte("a"), []byte("1"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	hash := tree.WorkingHash()
+
+	_, err = tree.Set([]byte("b\n"), []byte("2"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+	require.ErrorIs(t, err, errControlByte)
+	_, _, err = tree.Remove([]byte{0})
+	require.ErrorIs(t, err, ErrInvalidKey)
+	err = tree.SetBatch([]*KVPair{NewKVPair([]byte("c"), []byte("3")), NewKVPair([]byte{'d', 0x7f}, []byte("4"))})
+	require.ErrorIs(t, err, ErrInvalidKey)
+
+	// only the valid pair of the batch was applied
+	value, err := tree.Get([]byte("b\n"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	_, _, err = tree.Remove([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, hash, tree.WorkingHash())
+
+	_, removed, err := tree.Remove([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, removed)
+}
+
+func TestMutableTree_EmptyValue(t *testing.T) {
+	for _, skipFastStorage := range []bool{false, true} {
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, skipFastStorage, NewNopLogger())
+		_, err := tree.Set([]byte("empty"), []byte{})
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("other"), []byte("value"))
+		require.NoError(t, err)
+		_, err = tree.Set([]byte("nil"), nil)
+		require.Error(t, err)
+
+		requirePresent := func(tree *MutableTree) {
+			value, err := tree.Get([]byte("empty"))
+			require.NoError(t, err)
+			require.NotNil(t, value)
+			require.Empty(t, value)
+			has, err := tree.Has([]byte("empty"))
+			require.NoError(t, err)
+			require.True(t, has)
+			found := false
+			_, err = tree.Iterate(func(key, value []byte) bool {
+				if string(key) == "empty" {
+					found = true
+					require.NotNil(t, value)
+					require.Empty(t, value)
+				}
+				return false
+			})
+			require.NoError(t, err)
+			require.True(t, found)
+		}
+		requirePresent(tree)
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		requirePresent(tree)
+
+		// the empty value is kept on disk, in the nodes and the fast nodes
+		tree = NewMutableTree(db, 0, skipFastStorage, NewNopLogger())
+		_, err = tree.Load()
+		require.NoError(t, err)
+		requirePresent(tree)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		value, err := itree.Get([]byte("empty"))
+		require.NoError(t, err)
+		require.NotNil(t, value)
+		require.Empty(t, value)
+
+		// a membership proof is produced, but ICS23 rejects the empty leaf value of IavlSpec
+		proof, err := itree.GetProof([]byte("empty"))
+		require.NoError(t, err)
+		require.NotNil(t, proof.GetExist())
+		require.Empty(t, proof.GetExist().Value)
+		require.False(t, ics23.VerifyMembership(ics23.IavlSpec, itree.Hash(), proof, []byte("empty"), []byte{}))
+		ok, err := itree.VerifyMembership(proof, []byte("empty"))
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// removing the key makes it absent, with a nil value
+		removed, ok, err := tree.Remove([]byte("empty"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NotNil(t, removed)
+		require.Empty(t, removed)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		value, err = tree.Get([]byte("empty"))
+		require.NoError(t, err)
+		require.Nil(t, value)
+		has, err := tree.Has([]byte("empty"))
+		require.NoError(t, err)
+		require.False(t, has)
+		proof, err = tree.GetProof([]byte("empty"))
+		require.NoError(t, err)
+		require.NotNil(t, proof.GetNonexist())
+		require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, tree.Hash(), proof, []byte("empty")))
+	}
+
+	// with HashLeafValues, the proof carries the hash of the empty value and verifies
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), HashLeafValuesOption(true))
+	_, err := tree.Set([]byte("empty"), []byte{})
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	proof, err := tree.GetMembershipProof([]byte("empty"))
+	require.NoError(t, err)
+	valueHash := sha256.Sum256([]byte{})
+	require.True(t, ics23.VerifyMembership(ValueHashSpec, tree.Hash(), proof, []byte("empty"), valueHash[:]))
+	ok, err := tree.VerifyMembership(proof, []byte("empty"))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestMutableTree_NilValueSemantics(t *testing.T) {
+	for name, semantics := range map[string]NilValueSemantics{
+		"error":       NilValueError,
+		"store empty": NilValueStoreEmpty,
+		"delete":      NilValueDelete,
+	} {
+		t.Run(name, func(t *testing.T) {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), NilValueSemanticsOption(semantics))
+			_, err := tree.Set([]byte("key"), []byte("value"))
+			require.NoError(t, err)
+			_, err = tree.Set([]byte("other"), []byte("value"))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			updated, err := tree.Set([]byte("key"), nil)
+			if semantics == NilValueError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.True(t, updated)
+			}
+			updated, err = tree.Set([]byte("new"), nil)
+			if semantics == NilValueError {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.False(t, updated)
+			}
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+
+			for _, key := range []string{"key", "new"} {
+				value, err := tree.Get([]byte(key))
+				require.NoError(t, err)
+				has, err := tree.Has([]byte(key))
+				require.NoError(t, err)
+				proof, err := tree.GetProof([]byte(key))
+				require.NoError(t, err)
+				switch {
+				case semantics == NilValueStoreEmpty:
+					require.NotNil(t, value)
+					require.Empty(t, value)
+					require.True(t, has)
+					require.NotNil(t, proof.GetExist())
+					require.Empty(t, proof.GetExist().Value)
+				case semantics == NilValueError && key == "key":
+					require.Equal(t, []byte("value"), value)
+					require.True(t, has)
+					require.True(t, ics23.VerifyMembership(ics23.IavlSpec, tree.Hash(), proof, []byte(key), value))
+				default:
+					require.Nil(t, value)
+					require.False(t, has)
+					require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, tree.Hash(), proof, []byte(key)))
+				}
+			}
+		})
+	}
+}
+
+type capturingLogger struct {
+	messages []string
+}
+
+func (l *capturingLogger) Info(msg string, _ ...any)  { l.messages = append(l.messages, "INFO "+msg) }
+func (l *capturingLogger) Warn(msg string, _ ...any)  { l.messages = append(l.messages, "WARN "+msg) }
+func (l *capturingLogger) Error(msg string, _ ...any) { l.messages = append(l.messages, "ERROR "+msg) }
+func (l *capturingLogger) Debug(msg string, _ ...any) { l.messages = append(l.messages, "DEBUG "+msg) }
+
+func TestNewLeveledLogger(t *testing.T) {
+	for _, tc := range []struct {
+		level    Level
+		expected []string
+		dropped  []string
+	}{
+		{LevelDebug, []string{"DEBUG BATCH SAVE", "DEBUG saved version", "INFO pruned versions", "INFO loaded version"}, nil},
+		{LevelInfo, []string{"INFO pruned versions", "INFO loaded version"}, []string{"DEBUG BATCH SAVE", "DEBUG saved version"}},
+		{LevelError, nil, []string{"DEBUG saved version", "INFO pruned versions", "INFO loaded version"}},
+		{LevelNone, nil, []string{"DEBUG saved version", "INFO loaded version"}},
+	} {
+		logger := &capturingLogger{}
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, false, NewLeveledLogger(logger, tc.level))
+		for i := 0; i < 3; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		require.NoError(t, tree.DeleteVersionsTo(1))
+
+		tree = NewMutableTree(db, 0, false, NewLeveledLogger(logger, tc.level))
+		_, err := tree.Load()
+		require.NoError(t, err)
+
+		for _, msg := range tc.expected {
+			require.Contains(t, logger.messages, msg, "level %d", tc.level)
+		}
+		for _, msg := range tc.dropped {
+			require.NotContains(t, logger.messages, msg, "level %d", tc.level)
+		}
+		if tc.level == LevelNone {
+			require.Empty(t, logger.messages)
+		}
+	}
+}
+
+func TestMutableTree_ReplaceAll(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("old-%02d", i)), []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, err := tree.Set([]byte("kept"), []byte("old"))
+	require.NoError(t, err)
+	oldHash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	_, err = tree.Set([]byte("pending"), []byte{1})
+	require.NoError(t, err)
+	require.Error(t, tree.ReplaceAll(ChangeSet{}))
+	tree.Rollback()
+
+	// a failing changeset leaves the tree untouched
+	require.Error(t, tree.ReplaceAll(ChangeSet{Pairs: []*KVPair{{Key: []byte("a"), Value: []byte{1}}, nil}}))
+	require.Equal(t, int64(1), tree.Version())
+	require.Equal(t, oldHash, tree.WorkingHash())
+
+	cs := ChangeSet{Pairs: []*KVPair{
+		{Key: []byte("kept"), Value: []byte("new")},
+		{Key: []byte("new-1"), Value: []byte{1}},
+		{Key: []byte("new-2"), Value: []byte{2}},
+		{Key: []byte("old-00"), Delete: true},
+	}}
+	require.NoError(t, tree.ReplaceAll(cs))
+	require.Equal(t, int64(2), tree.Version())
+
+	// the same contents applied to an empty tree, at the same version
+	expected := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), InitialVersionOption(2))
+	require.NoError(t, expected.SetBatch(cs.Pairs))
+	require.Equal(t, expected.WorkingHash(), tree.Hash())
+
+	// the fast index of the reloaded tree has no old keys
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	var keys []string
+	_, err = tree.Iterate(func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"kept", "new-1", "new-2"}, keys)
+	value, err := tree.Get([]byte("old-10"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	// the history is intact
+	old, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	require.Equal(t, oldHash, old.Hash())
+	value, err = old.Get([]byte("old-10"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{10}, value)
+	value, err = old.Get([]byte("kept"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), value)
+}
+
+type xorTransform byte
+
+func (x xorTransform) Encode(_, value []byte) []byte {
+	stored := make([]byte, len(value))
+	for i, b := range value {
+		stored[i] = b ^ byte(x)
+	}
+	return stored
+}
+
+func (x xorTransform) Decode(key, stored []byte) []byte {
+	return x.Encode(key, stored)
+}
+
+func TestMutableTree_ValueTransform(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), ValueTransformOption(xorTransform(0x5a)))
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, tr := range []*MutableTree{tree, plain} {
+		for v := 0; v < 3; v++ {
+			for i := 0; i < 20; i++ {
+				_, err := tr.Set([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("plaintext-%02d-%d", i, v)))
+				require.NoError(t, err)
+			}
+			_, _, err := tr.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	require.Equal(t, plain.Hash(), tree.Hash())
+
+	// the database only holds the transformed values, of the nodes and the fast nodes
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	for ; itr.Valid(); itr.Next() {
+		require.NotContains(t, string(itr.Value()), "plaintext", "key %X", itr.Key())
+	}
+	require.NoError(t, itr.Close())
+
+	// reads return the original values, from the fast index, the nodes and the proofs
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), ValueTransformOption(xorTransform(0x5a)))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, plain.Hash(), tree.Hash())
+	value, err := tree.Get([]byte("key-07"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("plaintext-07-2"), value)
+
+	old, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	value, err = old.Get([]byte("key-07"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("plaintext-07-0"), value)
+
+	proof, err := tree.GetMembershipProof([]byte("key-07"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("plaintext-07-2"), proof.GetExist().Value)
+	ok, err := tree.VerifyMembership(proof, []byte("key-07"))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestMutableTree_SkipNoOpSets(t *testing.T) {
+	countKeys := func(db dbm.DB) int {
+		itr, err := db.Iterator(nil, nil)
+		require.NoError(t, err)
+		defer itr.Close()
+		count := 0
+		for ; itr.Valid(); itr.Next() {
+			count++
+		}
+		return count
+	}
+
+	for _, skip := range []bool{false, true} {
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), SkipNoOpSetsOption(skip))
+		for i := 0; i < 50; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+			require.NoError(t, err)
+		}
+		_, err := tree.Set([]byte("empty"), []byte{})
+		require.NoError(t, err)
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		keys := countKeys(db)
+
+		for i := 0; i < 50; i++ {
+			updated, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+			require.NoError(t, err)
+			require.True(t, updated)
+		}
+		_, err = tree.Set([]byte("empty"), []byte{})
+		require.NoError(t, err)
+		if !skip {
+			// the leaves are rewritten at the new version
+			require.NotEqual(t, hash, tree.WorkingHash())
+			continue
+		}
+		require.Equal(t, hash, tree.WorkingHash())
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		// only the reference to the unchanged root is written
+		require.Equal(t, keys+1, countKeys(db))
+
+		// other values are still set
+		_, err = tree.Set([]byte{7}, []byte{8})
+		require.NoError(t, err)
+		require.NotEqual(t, hash, tree.WorkingHash())
+		value, err := tree.Get([]byte{7})
+		require.NoError(t, err)
+		require.Equal(t, []byte{8}, value)
+	}
+}
+
+func TestMutableTree_PrunableStats(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for version := 1; version <= 6; version++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key_%d", (version*7+i)%40)), []byte(fmt.Sprintf("val_%d_%d", version, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key_%d", version*3)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	versionNodes := func(version int64) map[string]bool {
+		nodes := make(map[string]bool)
+		rootKey, err := tree.ndb.GetRoot(version)
+		require.NoError(t, err)
+		var walk func(nk []byte)
+		walk = func(nk []byte) {
+			node, err := tree.ndb.GetNode(nk)
+			require.NoError(t, err)
+			nodes[string(node.GetKey())] = true
+			if !node.isLeaf() {
+				walk(node.leftNodeKey)
+				walk(node.rightNodeKey)
+			}
+		}
+		walk(rootKey)
+		return nodes
+	}
+	exclusiveNodes := func(keepRecent int64) int64 {
+		retained := make(map[string]bool)
+		for version := 7 - keepRecent; version <= 6; version++ {
+			for nk := range versionNodes(version) {
+				retained[nk] = true
+			}
+		}
+		deletable := make(map[string]bool)
+		for version := int64(1); version < 7-keepRecent; version++ {
+			for nk := range versionNodes(version) {
+				if !retained[nk] {
+					deletable[nk] = true
+				}
+			}
+		}
+		return int64(len(deletable))
+	}
+
+	// retain the last 3 versions, without pruning on load
+	tree = NewMutableTree(db, 0, false, NewNopLogger(), KeepRecentVersionsOption(3))
+	_, err := tree.Load()
+	require.NoError(t, err)
+	nodes, size, err := tree.PrunableStats()
+	require.NoError(t, err)
+	require.Equal(t, exclusiveNodes(3), nodes)
+	require.Positive(t, size)
+
+	// the pinned version and the following ones are retained too
+	require.NoError(t, tree.PinVersion(2))
+	nodes, _, err = tree.PrunableStats()
+	require.NoError(t, err)
+	require.Equal(t, exclusiveNodes(5), nodes)
+	tree.UnpinVersion(2)
+
+	// retain the latest version, and check the size against the pruned entries
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	nodes, size, err = tree.PrunableStats()
+	require.NoError(t, err)
+	require.Equal(t, exclusiveNodes(1), nodes)
+	require.Greater(t, nodes, exclusiveNodes(3))
+
+	nodeEntriesSize := func() int64 {
+		itr, err := db.Iterator(nodeKeyPrefixFormat.KeyInt64(0), nodeKeyPrefixFormat.KeyInt64(math.MaxInt64))
+		require.NoError(t, err)
+		defer itr.Close()
+		var total int64
+		for ; itr.Valid(); itr.Next() {
+			total += int64(len(itr.Key()) + len(itr.Value()))
+		}
+		return total
+	}
+	before := nodeEntriesSize()
+	require.NoError(t, tree.DeleteVersionsTo(5))
+	require.Equal(t, size, before-nodeEntriesSize())
+	nodes, size, err = tree.PrunableStats()
+	require.NoError(t, err)
+	require.Zero(t, nodes)
+	require.Zero(t, size)
+}
+
+func TestMutableTree_IncrementalExportSize(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for version := 1; version <= 6; version++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key_%d", (version*7+i)%40)), []byte(fmt.Sprintf("val_%d_%d", version, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key_%d", version*3)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// a version without changes writes no nodes
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	nodes, size, err := tree.IncrementalExportSize(7)
+	require.NoError(t, err)
+	require.Zero(t, nodes)
+	require.Zero(t, size)
+
+	// the first version is exported in full
+	itree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	exporter, err := itree.Export()
+	require.NoError(t, err)
+	var exported int64
+	for {
+		_, err := exporter.Next()
+		if errors.Is(err, ErrorExportDone) {
+			break
+		}
+		require.NoError(t, err)
+		exported++
+	}
+	exporter.Close()
+	nodes, _, err = tree.IncrementalExportSize(1)
+	require.NoError(t, err)
+	require.Equal(t, exported, nodes)
+
+	// without pruning, the versions add up to all the stored nodes
+	var totalNodes, totalSize int64
+	for version := int64(1); version <= 7; version++ {
+		nodes, size, err := tree.IncrementalExportSize(version)
+		require.NoError(t, err)
+		totalNodes += nodes
+		totalSize += size
+	}
+	var storedNodes, storedSize int64
+	err = tree.ndb.traversePrefix(nodeKeyFormat.Prefix(), func(k, v []byte) error {
+		if isRef, _ := isReferenceRoot(v); !isRef {
+			storedNodes++
+			storedSize += int64(len(k) + len(v))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, storedNodes, totalNodes)
+	require.Equal(t, storedSize, totalSize)
+
+	_, _, err = tree.IncrementalExportSize(8)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_PrepareCommit(t *testing.T) {
+	db := dbm.NewMemDB()
+	// a small threshold, so that the staged nodes would be flushed to disk
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), FlushThresholdOption(1000))
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%03d", i)), []byte(fmt.Sprintf("val_%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	hasNodes := func(t *testing.T, version int64) bool {
+		itr, err := db.Iterator(nodeKeyPrefixFormat.KeyInt64(version), nodeKeyPrefixFormat.KeyInt64(version+1))
+		require.NoError(t, err)
+		defer itr.Close()
+		return itr.Valid()
+	}
+	setAll := func(t *testing.T, val string) {
+		for i := 0; i < 100; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key_%03d", i)), []byte(val))
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		setAll(t, "committed")
+		expected := tree.WorkingHash()
+		handle, err := tree.PrepareCommit()
+		require.NoError(t, err)
+		require.EqualValues(t, 2, handle.Version())
+		require.False(t, tree.VersionExists(2))
+		require.False(t, hasNodes(t, 2))
+
+		hash, version, err := handle.Commit()
+		require.NoError(t, err)
+		require.EqualValues(t, 2, version)
+		require.Equal(t, expected, hash)
+		require.True(t, tree.VersionExists(2))
+		require.True(t, hasNodes(t, 2))
+		_, _, err = handle.Commit()
+		require.Error(t, err)
+		require.Error(t, handle.Abort())
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		setAll(t, "aborted")
+		handle, err := tree.PrepareCommit()
+		require.NoError(t, err)
+		require.NoError(t, handle.Abort())
+		require.False(t, tree.VersionExists(3))
+		require.False(t, hasNodes(t, 3))
+		value, err := tree.Get([]byte("key_000"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("committed"), value)
+
+		// the version is saved again without the aborted nodes
+		setAll(t, "saved")
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.EqualValues(t, 3, version)
+		reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+		_, err = reloaded.Load()
+		require.NoError(t, err)
+		require.Equal(t, tree.Hash(), reloaded.Hash())
+		value, err = reloaded.Get([]byte("key_050"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("saved"), value)
+		immutable, err := reloaded.GetImmutable(3)
+		require.NoError(t, err)
+		value, err = immutable.Get([]byte("key_050"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("saved"), value)
+	})
+
+	t.Run("pending", func(t *testing.T) {
+		setAll(t, "pending")
+		handle, err := tree.PrepareCommit()
+		require.NoError(t, err)
+		_, err = tree.PrepareCommit()
+		require.ErrorIs(t, err, ErrCommitPrepared)
+		_, err = tree.Set([]byte("key_000"), []byte("other"))
+		require.ErrorIs(t, err, ErrCommitPrepared)
+		_, _, err = tree.SaveVersion()
+		require.ErrorIs(t, err, ErrCommitPrepared)
+
+		_, _, err = handle.Commit()
+		require.NoError(t, err)
+		handle, err = tree.PrepareCommit()
+		require.NoError(t, err)
+		require.EqualValues(t, 5, handle.Version())
+		require.NoError(t, handle.Abort())
+	})
+}
+
+func TestMutableTree_PrepareCommitRejectsBatchCommits(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for version := 1; version <= 3; version++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%d", version)), []byte("value"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	_, err := tree.Set([]byte("key4"), []byte("value"))
+	require.NoError(t, err)
+	handle, err := tree.PrepareCommit()
+	require.NoError(t, err)
+
+	for name, fn := range map[string]func() error{
+		"DeleteVersionsTo":          func() error { return tree.DeleteVersionsTo(1) },
+		"DeleteVersionsFrom":        func() error { return tree.DeleteVersionsFrom(3) },
+		"PruneWithPolicy":           func() error { return tree.PruneWithPolicy(func(int64) bool { return false }) },
+		"CollapseHistory":           func() error { return tree.CollapseHistory(nil) },
+		"LoadVersionForOverwriting": func() error { return tree.LoadVersionForOverwriting(2) },
+		"MigrateFastStorage":        func() error { return tree.MigrateFastStorage(context.Background(), nil) },
+		"RebuildFastIndex":          tree.RebuildFastIndex,
+		"Defragment":                func() error { return tree.Defragment(3) },
+		"MigrateLegacyFormat":       tree.MigrateLegacyFormat,
+		"LoadVersion": func() error {
+			_, err := tree.LoadVersion(3)
+			return err
+		},
+		"PruneDanglingVersions": func() error {
+			_, err := tree.PruneDanglingVersions()
+			return err
+		},
+		"ndb.Commit": tree.ndb.Commit,
+	} {
+		require.ErrorIs(t, fn(), ErrCommitPrepared, name)
+	}
+
+	// the prepared version is not visible to another reader, before and after the abort
+	reader := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reader.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	require.NoError(t, handle.Abort())
+	reader = NewMutableTree(db, 0, false, NewNopLogger())
+	version, err = reader.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), version)
+	require.Equal(t, []int{1, 2, 3}, reader.AvailableVersions())
+
+	// the tree commits again once the handle is resolved
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	require.Equal(t, []int{2, 3}, tree.AvailableVersions())
+}
+
+func TestMutableTree_TrimCaches(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 10000, false, NewNopLogger())
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%04d", i)), []byte(fmt.Sprintf("val_%d", i)))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// fill the caches
+	tree = NewMutableTree(db, 10000, false, NewNopLogger())
+	_, err = tree.Load()
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		_, err := tree.Get([]byte(fmt.Sprintf("key_%04d", i)))
+		require.NoError(t, err)
+		_, _, err = tree.GetWithIndex([]byte(fmt.Sprintf("key_%04d", i)))
+		require.NoError(t, err)
+	}
+	full := tree.TrimCaches(math.MaxInt64)
+	require.Positive(t, full)
+	nodes, fastNodes := tree.ndb.nodeCache.Len(), tree.ndb.fastNodeCache.Len()
+	require.Positive(t, nodes)
+	require.Positive(t, fastNodes)
+
+	remaining := tree.TrimCaches(full / 10)
+	require.LessOrEqual(t, remaining, full/10)
+	require.Less(t, tree.ndb.nodeCache.Len(), nodes)
+	require.Less(t, tree.ndb.fastNodeCache.Len(), fastNodes)
+	require.Zero(t, tree.TrimCaches(0))
+	require.Zero(t, tree.ndb.nodeCache.Len())
+	require.Zero(t, tree.ndb.fastNodeCache.Len())
+
+	// the evicted nodes are read from the database
+	for i := 0; i < 1000; i++ {
+		value, err := tree.Get([]byte(fmt.Sprintf("key_%04d", i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("val_%d", i)), value)
+		index, value, err := tree.GetWithIndex([]byte(fmt.Sprintf("key_%04d", i)))
+		require.NoError(t, err)
+		require.EqualValues(t, i, index)
+		require.Equal(t, []byte(fmt.Sprintf("val_%d", i)), value)
+	}
+}
+
+func TestMutableTree_LoadVersionInfo(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for version := 1; version <= 3; version++ {
+		for i := 0; i < 10*version; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key_%d", i)), []byte(fmt.Sprintf("val_%d_%d", version, i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	for _, target := range []int64{0, 1, 2, 3} {
+		loaded := NewMutableTree(db, 0, false, NewNopLogger())
+		version, rootHash, size, err := loaded.LoadVersionInfo(target)
+		require.NoError(t, err)
+		if target == 0 {
+			require.EqualValues(t, 3, version)
+		} else {
+			require.Equal(t, target, version)
+		}
+		immutable, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, immutable.Hash(), rootHash)
+		require.Equal(t, immutable.Size(), size)
+		require.EqualValues(t, 10*version, size)
+	}
+
+	_, rootHash, _, err := NewMutableTree(db, 0, false, NewNopLogger()).LoadVersionInfo(4)
+	require.Error(t, err)
+	require.Nil(t, rootHash)
+}
+
+func TestMutableTree_Move(t *testing.T) {
+	newTree := func() *MutableTree {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key_%02d", i)), []byte(fmt.Sprintf("val_%d", i)))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		return tree
+	}
+
+	for _, tc := range []struct {
+		name           string
+		oldKey, newKey string
+	}{
+		{"new key", "key_03", "key_50"},
+		{"existing key", "key_03", "key_11"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tree, expected := newTree(), newTree()
+			moved, err := tree.Move([]byte(tc.oldKey), []byte(tc.newKey))
+			require.NoError(t, err)
+			require.True(t, moved)
+
+			value, _, err := expected.Remove([]byte(tc.oldKey))
+			require.NoError(t, err)
+			_, err = expected.Set([]byte(tc.newKey), value)
+			require.NoError(t, err)
+			require.Equal(t, expected.WorkingHash(), tree.WorkingHash())
+
+			has, err := tree.Has([]byte(tc.oldKey))
+			require.NoError(t, err)
+			require.False(t, has)
+			got, err := tree.Get([]byte(tc.newKey))
+			require.NoError(t, err)
+			require.Equal(t, []byte("val_3"), got)
+
+			hash, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+			_, _, err = expected.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, expected.Hash(), hash)
+		})
+	}
+
+	t.Run("absent key", func(t *testing.T) {
+		tree := newTree()
+		moved, err := tree.Move([]byte("missing"), []byte("key_50"))
+		require.NoError(t, err)
+		require.False(t, moved)
+		require.Equal(t, tree.Hash(), tree.WorkingHash())
+		has, err := tree.Has([]byte("key_50"))
+		require.NoError(t, err)
+		require.False(t, has)
+	})
+
+	t.Run("same key", func(t *testing.T) {
+		tree := newTree()
+		moved, err := tree.Move([]byte("key_03"), []byte("key_03"))
+		require.NoError(t, err)
+		require.True(t, moved)
+		require.Equal(t, tree.Hash(), tree.WorkingHash())
+
+		moved, err = tree.Move([]byte("missing"), []byte("missing"))
+		require.NoError(t, err)
+		require.False(t, moved)
+	})
+}
+
+// recordingDB is a MemDB recording the node and fast node entries written by its batches.
+type recordingDB struct {
+	*dbm.MemDB
+	entries, size int
+}
+
+func (db *recordingDB) NewBatch() corestore.Batch {
+	return &recordingBatch{Batch: db.MemDB.NewBatch(), db: db}
+}
+
+func (db *recordingDB) NewBatchWithSize(size int) corestore.Batch {
+	return &recordingBatch{Batch: db.MemDB.NewBatchWithSize(size), db: db}
+}
+
+type recordingBatch struct {
+	corestore.Batch
+	db *recordingDB
+}
+
+func (b *recordingBatch) record(key, value []byte) {
+	if key[0] == nodeKeyFormat.Prefix()[0] || key[0] == fastKeyFormat.Prefix()[0] {
+		b.db.entries++
+		b.db.size += len(key) + len(value)
+	}
+}
+
+func (b *recordingBatch) Set(key, value []byte) error {
+	b.record(key, value)
+	return b.Batch.Set(key, value)
+}
+
+func (b *recordingBatch) Delete(key []byte) error {
+	b.record(key, nil)
+	return b.Batch.Delete(key)
+}
+
+func TestMutableTree_PendingCommitSize(t *testing.T) {
+	for _, opts := range [][]Option{nil, {ValueTransformOption(xorTransform(0x5a))}} {
+		db := &recordingDB{MemDB: dbm.NewMemDB()}
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), opts...)
+		check := func(changes func()) {
+			changes()
+			nodeCount, size, err := tree.PendingCommitSize()
+			require.NoError(t, err)
+			db.entries, db.size = 0, 0
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+			require.Equal(t, db.entries, nodeCount)
+			require.Equal(t, db.size, size)
+		}
+
+		check(func() {})
+		check(func() {
+			for i := 0; i < 100; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key_%03d", i)), bytes.Repeat([]byte{byte(i)}, i))
+				require.NoError(t, err)
+			}
+		})
+		check(func() {
+			for i := 0; i < 100; i += 7 {
+				_, err := tree.Set([]byte(fmt.Sprintf("key_%03d", i)), []byte("updated"))
+				require.NoError(t, err)
+				_, _, err = tree.Remove([]byte(fmt.Sprintf("key_%03d", i+1)))
+				require.NoError(t, err)
+			}
+		})
+		// the root of the previous version is referenced
+		check(func() {})
+		check(func() {
+			_, err := tree.Set([]byte("key_000"), []byte("updated"))
+			require.NoError(t, err)
+			_, _, err = tree.Remove([]byte("key_000"))
+			require.NoError(t, err)
+		})
+		// the empty root is saved
+		check(func() {
+			for i := 0; i < 100; i++ {
+				_, _, err := tree.Remove([]byte(fmt.Sprintf("key_%03d", i)))
+				require.NoError(t, err)
+			}
+			require.Nil(t, tree.root)
+		})
+	}
+}
+
+func TestMutableTree_VersionMeta(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := 1; i <= 4; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%d", i)), []byte("value"))
+		require.NoError(t, err)
+		var version int64
+		if i == 3 {
+			_, version, err = tree.SaveVersion()
+		} else {
+			_, version, err = tree.SaveVersionWithMeta([]byte(fmt.Sprintf("meta_%d", i)))
+		}
+		require.NoError(t, err)
+		require.EqualValues(t, i, version)
+	}
+
+	for _, version := range []int64{1, 2, 4} {
+		meta, err := tree.VersionMeta(version)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("meta_%d", version)), meta)
+	}
+	meta, err := tree.VersionMeta(3)
+	require.NoError(t, err)
+	require.Nil(t, meta)
+	_, err = tree.VersionMeta(5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+
+	// the metadata is deleted with the pruned versions
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	_, err = tree.VersionMeta(2)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	for _, version := range []int64{1, 2} {
+		bz, err := tree.ndb.db.Get(versionMetaKeyFormat.KeyInt64(version))
+		require.NoError(t, err)
+		require.Nil(t, bz)
+	}
+	meta, err = tree.VersionMeta(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("meta_4"), meta)
+
+	// and with the versions deleted from the latest ones
+	require.NoError(t, tree.ndb.DeleteVersionsFrom(4))
+	require.NoError(t, tree.ndb.Commit())
+	bz, err := tree.ndb.db.Get(versionMetaKeyFormat.KeyInt64(4))
+	require.NoError(t, err)
+	require.Nil(t, bz)
+}
+
+func TestMutableTree_GetNodeSequence(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), TrackNodeSequenceOption(true))
+	untracked := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var last int64
+	for version := int64(1); version <= 4; version++ {
+		for _, tr := range []*MutableTree{tree, untracked} {
+			for i := int64(0); i < 10; i++ {
+				_, err := tr.Set([]byte(fmt.Sprintf("key%d", (version*7+i)%25)), []byte(fmt.Sprintf("value%d", version)))
+				require.NoError(t, err)
+			}
+			_, _, err := tr.SaveVersion()
+			require.NoError(t, err)
+		}
+		// the sequence does not change the hashes
+		require.Equal(t, untracked.Hash(), tree.Hash())
+
+		// the new nodes of the version follow the ones of the previous versions, in nonce order
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		var created []*Node
+		var walk func(node *Node)
+		walk = func(node *Node) {
+			if node.nodeKey.version != version {
+				return
+			}
+			created = append(created, node)
+			if !node.isLeaf() {
+				left, err := node.getLeftNode(itree)
+				require.NoError(t, err)
+				walk(left)
+				right, err := node.getRightNode(itree)
+				require.NoError(t, err)
+				walk(right)
+			}
+		}
+		walk(itree.root)
+		require.NotEmpty(t, created)
+		sort.Slice(created, func(i, j int) bool { return created[i].nodeKey.nonce < created[j].nodeKey.nonce })
+		for _, node := range created {
+			seq, err := tree.GetNodeSequence(node.hash)
+			require.NoError(t, err)
+			require.Equal(t, last+1, seq, "node %v", node.nodeKey)
+			last = seq
+		}
+	}
+
+	// the nodes of a deleted version which are still referenced keep their sequence
+	var kept *Node
+	var find func(node *Node)
+	find = func(node *Node) {
+		if kept != nil {
+			return
+		}
+		if node.nodeKey.version == 1 {
+			kept = node
+			return
+		}
+		if !node.isLeaf() {
+			left, err := node.getLeftNode(tree.ImmutableTree)
+			require.NoError(t, err)
+			find(left)
+			right, err := node.getRightNode(tree.ImmutableTree)
+			require.NoError(t, err)
+			find(right)
+		}
+	}
+	find(tree.root)
+	require.NotNil(t, kept)
+	seq, err := tree.GetNodeSequence(kept.hash)
+	require.NoError(t, err)
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	again, err := tree.GetNodeSequence(kept.hash)
+	require.NoError(t, err)
+	require.Equal(t, seq, again)
+
+	_, err = tree.GetNodeSequence(make([]byte, 32))
+	require.ErrorIs(t, err, ErrNodeNotFound)
+	_, err = untracked.GetNodeSequence(untracked.root.hash)
+	require.ErrorIs(t, err, ErrNodeSequenceNotTracked)
+}
+
+func TestMutableTree_NodeSequencePruning(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), TrackNodeSequenceOption(true))
+	for version := int64(1); version <= 20; version++ {
+		// every fifth version is unchanged
+		if version%5 != 0 {
+			for i := int64(0); i < 6; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("key%d", (version*3+i)%30)), []byte(fmt.Sprintf("value%d", version)))
+				require.NoError(t, err)
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// a version keeps its record exactly while some of its nodes are stored
+	checkRecords := func() {
+		for version := int64(1); version <= 20; version++ {
+			itr, err := db.Iterator(nodeKeyPrefixFormat.KeyInt64(version), nodeKeyPrefixFormat.KeyInt64(version+1))
+			require.NoError(t, err)
+			hasNodes := itr.Valid()
+			require.NoError(t, itr.Close())
+			has, err := db.Has(nodeSequenceKeyFormat.KeyInt64(version))
+			require.NoError(t, err)
+			require.Equal(t, hasNodes, has, "version %d", version)
+		}
+		// the nodes left keep their sequence
+		tree.root.traverse(tree.ImmutableTree, true, func(node *Node) bool {
+			_, err := tree.GetNodeSequence(node.hash)
+			require.NoError(t, err, "node %v", node.nodeKey)
+			return false
+		})
+	}
+
+	require.NoError(t, tree.PruneWithPolicy(func(version int64) bool { return version%4 == 0 }))
+	checkRecords()
+	require.NoError(t, tree.DeleteVersionsTo(12))
+	checkRecords()
+	require.NoError(t, tree.PruneWithPolicy(func(int64) bool { return false }))
+	checkRecords()
+	require.Equal(t, []int{20}, tree.AvailableVersions())
+}
+
+func TestMutableTree_NodeReferenceCount(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range []string{"a", "b", "c", "d"} {
+		_, err := tree.Set([]byte(key), []byte(key))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	_, err = tree.Set([]byte("d"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	// the third version refers to the root of the second one
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	path := func(t *testing.T, version int64, key string) ([]byte, []SiblingHash) {
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		leafHash, siblings, err := itree.GetMerklePath([]byte(key))
+		require.NoError(t, err)
+		return leafHash, siblings
+	}
+	leafA, _ := path(t, 1, "a")
+	oldLeafD, oldSiblings := path(t, 1, "d")
+	newLeafD, _ := path(t, 2, "d")
+	// the subtree off the path to the updated key at the root is part of all the versions
+	shared := oldSiblings[len(oldSiblings)-1].Hash
+	oldRoot, err := tree.rootHash(1)
+	require.NoError(t, err)
+	newRoot, err := tree.rootHash(2)
+	require.NoError(t, err)
+
+	counts := func(t *testing.T) []int {
+		var counts []int
+		for _, hash := range [][]byte{leafA, oldLeafD, newLeafD, shared, oldRoot, newRoot, []byte("missing")} {
+			count, err := tree.NodeReferenceCount(hash)
+			require.NoError(t, err)
+			counts = append(counts, count)
+		}
+		return counts
+	}
+	require.Equal(t, []int{3, 1, 2, 3, 1, 2, 0}, counts(t))
+
+	require.NoError(t, tree.DeleteVersionsTo(1))
+	require.Equal(t, []int{2, 0, 2, 2, 0, 2, 0}, counts(t))
+}
+
+func TestMutableTree_ApplyChangeSetStream(t *testing.T) {
+	cs := &ChangeSet{}
+	for i := 0; i < 50; i++ {
+		cs.Pairs = append(cs.Pairs, &KVPair{Key: []byte(fmt.Sprintf("key_%02d", i)), Value: []byte(fmt.Sprintf("value_%d", i))})
+	}
+	for i := 0; i < 50; i += 3 {
+		cs.Pairs = append(cs.Pairs, NewDeleteKVPair([]byte(fmt.Sprintf("key_%02d", i))))
+	}
+	cs.Pairs = append(cs.Pairs, &KVPair{Key: []byte("key_01"), Value: []byte("updated")}, &KVPair{Key: []byte("empty"), Value: []byte{}})
+
+	expected := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err := expected.SaveChangeSet(cs)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteChangeSetStream(&buf, cs))
+	stream := buf.Bytes()
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	applied, err := tree.ApplyChangeSetStream(bytes.NewReader(stream))
+	require.NoError(t, err)
+	require.Equal(t, len(cs.Pairs), applied)
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, expected.Hash(), hash)
+
+	// a truncated stream applies the complete operations before the torn one
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	applied, err = tree.ApplyChangeSetStream(bytes.NewReader(stream[:len(stream)-3]))
+	require.ErrorIs(t, err, ErrInvalidChangeSetStream)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, len(cs.Pairs)-1, applied)
+	value, err := tree.Get([]byte("key_01"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("updated"), value)
+
+	tree = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	applied, err = tree.ApplyChangeSetStream(bytes.NewReader([]byte{changeSetStreamSet, 1, 'a', 0, 7}))
+	require.ErrorIs(t, err, ErrInvalidChangeSetStream)
+	require.Equal(t, 1, applied)
+}
+
+func TestMutableTree_BuildFromSorted(t *testing.T) {
+	sortedPairs := func(n int) []KVPair {
+		pairs := make([]KVPair, n)
+		for i := range pairs {
+			pairs[i] = KVPair{Key: []byte(fmt.Sprintf("key_%06d", i)), Value: []byte(fmt.Sprintf("value_%d", i))}
+		}
+		return pairs
+	}
+	sizes := []int{1000, 1023, 1024, 1025, 4097}
+	for n := 0; n <= 130; n++ {
+		sizes = append(sizes, n)
+	}
+	for _, n := range sizes {
+		pairs := sortedPairs(n)
+		expected := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), InitialVersionOption(3))
+		for _, pair := range pairs {
+			_, err := expected.Set(pair.Key, pair.Value)
+			require.NoError(t, err)
+		}
+		hash, _, err := expected.SaveVersion()
+		require.NoError(t, err)
+
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		require.NoError(t, tree.BuildFromSorted(3, pairs))
+		require.Equal(t, int64(3), tree.Version())
+		require.Equal(t, hash, tree.Hash(), "size %d", n)
+		require.Equal(t, expected.Height(), tree.Height(), "size %d", n)
+		if n > 0 {
+			value, err := tree.Get(pairs[n/2].Key)
+			require.NoError(t, err)
+			require.Equal(t, pairs[n/2].Value, value)
+		}
+	}
+
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	unsorted := sortedPairs(3)
+	unsorted[1], unsorted[2] = unsorted[2], unsorted[1]
+	require.ErrorIs(t, tree.BuildFromSorted(1, unsorted), ErrInvalidInputs)
+	require.ErrorIs(t, tree.BuildFromSorted(1, append(sortedPairs(2), sortedPairs(1)...)), ErrInvalidInputs)
+	require.Error(t, tree.BuildFromSorted(1, []KVPair{{Key: []byte("nil")}}))
+	require.NoError(t, tree.BuildFromSorted(1, sortedPairs(10)))
+	require.Error(t, tree.BuildFromSorted(2, sortedPairs(10)))
+}
+
+func BenchmarkBuildFromSorted(b *testing.B) {
+	pairs := make([]KVPair, 100000)
+	for i := range pairs {
+		pairs[i] = KVPair{Key: []byte(fmt.Sprintf("key_%08d", i)), Value: []byte("value")}
+	}
+	b.Run("sequential set", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+			for _, pair := range pairs {
+				if _, err := tree.Set(pair.Key, pair.Value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if _, _, err := tree.SaveVersion(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("build from sorted", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+			if err := tree.BuildFromSorted(1, pairs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestMutableTree_VersionGaps(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	gaps, err := tree.VersionGaps()
+	require.NoError(t, err)
+	require.Empty(t, gaps)
+	for i := 0; i < 8; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	gaps, err = tree.VersionGaps()
+	require.NoError(t, err)
+	require.Empty(t, gaps)
+
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	gaps, err = tree.VersionGaps()
+	require.NoError(t, err)
+	require.Empty(t, gaps)
+
+	require.NoError(t, tree.PruneWithPolicy(func(version int64) bool {
+		return version != 4 && version != 6 && version != 7
+	}))
+	gaps, err = tree.VersionGaps()
+	require.NoError(t, err)
+	require.Equal(t, [][2]int64{{4, 4}, {6, 7}}, gaps)
+	require.Equal(t, []int{3, 5, 8}, tree.AvailableVersions())
+}
+
+func TestMutableTree_WriteOnlyMode(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("value%d", i)))
+		require.NoError(t, err)
+	}
+	require.Error(t, tree.SetWriteOnlyMode(true))
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	fastNodes := func(t *testing.T) map[string]string {
+		nodes := make(map[string]string)
+		itr := NewFastIterator(nil, nil, true, tree.ndb)
+		defer itr.Close()
+		for ; itr.Valid(); itr.Next() {
+			nodes[string(itr.Key())] = string(itr.Value())
+		}
+		require.NoError(t, itr.Error())
+		return nodes
+	}
+	before := fastNodes(t)
+	require.Len(t, before, 50)
+
+	require.NoError(t, tree.SetWriteOnlyMode(true))
+	expected := make(map[string]string)
+	for v := 0; v < 3; v++ {
+		for i := 0; i < 100; i++ {
+			key, value := fmt.Sprintf("key%03d", (i*7+v)%150), fmt.Sprintf("value%d-%d", v, i)
+			_, err := tree.Set([]byte(key), []byte(value))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key%03d", v)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	// the fast index is not written, and the reads fall back to the tree
+	require.Equal(t, before, fastNodes(t))
+	_, err = tree.Iterate(func(key, value []byte) bool {
+		expected[string(key)] = string(value)
+		return false
+	})
+	require.NoError(t, err)
+	for key, value := range expected {
+		got, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, value, string(got))
+	}
+	got, err := tree.Get([]byte("key002"))
+	require.NoError(t, err)
+	require.Nil(t, got)
+	require.Error(t, tree.RebuildFastIndex())
+
+	require.NoError(t, tree.SetWriteOnlyMode(false))
+	require.NoError(t, tree.RebuildFastIndex())
+	require.Equal(t, expected, fastNodes(t))
+	enabled, err := tree.IsFastCacheEnabled()
+	require.NoError(t, err)
+	require.True(t, enabled)
+	// the index is maintained again
+	_, err = tree.Set([]byte("new"), []byte("value"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+	expected["new"] = "value"
+	require.Equal(t, expected, fastNodes(t))
+	require.NoError(t, tree.RebuildFastIndex())
+}
+
+func BenchmarkWriteOnlyMode(b *testing.B) {
+	load := func(b *testing.B, writeOnly bool) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+		if writeOnly {
+			if err := tree.SetWriteOnlyMode(true); err != nil {
+				b.Fatal(err)
+			}
+		}
+		for v := 0; v < 10; v++ {
+			for i := 0; i < 10000; i++ {
+				if _, err := tree.Set([]byte(fmt.Sprintf("key%08d", rand.Intn(1000000))), []byte("value")); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if _, _, err := tree.SaveVersion(); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if writeOnly {
+			if err := tree.SetWriteOnlyMode(false); err != nil {
+				b.Fatal(err)
+			}
+			if err := tree.RebuildFastIndex(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	for _, writeOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("write-only=%t", writeOnly), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				load(b, writeOnly)
+			}
+		})
+	}
+}
+
+func TestMutableTree_OnHashCollision(t *testing.T) {
+	db := dbm.NewMemDB()
+	var existing, incoming *Node
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), OnHashCollisionOption(func(e, i *Node) {
+		existing, incoming = e, i
+	}))
+	for i := 0; i < 8; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	hash, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// a stale node at a node key of the next version, which is not the root so that the version
+	// does not exist
+	stale := NewNode([]byte("stale"), []byte("stale"))
+	stale.nodeKey = &NodeKey{version: 2, nonce: 2}
+	stale._hash(2)
+	var buf bytes.Buffer
+	require.NoError(t, stale.writeBytes(&buf))
+	require.NoError(t, db.Set(tree.ndb.nodeKey(stale.GetKey()), buf.Bytes()))
+
+	_, err = tree.Set([]byte("key3"), []byte("updated"))
+	require.NoError(t, err)
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, ErrNodeCollision)
+	require.NotNil(t, incoming)
+	require.Equal(t, stale.nodeKey, existing.nodeKey)
+	require.Equal(t, []byte("stale"), existing.key)
+	require.Equal(t, existing.nodeKey, incoming.nodeKey)
+	require.NotEqual(t, existing.hash, incoming.hash)
+
+	// the stale node is not overwritten, and nothing else of the version is saved
+	bz, err := db.Get(tree.ndb.nodeKey(stale.GetKey()))
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), bz)
+	require.NoError(t, db.Delete(tree.ndb.nodeKey(stale.GetKey())))
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, hash, reloaded.Hash())
+
+	// the nodes saved again unchanged do not collide
+	existing, incoming = nil, nil
+	tree2 := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), OnHashCollisionOption(func(e, i *Node) {
+		existing, incoming = e, i
+	}))
+	for version := 0; version < 3; version++ {
+		_, err := tree2.Set([]byte(fmt.Sprintf("key%d", version)), []byte("value"))
+		require.NoError(t, err)
+		_, _, err = tree2.SaveVersion()
+		require.NoError(t, err)
+	}
+	require.Nil(t, existing)
+	require.Nil(t, incoming)
+}
+
+func TestMutableTree_PreCommit(t *testing.T) {
+	errTooManyKeys := errors.New("too many keys")
+	var calls int
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), PreCommitOption(func(cs ChangeSet) error {
+		calls++
+		if len(cs.Pairs) > 3 {
+			return errTooManyKeys
+		}
+		return nil
+	}))
+	for i := 0; i < 3; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+
+	for i := 3; i < 8; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%d", i)), []byte("value"))
+		require.NoError(t, err)
+	}
+	_, _, err = tree.Remove([]byte("key0"))
+	require.NoError(t, err)
+	workingHash := tree.WorkingHash()
+	pending, err := tree.PendingChanges()
+	require.NoError(t, err)
+
+	_, _, err = tree.SaveVersion()
+	require.ErrorIs(t, err, errTooManyKeys)
+	_, err = tree.PrepareCommit()
+	require.ErrorIs(t, err, errTooManyKeys)
+	require.Equal(t, 3, calls)
+
+	// nothing is persisted, and the working tree is unchanged
+	require.False(t, tree.VersionExists(2))
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	version, err := reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), version)
+	require.Equal(t, workingHash, tree.WorkingHash())
+	require.Equal(t, int64(2), tree.WorkingVersion())
+	after, err := tree.PendingChanges()
+	require.NoError(t, err)
+	require.Equal(t, pending, after)
+
+	// the caller fixes the changes
+	for i := 5; i < 8; i++ {
+		_, _, err := tree.Remove([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+	}
+	_, version, err = tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), version)
+	value, err := tree.Get([]byte("key4"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+}
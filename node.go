@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
 
 	"github.com/cosmos/iavl/cache"
 
@@ -72,6 +73,7 @@ type Node struct {
 	rightNode     *Node
 	subtreeHeight int8
 	isLegacy      bool
+	unverified    bool // decoded for the hash of its parent, see nodeDB.childHash
 }
 
 var _ cache.Node = (*Node)(nil)
@@ -86,6 +88,16 @@ func NewNode(key []byte, value []byte) *Node {
 	}
 }
 
+// isSameNode returns true if a and b are the same persisted node. Nodes are compared by hash,
+// which also matches legacy nodes, or by node key when the hashes are missing with the NoHash
+// option.
+func isSameNode(a, b *Node) bool {
+	if a.hash == nil || b.hash == nil {
+		return bytes.Equal(a.GetKey(), b.GetKey())
+	}
+	return bytes.Equal(a.hash, b.hash)
+}
+
 // GetKey returns the key of the node.
 func (node *Node) GetKey() []byte {
 	if node.isLegacy {
@@ -140,6 +152,10 @@ func MakeNode(nk, buf []byte) (*Node, error) {
 		if err != nil {
 			return nil, fmt.Errorf("decoding node.hash, %w", err)
 		}
+		if len(node.hash) == 0 {
+			// written without hash by a tree with the NoHash option
+			node.hash = nil
+		}
 		buf = buf[n:]
 
 		mode, n, err := encoding.DecodeVarint(buf)
@@ -356,6 +372,46 @@ func (node *Node) has(t *ImmutableTree, key []byte) (has bool, err error) {
 	return rightNode.has(t, key)
 }
 
+// findBatch descends to the leaves of the keys referred by order, which must be sorted by key,
+// and calls found with the original index of each key and the leaf where its search ends, which
+// holds the key if it exists.
+func (node *Node) findBatch(t *ImmutableTree, keys [][]byte, order []int, found func(i int, leaf *Node)) error {
+	if len(order) == 0 {
+		return nil
+	}
+	if node.isLeaf() {
+		for _, i := range order {
+			found(i, node)
+		}
+		return nil
+	}
+
+	// keys less than node.key belong to the left subtree, the rest to the right one.
+	split := sort.Search(len(order), func(i int) bool {
+		return bytes.Compare(keys[order[i]], node.key) >= 0
+	})
+
+	if split > 0 {
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		if err := leftNode.findBatch(t, keys, order[:split], found); err != nil {
+			return err
+		}
+	}
+	if split < len(order) {
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		if err := rightNode.findBatch(t, keys, order[split:], found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Get a key under the node.
 //
 // The index is the index in the list of leaf nodes sorted lexicographically by key. The leftmost leaf has index 0.
@@ -604,7 +660,11 @@ func (node *Node) writeBytes(w io.Writer) error {
 			return fmt.Errorf("writing value, %w", err)
 		}
 	} else {
-		err = encoding.Encode32BytesHash(w, node.hash)
+		if node.hash == nil {
+			err = encoding.EncodeBytes(w, nil)
+		} else {
+			err = encoding.Encode32BytesHash(w, node.hash)
+		}
 		if err != nil {
 			return fmt.Errorf("writing hash, %w", err)
 		}
@@ -0,0 +1,238 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// A node blob is the node key of the node followed by the node as stored in the database, before
+// Options.ValueTransform. The roots of the versions, the nodes with nonce 1, are put in the
+// database like roots reformatted by the pruning, so that their versions are not mistaken for
+// existing ones until CommitNodeBlobs is called.
+const nodeBlobKeySize = int64Size + int32Size
+
+// ErrNodeBlobHashMismatch is returned by PutNodeBlob when the blob does not match the hash.
+var ErrNodeBlobHashMismatch = errors.New("node blob does not match its hash")
+
+// NodeBlobs returns the blobs of all the nodes of the given version, keyed by string(hash). A
+// peer holding some of the nodes can put the missing ones with PutNodeBlob and then make the
+// version visible with CommitNodeBlobs. The whole tree is held in memory. The version must not be
+// stored in the legacy format.
+func (tree *MutableTree) NodeBlobs(version int64) (map[string][]byte, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if tree.noHash() {
+		return nil, ErrHashingDisabled
+	}
+	if !tree.VersionExists(version) {
+		return nil, fmt.Errorf("%w: %d", ErrVersionDoesNotExist, version)
+	}
+	tree.ndb.incrVersionReaders(version)
+	defer tree.ndb.decrVersionReaders(version)
+
+	rootKey, err := tree.ndb.GetRoot(version)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make(map[string][]byte)
+	if rootKey == nil {
+		return blobs, nil
+	}
+	if len(rootKey) == hashSize {
+		return nil, fmt.Errorf("version %d is stored in the legacy format", version)
+	}
+	root, err := tree.ndb.GetNode(rootKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := tree.addNodeBlobs(blobs, root); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+func (tree *MutableTree) addNodeBlobs(blobs map[string][]byte, node *Node) error {
+	if node.isLegacy || len(node.leftNodeKey) == hashSize || len(node.rightNodeKey) == hashSize {
+		return fmt.Errorf("node %v references the legacy format", node.nodeKey)
+	}
+	var buf bytes.Buffer
+	buf.Write(node.GetKey())
+	if err := node.writeBytes(&buf); err != nil {
+		return err
+	}
+	blobs[string(node.hash)] = buf.Bytes()
+	if node.isLeaf() {
+		return nil
+	}
+	for _, nk := range [][]byte{node.leftNodeKey, node.rightNodeKey} {
+		child, err := tree.ndb.GetNode(nk)
+		if err != nil {
+			return err
+		}
+		if err := tree.addNodeBlobs(blobs, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutNodeBlob writes a blob returned by NodeBlobs to the database. The hash of a leaf is recomputed
+// from its contents, and the hash of an inner node is checked against the one it stores, which is
+// recomputed from the hashes of its children by CommitNodeBlobs. The blobs are flushed by
+// CommitNodeBlobs.
+func (tree *MutableTree) PutNodeBlob(hash, blob []byte) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	if len(blob) < nodeBlobKeySize {
+		return fmt.Errorf("node blob of %d bytes is too short", len(blob))
+	}
+	nk, bz := blob[:nodeBlobKeySize], blob[nodeBlobKeySize:]
+	node, err := MakeNode(nk, bz)
+	if err != nil {
+		return fmt.Errorf("decoding node blob: %w", err)
+	}
+	if !bytes.Equal(node.hash, hash) {
+		return fmt.Errorf("%w: node %v: expected %X, got %X", ErrNodeBlobHashMismatch, node.nodeKey, hash, node.hash)
+	}
+
+	storeKey := *node.nodeKey
+	if storeKey.nonce == 1 {
+		if has, err := tree.ndb.hasNode(nk); err != nil || has {
+			return err
+		}
+		storeKey.nonce = 0
+	}
+	var buf bytes.Buffer
+	if err := tree.ndb.writeNode(&buf, node); err != nil {
+		return err
+	}
+	tree.ndb.mtx.Lock()
+	defer tree.ndb.mtx.Unlock()
+	if err := tree.ndb.batch.Set(tree.ndb.nodeKey(storeKey.GetKey()), buf.Bytes()); err != nil {
+		return err
+	}
+	if tree.nodeBlobs == nil {
+		tree.nodeBlobs = make(map[string]*Node)
+	}
+	tree.nodeBlobs[string(nk)] = node
+	return nil
+}
+
+// CommitNodeBlobs flushes the blobs put with PutNodeBlob and makes the version visible, with the
+// root node whose blob is rootBlob, or with an empty root if rootBlob is nil. The root must have
+// been put, or already be in the database. The subtree of the root is checked first, and the blobs
+// are discarded if a node put does not match its children. The tree is not loaded at the version.
+func (tree *MutableTree) CommitNodeBlobs(version int64, rootBlob []byte) error {
+	if tree.closed.Load() {
+		return ErrClosed
+	}
+	if tree.prepared {
+		return ErrCommitPrepared
+	}
+	defer func() { tree.nodeBlobs = nil }()
+	if tree.VersionExists(version) {
+		return fmt.Errorf("version %d already exists", version)
+	}
+	if rootBlob == nil {
+		if err := tree.ndb.SaveEmptyRoot(version); err != nil {
+			return err
+		}
+	} else {
+		if len(rootBlob) < nodeBlobKeySize {
+			return fmt.Errorf("node blob of %d bytes is too short", len(rootBlob))
+		}
+		rootKey := GetNodeKey(rootBlob[:nodeBlobKeySize])
+		if rootKey.version > version || rootKey.nonce != 1 {
+			return fmt.Errorf("node %v cannot be the root of version %d", rootKey, version)
+		}
+		if _, err := tree.verifyNodeBlobs(rootKey.GetKey()); err != nil {
+			tree.ndb.mtx.Lock()
+			tree.ndb.discardBatches()
+			tree.ndb.mtx.Unlock()
+			return err
+		}
+		// put the pending blobs, so that the root is found even if it was just put
+		if err := tree.ndb.Commit(); err != nil {
+			return err
+		}
+		if err := tree.saveNodeBlobsRoot(version, rootKey); err != nil {
+			return err
+		}
+	}
+	if err := tree.ndb.Commit(); err != nil {
+		return err
+	}
+	if _, latestVersion, err := tree.ndb.getLatestVersion(); err == nil && latestVersion < version {
+		tree.ndb.resetLatestVersion(version)
+	}
+	return nil
+}
+
+// verifyNodeBlobs checks the subtree of the node nk, recomputing the hash of each inner node put
+// with PutNodeBlob from the hashes of its children, like the importer. The nodes which were
+// already in the database are not checked again.
+func (tree *MutableTree) verifyNodeBlobs(nk []byte) (*Node, error) {
+	node, ok := tree.nodeBlobs[string(nk)]
+	if !ok {
+		return tree.ndb.GetNode(nk)
+	}
+	if node.isLeaf() {
+		return node, nil
+	}
+	left, err := tree.verifyNodeBlobs(node.leftNodeKey)
+	if err != nil {
+		return nil, err
+	}
+	right, err := tree.verifyNodeBlobs(node.rightNodeKey)
+	if err != nil {
+		return nil, err
+	}
+	if node.subtreeHeight != maxInt8(left.subtreeHeight, right.subtreeHeight)+1 || node.size != left.size+right.size {
+		return nil, fmt.Errorf("%w: node %v does not match the height and size of its children", ErrNodeBlobHashMismatch, node.nodeKey)
+	}
+	check := &Node{
+		size:          node.size,
+		subtreeHeight: node.subtreeHeight,
+		leftNode:      left,
+		rightNode:     right,
+	}
+	if hash := check._hash(node.nodeKey.version); !bytes.Equal(hash, node.hash) {
+		return nil, fmt.Errorf("%w: node %v: stored %X, computed %X", ErrNodeBlobHashMismatch, node.nodeKey, node.hash, hash)
+	}
+	return node, nil
+}
+
+// saveNodeBlobsRoot writes the root of version, put with nonce 0 by PutNodeBlob.
+func (tree *MutableTree) saveNodeBlobsRoot(version int64, rootKey *NodeKey) error {
+	ndb := tree.ndb
+	has, err := ndb.hasNode(rootKey.GetKey())
+	if err != nil {
+		return err
+	}
+	if !has {
+		return fmt.Errorf("root %v of version %d is missing", rootKey, version)
+	}
+	if rootKey.version < version {
+		// GetRoot falls back to the reformatted root
+		return ndb.SaveRoot(version, rootKey)
+	}
+
+	reformatted := ndb.nodeKey((&NodeKey{version: version, nonce: 0}).GetKey())
+	bz, err := ndb.db.Get(reformatted)
+	if err != nil || bz == nil {
+		// the root is already stored as the root of its version
+		return err
+	}
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if err := ndb.batch.Set(ndb.nodeKey(rootKey.GetKey()), bz); err != nil {
+		return err
+	}
+	return ndb.batch.Delete(reformatted)
+}
@@ -4,20 +4,25 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	corestore "cosmossdk.io/core/store"
 
 	"github.com/cosmos/iavl/cache"
 	"github.com/cosmos/iavl/fastnode"
 	ibytes "github.com/cosmos/iavl/internal/bytes"
+	"github.com/cosmos/iavl/internal/encoding"
 	"github.com/cosmos/iavl/keyformat"
 )
 
@@ -27,6 +32,14 @@ const (
 	hashSize          = sha256.Size
 	genesisVersion    = 1
 	storageVersionKey = "storage_version"
+	// legacyMigrationKey records the latest legacy version rewritten by migrateLegacyFormat, whose
+	// next run only resumes the deletion of the legacy data.
+	legacyMigrationKey = "legacy_migration"
+	// fastMigrationKey records the progress of MutableTree.MigrateFastStorage, with the fast nodes.
+	fastMigrationKey = "fast_storage_migration"
+	// versionGapsKey records the first version once MutableTree.PruneWithPolicy left gaps between
+	// the versions, whose existence is then checked on disk.
+	versionGapsKey = "version_gaps"
 	// We store latest saved version together with storage version delimited by the constant below.
 	// This delimiter is valid only if fast storage is enabled (i.e. storageVersion >= fastStorageVersionValue).
 	// The latest saved version is needed for protection against downgrade and re-upgrade. In such a case, it would
@@ -67,8 +80,18 @@ var (
 
 	// All legacy root keys are prefixed with the byte 'r'.
 	legacyRootKeyFormat = keyformat.NewKeyFormat('r', int64Size) // r<version>
+
+	// The metadata blobs saved with MutableTree.SaveVersionWithMeta are prefixed with the byte 'v'.
+	versionMetaKeyFormat = keyformat.NewFastPrefixFormatter('v', int64Size) // v<version>
+
+	// The node sequence records of Options.TrackNodeSequence are prefixed with the byte 'q'.
+	nodeSequenceKeyFormat = keyformat.NewFastPrefixFormatter('q', int64Size) // q<version>
 )
 
+// errFastIndexAhead is wrapped by the errors of Commit when the fast batch was written to
+// Options.FastNodeDB but the main batch failed, which leaves the fast index ahead of the tree.
+var errFastIndexAhead = errors.New("the fast index is ahead of the tree")
+
 var errInvalidFastStorageVersion = fmt.Errorf("fast storage version must be in the format <storage version>%s<latest fast cache version>", fastStorageVersionDelimiter)
 
 type nodeDB struct {
@@ -80,25 +103,39 @@ type nodeDB struct {
 	done                chan struct{}              // Channel to signal that the pruning process is done.
 	db                  corestore.KVStoreWithBatch // Persistent node storage.
 	batch               corestore.Batch            // Batched writing buffer.
+	fastDB              corestore.KVStoreWithBatch // Fast index storage, db unless Options.FastNodeDB is set.
+	fastBatch           corestore.Batch            // Batched writing buffer for the fast index, batch unless Options.FastNodeDB is set.
 	opts                Options                    // Options to customize for pruning/writing
 	versionReaders      map[int64]uint32           // Number of active version readers
+	pinnedVersions      map[int64]bool             // Versions pinned against pruning
+	openIterators       int                        // Number of open iterators, with Options.MaxOpenIterators
 	storageVersion      string                     // Storage version
 	firstVersion        int64                      // First version of nodeDB.
 	latestVersion       int64                      // Latest version of nodeDB.
 	pruneVersion        int64                      // Version to prune up to.
+	pruneMtx            sync.Mutex                 // Held while the pending versions are pruned.
+	pruningPaused       bool                       // The async pruning is paused, see pauseBackground.
+	flushesHeld         bool                       // The flushes of the batches are held, see holdFlushes.
 	legacyLatestVersion int64                      // Latest version of nodeDB in legacy format.
 	nodeCache           cache.Cache                // Cache for nodes in the regular tree that consists of key-value pairs at any version.
 	fastNodeCache       cache.Cache                // Cache for nodes in the fast index that represents only key-value pairs at the latest version.
 	isCommitting        bool                       // Flag to indicate that the nodeDB is committing.
 	chCommitting        chan struct{}              // Channel to signal that the committing is done.
+	versionGaps         bool                       // Versions may be missing between the first and latest ones, see versionGapsKey.
+	versionGapsRead     bool                       // versionGaps was read from disk.
+	closed              atomic.Bool                // Close was called, the trees of the nodeDB return ErrClosed.
+	nodeSequences       map[int64][]byte           // The node sequence records written to the batch, nil if deleted.
+	stagedVersion       int64                      // Version written to the batch but not committed, see stageVersion.
+	stagedRoot          []byte                     // Root key of stagedVersion, nil if empty.
+	stagedNodes         map[string]*Node           // New nodes of stagedVersion by node key.
 }
 
 func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Logger) *nodeDB {
-	storeVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
-
-	if err != nil || storeVersion == nil {
-		storeVersion = []byte(defaultStorageVersionValue)
+	fastDB := db
+	if opts.FastNodeDB != nil {
+		fastDB = opts.FastNodeDB
 	}
+	batch, fastBatch := newBatches(db, fastDB, opts)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	ndb := &nodeDB{
@@ -106,7 +143,9 @@ func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Lo
 		cancel:              cancel,
 		logger:              lg,
 		db:                  db,
-		batch:               NewBatchWithFlusher(db, opts.FlushThreshold),
+		batch:               batch,
+		fastDB:              fastDB,
+		fastBatch:           fastBatch,
 		opts:                opts,
 		firstVersion:        0,
 		latestVersion:       0, // initially invalid
@@ -115,7 +154,8 @@ func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Lo
 		nodeCache:           cache.New(cacheSize),
 		fastNodeCache:       cache.New(fastNodeCacheSize),
 		versionReaders:      make(map[int64]uint32, 8),
-		storageVersion:      string(storeVersion),
+		pinnedVersions:      make(map[int64]bool),
+		storageVersion:      readStorageVersion(fastDB),
 		chCommitting:        make(chan struct{}, 1),
 	}
 
@@ -127,6 +167,15 @@ func newNodeDB(db corestore.KVStoreWithBatch, cacheSize int, opts Options, lg Lo
 	return ndb
 }
 
+// readStorageVersion reads the storage version from the db holding the fast index.
+func readStorageVersion(db corestore.KVStoreWithBatch) string {
+	storeVersion, err := db.Get(metadataKeyFormat.Key([]byte(storageVersionKey)))
+	if err != nil || storeVersion == nil {
+		return defaultStorageVersionValue
+	}
+	return string(storeVersion)
+}
+
 // GetNode gets a node from memory or disk. If it is an inner node, it does not
 // load its children.
 // It is used for both formats of nodes: legacy and new.
@@ -142,12 +191,118 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 	// Check the cache.
 	if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
 		ndb.opts.Stat.IncCacheHitCnt()
-		return cachedNode.(*Node), nil
+		node := cachedNode.(*Node)
+		if node.unverified {
+			if err := ndb.verifyNodeHash(node); err != nil {
+				return nil, err
+			}
+			node.unverified = false
+		}
+		return node, nil
 	}
 
 	ndb.opts.Stat.IncCacheMissCnt()
 
+	if node, ok := ndb.stagedNodes[string(nk)]; ok {
+		return node, nil
+	}
+
 	// Doesn't exist, load.
+	node, err := ndb.loadNode(nk)
+	if err != nil {
+		return nil, err
+	}
+	if ndb.opts.VerifyNodeHashOnRead {
+		if err := ndb.verifyNodeHash(node); err != nil {
+			return nil, err
+		}
+	}
+
+	ndb.nodeCache.Add(node)
+
+	return node, nil
+}
+
+// getLeafValue returns the value of the leaf nk and whether its key is key. Unless the leaf is
+// cached, only its key and value are decoded from disk, without hashing or caching it, so that
+// reading a large value costs no more than copying it.
+func (ndb *nodeDB) getLeafValue(nk, key []byte) ([]byte, bool, error) {
+	if len(nk) == hashSize || ndb.opts.VerifyNodeHashOnRead {
+		// legacy leaves are decoded in full, as are verified ones
+		node, err := ndb.GetNode(nk)
+		if err != nil {
+			return nil, false, err
+		}
+		return node.value, bytes.Equal(node.key, key), nil
+	}
+
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
+		ndb.opts.Stat.IncCacheHitCnt()
+		node := cachedNode.(*Node)
+		return node.value, bytes.Equal(node.key, key), nil
+	}
+	ndb.opts.Stat.IncCacheMissCnt()
+
+	buf, err := ndb.readNode(nk)
+	if err != nil {
+		return nil, false, err
+	}
+	height, n, err := encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding node.height, %w", err)
+	}
+	if height != 0 {
+		return nil, false, fmt.Errorf("node %v is not a leaf", GetNodeKey(nk))
+	}
+	buf = buf[n:]
+	_, n, err = encoding.DecodeVarint(buf)
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding node.size, %w", err)
+	}
+	buf = buf[n:]
+	leafKey, n, err := encoding.DecodeBytes(buf)
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding node.key, %w", err)
+	}
+	if !bytes.Equal(leafKey, key) {
+		return nil, false, nil
+	}
+	value, _, err := encoding.DecodeBytes(buf[n:])
+	if err != nil {
+		return nil, false, fmt.Errorf("decoding node.value, %w", err)
+	}
+	if ndb.opts.ValueTransform != nil {
+		value = ndb.opts.ValueTransform.Decode(key, value)
+	}
+	return value, true, nil
+}
+
+// loadNode reads and decodes a node from disk, without the cache.
+func (ndb *nodeDB) loadNode(nk []byte) (*Node, error) {
+	buf, err := ndb.readNode(nk)
+	if err != nil {
+		return nil, err
+	}
+
+	var node *Node
+	if len(nk) == hashSize {
+		node, err = MakeLegacyNode(nk, buf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading Legacy Node. bytes: %x, error: %v", buf, err)
+		}
+	} else {
+		node, err = ndb.makeNode(nk, buf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+		}
+	}
+	return node, nil
+}
+
+// readNode reads the stored bytes of a node from disk.
+func (ndb *nodeDB) readNode(nk []byte) ([]byte, error) {
 	isLegcyNode := len(nk) == hashSize
 	var nodeKey []byte
 	if isLegcyNode {
@@ -176,23 +331,57 @@ func (ndb *nodeDB) GetNode(nk []byte) (*Node, error) {
 	if buf == nil {
 		return nil, fmt.Errorf("Value missing for key %v corresponding to nodeKey %x", nk, nodeKey)
 	}
+	return buf, nil
+}
 
-	var node *Node
-	if isLegcyNode {
-		node, err = MakeLegacyNode(nk, buf)
+// verifyNodeHash recomputes the hash of a node read from disk, with Options.VerifyNodeHashOnRead.
+// The hash of an inner node is computed from the hashes of its children, which are read too if
+// they are not cached, and the hash of a leaf is computed from its contents on decoding, so a
+// corrupt leaf is detected when its parent is read.
+func (ndb *nodeDB) verifyNodeHash(node *Node) error {
+	if node.hash == nil || (node.isLeaf() && !node.isLegacy) {
+		return nil
+	}
+	check := &Node{
+		key:           node.key,
+		value:         node.value,
+		size:          node.size,
+		subtreeHeight: node.subtreeHeight,
+	}
+	if !node.isLeaf() {
+		leftHash, err := ndb.childHash(node.leftNodeKey)
 		if err != nil {
-			return nil, fmt.Errorf("error reading Legacy Node. bytes: %x, error: %v", buf, err)
+			return err
 		}
-	} else {
-		node, err = MakeNode(nk, buf)
+		rightHash, err := ndb.childHash(node.rightNodeKey)
 		if err != nil {
-			return nil, fmt.Errorf("error reading Node. bytes: %x, error: %v", buf, err)
+			return err
 		}
+		check.leftNode, check.rightNode = &Node{hash: leftHash}, &Node{hash: rightHash}
 	}
+	if hash := check._hash(node.nodeKey.version); !bytes.Equal(hash, node.hash) {
+		return fmt.Errorf("%w: node %v: stored %X, computed %X", ErrNodeHashMismatch, node.nodeKey, node.hash, hash)
+	}
+	return nil
+}
 
-	ndb.nodeCache.Add(node)
-
-	return node, nil
+// childHash returns the hash of the child referenced by nk. A child read from disk is cached, so
+// that it is not read again, and is verified itself when GetNode returns it.
+func (ndb *nodeDB) childHash(nk []byte) ([]byte, error) {
+	if len(nk) == hashSize {
+		// legacy nodes are referenced by hash
+		return nk, nil
+	}
+	if cachedNode := ndb.nodeCache.Get(nk); cachedNode != nil {
+		return cachedNode.(*Node).hash, nil
+	}
+	child, err := ndb.loadNode(nk)
+	if err != nil {
+		return nil, err
+	}
+	child.unverified = true
+	ndb.nodeCache.Add(child)
+	return child.hash, nil
 }
 
 func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
@@ -215,7 +404,7 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 	ndb.opts.Stat.IncFastCacheMissCnt()
 
 	// Doesn't exist, load.
-	buf, err := ndb.db.Get(ndb.fastNodeKey(key))
+	buf, err := ndb.fastDB.Get(ndb.fastNodeKey(key))
 	if err != nil {
 		return nil, fmt.Errorf("can't get FastNode %X: %w", key, err)
 	}
@@ -223,7 +412,7 @@ func (ndb *nodeDB) GetFastNode(key []byte) (*fastnode.Node, error) {
 		return nil, nil
 	}
 
-	fastNode, err := fastnode.DeserializeNode(key, buf)
+	fastNode, err := ndb.makeFastNode(key, buf)
 	if err != nil {
 		return nil, fmt.Errorf("error reading FastNode. bytes: %x, error: %w", buf, err)
 	}
@@ -244,7 +433,7 @@ func (ndb *nodeDB) SaveNode(node *Node) error {
 	var buf bytes.Buffer
 	buf.Grow(node.encodedSize())
 
-	if err := node.writeBytes(&buf); err != nil {
+	if err := ndb.writeNode(&buf, node); err != nil {
 		return err
 	}
 
@@ -257,6 +446,28 @@ func (ndb *nodeDB) SaveNode(node *Node) error {
 	return nil
 }
 
+// checkNodeCollision returns ErrNodeCollision, after calling Options.OnHashCollision, if a node
+// with different contents is stored at the node key of node.
+func (ndb *nodeDB) checkNodeCollision(node *Node) error {
+	bz, err := ndb.db.Get(ndb.nodeKey(node.GetKey()))
+	if err != nil || bz == nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := ndb.writeNode(&buf, node); err != nil {
+		return err
+	}
+	if bytes.Equal(buf.Bytes(), bz) {
+		return nil
+	}
+	existing, err := ndb.makeNode(node.GetKey(), bz)
+	if err != nil {
+		return fmt.Errorf("%w: node %v: decoding the stored node: %w", ErrNodeCollision, node.nodeKey, err)
+	}
+	ndb.opts.OnHashCollision(existing, node)
+	return fmt.Errorf("%w: node %v", ErrNodeCollision, node.nodeKey)
+}
+
 // SaveFastNode saves a FastNode to disk and add to cache.
 func (ndb *nodeDB) SaveFastNode(node *fastnode.Node) error {
 	ndb.mtx.Lock()
@@ -321,13 +532,51 @@ func (ndb *nodeDB) SetFastStorageVersionToBatch(latestVersion int64) error {
 
 	newVersion += fastStorageVersionDelimiter + strconv.Itoa(int(latestVersion))
 
-	if err := ndb.batch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
+	if err := ndb.fastBatch.Set(metadataKeyFormat.Key([]byte(storageVersionKey)), []byte(newVersion)); err != nil {
 		return err
 	}
 	ndb.storageVersion = newVersion
 	return nil
 }
 
+// getFastMigrationCheckpoint returns the number of keys migrated and the last migrated key
+// recorded by setFastMigrationCheckpoint for version, or false if there is none.
+func (ndb *nodeDB) getFastMigrationCheckpoint(version int64) (int64, []byte, bool, error) {
+	bz, err := ndb.fastDB.Get(metadataKeyFormat.Key([]byte(fastMigrationKey)))
+	if err != nil || bz == nil {
+		return 0, nil, false, err
+	}
+	cpVersion, n := binary.Varint(bz)
+	if n <= 0 {
+		return 0, nil, false, errors.New("invalid fast storage migration checkpoint")
+	}
+	done, m := binary.Varint(bz[n:])
+	if m <= 0 {
+		return 0, nil, false, errors.New("invalid fast storage migration checkpoint")
+	}
+	if cpVersion != version {
+		return 0, nil, false, nil
+	}
+	return done, bz[n+m:], true, nil
+}
+
+// setFastMigrationCheckpoint records that done keys of version were migrated to the fast index,
+// up to lastKey.
+func (ndb *nodeDB) setFastMigrationCheckpoint(version, done int64, lastKey []byte) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	bz := binary.AppendVarint(nil, version)
+	bz = binary.AppendVarint(bz, done)
+	bz = append(bz, lastKey...)
+	return ndb.fastBatch.Set(metadataKeyFormat.Key([]byte(fastMigrationKey)), bz)
+}
+
+func (ndb *nodeDB) deleteFastMigrationCheckpoint() error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.fastBatch.Delete(metadataKeyFormat.Key([]byte(fastMigrationKey)))
+}
+
 func (ndb *nodeDB) getStorageVersion() string {
 	return ndb.storageVersion
 }
@@ -367,11 +616,15 @@ func (ndb *nodeDB) saveFastNodeUnlocked(node *fastnode.Node, shouldAddToCache bo
 	var buf bytes.Buffer
 	buf.Grow(node.EncodedSize())
 
-	if err := node.WriteBytes(&buf); err != nil {
+	stored := node
+	if ndb.opts.ValueTransform != nil {
+		stored = fastnode.NewNode(node.GetKey(), ndb.opts.ValueTransform.Encode(node.GetKey(), node.GetValue()), node.GetVersionLastUpdatedAt())
+	}
+	if err := stored.WriteBytes(&buf); err != nil {
 		return fmt.Errorf("error while writing fastnode bytes. Err: %w", err)
 	}
 
-	if err := ndb.batch.Set(ndb.fastNodeKey(node.GetKey()), buf.Bytes()); err != nil {
+	if err := ndb.fastBatch.Set(ndb.fastNodeKey(node.GetKey()), buf.Bytes()); err != nil {
 		return fmt.Errorf("error while writing key/val to nodedb batch. Err: %w", err)
 	}
 	if shouldAddToCache {
@@ -410,12 +663,44 @@ func (ndb *nodeDB) saveNodeFromPruning(node *Node) error {
 	// Save node bytes to db.
 	var buf bytes.Buffer
 	buf.Grow(node.encodedSize())
-	if err := node.writeBytes(&buf); err != nil {
+	if err := ndb.writeNode(&buf, node); err != nil {
 		return err
 	}
 	return ndb.batch.Set(ndb.nodeKey(node.GetKey()), buf.Bytes())
 }
 
+// writeNode writes the stored bytes of node to w, with Options.ValueTransform applied to the
+// value of a leaf.
+func (ndb *nodeDB) writeNode(w io.Writer, node *Node) error {
+	if ndb.opts.ValueTransform != nil && node.isLeaf() {
+		stored := *node
+		stored.value = ndb.opts.ValueTransform.Encode(node.key, node.value)
+		node = &stored
+	}
+	return node.writeBytes(w)
+}
+
+// makeNode decodes a node written by writeNode, and hashes leaves from their original value.
+func (ndb *nodeDB) makeNode(nk, buf []byte) (*Node, error) {
+	node, err := MakeNode(nk, buf)
+	if err != nil || ndb.opts.ValueTransform == nil || !node.isLeaf() {
+		return node, err
+	}
+	node.value = ndb.opts.ValueTransform.Decode(node.key, node.value)
+	node.hash = nil
+	node._hash(node.nodeKey.version)
+	return node, nil
+}
+
+// makeFastNode decodes a fast node written by saveFastNodeUnlocked.
+func (ndb *nodeDB) makeFastNode(key, buf []byte) (*fastnode.Node, error) {
+	node, err := fastnode.DeserializeNode(key, buf)
+	if err != nil || ndb.opts.ValueTransform == nil {
+		return node, err
+	}
+	return fastnode.NewNode(node.GetKey(), ndb.opts.ValueTransform.Decode(key, node.GetValue()), node.GetVersionLastUpdatedAt()), nil
+}
+
 // rootkey cache of two elements, attempting to mimic a direct-mapped cache.
 type rootkeyCache struct {
 	// initial value is set to {-1, -1}, which is an invalid version for a getrootkey call.
@@ -455,20 +740,134 @@ func newRootkeyCache() *rootkeyCache {
 	}
 }
 
+// deleteVersionsKeepingNeighbours deletes the given versions, in ascending order, to the batch.
+// The deletion of each version keeps the nodes shared with the previous and next remaining
+// versions, which may leave gaps between the versions. Legacy, pinned and missing versions and the
+// latest version are skipped. On error, the batch is discarded.
+func (ndb *nodeDB) deleteVersionsKeepingNeighbours(versions []int64) (err error) {
+	_, latestVersion, err := ndb.getLatestVersion()
+	if err != nil {
+		return err
+	}
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return err
+	}
+	gaps, err := ndb.hasVersionGaps()
+	if err != nil {
+		return err
+	}
+	firstVersion, err := ndb.getFirstVersion()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			ndb.mtx.Lock()
+			ndb.discardBatches()
+			ndb.mtx.Unlock()
+			ndb.resetFirstVersion(firstVersion)
+		}
+	}()
+
+	// the deletions are not visible in the database until the batch is committed
+	deleted := make(map[int64]bool)
+	exists := func(version int64) (bool, error) {
+		if deleted[version] {
+			return false, nil
+		}
+		return ndb.hasVersion(version)
+	}
+	for _, version := range versions {
+		// the versions before the first one may be deleted to the batch already
+		if version <= legacyLatestVersion || version < firstVersion || version >= latestVersion || ndb.firstPinnedVersion(version, version) != 0 {
+			continue
+		}
+		if has, err := exists(version); err != nil || !has {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		first, err := ndb.getFirstVersion()
+		if err != nil {
+			return err
+		}
+
+		// prev is the previous remaining version, whose nodes are kept
+		prev := int64(0)
+		if legacyLatestVersion >= first {
+			prev = legacyLatestVersion
+		}
+		for v := version - 1; v > prev && v >= first; v-- {
+			has, err := exists(v)
+			if err != nil {
+				return err
+			}
+			if has {
+				prev = v
+				break
+			}
+		}
+		next, err := ndb.firstVersionFrom(version+1, latestVersion)
+		if err != nil {
+			return err
+		}
+
+		ndb.mtx.Lock()
+		readers := ndb.versionReaders[version]
+		ndb.mtx.Unlock()
+		if readers != 0 {
+			return fmt.Errorf("unable to delete version %d with %d active readers", version, readers)
+		}
+		if err := ndb.deleteVersion(version, prev, next, newRootkeyCache()); err != nil {
+			return err
+		}
+		deleted[version] = true
+		if prev == 0 {
+			ndb.resetFirstVersion(next)
+		} else {
+			gaps = true
+		}
+	}
+	if gaps {
+		first, err := ndb.getFirstVersion()
+		if err != nil {
+			return err
+		}
+		return ndb.setVersionGaps(first)
+	}
+	return nil
+}
+
 // deleteVersion deletes a tree version from disk.
 // deletes orphans
-func (ndb *nodeDB) deleteVersion(version int64, cache *rootkeyCache) error {
+// prev and next are the existing versions around it, 0 and version+1 unless some are missing,
+// and the nodes up to prev are kept for it.
+func (ndb *nodeDB) deleteVersion(version, prev, next int64, cache *rootkeyCache) error {
 	rootKey, err := cache.getRootKey(ndb, version)
 	if err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
 		return err
 	}
 
 	if errors.Is(err, ErrVersionDoesNotExist) {
-		ndb.logger.Error("Error while pruning, moving on the the next version in the store", "version missing", version, "next version", version+1, "err", err)
+		ndb.logger.Error("Error while pruning, moving on the the next version in the store", "version missing", version, "next version", next, "err", err)
 	}
 
+	// the orphans of each version, to release the node sequence records
+	var orphaned map[int64]uint32
+	if ndb.opts.TrackNodeSequence {
+		orphaned = make(map[int64]uint32)
+	}
 	if rootKey != nil {
-		if err := ndb.traverseOrphansWithRootkeyCache(cache, version, version+1, func(orphan *Node) error {
+		if err := ndb.traverseOrphansWithRootkeyCache(cache, version, next, func(orphan *Node) error {
+			if orphan.nodeKey.version <= prev {
+				// the node is still part of the previous version
+				return nil
+			}
+			if orphaned != nil && !orphan.isLegacy {
+				orphaned[orphan.nodeKey.version]++
+			}
 			if orphan.nodeKey.nonce == 0 && !orphan.isLegacy {
 				// if the orphan is a reformatted root, it can be a legacy root
 				// so it should be removed from the pruning process.
@@ -490,6 +889,15 @@ func (ndb *nodeDB) deleteVersion(version int64, cache *rootkeyCache) error {
 		}); err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
 			return err
 		}
+		if orphaned != nil {
+			if err := ndb.releaseNodeSequences(version, orphaned); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := ndb.deleteFromPruning(versionMetaKeyFormat.KeyInt64(version)); err != nil {
+		return err
 	}
 
 	literalRootKey := GetRootKey(version)
@@ -502,7 +910,7 @@ func (ndb *nodeDB) deleteVersion(version int64, cache *rootkeyCache) error {
 	}
 
 	// check if the version is referred by the next version
-	nextRootKey, err := cache.getRootKey(ndb, version+1)
+	nextRootKey, err := cache.getRootKey(ndb, next)
 	if err != nil && !errors.Is(err, ErrVersionDoesNotExist) {
 		return err
 	}
@@ -582,6 +990,154 @@ func (ndb *nodeDB) deleteLegacyVersions(legacyLatestVersion int64) error {
 	return nil
 }
 
+// migrateLegacyFormat rewrites the legacy nodes, addressed by hash, in the current format
+// addressed by (version, nonce), rewrites the new nodes referencing legacy children, replaces the
+// legacy roots and deletes the legacy nodes, orphans and roots. It returns the latest legacy
+// version, or 0 if the store has no legacy version. The hashes of the nodes, and thus of the
+// versions, are unchanged. The rewrite is committed at once, along with the legacyMigrationKey
+// marker, and keeps a map of the migrated node keys in memory. The legacy data is deleted
+// afterwards, the roots last, so that an interrupted deletion is resumed by the next run.
+func (ndb *nodeDB) migrateLegacyFormat() (int64, error) {
+	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
+	if err != nil {
+		return 0, err
+	}
+	if legacyLatestVersion <= 0 {
+		return 0, nil
+	}
+
+	rewritten, err := ndb.db.Get(metadataKeyFormat.Key([]byte(legacyMigrationKey)))
+	if err != nil {
+		return 0, err
+	}
+	if rewritten == nil {
+		// the legacy nodes are still needed to run the rewrite again, so it is written at once
+		ndb.holdFlushes(true)
+		if err := ndb.rewriteLegacyFormat(legacyLatestVersion); err != nil {
+			ndb.mtx.Lock()
+			ndb.discardBatches()
+			ndb.mtx.Unlock()
+			return 0, err
+		}
+		ndb.holdFlushes(false)
+		if err := ndb.Commit(); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, prefix := range [][]byte{legacyNodeKeyFormat.Prefix(), []byte(legacyOrphanKeyFormat.Prefix()), []byte(legacyRootKeyFormat.Prefix())} {
+		if err := ndb.traversePrefix(prefix, func(key, _ []byte) error {
+			return ndb.batch.Delete(key)
+		}); err != nil {
+			return 0, err
+		}
+	}
+	if err := ndb.Commit(); err != nil {
+		return 0, err
+	}
+	ndb.resetLegacyLatestVersion(-1)
+	return legacyLatestVersion, nil
+}
+
+// rewriteLegacyFormat writes the legacy versions in the current format for migrateLegacyFormat,
+// along with the legacyMigrationKey marker.
+func (ndb *nodeDB) rewriteLegacyFormat(legacyLatestVersion int64) error {
+	migrated := make(map[string][]byte) // legacy hash -> new node key
+	nonces := make(map[int64]uint32)    // last nonce assigned per version, 1 is kept for the root
+	var migrate func(hash []byte, rootVersion int64) ([]byte, error)
+	migrate = func(hash []byte, rootVersion int64) ([]byte, error) {
+		if nk, ok := migrated[string(hash)]; ok {
+			return nk, nil
+		}
+		legacy, err := ndb.GetNode(hash)
+		if err != nil {
+			return nil, err
+		}
+		version := legacy.nodeKey.version
+		nk := &NodeKey{version: version, nonce: 1}
+		if version != rootVersion {
+			if nonces[version] == 0 {
+				nonces[version] = 1
+			}
+			nonces[version]++
+			nk.nonce = nonces[version]
+		}
+		node := &Node{
+			key:           legacy.key,
+			value:         legacy.value,
+			hash:          legacy.hash,
+			nodeKey:       nk,
+			size:          legacy.size,
+			subtreeHeight: legacy.subtreeHeight,
+		}
+		if !legacy.isLeaf() {
+			if node.leftNodeKey, err = migrate(legacy.leftNodeKey, 0); err != nil {
+				return nil, err
+			}
+			if node.rightNodeKey, err = migrate(legacy.rightNodeKey, 0); err != nil {
+				return nil, err
+			}
+		}
+		if err := ndb.SaveNode(node); err != nil {
+			return nil, err
+		}
+		migrated[string(hash)] = nk.GetKey()
+		return nk.GetKey(), nil
+	}
+
+	// rewrite the legacy versions in ascending order, so that the root of a version is the first
+	// node of the version
+	if err := ndb.traversePrefix(legacyRootKeyFormat.Key(), func(key, rootHash []byte) error {
+		var version int64
+		legacyRootKeyFormat.Scan(key, &version)
+		if len(rootHash) == 0 {
+			return ndb.SaveEmptyRoot(version)
+		}
+		nk, err := migrate(rootHash, version)
+		if err != nil {
+			return fmt.Errorf("migrating legacy version %d: %w", version, err)
+		}
+		if rootKey := GetNodeKey(nk); rootKey.version != version {
+			return ndb.SaveRoot(version, rootKey)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// rewrite the nodes written by the lazy upgrade which reference legacy children
+	if err := ndb.traversePrefix(nodeKeyFormat.Prefix(), func(key, value []byte) error {
+		if len(value) == 0 {
+			return nil
+		}
+		if isRef, _ := isReferenceRoot(value); isRef {
+			return nil
+		}
+		node, err := MakeNode(key[1:], value)
+		if err != nil {
+			return err
+		}
+		if node.isLeaf() || (len(node.leftNodeKey) != hashSize && len(node.rightNodeKey) != hashSize) {
+			return nil
+		}
+		if len(node.leftNodeKey) == hashSize {
+			if node.leftNodeKey, err = migrate(node.leftNodeKey, 0); err != nil {
+				return err
+			}
+		}
+		if len(node.rightNodeKey) == hashSize {
+			if node.rightNodeKey, err = migrate(node.rightNodeKey, 0); err != nil {
+				return err
+			}
+		}
+		return ndb.SaveNode(node)
+	}); err != nil {
+		return err
+	}
+
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(legacyMigrationKey)), []byte(strconv.FormatInt(legacyLatestVersion, 10)))
+}
+
 // DeleteVersionsFrom permanently deletes all tree versions from the given version upwards.
 func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 	_, latest, err := ndb.getLatestVersion()
@@ -600,12 +1156,36 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 		}
 	}
 	ndb.mtx.Unlock()
+	if v := ndb.firstPinnedVersion(fromVersion, latest); v != 0 {
+		return fmt.Errorf("%w: unable to delete version %d", ErrVersionPinned, v)
+	}
 
 	// Delete the legacy versions
 	legacyLatestVersion, err := ndb.getLegacyLatestVersion()
 	if err != nil {
 		return err
 	}
+	gaps, err := ndb.hasVersionGaps()
+	if err != nil {
+		return err
+	}
+	if gaps {
+		// the nodes of the missing versions before fromVersion are only part of the deleted ones
+		first, err := ndb.getFirstVersion()
+		if err != nil {
+			return err
+		}
+		for fromVersion-1 > first && fromVersion-1 > legacyLatestVersion {
+			has, err := ndb.hasVersion(fromVersion - 1)
+			if err != nil {
+				return err
+			}
+			if has {
+				break
+			}
+			fromVersion--
+		}
+	}
 	dumpFromVersion := fromVersion
 	if legacyLatestVersion >= fromVersion {
 		if err := ndb.traverseRange(legacyRootKeyFormat.Key(fromVersion), legacyRootKeyFormat.Key(legacyLatestVersion+1), func(k, v []byte) error {
@@ -632,6 +1212,16 @@ func (ndb *nodeDB) DeleteVersionsFrom(fromVersion int64) error {
 	}); err != nil {
 		return err
 	}
+	if err = ndb.traverseRange(versionMetaKeyFormat.KeyInt64(dumpFromVersion), versionMetaKeyFormat.KeyInt64(latest+1), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	if err = ndb.traverseRange(nodeSequenceKeyFormat.KeyInt64(dumpFromVersion), nodeSequenceKeyFormat.KeyInt64(latest+1), func(k, _ []byte) error {
+		return ndb.batch.Delete(k)
+	}); err != nil {
+		return err
+	}
 
 	// NOTICE: we don't touch fast node indexes here, because it'll be rebuilt later because of version mismatch.
 
@@ -645,33 +1235,73 @@ func (ndb *nodeDB) startPruning() {
 	for {
 		select {
 		case <-ndb.ctx.Done():
+			// finish the pending pruning, so that Close can flush it, even if paused
+			if _, err := ndb.prunePending(true); err != nil {
+				ndb.backgroundError("Error while pruning", err)
+			}
 			close(ndb.done)
 			return
 		default:
-			ndb.mtx.Lock()
-			toVersion := ndb.pruneVersion
-			ndb.mtx.Unlock()
-
-			if toVersion == 0 {
-				time.Sleep(100 * time.Millisecond)
-				continue
-			}
-
-			if err := ndb.deleteVersionsTo(toVersion); err != nil {
-				ndb.logger.Error("Error while pruning", "err", err)
+			pruned, err := ndb.prunePending(false)
+			if err != nil {
+				ndb.backgroundError("Error while pruning", err)
 				time.Sleep(1 * time.Second)
 				continue
 			}
-
-			ndb.mtx.Lock()
-			if ndb.pruneVersion <= toVersion {
-				ndb.pruneVersion = 0
+			if !pruned {
+				time.Sleep(100 * time.Millisecond)
 			}
-			ndb.mtx.Unlock()
 		}
 	}
 }
 
+// backgroundError logs an error of a background operation and reports it to
+// Options.OnBackgroundError. It must be called without holding the lock.
+func (ndb *nodeDB) backgroundError(msg string, err error) {
+	ndb.logger.Error(msg, "err", err)
+	if ndb.opts.OnBackgroundError != nil {
+		ndb.opts.OnBackgroundError(err)
+	}
+}
+
+// prunePending deletes the versions up to the pending prune version, if any, unless the pruning
+// is paused and ignorePause is false. It returns false if nothing was pruned.
+func (ndb *nodeDB) prunePending(ignorePause bool) (bool, error) {
+	ndb.pruneMtx.Lock()
+	defer ndb.pruneMtx.Unlock()
+	ndb.mtx.Lock()
+	toVersion := ndb.pruneVersion
+	paused := ndb.pruningPaused
+	ndb.mtx.Unlock()
+
+	if toVersion == 0 || (paused && !ignorePause) {
+		return false, nil
+	}
+
+	if err := ndb.deleteVersionsTo(toVersion); err != nil {
+		return false, err
+	}
+
+	ndb.mtx.Lock()
+	if ndb.pruneVersion <= toVersion {
+		ndb.pruneVersion = 0
+	}
+	ndb.mtx.Unlock()
+	return true, nil
+}
+
+// pauseBackground pauses or resumes the async pruning. The pending prune version is kept while
+// paused, and pruned once resumed. Pausing waits for a pruning in progress to finish.
+func (ndb *nodeDB) pauseBackground(paused bool) {
+	ndb.mtx.Lock()
+	ndb.pruningPaused = paused
+	ndb.mtx.Unlock()
+	if paused {
+		ndb.pruneMtx.Lock()
+		ndb.pruneMtx.Unlock() //nolint:staticcheck // only waits for the pruning in progress
+	}
+}
+
 // DeleteVersionsTo deletes the oldest versions up to the given version from disk.
 func (ndb *nodeDB) DeleteVersionsTo(toVersion int64) error {
 	if !ndb.opts.AsyncPruning {
@@ -680,6 +1310,11 @@ func (ndb *nodeDB) DeleteVersionsTo(toVersion int64) error {
 
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
+	for v := range ndb.pinnedVersions {
+		if v <= toVersion {
+			return fmt.Errorf("%w: unable to delete version %d", ErrVersionPinned, v)
+		}
+	}
 	ndb.pruneVersion = toVersion
 	return nil
 }
@@ -718,40 +1353,223 @@ func (ndb *nodeDB) deleteVersionsTo(toVersion int64) error {
 		}
 	}
 	ndb.mtx.Unlock()
+	if v := ndb.firstPinnedVersion(first, toVersion); v != 0 {
+		return fmt.Errorf("%w: unable to delete version %d", ErrVersionPinned, v)
+	}
 
 	// Delete the legacy versions
 	if legacyLatestVersion >= first {
 		if err := ndb.deleteLegacyVersions(legacyLatestVersion); err != nil {
 			ndb.logger.Error("Error deleting legacy versions", "err", err)
 		}
-		// NOTE: When pruning is broken for legacy versions we need to find the
-		// latest non legacy version in the store
-		// TODO: Make sure legacy pruning works as expected and does not fail
-		firstNonLegacyVersion, err := ndb.getFirstNonLegacyVersion()
-		if err != nil {
+		// NOTE: When pruning is broken for legacy versions we need to find the
+		// latest non legacy version in the store
+		// TODO: Make sure legacy pruning works as expected and does not fail
+		firstNonLegacyVersion, err := ndb.getFirstNonLegacyVersion()
+		if err != nil {
+			return err
+		}
+		first = firstNonLegacyVersion
+
+		// reset the legacy latest version forcibly to avoid multiple calls
+		ndb.resetLegacyLatestVersion(-1)
+	}
+
+	gaps, err := ndb.hasVersionGaps()
+	if err != nil {
+		return err
+	}
+	rootkeyCache := newRootkeyCache()
+	for version := first; version <= toVersion; {
+		next := version + 1
+		if gaps {
+			if next, err = ndb.firstVersionFrom(next, latest); err != nil {
+				return err
+			}
+		}
+		if err := ndb.deleteVersion(version, 0, next, rootkeyCache); err != nil {
+			return err
+		}
+		ndb.resetFirstVersion(next)
+		version = next
+	}
+	if gaps {
+		if err := ndb.setVersionGaps(toVersion + 1); err != nil {
+			return err
+		}
+	}
+
+	ndb.logger.Info("pruned versions", "from", first, "to", toVersion)
+	return nil
+}
+
+// defragmentVersion rewrites the nodes of version with consecutive nonces per node version, and
+// deletes the nodes, roots, metadata and node sequences of the earlier versions, in a single
+// batch written at once. The root keeps nonce 1, so the node versions and hashes are unchanged.
+// The later versions are kept, and their nodes and roots referencing the rewritten nodes are
+// updated. The batch and the map of the rewritten node keys hold the whole version in memory.
+func (ndb *nodeDB) defragmentVersion(version int64) error {
+	rootKey, err := ndb.GetRoot(version)
+	if err != nil {
+		return err
+	}
+
+	batch := ndb.db.NewBatch()
+	defer batch.Close()
+	var keys [][]byte // the rewritten keys, evicted from the node cache
+	if err := ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(0), nodeKeyPrefixFormat.KeyInt64(version+1), func(k, _ []byte) error {
+		keys = append(keys, ibytes.Cp(k))
+		return batch.Delete(k)
+	}); err != nil {
+		return err
+	}
+	for _, kf := range []*keyformat.FastPrefixFormatter{versionMetaKeyFormat, nodeSequenceKeyFormat} {
+		end := version
+		if kf == nodeSequenceKeyFormat {
+			// the nonces of the version are reassigned too
+			end++
+		}
+		if err := ndb.traverseRange(kf.KeyInt64(0), kf.KeyInt64(end), func(k, _ []byte) error {
+			return batch.Delete(k)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// the sets follow the deletes of the same keys in the batch
+	rewritten := make(map[string][]byte) // old node key -> new node key
+	if rootKey == nil {
+		if err := batch.Set(nodeKeyFormat.Key(GetRootKey(version)), []byte{}); err != nil {
+			return err
+		}
+	} else {
+		nonces := make(map[int64]uint32) // last nonce assigned per node version, 1 is kept for the root
+		var rewrite func(nk []byte, isRoot bool) ([]byte, error)
+		rewrite = func(nk []byte, isRoot bool) ([]byte, error) {
+			old, err := ndb.GetNode(nk)
+			if err != nil {
+				return nil, err
+			}
+			node := &Node{
+				key:           old.key,
+				value:         old.value,
+				hash:          old.hash,
+				size:          old.size,
+				subtreeHeight: old.subtreeHeight,
+				nodeKey:       &NodeKey{version: old.nodeKey.version, nonce: 1},
+			}
+			if !old.isLeaf() {
+				if node.leftNodeKey, err = rewrite(old.leftNodeKey, false); err != nil {
+					return nil, err
+				}
+				if node.rightNodeKey, err = rewrite(old.rightNodeKey, false); err != nil {
+					return nil, err
+				}
+			}
+			storeKey := *node.nodeKey
+			if !isRoot {
+				if nonces[storeKey.version] == 0 {
+					nonces[storeKey.version] = 1
+				}
+				nonces[storeKey.version]++
+				node.nodeKey.nonce = nonces[storeKey.version]
+				storeKey.nonce = node.nodeKey.nonce
+			} else if storeKey.version < version {
+				// the root of a deleted version is stored like a root reformatted by the pruning
+				storeKey.nonce = 0
+				if err := batch.Set(nodeKeyFormat.Key(GetRootKey(version)), nodeKeyFormat.Key(node.GetKey())); err != nil {
+					return nil, err
+				}
+			}
+			var buf bytes.Buffer
+			if err := ndb.writeNode(&buf, node); err != nil {
+				return nil, err
+			}
+			if err := batch.Set(nodeKeyFormat.Key(storeKey.GetKey()), buf.Bytes()); err != nil {
+				return nil, err
+			}
+			rewritten[string(old.GetKey())] = node.GetKey()
+			return node.GetKey(), nil
+		}
+		if _, err := rewrite(rootKey, true); err != nil {
+			return err
+		}
+		if rk := GetNodeKey(rootKey); rk.nonce == 0 {
+			// the later versions reference the reformatted root with nonce 1
+			rk.nonce = 1
+			rewritten[string(rk.GetKey())] = rewritten[string(rootKey)]
+		}
+	}
+	lookup := func(nk []byte) ([]byte, bool, error) {
+		if GetNodeKey(nk).version > version {
+			return nk, false, nil
+		}
+		newKey, ok := rewritten[string(nk)]
+		if !ok {
+			return nil, false, fmt.Errorf("node %v is not part of version %d", GetNodeKey(nk), version)
+		}
+		return newKey, true, nil
+	}
+
+	// update the references of the later versions
+	if err := ndb.traverseRange(nodeKeyPrefixFormat.KeyInt64(version+1), nodeKeyPrefixFormat.KeyInt64(math.MaxInt64), func(k, v []byte) error {
+		if len(v) == 0 {
+			return nil
+		}
+		if isRef, n := isReferenceRoot(v); isRef {
+			if n != nodeKeyFormat.Length() {
+				return fmt.Errorf("invalid reference root: %x", v)
+			}
+			newKey, changed, err := lookup(v[1:])
+			if err != nil || !changed {
+				return err
+			}
+			keys = append(keys, ibytes.Cp(k))
+			return batch.Set(ibytes.Cp(k), nodeKeyFormat.Key(newKey))
+		}
+		node, err := ndb.makeNode(k[1:], v)
+		if err != nil {
+			return err
+		}
+		if node.isLeaf() {
+			return nil
+		}
+		var leftChanged, rightChanged bool
+		if node.leftNodeKey, leftChanged, err = lookup(node.leftNodeKey); err != nil {
+			return err
+		}
+		if node.rightNodeKey, rightChanged, err = lookup(node.rightNodeKey); err != nil {
 			return err
 		}
-		first = firstNonLegacyVersion
-
-		// reset the legacy latest version forcibly to avoid multiple calls
-		ndb.resetLegacyLatestVersion(-1)
-	}
-
-	rootkeyCache := newRootkeyCache()
-	for version := first; version <= toVersion; version++ {
-		if err := ndb.deleteVersion(version, rootkeyCache); err != nil {
+		if !leftChanged && !rightChanged {
+			return nil
+		}
+		var buf bytes.Buffer
+		if err := ndb.writeNode(&buf, node); err != nil {
 			return err
 		}
-		ndb.resetFirstVersion(version + 1)
+		keys = append(keys, ibytes.Cp(k))
+		return batch.Set(ibytes.Cp(k), buf.Bytes())
+	}); err != nil {
+		return err
+	}
+	if err := batch.WriteSync(); err != nil {
+		return err
 	}
 
+	ndb.mtx.Lock()
+	for _, k := range keys {
+		ndb.nodeCache.Remove(k[1:])
+	}
+	ndb.mtx.Unlock()
+	ndb.resetFirstVersion(0)
 	return nil
 }
 
 func (ndb *nodeDB) DeleteFastNode(key []byte) error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
-	if err := ndb.batch.Delete(ndb.fastNodeKey(key)); err != nil {
+	if err := ndb.fastBatch.Delete(ndb.fastNodeKey(key)); err != nil {
 		return err
 	}
 	ndb.fastNodeCache.Remove(key)
@@ -829,6 +1647,27 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 	if err != nil {
 		return 0, err
 	}
+	gaps, err := ndb.hasVersionGaps()
+	if err != nil {
+		return 0, err
+	}
+	if gaps {
+		// the versions are not contiguous, scan them from the recorded first version
+		bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(versionGapsKey)))
+		if err != nil {
+			return 0, err
+		}
+		from, err := strconv.ParseInt(string(bz), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("decoding %s: %w", versionGapsKey, err)
+		}
+		version, err := ndb.firstVersionFrom(from, latestVersion)
+		if err != nil {
+			return 0, err
+		}
+		ndb.resetFirstVersion(version)
+		return version, nil
+	}
 	for firstVersion < latestVersion {
 		version := (latestVersion + firstVersion) >> 1
 		has, err := ndb.hasVersion(version)
@@ -847,6 +1686,69 @@ func (ndb *nodeDB) getFirstVersion() (int64, error) {
 	return latestVersion, nil
 }
 
+// hasVersionGaps returns true if versions may be missing between the first and latest ones.
+func (ndb *nodeDB) hasVersionGaps() (bool, error) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if !ndb.versionGapsRead {
+		bz, err := ndb.db.Get(metadataKeyFormat.Key([]byte(versionGapsKey)))
+		if err != nil {
+			return false, err
+		}
+		ndb.versionGaps, ndb.versionGapsRead = bz != nil, true
+	}
+	return ndb.versionGaps, nil
+}
+
+// setVersionGaps records that versions may be missing from firstVersion on, to the batch.
+func (ndb *nodeDB) setVersionGaps(firstVersion int64) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.versionGaps, ndb.versionGapsRead = true, true
+	return ndb.batch.Set(metadataKeyFormat.Key([]byte(versionGapsKey)), []byte(strconv.FormatInt(firstVersion, 10)))
+}
+
+// firstVersionFrom returns the first existing version in [from, to], or 0 if there is none. It
+// seeks the roots, which are the nodes with nonce 1, skipping the other nodes of each version.
+func (ndb *nodeDB) firstVersionFrom(from, to int64) (int64, error) {
+	if _, ok := ndb.getStagedRoot(to); ok && from <= to {
+		// the staged version follows the committed ones
+		if version, err := ndb.firstVersionFrom(from, to-1); err != nil || version != 0 {
+			return version, err
+		}
+		return to, nil
+	}
+	for version := from; version <= to; {
+		itr, err := ndb.db.Iterator(nodeKeyFormat.Key(GetRootKey(version)), nodeKeyPrefixFormat.KeyInt64(to+1))
+		if err != nil {
+			return 0, err
+		}
+		var nk *NodeKey
+		if itr.Valid() {
+			var bz []byte
+			nodeKeyFormat.Scan(itr.Key(), &bz)
+			nk = GetNodeKey(bz)
+		}
+		err = itr.Error()
+		if closeErr := itr.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil || nk == nil {
+			return 0, err
+		}
+		switch nk.nonce {
+		case 1:
+			return nk.version, nil
+		case 0:
+			// a reformatted root precedes the root of its version, if any
+			version = nk.version
+		default:
+			version = nk.version + 1
+		}
+	}
+	return 0, nil
+}
+
 func (ndb *nodeDB) resetFirstVersion(version int64) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -898,6 +1800,9 @@ func (ndb *nodeDB) resetLegacyLatestVersion(version int64) {
 func (ndb *nodeDB) getLatestVersion() (bool, int64, error) {
 	ndb.mtx.Lock()
 	latestVersion := ndb.latestVersion
+	if ndb.stagedVersion > 0 {
+		latestVersion = ndb.stagedVersion
+	}
 	ndb.mtx.Unlock()
 
 	if latestVersion > 0 {
@@ -946,8 +1851,38 @@ func (ndb *nodeDB) resetLatestVersion(version int64) {
 	ndb.latestVersion = version
 }
 
+// stageVersion makes version, written to the batch with the root key rootKey and the new nodes
+// nodes, readable before the batch is committed, so that the earlier versions can be pruned in
+// the same batch. Calling it with version 0 ends the staging.
+func (ndb *nodeDB) stageVersion(version int64, rootKey []byte, nodes []*Node) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.stagedVersion, ndb.stagedRoot, ndb.stagedNodes = version, rootKey, nil
+	if version == 0 {
+		return
+	}
+	ndb.stagedNodes = make(map[string]*Node, len(nodes))
+	for _, node := range nodes {
+		ndb.stagedNodes[string(node.GetKey())] = node
+	}
+}
+
+// getStagedRoot returns the root key of version and true if it is the staged version, see
+// stageVersion.
+func (ndb *nodeDB) getStagedRoot(version int64) ([]byte, bool) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if version == 0 || version != ndb.stagedVersion {
+		return nil, false
+	}
+	return ndb.stagedRoot, true
+}
+
 // hasVersion checks if the given version exists.
 func (ndb *nodeDB) hasVersion(version int64) (bool, error) {
+	if _, ok := ndb.getStagedRoot(version); ok {
+		return true, nil
+	}
 	return ndb.db.Has(nodeKeyFormat.Key(GetRootKey(version)))
 }
 
@@ -956,8 +1891,73 @@ func (ndb *nodeDB) hasLegacyVersion(version int64) (bool, error) {
 	return ndb.db.Has(ndb.legacyRootKey(version))
 }
 
+// hasNode returns true if the node of nk is stored, looking it up like GetNode.
+func (ndb *nodeDB) hasNode(nk []byte) (bool, error) {
+	if ndb.nodeCache.Get(nk) != nil {
+		return true, nil
+	}
+	if len(nk) == hashSize {
+		return ndb.db.Has(ndb.legacyNodeKey(nk))
+	}
+	has, err := ndb.db.Has(ndb.nodeKey(nk))
+	if err != nil || has {
+		return has, err
+	}
+	// the root may be reformatted by pruning
+	if nKey := GetNodeKey(nk); nKey.nonce == 1 {
+		return ndb.db.Has(ndb.nodeKey((&NodeKey{version: nKey.version, nonce: 0}).GetKey()))
+	}
+	return false, nil
+}
+
+// isRootMissing returns true if version is in the version index but its root node is missing.
+func (ndb *nodeDB) isRootMissing(version int64) (bool, error) {
+	rootKey, err := ndb.GetRoot(version)
+	if errors.Is(err, ErrVersionRootMissing) {
+		return true, nil
+	}
+	if errors.Is(err, ErrVersionDoesNotExist) {
+		return false, nil
+	}
+	if err != nil || rootKey == nil {
+		return false, err
+	}
+	has, err := ndb.hasNode(rootKey)
+	return !has, err
+}
+
+// deleteDanglingVersions removes the version index entries of versions, whose root nodes are
+// missing, and commits.
+func (ndb *nodeDB) deleteDanglingVersions(versions []int64) error {
+	ndb.mtx.Lock()
+	for _, version := range versions {
+		rootKey := GetRootKey(version)
+		if err := ndb.batch.Delete(nodeKeyFormat.Key(rootKey)); err != nil {
+			ndb.mtx.Unlock()
+			return err
+		}
+		if err := ndb.batch.Delete(ndb.legacyRootKey(version)); err != nil {
+			ndb.mtx.Unlock()
+			return err
+		}
+		ndb.nodeCache.Remove(rootKey)
+	}
+	ndb.mtx.Unlock()
+	if err := ndb.Commit(); err != nil {
+		return err
+	}
+
+	ndb.resetFirstVersion(0)
+	ndb.resetLatestVersion(0)
+	ndb.resetLegacyLatestVersion(0)
+	return nil
+}
+
 // GetRoot gets the nodeKey of the root for the specific version.
 func (ndb *nodeDB) GetRoot(version int64) ([]byte, error) {
+	if rootKey, ok := ndb.getStagedRoot(version); ok {
+		return rootKey, nil
+	}
 	rootKey := GetRootKey(version)
 	val, err := ndb.db.Get(nodeKeyFormat.Key(rootKey))
 	if err != nil {
@@ -997,7 +1997,7 @@ func (ndb *nodeDB) GetRoot(version int64) ([]byte, error) {
 					return nil, err
 				}
 				if val == nil {
-					return nil, ErrVersionDoesNotExist
+					return nil, fmt.Errorf("%w: version %d references the root of version %d", ErrVersionRootMissing, version, nk.version)
 				}
 				return rnk.GetKey(), nil
 			}
@@ -1019,6 +2019,159 @@ func (ndb *nodeDB) SaveEmptyRoot(version int64) error {
 	return ndb.batch.Set(nodeKeyFormat.Key(GetRootKey(version)), []byte{})
 }
 
+// SaveVersionMeta saves the metadata blob of the version.
+func (ndb *nodeDB) SaveVersionMeta(version int64, meta []byte) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Set(versionMetaKeyFormat.KeyInt64(version), meta)
+}
+
+// getVersionMeta returns the metadata blob of the version, or nil if there is none.
+func (ndb *nodeDB) getVersionMeta(version int64) ([]byte, error) {
+	return ndb.db.Get(versionMetaKeyFormat.KeyInt64(version))
+}
+
+// saveNodeSequence records that the version numbers count new nodes with their nonces, after the
+// nodes of the previous versions recorded, from the sequence number following theirs. The record
+// is the first sequence number as a varint followed by count as a uvarint, and once the version
+// is deleted, the number of its nodes left as a uvarint, see releaseNodeSequences.
+func (ndb *nodeDB) saveNodeSequence(version int64, count uint32) error {
+	itr, err := ndb.db.ReverseIterator(nodeSequenceKeyFormat.KeyInt64(0), nodeSequenceKeyFormat.KeyInt64(version))
+	if err != nil {
+		return err
+	}
+	first := int64(1)
+	if itr.Valid() {
+		prevFirst, prevCount, _, _, err := decodeNodeSequence(itr.Value())
+		if err != nil {
+			itr.Close()
+			return err
+		}
+		first = prevFirst + int64(prevCount)
+	}
+	if err := itr.Error(); err != nil {
+		itr.Close()
+		return err
+	}
+	if err := itr.Close(); err != nil {
+		return err
+	}
+
+	bz := binary.AppendVarint(nil, first)
+	bz = binary.AppendUvarint(bz, uint64(count))
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	return ndb.batch.Set(nodeSequenceKeyFormat.KeyInt64(version), bz)
+}
+
+// getNodeSequence returns the sequence number of the node with the given node key, recorded by
+// saveNodeSequence.
+func (ndb *nodeDB) getNodeSequence(nk *NodeKey) (int64, error) {
+	bz, err := ndb.db.Get(nodeSequenceKeyFormat.KeyInt64(nk.version))
+	if err != nil {
+		return 0, err
+	}
+	if bz == nil {
+		return 0, fmt.Errorf("%w: version %d", ErrNodeSequenceNotTracked, nk.version)
+	}
+	first, count, _, _, err := decodeNodeSequence(bz)
+	if err != nil {
+		return 0, err
+	}
+	nonce := nk.nonce
+	if nonce == 0 {
+		// a root reformatted by the pruning was saved with nonce 1
+		nonce = 1
+	}
+	if nonce > count {
+		return 0, fmt.Errorf("node %v is beyond the %d nodes recorded for its version", nk, count)
+	}
+	return first + int64(nonce) - 1, nil
+}
+
+// releaseNodeSequences updates the node sequence records after the deletion of version, which
+// orphaned the given number of nodes of each version. The deleted versions whose nodes are still
+// part of the next versions keep their record with the number of nodes left, and a record is
+// deleted along with the last node of its version.
+func (ndb *nodeDB) releaseNodeSequences(version int64, orphaned map[int64]uint32) error {
+	versions := make([]int64, 0, len(orphaned)+1)
+	if _, ok := orphaned[version]; !ok {
+		versions = append(versions, version)
+	}
+	for v := range orphaned {
+		versions = append(versions, v)
+	}
+	for _, v := range versions {
+		ndb.mtx.Lock()
+		bz, pending := ndb.nodeSequences[v]
+		ndb.mtx.Unlock()
+		if !pending {
+			var err error
+			if bz, err = ndb.db.Get(nodeSequenceKeyFormat.KeyInt64(v)); err != nil {
+				return err
+			}
+		}
+		if bz == nil {
+			continue
+		}
+		first, count, remaining, released, err := decodeNodeSequence(bz)
+		if err != nil {
+			return err
+		}
+		if v != version && !released {
+			// the version was deleted before the nodes left were recorded
+			continue
+		}
+
+		key := nodeSequenceKeyFormat.KeyInt64(v)
+		bz = nil
+		if orphaned[v] < remaining {
+			bz = binary.AppendVarint(nil, first)
+			bz = binary.AppendUvarint(bz, uint64(count))
+			bz = binary.AppendUvarint(bz, uint64(remaining-orphaned[v]))
+		}
+		ndb.mtx.Lock()
+		if bz == nil {
+			err = ndb.batch.Delete(key)
+		} else {
+			err = ndb.batch.Set(key, bz)
+		}
+		if err == nil {
+			if ndb.nodeSequences == nil {
+				ndb.nodeSequences = make(map[int64][]byte)
+			}
+			ndb.nodeSequences[v] = bz
+		}
+		ndb.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeNodeSequence decodes a record of saveNodeSequence. released reports whether the number
+// of nodes left of the deleted version is recorded, as remaining, which is count otherwise.
+func decodeNodeSequence(bz []byte) (first int64, count, remaining uint32, released bool, err error) {
+	first, n := binary.Varint(bz)
+	if n <= 0 {
+		return 0, 0, 0, false, errors.New("invalid node sequence record")
+	}
+	c, m := binary.Uvarint(bz[n:])
+	if m <= 0 || c > math.MaxUint32 {
+		return 0, 0, 0, false, errors.New("invalid node sequence record")
+	}
+	count, remaining = uint32(c), uint32(c)
+	if rest := bz[n+m:]; len(rest) > 0 {
+		r, k := binary.Uvarint(rest)
+		if k <= 0 || r > c {
+			return 0, 0, 0, false, errors.New("invalid node sequence record")
+		}
+		remaining, released = uint32(r), true
+	}
+	return first, count, remaining, released, nil
+}
+
 // SaveRoot saves the root when no updates.
 func (ndb *nodeDB) SaveRoot(version int64, nk *NodeKey) error {
 	ndb.mtx.Lock()
@@ -1029,7 +2182,20 @@ func (ndb *nodeDB) SaveRoot(version int64, nk *NodeKey) error {
 
 // Traverse fast nodes and return error if any, nil otherwise
 func (ndb *nodeDB) traverseFastNodes(fn func(k, v []byte) error) error {
-	return ndb.traversePrefix(fastKeyFormat.Key(), fn)
+	prefix := fastKeyFormat.Key()
+	itr, err := ndb.fastDB.Iterator(ibytes.Cp(prefix), ibytes.CpIncr(prefix))
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+
+	for ; itr.Valid(); itr.Next() {
+		if err := fn(itr.Key(), itr.Value()); err != nil {
+			return err
+		}
+	}
+
+	return itr.Error()
 }
 
 // Traverse all keys and return error if any, nil otherwise
@@ -1104,30 +2270,130 @@ func (ndb *nodeDB) getFastIterator(start, end []byte, ascending bool) (corestore
 	}
 
 	if ascending {
-		return ndb.db.Iterator(startFormatted, endFormatted)
+		return ndb.fastDB.Iterator(startFormatted, endFormatted)
 	}
 
-	return ndb.db.ReverseIterator(startFormatted, endFormatted)
+	return ndb.fastDB.ReverseIterator(startFormatted, endFormatted)
+}
+
+// reserveBatch hints the batch about the number of bytes to be written until the next Commit.
+func (ndb *nodeDB) reserveBatch(size int) error {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+
+	if batch, ok := ndb.batch.(*BatchWithFlusher); ok {
+		return batch.Reserve(size)
+	}
+	return nil
 }
 
-// Write to disk.
+// Write to disk. When the fast index is stored in a separate db, its batch is written first and
+// a failure discards both batches. If the main batch fails after the fast batch was written, the
+// fast index is ahead of the tree, which the error wraps errFastIndexAhead for, and is rebuilt on
+// the next load.
 func (ndb *nodeDB) Commit() error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
-	var err error
-	if ndb.opts.Sync {
-		err = ndb.batch.WriteSync()
-	} else {
-		err = ndb.batch.Write()
+	if ndb.flushesHeld {
+		// the batches hold a prepared version, which only its handle can commit
+		return ErrCommitPrepared
 	}
-	if err != nil {
+
+	if ndb.opts.FastNodeDB != nil {
+		if err := ndb.writeBatch(ndb.fastBatch); err != nil {
+			ndb.discardBatches()
+			return fmt.Errorf("failed to write fast node batch, %w", err)
+		}
+	}
+	if err := ndb.writeBatch(ndb.batch); err != nil {
+		if ndb.opts.FastNodeDB != nil {
+			ndb.discardBatches()
+			return fmt.Errorf("%w: failed to write batch, %w", errFastIndexAhead, err)
+		}
 		return fmt.Errorf("failed to write batch, %w", err)
 	}
+	ndb.nodeSequences = nil
 
 	return nil
 }
 
+func (ndb *nodeDB) writeBatch(batch corestore.Batch) error {
+	if ndb.opts.Sync {
+		return batch.WriteSync()
+	}
+	return batch.Write()
+}
+
+// newBatches returns the batches of db and fastDB, which share the same batch unless
+// Options.FastNodeDB is set.
+func newBatches(db, fastDB corestore.KVStoreWithBatch, opts Options) (batch, fastBatch corestore.Batch) {
+	batch = NewBatchWithFlusher(db, opts.FlushThreshold)
+	fastBatch = batch
+	if opts.FastNodeDB != nil {
+		fastBatch = NewBatchWithFlusher(fastDB, opts.FlushThreshold)
+	}
+	return batch, fastBatch
+}
+
+// holdFlushes makes the batches keep their writes when held is true, see
+// BatchWithFlusher.holdFlushes, and makes Commit fail until they are released.
+func (ndb *nodeDB) holdFlushes(held bool) {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	ndb.flushesHeld = held
+	for _, batch := range []corestore.Batch{ndb.batch, ndb.fastBatch} {
+		if batch, ok := batch.(*BatchWithFlusher); ok {
+			batch.holdFlushes(held)
+		}
+	}
+}
+
+// discardBatches drops the pending writes of both batches, along with the cached fast nodes
+// and storage version they may have changed. It must be called with the lock held.
+func (ndb *nodeDB) discardBatches() {
+	if err := ndb.batch.Close(); err != nil {
+		ndb.logger.Error("failed to close batch", "err", err)
+	}
+	if err := ndb.fastBatch.Close(); err != nil {
+		ndb.logger.Error("failed to close fast node batch", "err", err)
+	}
+	ndb.batch, ndb.fastBatch = newBatches(ndb.db, ndb.fastDB, ndb.opts)
+	ndb.flushesHeld = false
+	ndb.nodeSequences = nil
+	ndb.fastNodeCache = cache.New(fastNodeCacheSize)
+	ndb.storageVersion = readStorageVersion(ndb.fastDB)
+}
+
+// trimCaches evicts the least recently used nodes of the caches until their estimated memory size
+// is at most targetBytes, half of which at most is left to the fast node cache, and returns the
+// remaining size. The evicted nodes are read from the database again when needed.
+func (ndb *nodeDB) trimCaches(targetBytes int64) int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	if targetBytes < 0 {
+		targetBytes = 0
+	}
+	fastBytes := ndb.fastNodeCache.Trim(targetBytes/2, cachedNodeSize)
+	return fastBytes + ndb.nodeCache.Trim(targetBytes-fastBytes, cachedNodeSize)
+}
+
+// cachedNodeSize estimates the memory held by a cached node.
+func cachedNodeSize(n cache.Node) int64 {
+	switch n := n.(type) {
+	case *Node:
+		size := unsafe.Sizeof(Node{}) + uintptr(len(n.key)+len(n.value)+len(n.hash)+len(n.leftNodeKey)+len(n.rightNodeKey))
+		if n.nodeKey != nil {
+			size += unsafe.Sizeof(NodeKey{})
+		}
+		return int64(size)
+	case *fastnode.Node:
+		return int64(unsafe.Sizeof(fastnode.Node{})) + int64(len(n.GetKey())+len(n.GetValue()))
+	default:
+		return int64(len(n.GetKey()))
+	}
+}
+
 func (ndb *nodeDB) incrVersionReaders(version int64) {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
@@ -1145,6 +2411,53 @@ func (ndb *nodeDB) decrVersionReaders(version int64) {
 	}
 }
 
+// limitIterators opens an iterator with newIterator, unless Options.MaxOpenIterators iterators
+// are open. The iterator is counted until it is closed.
+func (ndb *nodeDB) limitIterators(newIterator func() corestore.Iterator) (corestore.Iterator, error) {
+	if ndb == nil || ndb.opts.MaxOpenIterators <= 0 {
+		return newIterator(), nil
+	}
+	ndb.mtx.Lock()
+	if ndb.openIterators >= ndb.opts.MaxOpenIterators {
+		ndb.mtx.Unlock()
+		return nil, fmt.Errorf("%w: %d iterators are open", ErrTooManyIterators, ndb.openIterators)
+	}
+	ndb.openIterators++
+	ndb.mtx.Unlock()
+	return &countedIterator{Iterator: newIterator(), ndb: ndb}, nil
+}
+
+// countedIterator is an iterator counted by nodeDB.limitIterators.
+type countedIterator struct {
+	corestore.Iterator
+	ndb    *nodeDB
+	closed bool
+}
+
+// Close implements dbm.Iterator
+func (iter *countedIterator) Close() error {
+	if !iter.closed {
+		iter.closed = true
+		iter.ndb.mtx.Lock()
+		iter.ndb.openIterators--
+		iter.ndb.mtx.Unlock()
+	}
+	return iter.Iterator.Close()
+}
+
+// firstPinnedVersion returns the first pinned version in [from, to], or 0 if there is none.
+func (ndb *nodeDB) firstPinnedVersion(from, to int64) int64 {
+	ndb.mtx.Lock()
+	defer ndb.mtx.Unlock()
+	first := int64(0)
+	for v := range ndb.pinnedVersions {
+		if v >= from && v <= to && (first == 0 || v < first) {
+			first = v
+		}
+	}
+	return first
+}
+
 func isReferenceRoot(bz []byte) (bool, int) {
 	if bz[0] == nodeKeyFormat.Prefix()[0] {
 		return true, len(bz)
@@ -1192,7 +2505,7 @@ func (ndb *nodeDB) traverseOrphansWithRootkeyCache(cache *rootkeyCache, prevVers
 		}
 		pNode := prevIter.GetNode()
 
-		if orgNode != nil && bytes.Equal(pNode.hash, orgNode.hash) {
+		if orgNode != nil && isSameNode(pNode, orgNode) {
 			prevIter.Next(true)
 			orgNode = nil
 		} else {
@@ -1209,6 +2522,7 @@ func (ndb *nodeDB) traverseOrphansWithRootkeyCache(cache *rootkeyCache, prevVers
 
 // Close the nodeDB.
 func (ndb *nodeDB) Close() error {
+	ndb.closed.Store(true)
 	ndb.cancel()
 
 	if ndb.opts.AsyncPruning {
@@ -1218,14 +2532,43 @@ func (ndb *nodeDB) Close() error {
 	ndb.mtx.Lock()
 	defer ndb.mtx.Unlock()
 
-	if ndb.batch != nil {
-		if err := ndb.batch.Close(); err != nil {
+	if ndb.batch == nil {
+		return nil
+	}
+
+	// the deletions of async pruning are only written by the next commit
+	if ndb.opts.AsyncPruning {
+		if err := ndb.writeBatch(ndb.batch); err != nil {
+			return fmt.Errorf("failed to write batch, %w", err)
+		}
+	}
+	if err := ndb.batch.Close(); err != nil {
+		return err
+	}
+	ndb.batch = nil
+	if ndb.opts.FastNodeDB != nil {
+		if err := ndb.fastBatch.Close(); err != nil {
+			return err
+		}
+	}
+	ndb.fastBatch = nil
+
+	// the db is only closed on request since it can be used by other trees
+	if ndb.opts.CloseDB {
+		if err := closeDB(ndb.db); err != nil {
 			return err
 		}
-		ndb.batch = nil
+		if ndb.opts.FastNodeDB != nil {
+			return closeDB(ndb.fastDB)
+		}
 	}
+	return nil
+}
 
-	// skip the db.Close() since it can be used by other trees
+func closeDB(db corestore.KVStoreWithBatch) error {
+	if closer, ok := db.(io.Closer); ok {
+		return closer.Close()
+	}
 	return nil
 }
 
@@ -1319,7 +2662,7 @@ func (ndb *nodeDB) traverseNodes(fn func(node *Node) error) error {
 		if isRef, _ := isReferenceRoot(value); isRef {
 			return nil
 		}
-		node, err := MakeNode(key[1:], value)
+		node, err := ndb.makeNode(key[1:], value)
 		if err != nil {
 			return err
 		}
@@ -1429,3 +2772,11 @@ func (ndb *nodeDB) String() (string, error) {
 }
 
 var ErrNodeMissingNodeKey = errors.New("node does not have a nodeKey")
+
+// ErrNodeHashMismatch is returned when a node read from disk does not match its hash, with
+// Options.VerifyNodeHashOnRead.
+var ErrNodeHashMismatch = errors.New("node does not match its hash")
+
+// ErrNodeCollision is returned by SaveVersion with Options.OnHashCollision when a node with
+// different contents is stored at the node key of a new node.
+var ErrNodeCollision = errors.New("a different node is stored at the node key")
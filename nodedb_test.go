@@ -1,6 +1,7 @@
 package iavl
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"strconv"
@@ -11,6 +12,7 @@ import (
 	gomock "go.uber.org/mock/gomock"
 
 	dbm "github.com/cosmos/iavl/db"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
 	"github.com/cosmos/iavl/mock"
 )
 
@@ -447,6 +449,45 @@ func TestCloseNodeDB(t *testing.T) {
 	require.NoError(t, ndb.Close()) // must not block or fail on second call
 }
 
+func TestOnBackgroundError(t *testing.T) {
+	errCh := make(chan error, 1)
+	var ndb *nodeDB
+	onError := func(err error) {
+		// no lock is held while calling the handler
+		locked := ndb.mtx.TryLock()
+		if locked {
+			ndb.mtx.Unlock()
+		} else {
+			err = errors.New("handler called while holding the lock")
+		}
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), AsyncPruningOption(true), OnBackgroundErrorOption(onError))
+	ndb = tree.ndb
+	for i := 0; i < 3; i++ {
+		_, err := tree.Set([]byte("key"), []byte{byte(i)})
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// an active reader makes the background pruning fail
+	ndb.incrVersionReaders(1)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+
+	select {
+	case err := <-errCh:
+		require.ErrorContains(t, err, "unable to delete version 1 with 1 active readers")
+	case <-time.After(5 * time.Second):
+		t.Fatal("background error was not reported")
+	}
+	ndb.decrVersionReaders(1)
+	require.NoError(t, tree.Close())
+}
+
 func TestGetFirstNonLegacyVersion(t *testing.T) {
 	db := dbm.NewMemDB()
 	ndb := newNodeDB(db, 0, DefaultOptions(), NewNopLogger())
@@ -486,3 +527,134 @@ func TestGetFirstNonLegacyVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, int64(2), firstVersion) // Should still return the first non-legacy version
 }
+
+func TestNodeKeysGroupedByVersion(t *testing.T) {
+	tree := getTestTree(0)
+	for v := 1; v <= 3; v++ {
+		for i := 0; i < 20; i++ {
+			_, err := tree.Set([]byte{byte(i)}, []byte{byte(v)})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// all the nodes created at a version share the version prefix
+	total := 0
+	for v := int64(1); v <= 3; v++ {
+		err := tree.ndb.traversePrefix(nodeKeyPrefixFormat.KeyInt64(v), func(k, _ []byte) error {
+			require.Equal(t, v, GetNodeKey(k[1:]).version)
+			total++
+			return nil
+		})
+		require.NoError(t, err)
+	}
+	count := 0
+	require.NoError(t, tree.ndb.traverseNodes(func(*Node) error {
+		count++
+		return nil
+	}))
+	require.Equal(t, count, total)
+
+	// reads and proofs are unaffected by pruning
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	itree, err := tree.GetImmutable(3)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		value, err := itree.Get([]byte{byte(i)})
+		require.NoError(t, err)
+		require.Equal(t, []byte{3}, value)
+		proof, err := itree.GetMembershipProof([]byte{byte(i)})
+		require.NoError(t, err)
+		ok, err := itree.VerifyMembership(proof, []byte{byte(i)})
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+}
+
+func TestNodeDB_VerifyNodeHashOnRead(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for i := 0; i < 20; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	// an intact store passes the verification
+	_, err = NewMutableTree(db, 0, true, NewNopLogger(), VerifyNodeHashOnReadOption(true)).Load()
+	require.NoError(t, err)
+
+	// corrupt the value of the leaf of key 7
+	itr, err := db.Iterator(nodeKeyFormat.Prefix(), ibytes.CpIncr(nodeKeyFormat.Prefix()))
+	require.NoError(t, err)
+	corrupted := false
+	for ; itr.Valid(); itr.Next() {
+		node, err := MakeNode(itr.Key()[1:], itr.Value())
+		require.NoError(t, err)
+		if !node.isLeaf() || !bytes.Equal(node.key, []byte{7}) {
+			continue
+		}
+		node.value = []byte{0xff}
+		var buf bytes.Buffer
+		require.NoError(t, node.writeBytes(&buf))
+		require.NoError(t, db.Set(bytes.Clone(itr.Key()), buf.Bytes()))
+		corrupted = true
+	}
+	require.NoError(t, itr.Close())
+	require.True(t, corrupted)
+
+	for _, verify := range []bool{false, true} {
+		tree := NewMutableTree(db, 0, true, NewNopLogger(), VerifyNodeHashOnReadOption(verify))
+		_, err := tree.Load()
+		require.NoError(t, err)
+		value, err := tree.Get([]byte{7})
+		if verify {
+			require.ErrorIs(t, err, ErrNodeHashMismatch)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, []byte{0xff}, value)
+		}
+		// the other branches are unaffected
+		value, err = tree.Get([]byte{17})
+		require.NoError(t, err)
+		require.Equal(t, []byte{17}, value)
+	}
+}
+
+// countingGetDB is a MemDB counting the reads of single keys.
+type countingGetDB struct {
+	*dbm.MemDB
+	gets int
+}
+
+func (db *countingGetDB) Get(key []byte) ([]byte, error) {
+	db.gets++
+	return db.MemDB.Get(key)
+}
+
+func TestNodeDB_VerifyNodeHashOnReadReadsOnce(t *testing.T) {
+	db := &countingGetDB{MemDB: dbm.NewMemDB()}
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte{byte(i)}, []byte{byte(i)})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	// the children read to verify a node are not read again when they are traversed
+	tree = NewMutableTree(db, 1000, true, NewNopLogger(), VerifyNodeHashOnReadOption(true))
+	_, err = tree.Load()
+	require.NoError(t, err)
+	db.gets = 0
+	itr := NewIterator(nil, nil, true, tree.ImmutableTree)
+	keys := 0
+	for ; itr.Valid(); itr.Next() {
+		keys++
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, 50, keys)
+	// all the nodes but the root and its children, which are read on load to verify the root
+	require.Equal(t, 2*50-1-3, db.gets)
+}
@@ -1,6 +1,11 @@
 package iavl
 
-import "sync/atomic"
+import (
+	"io"
+	"sync/atomic"
+
+	corestore "cosmossdk.io/core/store"
+)
 
 // Statisc about db runtime state
 type Statistics struct {
@@ -88,6 +93,141 @@ type Options struct {
 	// AsyncPruning is a flag to enable async pruning
 	AsyncPruning bool
 
+	// HashLeafValues makes membership proofs carry the SHA256 hash of the leaf value instead
+	// of the raw value, so proofs stay constant-size regardless of value length. Leaf hashes
+	// already commit to H(value), so root hashes are unaffected. Proofs generated in this mode
+	// must be verified against ValueHashSpec with the hashed value.
+	HashLeafValues bool
+
+	// NoHash skips computing node hashes, for throwaway trees that never need a root hash or
+	// proofs. Hash and WorkingHash return nil and SaveVersion returns a nil hash, while proofs
+	// and RootHashes fail with ErrHashingDisabled.
+	NoHash bool
+
+	// LoadParallelism is the maximum number of trees LoadTreesParallel loads at once. Defaults
+	// to GOMAXPROCS when zero.
+	LoadParallelism int
+
+	// LoadCacheSize, LoadSkipFastStorageUpgrade and LoadLogger are passed to NewMutableTree for
+	// the trees opened by LoadTreesParallel. LoadLogger defaults to a no-op logger when nil.
+	LoadCacheSize              int
+	LoadSkipFastStorageUpgrade bool
+	LoadLogger                 Logger
+
+	// FastNodeDB stores the fast index in a separate database instead of the tree's database,
+	// e.g. to put it on faster storage. Its batch is committed along with the tree's batch and
+	// the two are cross-checked for version consistency on load, rebuilding the fast index on
+	// mismatch.
+	FastNodeDB corestore.KVStoreWithBatch
+
+	// KeepRecentVersions makes SaveVersion keep only the last N versions, deleting the older
+	// ones in the same batch as the new version, which is read from the batch for the orphans of
+	// the previous one, so that a failed deletion fails SaveVersion. With AsyncPruning the
+	// deletions are handed to the pruning routine instead, and its errors are reported to
+	// OnBackgroundError. Zero keeps all versions.
+	KeepRecentVersions int64
+
+	// CloseDB makes MutableTree.Close close the database, and the FastNodeDB if set. Leave it
+	// unset when the database is shared with other trees.
+	CloseDB bool
+
+	// OnBackgroundError is called with the errors of background operations such as async
+	// pruning, which are otherwise only logged. It is called without holding any tree lock.
+	OnBackgroundError func(err error)
+
+	// ShadowVerify makes MutableTree keep an in-memory copy of its contents, mirroring every
+	// Set and Remove, and cross-check Get results and, after SaveVersion, a full iteration
+	// against it. The iteration follows the save, so its read errors are logged and reported to
+	// OnBackgroundError. It holds the whole store in memory, so only use it for small stores.
+	ShadowVerify bool
+
+	// ShadowSampleRate is the fraction of the Get and SaveVersion calls that are cross-checked
+	// with ShadowVerify. Zero checks every call.
+	ShadowSampleRate float64
+
+	// OnShadowMismatch is called with ShadowVerify for every key whose value in the tree
+	// differs from the shadow copy, after logging it. A nil value means the key is missing.
+	OnShadowMismatch func(key, expected, actual []byte)
+
+	// IteratorPrefetch makes tree iterators read up to this many pairs ahead in a background
+	// goroutine, overlapping the reads of slow databases with the processing of the caller.
+	// Zero disables prefetching.
+	IteratorPrefetch int
+
+	// WAL is a write-ahead log for crash recovery. SaveVersion appends the Set and Remove
+	// operations of the version to it before writing the nodes, and a completion record once
+	// they are committed, and MutableTree.RecoverFromWAL replays an incomplete version. A failed
+	// write of the completion record does not fail SaveVersion, since the version is saved: it is
+	// logged and reported to OnBackgroundError. The log only grows: it may be truncated whenever
+	// the last version is complete.
+	WAL io.ReadWriter
+
+	// KeyValidator, if set, is called with the key of every Set and Remove before the tree is
+	// modified. A returned error rejects the write, wrapped in ErrInvalidKey.
+	KeyValidator func(key []byte) error
+
+	// ValueTransform, if set, transforms the values of the leaf nodes and fast nodes written to the
+	// database, e.g. to encrypt them, and reverses the transformation when reading them. The
+	// hashes and proofs are computed from the original values, so they do not depend on it. It
+	// must be set for all the uses of a database once values were written with it. Nodes in the
+	// legacy format are read as they are.
+	ValueTransform ValueTransform
+
+	// VerifyNodeHashOnRead, if set, recomputes the hash of every inner node read from disk from
+	// the hashes of its children, which are read too, and fails the read with ErrNodeHashMismatch
+	// if it differs from the stored one. Reads become several times slower.
+	VerifyNodeHashOnRead bool
+
+	// SkipNoOpSets, if set, makes a Set of the value a key already has a no-op, which leaves the
+	// leaf and its version unchanged instead of rewriting the path to it. It costs a Get per Set.
+	SkipNoOpSets bool
+
+	// Pruner, if set, is asked for the versions to delete after each saved version, which are
+	// deleted like with MutableTree.PruneWithPolicy in the same batch as the new version, after
+	// the ones of KeepRecentVersions. As with KeepRecentVersions, a failure fails SaveVersion and
+	// leaves the previous version as the latest one, so that no pruning error goes unnoticed. It
+	// can be combined with KeepRecentVersions, but not with AsyncPruning.
+	Pruner Pruner
+
+	// MaxOpenIterators, if positive, limits the number of iterators of the tree which are open at
+	// once, including the iterators of its immutable versions, so that leaked iterators are
+	// detected before they exhaust the database resources. Opening one more fails with
+	// ErrTooManyIterators.
+	MaxOpenIterators int
+
+	// NilValueSemantics selects what MutableTree.Set does with a nil value. By default, it fails
+	// and the tree is unchanged.
+	NilValueSemantics NilValueSemantics
+
+	// FastIndexCheckRate is the fraction of the reads answered by the fast index which are
+	// cross-checked with the tree, from 0, which disables the check, to 1. On mismatch, the read
+	// returns the value of the tree, which is authoritative, and OnFastIndexMismatch is called.
+	FastIndexCheckRate float64
+
+	// OnFastIndexMismatch is called with FastIndexCheckRate for every key whose value in the fast
+	// index differs from the value in the tree, after logging it. A nil value means the key is
+	// missing.
+	OnFastIndexMismatch func(key, fastValue, value []byte)
+
+	// TrackNodeSequence records the creation order of the nodes saved by SaveVersion across all
+	// the versions, read with MutableTree.GetNodeSequence. It does not change the node hashes. The
+	// record of a version is deleted by the pruning along with the last node of the version, as
+	// long as the option is set.
+	TrackNodeSequence bool
+
+	// OnHashCollision is called when SaveVersion finds a stored node at the node key of a new
+	// node with different contents, e.g. nodes left by a write which never committed its version,
+	// instead of overwriting it. The nodes are addressed by their node key, the version and nonce,
+	// rather than their hash, so this is how two nodes can map to the same storage key. The
+	// version is then not saved, and SaveVersion returns ErrNodeCollision. The check reads the
+	// database once per new node, and is only done if set.
+	OnHashCollision func(existing, incoming *Node)
+
+	// PreCommit is called by SaveVersion and PrepareCommit with the changes of the working tree,
+	// as returned by MutableTree.PendingChanges, before anything is written. An error aborts the
+	// save, and is returned with the working tree left unchanged.
+	PreCommit func(cs ChangeSet) error
+
 	initialVersionSet bool
 }
 
@@ -96,6 +236,15 @@ func DefaultOptions() Options {
 	return Options{FlushThreshold: 100000}
 }
 
+// withDefaultOptions returns opts with its zero fields set to their value in DefaultOptions.
+func withDefaultOptions(opts Options) Options {
+	defaults := DefaultOptions()
+	if opts.FlushThreshold == 0 {
+		opts.FlushThreshold = defaults.FlushThreshold
+	}
+	return opts
+}
+
 // SyncOption sets the Sync option.
 func SyncOption(sync bool) Option {
 	return func(opts *Options) {
@@ -131,3 +280,180 @@ func AsyncPruningOption(asyncPruning bool) Option {
 		opts.AsyncPruning = asyncPruning
 	}
 }
+
+// HashLeafValuesOption sets the HashLeafValues option.
+func HashLeafValuesOption(hashLeafValues bool) Option {
+	return func(opts *Options) {
+		opts.HashLeafValues = hashLeafValues
+	}
+}
+
+// NoHashOption sets the NoHash option.
+func NoHashOption(noHash bool) Option {
+	return func(opts *Options) {
+		opts.NoHash = noHash
+	}
+}
+
+// LoadParallelismOption sets the LoadParallelism option.
+func LoadParallelismOption(n int) Option {
+	return func(opts *Options) {
+		opts.LoadParallelism = n
+	}
+}
+
+// FastNodeDBOption sets the FastNodeDB option.
+func FastNodeDBOption(db corestore.KVStoreWithBatch) Option {
+	return func(opts *Options) {
+		opts.FastNodeDB = db
+	}
+}
+
+// KeepRecentVersionsOption sets the KeepRecentVersions option.
+func KeepRecentVersionsOption(n int64) Option {
+	return func(opts *Options) {
+		opts.KeepRecentVersions = n
+	}
+}
+
+// CloseDBOption sets the CloseDB option.
+func CloseDBOption(closeDB bool) Option {
+	return func(opts *Options) {
+		opts.CloseDB = closeDB
+	}
+}
+
+// OnBackgroundErrorOption sets the OnBackgroundError handler.
+func OnBackgroundErrorOption(fn func(err error)) Option {
+	return func(opts *Options) {
+		opts.OnBackgroundError = fn
+	}
+}
+
+// ShadowVerifyOption sets the ShadowVerify option and its sample rate.
+func ShadowVerifyOption(sampleRate float64) Option {
+	return func(opts *Options) {
+		opts.ShadowVerify = true
+		opts.ShadowSampleRate = sampleRate
+	}
+}
+
+// OnShadowMismatchOption sets the OnShadowMismatch handler.
+func OnShadowMismatchOption(fn func(key, expected, actual []byte)) Option {
+	return func(opts *Options) {
+		opts.OnShadowMismatch = fn
+	}
+}
+
+// IteratorPrefetchOption sets the IteratorPrefetch option.
+func IteratorPrefetchOption(n int) Option {
+	return func(opts *Options) {
+		opts.IteratorPrefetch = n
+	}
+}
+
+// WALOption sets the WAL option.
+func WALOption(wal io.ReadWriter) Option {
+	return func(opts *Options) {
+		opts.WAL = wal
+	}
+}
+
+// KeyValidatorOption sets the KeyValidator option.
+func KeyValidatorOption(fn func(key []byte) error) Option {
+	return func(opts *Options) {
+		opts.KeyValidator = fn
+	}
+}
+
+// ValueTransformOption sets the ValueTransform option.
+func ValueTransformOption(transform ValueTransform) Option {
+	return func(opts *Options) {
+		opts.ValueTransform = transform
+	}
+}
+
+// ValueTransform transforms the values stored in the database, see Options.ValueTransform. Decode
+// must return the value passed to Encode for the same key.
+type ValueTransform interface {
+	Encode(key, value []byte) []byte
+	Decode(key, stored []byte) []byte
+}
+
+// VerifyNodeHashOnReadOption sets the VerifyNodeHashOnRead option.
+func VerifyNodeHashOnReadOption(verify bool) Option {
+	return func(opts *Options) {
+		opts.VerifyNodeHashOnRead = verify
+	}
+}
+
+// SkipNoOpSetsOption sets the SkipNoOpSets option.
+func SkipNoOpSetsOption(skip bool) Option {
+	return func(opts *Options) {
+		opts.SkipNoOpSets = skip
+	}
+}
+
+// PrunerOption sets the Pruner option.
+func PrunerOption(pruner Pruner) Option {
+	return func(opts *Options) {
+		opts.Pruner = pruner
+	}
+}
+
+// MaxOpenIteratorsOption sets the MaxOpenIterators option.
+func MaxOpenIteratorsOption(n int) Option {
+	return func(opts *Options) {
+		opts.MaxOpenIterators = n
+	}
+}
+
+// NilValueSemanticsOption sets the NilValueSemantics option.
+func NilValueSemanticsOption(semantics NilValueSemantics) Option {
+	return func(opts *Options) {
+		opts.NilValueSemantics = semantics
+	}
+}
+
+// FastIndexCheckOption sets the FastIndexCheckRate option and the OnFastIndexMismatch handler.
+func FastIndexCheckOption(rate float64, fn func(key, fastValue, value []byte)) Option {
+	return func(opts *Options) {
+		opts.FastIndexCheckRate = rate
+		opts.OnFastIndexMismatch = fn
+	}
+}
+
+// TrackNodeSequenceOption sets the TrackNodeSequence option.
+func TrackNodeSequenceOption(track bool) Option {
+	return func(opts *Options) {
+		opts.TrackNodeSequence = track
+	}
+}
+
+// PreCommitOption sets the PreCommit hook.
+func PreCommitOption(fn func(cs ChangeSet) error) Option {
+	return func(opts *Options) {
+		opts.PreCommit = fn
+	}
+}
+
+// OnHashCollisionOption sets the OnHashCollision handler.
+func OnHashCollisionOption(fn func(existing, incoming *Node)) Option {
+	return func(opts *Options) {
+		opts.OnHashCollision = fn
+	}
+}
+
+// NilValueSemantics is the handling of a nil value by MutableTree.Set, see
+// Options.NilValueSemantics. An empty non-nil value is always stored.
+type NilValueSemantics int
+
+const (
+	// NilValueError makes Set fail without changing the tree.
+	NilValueError NilValueSemantics = iota
+	// NilValueStoreEmpty makes Set store an empty value, which Get returns as an empty slice and
+	// which is proven like any other value.
+	NilValueStoreEmpty
+	// NilValueDelete makes Set remove the key like Remove, and return whether it was removed.
+	NilValueDelete
+)
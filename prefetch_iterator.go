@@ -0,0 +1,128 @@
+package iavl
+
+import (
+	"bytes"
+
+	corestore "cosmossdk.io/core/store"
+)
+
+type prefetchedPair struct {
+	key, value []byte
+}
+
+// PrefetchIterator reads ahead up to a fixed number of pairs of another iterator in a background
+// goroutine, so that the reads of a slow database overlap with the processing of the caller.
+// The pairs are yielded in the order of the source iterator. It does not support Seek, even over
+// an Iterator, since the pairs after the current one are already read ahead.
+type PrefetchIterator struct {
+	source     corestore.Iterator
+	start, end []byte
+
+	pairs chan prefetchedPair
+	stop  chan struct{}
+	done  chan struct{}
+
+	current prefetchedPair
+	valid   bool
+	closed  bool
+	err     error
+}
+
+var _ corestore.Iterator = (*PrefetchIterator)(nil)
+
+// NewPrefetchIterator returns an iterator over source reading up to size pairs ahead. The source
+// iterator must not be used by the caller anymore, and is closed by Close.
+func NewPrefetchIterator(source corestore.Iterator, size int) *PrefetchIterator {
+	if size < 1 {
+		size = 1
+	}
+	iter := &PrefetchIterator{
+		source: source,
+		pairs:  make(chan prefetchedPair, size),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	iter.start, iter.end = source.Domain()
+	go iter.fetch()
+	iter.Next()
+	return iter
+}
+
+func (iter *PrefetchIterator) fetch() {
+	defer close(iter.done)
+	defer close(iter.pairs)
+	for ; iter.source.Valid(); iter.source.Next() {
+		// the source may reuse its buffers once advanced
+		pair := prefetchedPair{key: bytes.Clone(iter.source.Key()), value: bytes.Clone(iter.source.Value())}
+		select {
+		case iter.pairs <- pair:
+		case <-iter.stop:
+			return
+		}
+	}
+}
+
+// Domain implements dbm.Iterator.
+func (iter *PrefetchIterator) Domain() ([]byte, []byte) {
+	return iter.start, iter.end
+}
+
+// Valid implements dbm.Iterator.
+func (iter *PrefetchIterator) Valid() bool {
+	return iter.valid
+}
+
+// Key implements dbm.Iterator
+func (iter *PrefetchIterator) Key() []byte {
+	return iter.current.key
+}
+
+// Value implements dbm.Iterator
+func (iter *PrefetchIterator) Value() []byte {
+	return iter.current.value
+}
+
+// Next implements dbm.Iterator
+func (iter *PrefetchIterator) Next() {
+	if iter.closed {
+		iter.valid = false
+		return
+	}
+	pair, ok := <-iter.pairs
+	if !ok {
+		// the fetching goroutine is done with the source
+		iter.current = prefetchedPair{}
+		iter.valid = false
+		iter.err = iter.source.Error()
+		return
+	}
+	iter.current, iter.valid = pair, true
+}
+
+// Close implements dbm.Iterator
+func (iter *PrefetchIterator) Close() error {
+	if iter.closed {
+		return iter.err
+	}
+	iter.closed = true
+	iter.valid = false
+	close(iter.stop)
+	<-iter.done
+	if err := iter.source.Close(); err != nil {
+		return err
+	}
+	return iter.err
+}
+
+// Error implements dbm.Iterator
+func (iter *PrefetchIterator) Error() error {
+	return iter.err
+}
+
+// withPrefetch wraps itr in a PrefetchIterator with Options.IteratorPrefetch.
+func (t *ImmutableTree) withPrefetch(itr corestore.Iterator) corestore.Iterator {
+	if t.ndb == nil || t.ndb.opts.IteratorPrefetch <= 0 {
+		return itr
+	}
+	return NewPrefetchIterator(itr, t.ndb.opts.IteratorPrefetch)
+}
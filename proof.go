@@ -26,6 +26,10 @@ var (
 
 	// ErrInvalidRoot is returned when the root passed in does not match the proof's.
 	ErrInvalidRoot = errors.New("invalid root")
+
+	// ErrHashingDisabled is returned by the hash and proof operations of trees with the NoHash
+	// option.
+	ErrHashingDisabled = errors.New("hashing is disabled")
 )
 
 //----------------------------------------
@@ -237,3 +241,60 @@ func (node *Node) pathToLeaf(t *ImmutableTree, key []byte, version int64, path *
 	n, err := rightNode.pathToLeaf(t, key, version, path)
 	return n, err
 }
+
+//----------------------------------------
+
+// SiblingHash is an inner node on the path from the root to a leaf, given by the hash of its
+// child which is not on the path, along with the fields it is hashed with.
+type SiblingHash struct {
+	// Left is true if the sibling is the left child, i.e. the path goes to the right child.
+	Left    bool
+	Hash    []byte
+	Height  int8
+	Size    int64
+	Version int64
+}
+
+// Fold returns the hash of the inner node from the hash of its child on the path, which is the
+// SHA-256 of the height, size and version as zigzag varints, followed by the length-prefixed
+// hashes of the left and right children, where lengths are uvarints.
+func (s SiblingHash) Fold(childHash []byte) ([]byte, error) {
+	pin := ProofInnerNode{Height: s.Height, Size: s.Size, Version: s.Version}
+	if s.Left {
+		pin.Left = s.Hash
+	} else {
+		pin.Right = s.Hash
+	}
+	return pin.Hash(childHash)
+}
+
+// GetMerklePath returns the hash of the leaf of key and the siblings of the path from the leaf to
+// the root, such that folding them in order into the leaf hash yields the root hash, for
+// verifiers which do not support ICS23. It returns an error if the key does not exist.
+func (t *ImmutableTree) GetMerklePath(key []byte) (leafHash []byte, siblings []SiblingHash, err error) {
+	if t.isClosed() {
+		return nil, nil, ErrClosed
+	}
+	if t.noHash() {
+		return nil, nil, ErrHashingDisabled
+	}
+	if t.root == nil {
+		return nil, nil, ErrKeyDoesNotExist
+	}
+	t.Hash()
+	path, leaf, err := t.root.PathToLeaf(t, key, t.version+1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	siblings = make([]SiblingHash, len(path))
+	for i, pin := range path {
+		sibling := SiblingHash{Left: len(pin.Left) > 0, Hash: pin.Right, Height: pin.Height, Size: pin.Size, Version: pin.Version}
+		if sibling.Left {
+			sibling.Hash = pin.Left
+		}
+		// the path starts from the root
+		siblings[len(path)-1-i] = sibling
+	}
+	return leaf.hash, siblings, nil
+}
@@ -1,17 +1,45 @@
 package iavl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 
 	ics23 "github.com/cosmos/ics23/go"
 )
 
+// ValueHashSpec is the ProofSpec for proofs generated with the HashLeafValues option. The
+// existence proofs carry H(value) instead of the value, so the leaf op does not prehash it.
+// The resulting leaf hashes are identical to the ones computed with ics23.IavlSpec.
+var ValueHashSpec = &ics23.ProofSpec{
+	LeafSpec: &ics23.LeafOp{
+		Prefix:       ics23.IavlSpec.LeafSpec.Prefix,
+		PrehashKey:   ics23.IavlSpec.LeafSpec.PrehashKey,
+		Hash:         ics23.IavlSpec.LeafSpec.Hash,
+		PrehashValue: ics23.HashOp_NO_HASH,
+		Length:       ics23.IavlSpec.LeafSpec.Length,
+	},
+	InnerSpec: ics23.IavlSpec.InnerSpec,
+	MaxDepth:  ics23.IavlSpec.MaxDepth,
+	MinDepth:  ics23.IavlSpec.MinDepth,
+}
+
 /*
 GetMembershipProof will produce a CommitmentProof that the given key (and queries value) exists in the iavl tree.
 If the key doesn't exist in the tree, this will return an error.
+ICS23 rejects the proofs of empty values against ics23.IavlSpec, they can only be verified with the
+HashLeafValues option, whose proofs carry the hash of the value.
 */
 func (t *ImmutableTree) GetMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	if t.noHash() {
+		return nil, ErrHashingDisabled
+	}
 	exist, err := t.createExistenceProof(key)
 	if err != nil {
 		return nil, err
@@ -26,12 +54,22 @@ func (t *ImmutableTree) GetMembershipProof(key []byte) (*ics23.CommitmentProof,
 
 // VerifyMembership returns true iff proof is an ExistenceProof for the given key.
 func (t *ImmutableTree) VerifyMembership(proof *ics23.CommitmentProof, key []byte) (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
+	if t.noHash() {
+		return false, ErrHashingDisabled
+	}
 	val, err := t.Get(key)
 	if err != nil {
 		return false, err
 	}
 	root := t.Hash()
 
+	if t.hashLeafValues() {
+		valueHash := sha256.Sum256(val)
+		return ics23.VerifyMembership(ValueHashSpec, root, proof, key, valueHash[:]), nil
+	}
 	return ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, val), nil
 }
 
@@ -40,6 +78,12 @@ GetNonMembershipProof will produce a CommitmentProof that the given key doesn't
 If the key exists in the tree, this will return an error.
 */
 func (t *ImmutableTree) GetNonMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	if t.noHash() {
+		return nil, ErrHashingDisabled
+	}
 	// idx is one node right of what we want....
 	var err error
 	idx, val, err := t.GetWithIndex(key)
@@ -90,26 +134,68 @@ func (t *ImmutableTree) GetNonMembershipProof(key []byte) (*ics23.CommitmentProo
 
 // VerifyNonMembership returns true iff proof is a NonExistenceProof for the given key.
 func (t *ImmutableTree) VerifyNonMembership(proof *ics23.CommitmentProof, key []byte) (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
+	if t.noHash() {
+		return false, ErrHashingDisabled
+	}
 	root := t.Hash()
 
-	return ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key), nil
+	return ics23.VerifyNonMembership(t.proofSpec(), root, proof, key), nil
+}
+
+// proofSpec returns the ProofSpec which the proofs generated by the tree conform to.
+func (t *ImmutableTree) proofSpec() *ics23.ProofSpec {
+	if t.hashLeafValues() {
+		return ValueHashSpec
+	}
+	return ics23.IavlSpec
+}
+
+// hashLeafValues returns true if the proofs should carry the value hash instead of the value.
+func (t *ImmutableTree) hashLeafValues() bool {
+	return t.ndb != nil && t.ndb.opts.HashLeafValues
+}
+
+// noHash returns true if the tree does not compute node hashes.
+func (t *ImmutableTree) noHash() bool {
+	return t.ndb != nil && t.ndb.opts.NoHash
 }
 
 // createExistenceProof will get the proof from the tree and convert the proof into a valid
 // existence proof, if that's what it is.
 func (t *ImmutableTree) createExistenceProof(key []byte) (*ics23.ExistenceProof, error) {
-	t.Hash()
-	path, node, err := t.root.PathToLeaf(t, key, t.version+1)
-	nodeVersion := t.version + 1
+	return t.createExistenceProofAt(key, t.version+1)
+}
+
+// createExistenceProofAt is like createExistenceProof, with the nodes which are not saved yet
+// hashed at version.
+func (t *ImmutableTree) createExistenceProofAt(key []byte, version int64) (*ics23.ExistenceProof, error) {
+	t.root.hashWithCount(version)
+	return t.createExistenceProofFrom(t.root, key, version)
+}
+
+// createExistenceProofFrom creates the existence proof of key in the subtree of node, whose path
+// ends at node. The nodes must be hashed.
+func (t *ImmutableTree) createExistenceProofFrom(subtree *Node, key []byte, version int64) (*ics23.ExistenceProof, error) {
+	path, node, err := subtree.PathToLeaf(t, key, version)
+	nodeVersion := version
 	if node.nodeKey != nil {
 		nodeVersion = node.nodeKey.version
 	}
-	return &ics23.ExistenceProof{
+	exist := &ics23.ExistenceProof{
 		Key:   node.key,
 		Value: node.value,
 		Leaf:  convertLeafOp(nodeVersion),
 		Path:  convertInnerOps(path),
-	}, err
+	}
+	if t.hashLeafValues() {
+		valueHash := sha256.Sum256(node.value)
+		exist.Value = valueHash[:]
+		exist.Leaf.PrehashValue = ics23.HashOp_NO_HASH
+	}
+	return exist, err
 }
 
 func convertLeafOp(version int64) *ics23.LeafOp {
@@ -174,8 +260,178 @@ func convertVarIntToBytes(orig int64, buf [binary.MaxVarintLen64]byte) []byte {
 	return buf[:n]
 }
 
+// ProofSize returns the size in bytes of the serialized membership proof of key, as returned by
+// GetMembershipProof, and its number of inner ops. It only reads the nodes on the path to the key,
+// as the sibling hashes included in the proof have a fixed size, and does not build the proof.
+func (t *ImmutableTree) ProofSize(key []byte) (size, depth int, err error) {
+	if t.isClosed() {
+		return 0, 0, ErrClosed
+	}
+	if t.noHash() {
+		return 0, 0, ErrHashingDisabled
+	}
+	if t.root == nil {
+		return 0, 0, errors.New("cannot generate the proof with nil root")
+	}
+
+	exist := 0
+	node := t.root
+	for node.subtreeHeight > 0 {
+		left := bytes.Compare(key, node.key) < 0
+		exist += t.innerOpSize(node, left)
+		if left {
+			node, err = node.getLeftNode(t)
+		} else {
+			node, err = node.getRightNode(t)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		depth++
+	}
+	if !bytes.Equal(node.key, key) {
+		return 0, 0, errors.New("key does not exist")
+	}
+	exist += t.leafProofSize(node)
+	return protoBytesSize(exist), depth, nil
+}
+
+// RangeProofSizeEstimate estimates the size in bytes of the serialized batch proof of the keys in
+// [start, end), with the membership proof of each key as returned by GetMembershipProof, and
+// returns the number of keys, where nil bounds are unbounded. Only the nodes on the paths to the
+// bounds are read. The keys of a subtree within the range are counted from its size, with the
+// depth of their leaves estimated as log2 of the size, and the lengths of their keys and values
+// as those of its left-most leaf. The estimate is within 5% of the size for keys and values of
+// similar lengths, and is 0 for an empty range.
+func (t *ImmutableTree) RangeProofSizeEstimate(start, end []byte) (size int, keys int64, err error) {
+	if t.isClosed() {
+		return 0, 0, ErrClosed
+	}
+	if t.noHash() {
+		return 0, 0, ErrHashingDisabled
+	}
+	if t.root == nil {
+		return 0, 0, nil
+	}
+
+	var batch float64
+	// the keys of the subtree of node are in [lo, hi), where nil is unbounded, and path is the
+	// total size of the inner ops above it
+	var walk func(node *Node, lo, hi []byte, path int) error
+	walk = func(node *Node, lo, hi []byte, path int) error {
+		if (hi != nil && start != nil && bytes.Compare(hi, start) <= 0) || (end != nil && lo != nil && bytes.Compare(lo, end) >= 0) {
+			return nil
+		}
+		if node.isLeaf() {
+			if (start == nil || bytes.Compare(node.key, start) >= 0) && (end == nil || bytes.Compare(node.key, end) < 0) {
+				batch += float64(protoBytesSize(protoBytesSize(path + t.leafProofSize(node))))
+				keys++
+			}
+			return nil
+		}
+
+		leftOp, rightOp := t.innerOpSize(node, true), t.innerOpSize(node, false)
+		if (start == nil || lo != nil && bytes.Compare(lo, start) >= 0) && (end == nil || hi != nil && bytes.Compare(hi, end) <= 0) {
+			leaf := node
+			for !leaf.isLeaf() {
+				if leaf, err = leaf.getLeftNode(t); err != nil {
+					return err
+				}
+			}
+			depth := math.Log2(float64(node.size))
+			exist := float64(path) + depth*float64(leftOp+rightOp)/2 + float64(t.leafProofSize(leaf))
+			batch += float64(node.size) * float64(protoBytesSize(protoBytesSize(int(math.Round(exist)))))
+			keys += node.size
+			return nil
+		}
+
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		if err := walk(leftNode, lo, node.key, path+leftOp); err != nil {
+			return err
+		}
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		return walk(rightNode, node.key, hi, path+rightOp)
+	}
+	if err := walk(t.root, nil, nil, 0); err != nil {
+		return 0, 0, err
+	}
+	if keys == 0 {
+		return 0, 0, nil
+	}
+	return protoBytesSize(int(math.Round(batch))), keys, nil
+}
+
+// proofNodeVersion returns the version at which node is hashed in proofs, with the nodes which
+// are not saved yet at the working version.
+func (t *ImmutableTree) proofNodeVersion(node *Node) int64 {
+	if node.nodeKey != nil {
+		return node.nodeKey.version
+	}
+	return t.version + 1
+}
+
+// innerOpSize returns the serialized size of the inner op of node in a proof, to its left or
+// right child.
+func (t *ImmutableTree) innerOpSize(node *Node, left bool) int {
+	var varintBuf [binary.MaxVarintLen64]byte
+	varintSize := func(v int64) int { return binary.PutVarint(varintBuf[:], v) }
+	// the child hash and the sibling hash are both length-prefixed, one in the prefix and the
+	// other in the prefix or the suffix, as in convertInnerOps
+	prefixLen := varintSize(int64(node.subtreeHeight)) + varintSize(node.size) + varintSize(t.proofNodeVersion(node)) + 1
+	suffixLen := 1 + hashSize
+	if !left {
+		prefixLen += suffixLen
+		suffixLen = 0
+	}
+	op := protoEnumSize(int64(ics23.HashOp_SHA256)) + protoBytesSize(prefixLen) + protoBytesSize(suffixLen)
+	return protoBytesSize(op)
+}
+
+// leafProofSize returns the serialized size of the key, value and leaf op of the leaf node in an
+// existence proof.
+func (t *ImmutableTree) leafProofSize(node *Node) int {
+	leaf := convertLeafOp(t.proofNodeVersion(node))
+	valueLen := len(node.value)
+	if t.hashLeafValues() {
+		leaf.PrehashValue = ics23.HashOp_NO_HASH
+		valueLen = sha256.Size
+	}
+	return protoBytesSize(len(node.key)) + protoBytesSize(valueLen) + protoBytesSize(leaf.Size())
+}
+
+// protoBytesSize returns the encoded size of a protobuf length-delimited field holding n bytes,
+// which is omitted when empty.
+func protoBytesSize(n int) int {
+	if n == 0 {
+		return 0
+	}
+	var buf [binary.MaxVarintLen64]byte
+	return 1 + binary.PutUvarint(buf[:], uint64(n)) + n
+}
+
+// protoEnumSize returns the encoded size of a protobuf enum field, which is omitted when zero.
+func protoEnumSize(v int64) int {
+	if v == 0 {
+		return 0
+	}
+	var buf [binary.MaxVarintLen64]byte
+	return 1 + binary.PutUvarint(buf[:], uint64(v))
+}
+
 // GetProof gets the proof for the given key.
 func (t *ImmutableTree) GetProof(key []byte) (*ics23.CommitmentProof, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	if t.noHash() {
+		return nil, ErrHashingDisabled
+	}
 	if t.root == nil {
 		return nil, errors.New("cannot generate the proof with nil root")
 	}
@@ -193,6 +449,9 @@ func (t *ImmutableTree) GetProof(key []byte) (*ics23.CommitmentProof, error) {
 
 // VerifyProof checks if the proof is correct for the given key.
 func (t *ImmutableTree) VerifyProof(proof *ics23.CommitmentProof, key []byte) (bool, error) {
+	if t.isClosed() {
+		return false, ErrClosed
+	}
 	if proof.GetExist() != nil {
 		return t.VerifyMembership(proof, key)
 	}
@@ -201,6 +460,9 @@ func (t *ImmutableTree) VerifyProof(proof *ics23.CommitmentProof, key []byte) (b
 
 // GetVersionedProof gets the proof for the given key at the specified version.
 func (tree *MutableTree) GetVersionedProof(key []byte, version int64) (*ics23.CommitmentProof, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
 	if tree.VersionExists(version) {
 		t, err := tree.GetImmutable(version)
 		if err != nil {
@@ -210,3 +472,254 @@ func (tree *MutableTree) GetVersionedProof(key []byte, version int64) (*ics23.Co
 	}
 	return nil, ErrVersionDoesNotExist
 }
+
+// GetMembershipProofAt gets the membership proof of key against the root of the given saved
+// version, which is read from the database. Pruned versions return ErrVersionPruned, and the
+// version is not deleted while the proof is generated.
+func (tree *MutableTree) GetMembershipProofAt(key []byte, version int64) (*ics23.CommitmentProof, error) {
+	if version <= 0 {
+		return nil, fmt.Errorf("invalid version %d", version)
+	}
+	tree.ndb.incrVersionReaders(version)
+	defer tree.ndb.decrVersionReaders(version)
+
+	t, err := tree.QueryVersion(version)
+	if err != nil {
+		return nil, err
+	}
+	return t.GetMembershipProof(key)
+}
+
+// ErrProofOrdering is returned by VerifyProofOrdering when the keys or paths of a proof are out
+// of order.
+var ErrProofOrdering = errors.New("proof is out of order")
+
+// VerifyProofOrdering checks that the keys of a proof are strictly increasing in bytewise order,
+// and that the paths of a non-membership proof are those of neighbouring leaves, without a root.
+// The entries of a batch proof must be ordered by key. It returns an error describing the first
+// violation.
+func VerifyProofOrdering(proof *ics23.CommitmentProof) error {
+	if proof == nil {
+		return fmt.Errorf("%w: proof is nil", ErrProofOrdering)
+	}
+	if ics23.IsCompressed(proof) {
+		proof = ics23.Decompress(proof)
+	}
+	switch p := proof.Proof.(type) {
+	case *ics23.CommitmentProof_Exist:
+		if p.Exist == nil {
+			return fmt.Errorf("%w: existence proof is nil", ErrProofOrdering)
+		}
+		return nil
+	case *ics23.CommitmentProof_Nonexist:
+		return verifyNonExistenceOrdering(p.Nonexist)
+	case *ics23.CommitmentProof_Batch:
+		if p.Batch == nil {
+			return fmt.Errorf("%w: batch proof is nil", ErrProofOrdering)
+		}
+		var prev []byte
+		for i, entry := range p.Batch.Entries {
+			var key []byte
+			if exist := entry.GetExist(); exist != nil {
+				key = exist.Key
+			} else if nonexist := entry.GetNonexist(); nonexist != nil {
+				if err := verifyNonExistenceOrdering(nonexist); err != nil {
+					return fmt.Errorf("batch entry %d: %w", i, err)
+				}
+				key = nonexist.Key
+			} else {
+				return fmt.Errorf("%w: batch entry %d is empty", ErrProofOrdering, i)
+			}
+			if i > 0 && bytes.Compare(prev, key) >= 0 {
+				return fmt.Errorf("%w: batch entry %d key %X is not after %X", ErrProofOrdering, i, key, prev)
+			}
+			prev = key
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported proof type %T", ErrProofOrdering, proof.Proof)
+	}
+}
+
+// verifyNonExistenceOrdering checks that the key of a non-membership proof is between its
+// neighbours, whose paths are adjacent, or are the left-most or right-most paths without the
+// other neighbour.
+func verifyNonExistenceOrdering(proof *ics23.NonExistenceProof) error {
+	if proof == nil {
+		return fmt.Errorf("%w: non-existence proof is nil", ErrProofOrdering)
+	}
+	spec := ics23.IavlSpec.InnerSpec
+	left, right := proof.Left, proof.Right
+	switch {
+	case left == nil && right == nil:
+		return fmt.Errorf("%w: non-existence proof has no neighbours", ErrProofOrdering)
+	case left != nil && bytes.Compare(left.Key, proof.Key) >= 0:
+		return fmt.Errorf("%w: left key %X is not before key %X", ErrProofOrdering, left.Key, proof.Key)
+	case right != nil && bytes.Compare(proof.Key, right.Key) >= 0:
+		return fmt.Errorf("%w: right key %X is not after key %X", ErrProofOrdering, right.Key, proof.Key)
+	case left == nil:
+		if !ics23.IsLeftMost(spec, right.Path) {
+			return fmt.Errorf("%w: right path is not the left-most path without a left neighbour", ErrProofOrdering)
+		}
+	case right == nil:
+		if !ics23.IsRightMost(spec, left.Path) {
+			return fmt.Errorf("%w: left path is not the right-most path without a right neighbour", ErrProofOrdering)
+		}
+	default:
+		// IsLeftNeighbor expects the paths to diverge below their common tail
+		l, r := len(left.Path), len(right.Path)
+		for l > 0 && r > 0 && bytes.Equal(left.Path[l-1].Prefix, right.Path[r-1].Prefix) &&
+			bytes.Equal(left.Path[l-1].Suffix, right.Path[r-1].Suffix) {
+			l--
+			r--
+		}
+		if l == 0 || r == 0 || !ics23.IsLeftNeighbor(spec, left.Path, right.Path) {
+			return fmt.Errorf("%w: left and right paths are not neighbours", ErrProofOrdering)
+		}
+	}
+	return nil
+}
+
+// ErrProofSpecMismatch is returned by ValidateAgainstSpec when the proofs of the tree do not
+// conform to the spec. It wraps the verification error.
+var ErrProofSpecMismatch = errors.New("proofs do not conform to the spec")
+
+// ValidateAgainstSpec checks that the proofs generated by the tree verify against spec, e.g. the
+// one of the light clients, by verifying the membership proofs of the first and last keys, whose
+// paths take the left-most and right-most children, and the non-membership proof of a key right
+// after the first one, whose neighbours depend on the child order. The tree must not be empty.
+func (t *ImmutableTree) ValidateAgainstSpec(spec *ics23.ProofSpec) error {
+	if t.isClosed() {
+		return ErrClosed
+	}
+	if spec == nil {
+		return errors.New("proof spec is nil")
+	}
+	if t.noHash() {
+		return ErrHashingDisabled
+	}
+	if t.root == nil {
+		return errors.New("cannot validate the proofs of an empty tree")
+	}
+	root := t.Hash()
+
+	firstKey, _, _, err := t.FirstKey()
+	if err != nil {
+		return err
+	}
+	lastKey, _, _, err := t.LastKey()
+	if err != nil {
+		return err
+	}
+	for _, key := range [][]byte{firstKey, lastKey} {
+		exist, err := t.createExistenceProof(key)
+		if err != nil {
+			return err
+		}
+		if err := exist.Verify(spec, root, key, exist.Value); err != nil {
+			return fmt.Errorf("%w: membership proof of key %X: %w", ErrProofSpecMismatch, key, err)
+		}
+	}
+
+	absent := append(bytes.Clone(firstKey), 0)
+	if has, err := t.Has(absent); err != nil || has {
+		return err
+	}
+	proof, err := t.GetNonMembershipProof(absent)
+	if err != nil {
+		return err
+	}
+	if err := proof.GetNonexist().Verify(spec, root, absent); err != nil {
+		return fmt.Errorf("%w: non-membership proof of key %X: %w", ErrProofSpecMismatch, absent, err)
+	}
+	return nil
+}
+
+// GetWorkingMembershipProof returns a membership proof of key in the working tree, including its
+// unsaved changes, which verifies against WorkingHash. The unsaved nodes are hashed at the working
+// version, like the nodes the tree would save.
+func (tree *MutableTree) GetWorkingMembershipProof(key []byte) (*ics23.CommitmentProof, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if tree.noHash() {
+		return nil, ErrHashingDisabled
+	}
+	if tree.root == nil {
+		return nil, fmt.Errorf("key %X does not exist in the empty working tree", key)
+	}
+	exist, err := tree.ImmutableTree.createExistenceProofAt(key, tree.WorkingVersion())
+	if err != nil {
+		return nil, err
+	}
+	return &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Exist{Exist: exist}}, nil
+}
+
+// ProvenChange is a key changed between two versions, with the proofs of its value in both.
+type ProvenChange struct {
+	Key      []byte
+	OldValue []byte // nil if the key did not exist
+	NewValue []byte // nil if the key was removed
+	// OldProof and NewProof are the membership or non-membership proofs of Key against the root
+	// of each version, nil if the version is empty.
+	OldProof *ics23.CommitmentProof
+	NewProof *ics23.CommitmentProof
+}
+
+// ProvenDiff returns the keys changed from version from to version to, ordered by key, with their
+// values and proofs in both versions. The changes are found by comparing the trees of both
+// versions, skipping their shared subtrees.
+func (tree *MutableTree) ProvenDiff(from, to int64) ([]ProvenChange, error) {
+	if tree.closed.Load() {
+		return nil, ErrClosed
+	}
+	if from >= to {
+		return nil, fmt.Errorf("%w: from version %d must be before to version %d", ErrInvalidInputs, from, to)
+	}
+	fromTree, err := tree.GetImmutable(from)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := tree.GetImmutable(to)
+	if err != nil {
+		return nil, err
+	}
+	fromRoot, err := tree.ndb.GetRoot(from)
+	if err != nil {
+		return nil, err
+	}
+	toRoot, err := tree.ndb.GetRoot(to)
+	if err != nil {
+		return nil, err
+	}
+
+	proof := func(t *ImmutableTree, key []byte) (*ics23.CommitmentProof, error) {
+		if t.root == nil {
+			return nil, nil
+		}
+		return t.GetProof(key)
+	}
+	var changes []ProvenChange
+	err = tree.ndb.extractStateChanges(from, fromRoot, toRoot, func(pair *KVPair) error {
+		change := ProvenChange{Key: pair.Key}
+		if !pair.Delete {
+			change.NewValue = pair.Value
+		}
+		var err error
+		if change.OldValue, err = fromTree.Get(pair.Key); err != nil {
+			return err
+		}
+		if change.OldProof, err = proof(fromTree, pair.Key); err != nil {
+			return fmt.Errorf("proving key %X in version %d: %w", pair.Key, from, err)
+		}
+		if change.NewProof, err = proof(toTree, pair.Key); err != nil {
+			return fmt.Errorf("proving key %X in version %d: %w", pair.Key, to, err)
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
@@ -3,6 +3,8 @@ package iavl
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
 	mrand "math/rand"
 	"sort"
 	"testing"
@@ -258,3 +260,429 @@ func BenchmarkConvertLeafOp(b *testing.B) {
 	}
 	sink = nil
 }
+
+func TestHashLeafValuesProof(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), HashLeafValuesOption(true))
+	plain := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+
+	smallValue := []byte("small")
+	largeValue := bytes.Repeat([]byte{0xab}, 10000)
+	for _, tr := range []*MutableTree{tree, plain} {
+		_, err := tr.Set([]byte("a"), smallValue)
+		require.NoError(t, err)
+		_, err = tr.Set([]byte("b"), smallValue)
+		require.NoError(t, err)
+		_, _, err = tr.SaveVersion()
+		require.NoError(t, err)
+	}
+	smallProof, err := tree.GetMembershipProof([]byte("b"))
+	require.NoError(t, err)
+
+	for _, tr := range []*MutableTree{tree, plain} {
+		_, err := tr.Set([]byte("b"), largeValue)
+		require.NoError(t, err)
+		_, _, err = tr.SaveVersion()
+		require.NoError(t, err)
+	}
+	// the option must not affect the root hash
+	require.Equal(t, plain.Hash(), tree.Hash())
+
+	largeProof, err := tree.GetMembershipProof([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, smallProof.Size(), largeProof.Size())
+
+	plainProof, err := plain.GetMembershipProof([]byte("b"))
+	require.NoError(t, err)
+	require.Greater(t, plainProof.Size(), len(largeValue))
+
+	root := tree.Hash()
+	largeHash := sha256.Sum256(largeValue)
+	require.True(t, ics23.VerifyMembership(ValueHashSpec, root, largeProof, []byte("b"), largeHash[:]))
+	require.False(t, ics23.VerifyMembership(ValueHashSpec, root, largeProof, []byte("b"), largeValue))
+	require.False(t, ics23.VerifyMembership(ics23.IavlSpec, root, largeProof, []byte("b"), largeValue))
+
+	ok, err := tree.VerifyProof(largeProof, []byte("b"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	nonProof, err := tree.GetProof([]byte("c"))
+	require.NoError(t, err)
+	ok, err = tree.VerifyProof(nonProof, []byte("c"))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestMutableTree_ProvenDiff(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	mirrors := []map[string]string{{}} // the contents of each version, version 1 is empty
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	for v := 2; v <= 4; v++ {
+		mirror := make(map[string]string)
+		for k, val := range mirrors[len(mirrors)-1] {
+			mirror[k] = val
+		}
+		for i := 0; i < 60; i++ {
+			key := string([]byte{byte(i)})
+			switch {
+			case v == 2 && i < 50, v > 2 && i%7 == v:
+				mirror[key] = string([]byte{byte(v), byte(i)})
+				_, err = tree.Set([]byte(key), []byte(mirror[key]))
+			case v > 2 && i%11 == v:
+				delete(mirror, key)
+				_, _, err = tree.Remove([]byte(key))
+			}
+			require.NoError(t, err)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		mirrors = append(mirrors, mirror)
+	}
+
+	for _, versions := range [][2]int64{{2, 3}, {2, 4}, {3, 4}, {1, 4}} {
+		from, to := versions[0], versions[1]
+		changes, err := tree.ProvenDiff(from, to)
+		require.NoError(t, err)
+		fromTree, err := tree.GetImmutable(from)
+		require.NoError(t, err)
+		toTree, err := tree.GetImmutable(to)
+		require.NoError(t, err)
+
+		oldMirror, newMirror := mirrors[from-1], mirrors[to-1]
+		var expected []string
+		for i := 0; i < 60; i++ {
+			key := string([]byte{byte(i)})
+			oldValue, oldOk := oldMirror[key]
+			newValue, newOk := newMirror[key]
+			if oldOk != newOk || oldValue != newValue {
+				expected = append(expected, key)
+			}
+		}
+		require.Len(t, changes, len(expected))
+
+		verify := func(root []byte, proof *ics23.CommitmentProof, key []byte, value []byte) {
+			if value == nil {
+				require.True(t, ics23.VerifyNonMembership(ics23.IavlSpec, root, proof, key))
+			} else {
+				require.True(t, ics23.VerifyMembership(ics23.IavlSpec, root, proof, key, value))
+			}
+		}
+		for i, change := range changes {
+			require.Equal(t, expected[i], string(change.Key))
+			if value, ok := oldMirror[expected[i]]; ok {
+				require.Equal(t, []byte(value), change.OldValue)
+			} else {
+				require.Nil(t, change.OldValue)
+			}
+			if value, ok := newMirror[expected[i]]; ok {
+				require.Equal(t, []byte(value), change.NewValue)
+			} else {
+				require.Nil(t, change.NewValue)
+			}
+			if from == 1 {
+				require.Nil(t, change.OldProof)
+			} else {
+				verify(fromTree.Hash(), change.OldProof, change.Key, change.OldValue)
+			}
+			verify(toTree.Hash(), change.NewProof, change.Key, change.NewValue)
+		}
+	}
+
+	_, err = tree.ProvenDiff(3, 3)
+	require.ErrorIs(t, err, ErrInvalidInputs)
+	_, err = tree.ProvenDiff(3, 9)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+}
+
+func TestMutableTree_GetMembershipProofAt(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for v := byte(1); v <= 4; v++ {
+		for i := byte(0); i < 20; i++ {
+			_, err := tree.Set([]byte{i}, []byte{v, i})
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	roots, err := tree.RootHashes(1, 4)
+	require.NoError(t, err)
+
+	for version := int64(1); version <= 4; version++ {
+		proof, err := tree.GetMembershipProofAt([]byte{7}, version)
+		require.NoError(t, err)
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, roots[version], proof, []byte{7}, []byte{byte(version), 7}))
+		if version < 4 {
+			require.False(t, ics23.VerifyMembership(ics23.IavlSpec, roots[4], proof, []byte{7}, []byte{byte(version), 7}))
+		}
+	}
+
+	_, err = tree.GetMembershipProofAt([]byte{30}, 2)
+	require.Error(t, err)
+	_, err = tree.GetMembershipProofAt([]byte{7}, 5)
+	require.ErrorIs(t, err, ErrVersionDoesNotExist)
+	require.NoError(t, tree.DeleteVersionsTo(2))
+	_, err = tree.GetMembershipProofAt([]byte{7}, 2)
+	require.ErrorIs(t, err, ErrVersionPruned)
+	_, err = tree.GetMembershipProofAt([]byte{7}, 3)
+	require.NoError(t, err)
+}
+
+func TestVerifyProofOrdering(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for i := byte(2); i <= 40; i += 2 {
+		_, err := tree.Set([]byte{i}, []byte{i})
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	nonMembership := func(t *testing.T, key byte) *ics23.NonExistenceProof {
+		proof, err := tree.GetNonMembershipProof([]byte{key})
+		require.NoError(t, err)
+		require.NoError(t, VerifyProofOrdering(proof))
+		return proof.GetNonexist()
+	}
+	membership := func(t *testing.T, key byte) *ics23.ExistenceProof {
+		proof, err := tree.GetMembershipProof([]byte{key})
+		require.NoError(t, err)
+		require.NoError(t, VerifyProofOrdering(proof))
+		return proof.GetExist()
+	}
+	nonexist := func(proof *ics23.NonExistenceProof) *ics23.CommitmentProof {
+		return &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Nonexist{Nonexist: proof}}
+	}
+	batch := func(entries ...*ics23.BatchEntry) *ics23.CommitmentProof {
+		return &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Batch{Batch: &ics23.BatchProof{Entries: entries}}}
+	}
+
+	// the well-formed proofs, including the ones without a left or right neighbour
+	for _, key := range []byte{1, 7, 41} {
+		nonMembership(t, key)
+	}
+	middle := nonMembership(t, 7)
+	exist := membership(t, 10)
+	inOrder := batch(
+		&ics23.BatchEntry{Proof: &ics23.BatchEntry_Nonexist{Nonexist: middle}},
+		&ics23.BatchEntry{Proof: &ics23.BatchEntry_Exist{Exist: exist}},
+	)
+	require.NoError(t, VerifyProofOrdering(inOrder))
+	require.NoError(t, VerifyProofOrdering(ics23.Compress(inOrder)))
+
+	for name, proof := range map[string]*ics23.CommitmentProof{
+		"swapped neighbours": nonexist(&ics23.NonExistenceProof{Key: middle.Key, Left: middle.Right, Right: middle.Left}),
+		"distant neighbour":  nonexist(&ics23.NonExistenceProof{Key: middle.Key, Left: middle.Left, Right: exist}),
+		"missing neighbour":  nonexist(&ics23.NonExistenceProof{Key: middle.Key, Left: middle.Left}),
+		"reordered batch": batch(
+			&ics23.BatchEntry{Proof: &ics23.BatchEntry_Exist{Exist: exist}},
+			&ics23.BatchEntry{Proof: &ics23.BatchEntry_Nonexist{Nonexist: middle}},
+		),
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.ErrorIs(t, VerifyProofOrdering(proof), ErrProofOrdering)
+		})
+	}
+}
+
+func TestMutableTree_GetWorkingMembershipProof(t *testing.T) {
+	for _, initialVersion := range []uint64{0, 10} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), InitialVersionOption(initialVersion))
+		_, err := tree.GetWorkingMembershipProof([]byte{1})
+		require.Error(t, err)
+
+		for i := byte(0); i < 20; i++ {
+			_, err := tree.Set([]byte{i}, []byte{i})
+			require.NoError(t, err)
+		}
+		verify := func(t *testing.T, key, value []byte) {
+			proof, err := tree.GetWorkingMembershipProof(key)
+			require.NoError(t, err)
+			require.True(t, ics23.VerifyMembership(ics23.IavlSpec, tree.WorkingHash(), proof, key, value))
+		}
+		// before any saved version
+		verify(t, []byte{7}, []byte{7})
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+
+		_, err = tree.Set([]byte{7}, []byte("updated"))
+		require.NoError(t, err)
+		_, err = tree.Set([]byte{30}, []byte("new"))
+		require.NoError(t, err)
+		verify(t, []byte{7}, []byte("updated"))
+		verify(t, []byte{30}, []byte("new"))
+		verify(t, []byte{3}, []byte{3})
+		proof, err := tree.GetWorkingMembershipProof([]byte{30})
+		require.NoError(t, err)
+		require.False(t, ics23.VerifyMembership(ics23.IavlSpec, tree.Hash(), proof, []byte{30}, []byte("new")))
+		_, err = tree.GetWorkingMembershipProof([]byte{25})
+		require.Error(t, err)
+
+		// the working hash is the hash of the saved version
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		require.True(t, ics23.VerifyMembership(ics23.IavlSpec, hash, proof, []byte{30}, []byte("new")))
+	}
+}
+
+func TestImmutableTree_ValidateAgainstSpec(t *testing.T) {
+	for _, hashLeafValues := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), HashLeafValuesOption(hashLeafValues))
+		require.Error(t, tree.ValidateAgainstSpec(ics23.IavlSpec))
+		for i := byte(0); i < 50; i++ {
+			_, err := tree.Set([]byte{i * 2}, []byte{i})
+			require.NoError(t, err)
+		}
+		_, version, err := tree.SaveVersion()
+		require.NoError(t, err)
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+
+		spec, wrongSpec := ics23.IavlSpec, ValueHashSpec
+		if hashLeafValues {
+			spec, wrongSpec = ValueHashSpec, ics23.IavlSpec
+		}
+		require.NoError(t, itree.ValidateAgainstSpec(spec))
+		require.ErrorIs(t, itree.ValidateAgainstSpec(wrongSpec), ErrProofSpecMismatch)
+		require.ErrorIs(t, itree.ValidateAgainstSpec(ics23.TendermintSpec), ErrProofSpecMismatch)
+
+		// the children in the opposite order
+		reversed := *spec.InnerSpec
+		reversed.ChildOrder = []int32{1, 0}
+		require.ErrorIs(t, itree.ValidateAgainstSpec(&ics23.ProofSpec{
+			LeafSpec:  spec.LeafSpec,
+			InnerSpec: &reversed,
+			MaxDepth:  spec.MaxDepth,
+			MinDepth:  spec.MinDepth,
+		}), ErrProofSpecMismatch)
+	}
+}
+
+func TestImmutableTree_GetSubtreeProof(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, prefix := range []string{"a/", "b/", "c/"} {
+		for i := 0; i < 30; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("%s%02d", prefix, i)), []byte(fmt.Sprintf("value%d", i)))
+			require.NoError(t, err)
+		}
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	for _, prefix := range []string{"b/", "a/", "c/1", "b/07", ""} {
+		proof, err := itree.GetSubtreeProof([]byte(prefix))
+		require.NoError(t, err, prefix)
+		require.NoError(t, proof.VerifyRoot(itree.Hash()), prefix)
+		require.Error(t, proof.VerifyRoot(make([]byte, 32)))
+
+		var count int
+		itree.IterateRange([]byte(prefix), nil, true, func(key, value []byte) bool {
+			if !bytes.HasPrefix(key, []byte(prefix)) {
+				return true
+			}
+			count++
+			require.NoError(t, proof.VerifyLeaf(ics23.IavlSpec, key, value), "key %s", key)
+			return false
+		})
+		require.Len(t, proof.Leaves, count)
+		require.ErrorIs(t, proof.VerifyLeaf(ics23.IavlSpec, proof.Leaves[0].Key, []byte("wrong")), ErrSubtreeProof)
+	}
+
+	// the subtree of a single key is its leaf
+	proof, err := itree.GetSubtreeProof([]byte("b/07"))
+	require.NoError(t, err)
+	require.NotEmpty(t, proof.Path)
+	require.Len(t, proof.Leaves, 1)
+	require.Empty(t, proof.Leaves[0].Path)
+
+	proof, err = itree.GetSubtreeProof([]byte("b/"))
+	require.NoError(t, err)
+	require.ErrorIs(t, proof.VerifyLeaf(ics23.IavlSpec, []byte("a/00"), []byte("value0")), ErrSubtreeProof)
+	require.ErrorIs(t, proof.VerifyLeaf(ics23.IavlSpec, []byte("b/99"), []byte("value0")), ErrSubtreeProof)
+
+	_, err = itree.GetSubtreeProof([]byte("d/"))
+	require.ErrorIs(t, err, ErrKeyDoesNotExist)
+}
+
+func TestProofSize(t *testing.T) {
+	for _, hashLeafValues := range []bool{false, true} {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), HashLeafValuesOption(hashLeafValues))
+		_, _, err := tree.ProofSize([]byte("a"))
+		require.Error(t, err)
+
+		keys := make([][]byte, 0, 300)
+		for i := 0; i < 300; i++ {
+			key := []byte{byte(i >> 8), byte(i)}
+			_, err := tree.Set(key, bytes.Repeat([]byte{1}, i))
+			require.NoError(t, err)
+			keys = append(keys, key)
+		}
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+		// the working tree mixes saved and unsaved nodes
+		for i := 0; i < 300; i += 7 {
+			_, err := tree.Set(keys[i], []byte("updated"))
+			require.NoError(t, err)
+		}
+
+		for _, tr := range []*ImmutableTree{tree.ImmutableTree, tree.lastSaved} {
+			for _, key := range keys {
+				proof, err := tr.GetMembershipProof(key)
+				require.NoError(t, err)
+				bz, err := proof.Marshal()
+				require.NoError(t, err)
+
+				size, depth, err := tr.ProofSize(key)
+				require.NoError(t, err)
+				require.Equal(t, len(bz), size, "key %X", key)
+				require.Equal(t, len(proof.GetExist().Path), depth)
+			}
+			_, _, err := tr.ProofSize([]byte("missing"))
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestRangeProofSizeEstimate(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	size, keys, err := tree.RangeProofSizeEstimate(nil, nil)
+	require.NoError(t, err)
+	require.Zero(t, size)
+	require.Zero(t, keys)
+
+	for version := 0; version < 4; version++ {
+		for i := 0; i < 250; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key%04d", i*4+version)), bytes.Repeat([]byte{byte(i)}, 40))
+			require.NoError(t, err)
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key%04d", i)) }
+	for _, r := range [][2][]byte{{nil, nil}, {key(100), key(200)}, {key(0), key(999)}, {nil, key(321)}, {key(777), nil}, {key(500), key(501)}, {key(500), key(500)}, {[]byte("z"), nil}} {
+		var entries []*ics23.BatchEntry
+		itr, err := tree.ImmutableTree.Iterator(r[0], r[1], true)
+		require.NoError(t, err)
+		for ; itr.Valid(); itr.Next() {
+			proof, err := tree.GetMembershipProof(itr.Key())
+			require.NoError(t, err)
+			entries = append(entries, &ics23.BatchEntry{Proof: &ics23.BatchEntry_Exist{Exist: proof.GetExist()}})
+		}
+		require.NoError(t, itr.Close())
+
+		size, keys, err := tree.RangeProofSizeEstimate(r[0], r[1])
+		require.NoError(t, err)
+		require.Equal(t, int64(len(entries)), keys, "range [%s, %s)", r[0], r[1])
+		if len(entries) == 0 {
+			require.Zero(t, size)
+			continue
+		}
+		proof := &ics23.CommitmentProof{Proof: &ics23.CommitmentProof_Batch{Batch: &ics23.BatchProof{Entries: entries}}}
+		// the documented tolerance for values of similar lengths
+		require.InEpsilon(t, proof.Size(), size, 0.05, "range [%s, %s)", r[0], r[1])
+		if len(entries) == 1 {
+			require.Equal(t, proof.Size(), size)
+		}
+	}
+}
@@ -106,6 +106,45 @@ func sortByteSlices(src [][]byte) [][]byte {
 	return bzz
 }
 
+func TestTreeGetMerklePath(t *testing.T) {
+	tree := getTestTree(0)
+	keys := make([][]byte, 0, 50)
+	for i := 0; i < 50; i++ {
+		key := []byte(iavlrand.RandStr(8))
+		keys = append(keys, key)
+		tree.Set(key, []byte(iavlrand.RandStr(8)))
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	// the working tree has unsaved changes
+	tree.Set(keys[0], []byte("updated"))
+
+	for _, check := range []struct {
+		tree *ImmutableTree
+		hash []byte
+	}{
+		{itree, itree.Hash()},
+		{tree.ImmutableTree, tree.WorkingHash()},
+	} {
+		for _, key := range keys {
+			leafHash, siblings, err := check.tree.GetMerklePath(key)
+			require.NoError(t, err)
+			require.NotEmpty(t, siblings)
+			hash := leafHash
+			for _, sibling := range siblings {
+				hash, err = sibling.Fold(hash)
+				require.NoError(t, err)
+			}
+			require.Equal(t, check.hash, hash)
+		}
+
+		_, _, err = check.tree.GetMerklePath([]byte("missing key"))
+		require.Error(t, err)
+	}
+}
+
 type byteslices [][]byte
 
 func (bz byteslices) Len() int {
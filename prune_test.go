@@ -2,10 +2,12 @@ package iavl
 
 import (
 	"fmt"
+	"io"
 	"testing"
 	"time"
 
 	dbm "github.com/cosmos/iavl/db"
+	ibytes "github.com/cosmos/iavl/internal/bytes"
 	"github.com/stretchr/testify/require"
 )
 
@@ -66,3 +68,387 @@ func TestAsyncPruning(t *testing.T) {
 		require.NoError(t, err)
 	}
 }
+
+func TestMutableTree_PruneWithPolicy(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	expected := make(map[int64]map[string]string)
+	current := make(map[string]string)
+	for version := int64(1); version <= 12; version++ {
+		// every third version is unchanged, and refers to the previous root
+		if version%3 != 0 {
+			for i := int64(0); i < 8; i++ {
+				key := fmt.Sprintf("key_%d", (version*5+i)%20)
+				value := fmt.Sprintf("val_%d_%d", version, i)
+				_, err := tree.Set([]byte(key), []byte(value))
+				require.NoError(t, err)
+				current[key] = value
+			}
+		}
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		expected[version] = make(map[string]string, len(current))
+		for k, v := range current {
+			expected[version][k] = v
+		}
+	}
+
+	checkVersions := func(tree *MutableTree, versions []int) {
+		require.Equal(t, versions, tree.AvailableVersions())
+		for version := int64(1); version <= 12; version++ {
+			exists := false
+			for _, v := range versions {
+				exists = exists || int64(v) == version
+			}
+			require.Equal(t, exists, tree.VersionExists(version), "version %d", version)
+			if !exists {
+				_, err := tree.GetImmutable(version)
+				require.Error(t, err)
+				continue
+			}
+			immutable, err := tree.GetImmutable(version)
+			require.NoError(t, err)
+			require.EqualValues(t, len(expected[version]), immutable.Size())
+			for k, v := range expected[version] {
+				value, err := immutable.Get([]byte(k))
+				require.NoError(t, err)
+				require.Equal(t, v, string(value))
+				proof, err := immutable.GetMembershipProof([]byte(k))
+				require.NoError(t, err)
+				ok, err := immutable.VerifyMembership(proof, []byte(k))
+				require.NoError(t, err)
+				require.True(t, ok)
+			}
+		}
+
+		// no node of the deleted versions is left
+		stored := make(map[string]bool)
+		for _, version := range versions {
+			stored[string(nodeKeyFormat.Key(GetRootKey(int64(version))))] = true
+			immutable, err := tree.GetImmutable(int64(version))
+			require.NoError(t, err)
+			var walk func(node *Node)
+			walk = func(node *Node) {
+				key := nodeKeyFormat.Key(node.GetKey())
+				if has, err := db.Has(key); err == nil && !has {
+					key = nodeKeyFormat.Key((&NodeKey{version: node.nodeKey.version, nonce: 0}).GetKey())
+				}
+				stored[string(key)] = true
+				if !node.isLeaf() {
+					left, err := node.getLeftNode(immutable)
+					require.NoError(t, err)
+					walk(left)
+					right, err := node.getRightNode(immutable)
+					require.NoError(t, err)
+					walk(right)
+				}
+			}
+			walk(immutable.root)
+		}
+		itr, err := db.Iterator(nodeKeyFormat.Prefix(), ibytes.CpIncr(nodeKeyFormat.Prefix()))
+		require.NoError(t, err)
+		defer itr.Close()
+		count := 0
+		for ; itr.Valid(); itr.Next() {
+			require.True(t, stored[string(itr.Key())], "leaked node %v", GetNodeKey(itr.Key()[1:]))
+			count++
+		}
+		require.Equal(t, len(stored), count)
+	}
+
+	require.NoError(t, tree.PruneWithPolicy(func(version int64) bool {
+		return version%2 == 0
+	}))
+	checkVersions(tree, []int{2, 4, 6, 8, 10, 12})
+
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := reloaded.Load()
+	require.NoError(t, err)
+	checkVersions(reloaded, []int{2, 4, 6, 8, 10, 12})
+
+	// the later deletions skip the missing versions
+	require.NoError(t, reloaded.PruneWithPolicy(func(version int64) bool {
+		return version != 10
+	}))
+	checkVersions(reloaded, []int{2, 4, 6, 8, 12})
+	require.NoError(t, reloaded.DeleteVersionsTo(4))
+	checkVersions(reloaded, []int{6, 8, 12})
+	require.NoError(t, reloaded.DeleteVersionsFrom(12))
+	checkVersions(reloaded, []int{6, 8})
+
+	reloaded = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	checkVersions(reloaded, []int{6, 8})
+}
+
+func TestMutableTree_PruneWithPolicyDiscardsOnError(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	for version := 1; version <= 5; version++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%d", version)), []byte("value"))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+
+	// versions 1 and 2 are deleted to the batch before version 3 fails
+	tree.ndb.incrVersionReaders(3)
+	require.ErrorContains(t, tree.PruneWithPolicy(func(int64) bool { return false }), "active readers")
+	tree.ndb.decrVersionReaders(3)
+
+	// the next commit does not write the deletions
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6}, tree.AvailableVersions())
+	reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+	_, err = reloaded.Load()
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3, 4, 5, 6}, reloaded.AvailableVersions())
+	for version := int64(1); version <= 6; version++ {
+		_, err := reloaded.GetImmutable(version)
+		require.NoError(t, err)
+	}
+}
+
+// scriptedPruner is a Pruner requesting fixed versions after each saved version.
+type scriptedPruner struct {
+	requests map[int64][]int64
+	calls    []int64
+}
+
+func (p *scriptedPruner) ShouldPrune(current int64) []int64 {
+	p.calls = append(p.calls, current)
+	return p.requests[current]
+}
+
+func TestMutableTree_Pruner(t *testing.T) {
+	saveVersions := func(tree *MutableTree, n int) {
+		for i := 0; i < n; i++ {
+			version := tree.WorkingVersion()
+			_, err := tree.Set([]byte(fmt.Sprintf("key_%d", version%4)), []byte(fmt.Sprintf("val_%d", version)))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+	checkValue := func(tree *MutableTree, version int64) {
+		immutable, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		value, err := immutable.Get([]byte(fmt.Sprintf("key_%d", version%4)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("val_%d", version), string(value))
+	}
+
+	t.Run("scripted", func(t *testing.T) {
+		pruner := &scriptedPruner{requests: map[int64][]int64{
+			3: {1},
+			5: {4, 2, 4},
+			// missing, latest and future versions are skipped
+			7: {1, 7, 9},
+			8: {6},
+		}}
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), PrunerOption(pruner))
+		saveVersions(tree, 8)
+		require.Equal(t, []int64{1, 2, 3, 4, 5, 6, 7, 8}, pruner.calls)
+		require.Equal(t, []int{3, 5, 7, 8}, tree.AvailableVersions())
+		for _, version := range []int64{3, 5, 7, 8} {
+			checkValue(tree, version)
+		}
+
+		reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+		_, err := reloaded.Load()
+		require.NoError(t, err)
+		require.Equal(t, []int{3, 5, 7, 8}, reloaded.AvailableVersions())
+	})
+
+	t.Run("keep every", func(t *testing.T) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), PrunerOption(NewKeepEveryPruner(2, 3)))
+		saveVersions(tree, 10)
+		require.Equal(t, []int{3, 6, 9, 10}, tree.AvailableVersions())
+		for _, version := range []int64{3, 6, 9, 10} {
+			checkValue(tree, version)
+		}
+	})
+
+	t.Run("keep recent", func(t *testing.T) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), PrunerOption(NewKeepRecentPruner(3)))
+		saveVersions(tree, 6)
+		require.Equal(t, []int{4, 5, 6}, tree.AvailableVersions())
+	})
+
+	t.Run("predicate", func(t *testing.T) {
+		pruner := NewPredicatePruner(0, func(version int64) bool { return version < 3 })
+		require.Nil(t, pruner.ShouldPrune(1))
+		require.Nil(t, pruner.ShouldPrune(3))
+		require.Equal(t, []int64{3}, pruner.ShouldPrune(4))
+	})
+
+	t.Run("keep recent versions", func(t *testing.T) {
+		// the versions deleted by KeepRecentVersions in the batch are skipped
+		pruner := &scriptedPruner{requests: map[int64][]int64{6: {1, 2, 4}}}
+		db := dbm.NewMemDB()
+		tree := NewMutableTree(db, 0, false, NewNopLogger(), KeepRecentVersionsOption(4), PrunerOption(pruner))
+		saveVersions(tree, 6)
+		require.Equal(t, []int{3, 5, 6}, tree.AvailableVersions())
+		for _, version := range []int64{3, 5, 6} {
+			checkValue(tree, version)
+		}
+
+		reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+		_, err := reloaded.Load()
+		require.NoError(t, err)
+		require.Equal(t, []int{3, 5, 6}, reloaded.AvailableVersions())
+	})
+
+	t.Run("async pruning", func(t *testing.T) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), AsyncPruningOption(true), PrunerOption(NewKeepRecentPruner(1)))
+		defer tree.Close()
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		// the pruning failure fails the save, like the ones of KeepRecentVersions
+		_, _, err = tree.SaveVersion()
+		require.Error(t, err)
+		require.False(t, tree.VersionExists(2))
+		require.True(t, tree.VersionExists(1))
+	})
+}
+
+func TestMutableTree_PinVersion(t *testing.T) {
+	saveVersions := func(t *testing.T, tree *MutableTree, n int) {
+		for i := 0; i < n; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key_%d", i%4)), []byte(fmt.Sprintf("val_%d", tree.WorkingVersion())))
+			require.NoError(t, err)
+			_, _, err = tree.SaveVersion()
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("keep recent", func(t *testing.T) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), KeepRecentVersionsOption(2))
+		saveVersions(t, tree, 3)
+		require.Equal(t, []int{2, 3}, tree.AvailableVersions())
+		require.NoError(t, tree.PinVersion(3))
+		require.ErrorIs(t, tree.PinVersion(1), ErrVersionDoesNotExist)
+
+		// the versions from the pinned one on survive the auto-prune
+		saveVersions(t, tree, 3)
+		require.Equal(t, []int{3, 4, 5, 6}, tree.AvailableVersions())
+		require.ErrorIs(t, tree.DeleteVersionsTo(4), ErrVersionPinned)
+		require.ErrorIs(t, tree.DeleteVersionsFrom(2), ErrVersionPinned)
+		require.Equal(t, []int{3, 4, 5, 6}, tree.AvailableVersions())
+
+		tree.UnpinVersion(3)
+		saveVersions(t, tree, 1)
+		require.Equal(t, []int{6, 7}, tree.AvailableVersions())
+		value, err := tree.Get([]byte("key_0"))
+		require.NoError(t, err)
+		require.Equal(t, "val_7", string(value))
+	})
+
+	t.Run("policies", func(t *testing.T) {
+		pruner := &scriptedPruner{requests: map[int64][]int64{5: {2, 3}}}
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), PrunerOption(pruner))
+		saveVersions(t, tree, 4)
+		require.NoError(t, tree.PinVersion(2))
+		saveVersions(t, tree, 1)
+		require.Equal(t, []int{1, 2, 4, 5}, tree.AvailableVersions())
+
+		require.NoError(t, tree.PruneWithPolicy(func(int64) bool { return false }))
+		require.Equal(t, []int{2, 5}, tree.AvailableVersions())
+
+		tree.UnpinVersion(2)
+		require.NoError(t, tree.DeleteVersionsTo(2))
+		require.Equal(t, []int{5}, tree.AvailableVersions())
+	})
+
+	t.Run("async pruning", func(t *testing.T) {
+		tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger(), AsyncPruningOption(true))
+		defer tree.Close()
+		saveVersions(t, tree, 4)
+		require.NoError(t, tree.PinVersion(2))
+		require.ErrorIs(t, tree.DeleteVersionsTo(3), ErrVersionPinned)
+		require.NoError(t, tree.DeleteVersionsTo(1))
+		require.ErrorIs(t, tree.PinVersion(1), ErrVersionPruned)
+	})
+}
+
+func TestMutableTree_PauseBackground(t *testing.T) {
+	firstVersion := func(t *testing.T, tree *MutableTree) int64 {
+		// the pruned versions are committed with the next version
+		tree.SetCommitting()
+		_, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		tree.UnsetCommitting()
+		version, err := tree.ndb.getFirstVersion()
+		require.NoError(t, err)
+		return version
+	}
+
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger(), AsyncPruningOption(true))
+	for i := 0; i < 6; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("key_%d", i%4)), []byte(fmt.Sprintf("val_%d", i)))
+		require.NoError(t, err)
+		_, _, err = tree.SaveVersion()
+		require.NoError(t, err)
+	}
+	tree.PauseBackground()
+	require.NoError(t, tree.DeleteVersionsTo(3))
+	// the pruner polls every 100ms
+	time.Sleep(300 * time.Millisecond)
+	require.EqualValues(t, 1, firstVersion(t, tree))
+
+	tree.ResumeBackground()
+	require.Eventually(t, func() bool {
+		return firstVersion(t, tree) == 4
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the versions queued while paused are pruned by Close
+	tree.PauseBackground()
+	require.NoError(t, tree.DeleteVersionsTo(5))
+	require.NoError(t, tree.Close())
+	tree = NewMutableTree(db, 0, false, NewNopLogger())
+	_, err := tree.Load()
+	require.NoError(t, err)
+	require.Equal(t, 6, tree.AvailableVersions()[0])
+}
+
+func TestMutableTree_CollapseHistory(t *testing.T) {
+	db := dbm.NewMemDB()
+	tree := NewMutableTree(db, 0, false, NewNopLogger())
+	roots := make(map[int64][]byte)
+	for version := int64(1); version <= 12; version++ {
+		for i := int64(0); i < 6; i++ {
+			_, err := tree.Set([]byte(fmt.Sprintf("key_%d", (version*7+i)%25)), []byte(fmt.Sprintf("val_%d_%d", version, i)))
+			require.NoError(t, err)
+		}
+		hash, _, err := tree.SaveVersion()
+		require.NoError(t, err)
+		roots[version] = hash
+	}
+
+	require.ErrorIs(t, tree.CollapseHistory([]int64{1, 20}), ErrVersionDoesNotExist)
+	require.Len(t, tree.AvailableVersions(), 12)
+
+	require.NoError(t, tree.CollapseHistory([]int64{1, 5, 10}))
+	require.Equal(t, []int{1, 5, 10, 12}, tree.AvailableVersions())
+	for version := int64(1); version <= 12; version++ {
+		reloaded := NewMutableTree(db, 0, false, NewNopLogger())
+		_, err := reloaded.LoadVersion(version)
+		if version != 1 && version != 5 && version != 10 && version != 12 {
+			require.Error(t, err, "version %d", version)
+			continue
+		}
+		require.NoError(t, err, "version %d", version)
+		require.Equal(t, roots[version], reloaded.Hash())
+		itree, err := tree.GetImmutable(version)
+		require.NoError(t, err)
+		require.Equal(t, roots[version], itree.Hash())
+		// the nodes of the kept versions are all still stored
+		count, err := itree.NodeHashes(io.Discard)
+		require.NoError(t, err)
+		require.EqualValues(t, 2*itree.Size()-1, count)
+	}
+}
@@ -0,0 +1,61 @@
+package iavl
+
+import (
+	"errors"
+	"sort"
+)
+
+// Pruner chooses the versions to delete after each saved version, see Options.Pruner.
+type Pruner interface {
+	// ShouldPrune returns the versions to delete once the version current is saved. Versions
+	// which do not exist, pinned and legacy versions and the latest version are skipped.
+	ShouldPrune(current int64) []int64
+}
+
+// PrunerFunc adapts a function to the Pruner interface.
+type PrunerFunc func(current int64) []int64
+
+// ShouldPrune implements Pruner.
+func (f PrunerFunc) ShouldPrune(current int64) []int64 {
+	return f(current)
+}
+
+// NewKeepRecentPruner returns a Pruner keeping the last n versions, which deletes the version
+// leaving them after each saved version.
+func NewKeepRecentPruner(n int64) Pruner {
+	return NewPredicatePruner(n, func(int64) bool { return false })
+}
+
+// NewKeepEveryPruner returns a Pruner keeping the last keepRecent versions and, out of the older
+// ones, the multiples of keepEvery.
+func NewKeepEveryPruner(keepRecent, keepEvery int64) Pruner {
+	return NewPredicatePruner(keepRecent, func(version int64) bool {
+		return keepEvery > 0 && version%keepEvery == 0
+	})
+}
+
+// NewPredicatePruner returns a Pruner keeping the last keepRecent versions, at least one, which
+// deletes the version leaving them after each saved version unless keep returns true for it.
+func NewPredicatePruner(keepRecent int64, keep func(version int64) bool) Pruner {
+	if keepRecent < 1 {
+		keepRecent = 1
+	}
+	return PrunerFunc(func(current int64) []int64 {
+		version := current - keepRecent
+		if version < 1 || keep(version) {
+			return nil
+		}
+		return []int64{version}
+	})
+}
+
+// pruneVersions deletes the given versions to the batch for Options.Pruner, keeping the nodes
+// shared with the previous and next remaining versions like PruneWithPolicy.
+func (tree *MutableTree) pruneVersions(versions []int64) error {
+	if tree.ndb.opts.AsyncPruning {
+		return errors.New("cannot use a Pruner with AsyncPruning")
+	}
+	versions = append([]int64(nil), versions...)
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	return tree.ndb.deleteVersionsKeepingNeighbours(versions)
+}
@@ -0,0 +1,138 @@
+package iavl
+
+import (
+	"bytes"
+	"sort"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// TreeReport summarizes the contents of a tree, see ImmutableTree.Report.
+type TreeReport struct {
+	Keys       int64
+	KeyBytes   int64
+	ValueBytes int64
+
+	AvgKeyLen      float64
+	AvgValueLen    float64
+	MedianKeyLen   float64
+	MedianValueLen float64
+
+	// Depth is the number of inner nodes on the longest path from the root to a leaf.
+	Depth int
+	// PrefixKeys holds the number of keys with each of the requested prefixes, keyed by
+	// string(prefix).
+	PrefixKeys map[string]int64
+}
+
+// reportPrefix is a requested prefix with the end of its key range, nil if unbounded.
+type reportPrefix struct {
+	prefix, end []byte
+}
+
+// Report returns statistics of the keys and values of the tree, and the number of keys with each
+// of prefixes, in a single traversal. A subtree whose key range is within a prefix is counted
+// from its size, without checking its leaves.
+func (t *ImmutableTree) Report(prefixes [][]byte) (*TreeReport, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	report := &TreeReport{PrefixKeys: make(map[string]int64, len(prefixes))}
+	candidates := make([]reportPrefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if _, ok := report.PrefixKeys[string(prefix)]; ok {
+			continue
+		}
+		report.PrefixKeys[string(prefix)] = 0
+		var end []byte
+		if len(prefix) > 0 {
+			end = ibytes.CpIncr(prefix)
+		}
+		candidates = append(candidates, reportPrefix{prefix: prefix, end: end})
+	}
+	if t.root == nil {
+		return report, nil
+	}
+
+	keyLens, valueLens := make(map[int]int64), make(map[int]int64)
+	var walk func(node *Node, lo, hi []byte, candidates []reportPrefix, depth int) error
+	walk = func(node *Node, lo, hi []byte, candidates []reportPrefix, depth int) error {
+		// the keys of the subtree are in [lo, hi), where nil is unbounded
+		remaining := make([]reportPrefix, 0, len(candidates))
+		for _, p := range candidates {
+			switch {
+			case (hi != nil && bytes.Compare(hi, p.prefix) <= 0) || (p.end != nil && lo != nil && bytes.Compare(lo, p.end) >= 0):
+				// the subtree is outside of the prefix
+			case (len(p.prefix) == 0 || lo != nil && bytes.Compare(lo, p.prefix) >= 0) && (p.end == nil || hi != nil && bytes.Compare(hi, p.end) <= 0):
+				report.PrefixKeys[string(p.prefix)] += node.size
+			default:
+				remaining = append(remaining, p)
+			}
+		}
+
+		if node.isLeaf() {
+			for _, p := range remaining {
+				if bytes.HasPrefix(node.key, p.prefix) {
+					report.PrefixKeys[string(p.prefix)]++
+				}
+			}
+			report.Keys++
+			report.KeyBytes += int64(len(node.key))
+			report.ValueBytes += int64(len(node.value))
+			keyLens[len(node.key)]++
+			valueLens[len(node.value)]++
+			if depth > report.Depth {
+				report.Depth = depth
+			}
+			return nil
+		}
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return err
+		}
+		if err := walk(leftNode, lo, node.key, remaining, depth+1); err != nil {
+			return err
+		}
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return err
+		}
+		return walk(rightNode, node.key, hi, remaining, depth+1)
+	}
+	if err := walk(t.root, nil, nil, candidates, 0); err != nil {
+		return nil, err
+	}
+
+	report.AvgKeyLen = float64(report.KeyBytes) / float64(report.Keys)
+	report.AvgValueLen = float64(report.ValueBytes) / float64(report.Keys)
+	report.MedianKeyLen = medianLength(keyLens, report.Keys)
+	report.MedianValueLen = medianLength(valueLens, report.Keys)
+	return report, nil
+}
+
+// medianLength returns the median of count lengths, given as the number of occurrences of each
+// length, with the mean of the two middle lengths for an even count.
+func medianLength(counts map[int]int64, count int64) float64 {
+	lengths := make([]int, 0, len(counts))
+	for length := range counts {
+		lengths = append(lengths, length)
+	}
+	sort.Ints(lengths)
+
+	// the 0-indexed positions of the middle lengths
+	lower, upper := (count-1)/2, count/2
+	var seen int64
+	median := 0.0
+	for _, length := range lengths {
+		next := seen + counts[length]
+		if lower >= seen && lower < next {
+			median += float64(length)
+		}
+		if upper >= seen && upper < next {
+			median += float64(length)
+			return median / 2
+		}
+		seen = next
+	}
+	return median / 2
+}
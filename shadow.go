@@ -0,0 +1,131 @@
+package iavl
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+)
+
+// shadowMap is the in-memory reference copy of the tree contents kept with
+// Options.ShadowVerify.
+type shadowMap struct {
+	kvs map[string][]byte
+	// undo holds the saved values of the keys changed since the last save, with nil for the
+	// keys that did not exist, so that a rollback does not need a full copy of kvs.
+	undo map[string][]byte
+}
+
+func newShadowMap() *shadowMap {
+	return &shadowMap{
+		kvs:  make(map[string][]byte),
+		undo: make(map[string][]byte),
+	}
+}
+
+func (s *shadowMap) set(key, value []byte) {
+	s.record(key)
+	s.kvs[string(key)] = bytes.Clone(value)
+}
+
+func (s *shadowMap) remove(key []byte) {
+	s.record(key)
+	delete(s.kvs, string(key))
+}
+
+func (s *shadowMap) record(key []byte) {
+	k := string(key)
+	if _, ok := s.undo[k]; !ok {
+		s.undo[k] = s.kvs[k]
+	}
+}
+
+// commit marks the current contents as saved.
+func (s *shadowMap) commit() {
+	s.undo = make(map[string][]byte)
+}
+
+// rollback restores the contents of the last save.
+func (s *shadowMap) rollback() {
+	for k, v := range s.undo {
+		if v == nil {
+			delete(s.kvs, k)
+		} else {
+			s.kvs[k] = v
+		}
+	}
+	s.undo = make(map[string][]byte)
+}
+
+// shadowSampled reports whether the next shadow check should run, according to
+// Options.ShadowSampleRate.
+func (tree *MutableTree) shadowSampled() bool {
+	rate := tree.ndb.opts.ShadowSampleRate
+	return rate <= 0 || rate >= 1 || rand.Float64() < rate
+}
+
+// resetShadow rebuilds the shadow map from the contents of the working tree, after a load.
+func (tree *MutableTree) resetShadow() error {
+	if tree.shadow == nil {
+		return nil
+	}
+	shadow := newShadowMap()
+	_, err := tree.ImmutableTree.Iterate(func(key, value []byte) bool {
+		shadow.kvs[string(key)] = bytes.Clone(value)
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	tree.shadow = shadow
+	return nil
+}
+
+// verifyShadowGet compares the result of Get with the shadow map.
+func (tree *MutableTree) verifyShadowGet(key, value []byte) {
+	if tree.shadow == nil || !tree.shadowSampled() {
+		return
+	}
+	if expected := tree.shadow.kvs[string(key)]; !bytes.Equal(expected, value) {
+		tree.shadowMismatch(key, expected, value)
+	}
+}
+
+// verifyShadowIteration compares a full iteration of the working tree with the shadow map.
+func (tree *MutableTree) verifyShadowIteration() error {
+	if tree.shadow == nil || !tree.shadowSampled() {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(tree.shadow.kvs))
+	_, err := tree.Iterate(func(key, value []byte) bool {
+		expected, ok := tree.shadow.kvs[string(key)]
+		if !ok || !bytes.Equal(expected, value) {
+			tree.shadowMismatch(key, expected, value)
+		}
+		seen[string(key)] = struct{}{}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if len(seen) == len(tree.shadow.kvs) {
+		return nil
+	}
+	missing := make([]string, 0, len(tree.shadow.kvs)-len(seen))
+	for k := range tree.shadow.kvs {
+		if _, ok := seen[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	sort.Strings(missing)
+	for _, k := range missing {
+		tree.shadowMismatch([]byte(k), tree.shadow.kvs[k], nil)
+	}
+	return nil
+}
+
+func (tree *MutableTree) shadowMismatch(key, expected, actual []byte) {
+	tree.logger.Error("shadow map mismatch", "key", key, "expected", expected, "actual", actual)
+	if tree.ndb.opts.OnShadowMismatch != nil {
+		tree.ndb.opts.OnShadowMismatch(key, expected, actual)
+	}
+}
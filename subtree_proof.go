@@ -0,0 +1,146 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	ics23 "github.com/cosmos/ics23/go"
+
+	ibytes "github.com/cosmos/iavl/internal/bytes"
+)
+
+// SubtreeProof proves all the keys with a prefix at once against the root of a tree, see
+// ImmutableTree.GetSubtreeProof. The root of the subtree is verified once with VerifyRoot, and
+// the leaves are then verified against it with VerifyLeaf.
+type SubtreeProof struct {
+	Prefix []byte
+	// SubtreeHash is the hash of the lowest subtree holding all the keys with the prefix, which
+	// may also hold keys around them.
+	SubtreeHash []byte
+	// Path holds the inner ops from the root of the subtree up to the root of the tree.
+	Path []*ics23.InnerOp
+	// Leaves holds the existence proofs of the keys with the prefix in ascending key order, whose
+	// paths end at the root of the subtree.
+	Leaves []*ics23.ExistenceProof
+}
+
+// ErrSubtreeProof is returned when a SubtreeProof does not verify.
+var ErrSubtreeProof = errors.New("invalid subtree proof")
+
+// GetSubtreeProof returns the proof of all the keys with the given prefix, with the path from the
+// lowest subtree holding them to the root of the tree. The proofs of the leaves are held in
+// memory. There must be at least one key with the prefix.
+func (t *ImmutableTree) GetSubtreeProof(prefix []byte) (*SubtreeProof, error) {
+	if t.isClosed() {
+		return nil, ErrClosed
+	}
+	if t.noHash() {
+		return nil, ErrHashingDisabled
+	}
+	if t.root == nil {
+		return nil, fmt.Errorf("%w: no key with prefix %X", ErrKeyDoesNotExist, prefix)
+	}
+	version := t.version + 1
+	t.root.hashWithCount(version)
+
+	var end []byte
+	if len(prefix) > 0 {
+		end = ibytes.CpIncr(prefix)
+	}
+	var keys [][]byte
+	itr := NewIterator(prefix, end, true, t)
+	for ; itr.Valid(); itr.Next() {
+		keys = append(keys, bytes.Clone(itr.Key()))
+	}
+	if err := itr.Error(); err != nil {
+		itr.Close()
+		return nil, err
+	}
+	if err := itr.Close(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no key with prefix %X", ErrKeyDoesNotExist, prefix)
+	}
+	first, last := keys[0], keys[len(keys)-1]
+
+	// descend while the keys are all on the same side of the node
+	var path PathToLeaf
+	node := t.root
+	for !node.isLeaf() {
+		nodeVersion := version
+		if node.nodeKey != nil {
+			nodeVersion = node.nodeKey.version
+		}
+		leftNode, err := node.getLeftNode(t)
+		if err != nil {
+			return nil, err
+		}
+		rightNode, err := node.getRightNode(t)
+		if err != nil {
+			return nil, err
+		}
+		pin := ProofInnerNode{Height: node.subtreeHeight, Size: node.size, Version: nodeVersion}
+		if bytes.Compare(last, node.key) < 0 {
+			pin.Right = rightNode.hash
+			node = leftNode
+		} else if bytes.Compare(first, node.key) >= 0 {
+			pin.Left = leftNode.hash
+			node = rightNode
+		} else {
+			break
+		}
+		path = append(path, pin)
+	}
+
+	proof := &SubtreeProof{
+		Prefix:      prefix,
+		SubtreeHash: node.hash,
+		Path:        convertInnerOps(path),
+		Leaves:      make([]*ics23.ExistenceProof, 0, len(keys)),
+	}
+	for _, key := range keys {
+		leaf, err := t.createExistenceProofFrom(node, key, version)
+		if err != nil {
+			return nil, err
+		}
+		proof.Leaves = append(proof.Leaves, leaf)
+	}
+	return proof, nil
+}
+
+// VerifyRoot checks that the path of the proof leads from the subtree hash to root.
+func (p *SubtreeProof) VerifyRoot(root []byte) error {
+	hash := p.SubtreeHash
+	for i, op := range p.Path {
+		var err error
+		if hash, err = op.Apply(hash); err != nil {
+			return fmt.Errorf("%w: inner op %d: %w", ErrSubtreeProof, i, err)
+		}
+	}
+	if !bytes.Equal(hash, root) {
+		return fmt.Errorf("%w: calculated root %X does not match %X", ErrSubtreeProof, hash, root)
+	}
+	return nil
+}
+
+// VerifyLeaf checks that the proof holds key with value, under the prefix, and that its path
+// leads to the subtree hash, like ics23.VerifyMembership with the subtree as root. With the
+// HashLeafValues option, value is the hash of the value and spec is ValueHashSpec.
+func (p *SubtreeProof) VerifyLeaf(spec *ics23.ProofSpec, key, value []byte) error {
+	if !bytes.HasPrefix(key, p.Prefix) {
+		return fmt.Errorf("%w: key %X does not have prefix %X", ErrSubtreeProof, key, p.Prefix)
+	}
+	i := sort.Search(len(p.Leaves), func(i int) bool {
+		return bytes.Compare(p.Leaves[i].Key, key) >= 0
+	})
+	if i == len(p.Leaves) || !bytes.Equal(p.Leaves[i].Key, key) {
+		return fmt.Errorf("%w: no leaf for key %X", ErrSubtreeProof, key)
+	}
+	if err := p.Leaves[i].Verify(spec, p.SubtreeHash, key, value); err != nil {
+		return fmt.Errorf("%w: leaf of key %X: %w", ErrSubtreeProof, key, err)
+	}
+	return nil
+}
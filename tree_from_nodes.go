@@ -0,0 +1,153 @@
+package iavl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	dbm "github.com/cosmos/iavl/db"
+)
+
+// builtNode is a node of NewImmutableTreeFromNodes with its resolved children, and the first and
+// last keys of its subtree.
+type builtNode struct {
+	export      *ExportNode
+	node        *Node
+	left, right *builtNode
+	first, last []byte
+}
+
+// NewImmutableTreeFromNodes builds a tree with the root hash root in an in-memory database, from
+// its nodes keyed by string(hash). The children of an inner node are the nodes whose subtrees
+// end before its key and start at it, and whose hashes give its hash, so every node must belong
+// to the tree. The tree is imported at the version of its root, which must be the greatest
+// version. This is meant for tests of handcrafted trees.
+func NewImmutableTreeFromNodes(root []byte, nodes map[string]*ExportNode) (*ImmutableTree, error) {
+	db := dbm.NewMemDB()
+	if len(root) == 0 {
+		if len(nodes) > 0 {
+			return nil, errors.New("nodes given for an empty tree")
+		}
+		return NewImmutableTree(db, 0, true, NewNopLogger()), nil
+	}
+
+	var leafKeys [][]byte
+	inner := make([]string, 0, len(nodes))
+	for hash, node := range nodes {
+		if node == nil {
+			return nil, fmt.Errorf("node %X is nil", hash)
+		}
+		if node.Height < 0 {
+			return nil, fmt.Errorf("node %X has a negative height %d", hash, node.Height)
+		}
+		if node.Height == 0 {
+			leafKeys = append(leafKeys, node.Key)
+		} else {
+			inner = append(inner, hash)
+		}
+	}
+	sort.Slice(leafKeys, func(i, j int) bool { return bytes.Compare(leafKeys[i], leafKeys[j]) < 0 })
+	for i := 1; i < len(leafKeys); i++ {
+		if bytes.Equal(leafKeys[i-1], leafKeys[i]) {
+			return nil, fmt.Errorf("duplicate leaf key %X", leafKeys[i])
+		}
+	}
+	// the children of the inner nodes are resolved first
+	sort.Slice(inner, func(i, j int) bool {
+		if hi, hj := nodes[inner[i]].Height, nodes[inner[j]].Height; hi != hj {
+			return hi < hj
+		}
+		return inner[i] < inner[j]
+	})
+
+	built := make(map[string]*builtNode, len(nodes))
+	byFirst := make(map[string][]*builtNode, len(nodes))
+	byLast := make(map[string][]*builtNode, len(nodes))
+	add := func(hash string, b *builtNode) {
+		built[hash] = b
+		byFirst[string(b.first)] = append(byFirst[string(b.first)], b)
+		byLast[string(b.last)] = append(byLast[string(b.last)], b)
+	}
+	for hash, export := range nodes {
+		if export.Height > 0 {
+			continue
+		}
+		node := &Node{key: export.Key, value: export.Value, size: 1}
+		if !bytes.Equal(node._hash(export.Version), []byte(hash)) {
+			return nil, fmt.Errorf("leaf %X does not match its hash %X", export.Key, hash)
+		}
+		add(hash, &builtNode{export: export, node: node, first: export.Key, last: export.Key})
+	}
+	for _, hash := range inner {
+		export := nodes[hash]
+		i := sort.Search(len(leafKeys), func(i int) bool { return bytes.Compare(leafKeys[i], export.Key) >= 0 })
+		if i == 0 || i == len(leafKeys) || !bytes.Equal(leafKeys[i], export.Key) {
+			return nil, fmt.Errorf("inner node %X: key %X does not split the leaves", hash, export.Key)
+		}
+		var found *builtNode
+	search:
+		for _, left := range byLast[string(leafKeys[i-1])] {
+			for _, right := range byFirst[string(export.Key)] {
+				if max(left.node.subtreeHeight, right.node.subtreeHeight)+1 != export.Height {
+					continue
+				}
+				node := &Node{
+					key:           export.Key,
+					subtreeHeight: export.Height,
+					size:          left.node.size + right.node.size,
+					leftNode:      left.node,
+					rightNode:     right.node,
+				}
+				if bytes.Equal(node._hash(export.Version), []byte(hash)) {
+					found = &builtNode{export: export, node: node, left: left, right: right, first: left.first, last: right.last}
+					break search
+				}
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("inner node %X: no children match its hash", hash)
+		}
+		add(hash, found)
+	}
+
+	rootNode, ok := built[string(root)]
+	if !ok {
+		return nil, fmt.Errorf("root %X is not in the nodes", root)
+	}
+	version := rootNode.export.Version
+	tree := NewMutableTree(db, 0, true, NewNopLogger())
+	importer, err := tree.Import(version)
+	if err != nil {
+		return nil, err
+	}
+	defer importer.Close()
+
+	visited := make(map[*builtNode]bool, len(nodes))
+	var walk func(b *builtNode) error
+	walk = func(b *builtNode) error {
+		if visited[b] {
+			return fmt.Errorf("node %X is a child of several nodes", b.node.hash)
+		}
+		visited[b] = true
+		if b.left != nil {
+			if err := walk(b.left); err != nil {
+				return err
+			}
+			if err := walk(b.right); err != nil {
+				return err
+			}
+		}
+		return importer.Add(b.export)
+	}
+	if err := walk(rootNode); err != nil {
+		return nil, err
+	}
+	if len(visited) != len(nodes) {
+		return nil, fmt.Errorf("%d of the nodes are not in the tree", len(nodes)-len(visited))
+	}
+	if err := importer.CommitExpecting(root); err != nil {
+		return nil, err
+	}
+	return tree.GetImmutable(version)
+}
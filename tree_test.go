@@ -6,9 +6,11 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"testing"
 
@@ -1615,6 +1617,199 @@ func TestIterate_ImmutableTree_Version2(t *testing.T) {
 	assertImmutableMirrorIterate(t, immutableTree, mirror)
 }
 
+func TestIterateValuesProjected_ImmutableTree(t *testing.T) {
+	tree, mirror := getRandomizedTreeAndMirror(t)
+	mirrorKeys := getSortedMirrorKeys(mirror)
+
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	immutableTree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	project := func(value []byte) []byte {
+		if len(value) > 1 {
+			return value[:1]
+		}
+		return value
+	}
+
+	start, end := []byte(mirrorKeys[len(mirrorKeys)/4]), []byte(mirrorKeys[3*len(mirrorKeys)/4])
+	var expected, actual [][]byte
+	_, err = immutableTree.Iterate(func(key, value []byte) bool {
+		if bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0 {
+			expected = append(expected, key, project(value))
+		}
+		return false
+	})
+	require.NoError(t, err)
+
+	stopped, err := immutableTree.IterateValuesProjected(start, end, project, func(key, value []byte) bool {
+		actual = append(actual, key, value)
+		return false
+	})
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.NotEmpty(t, actual)
+	require.Equal(t, expected, actual)
+
+	var count int
+	stopped, err = immutableTree.IterateValuesProjected(nil, nil, project, func(_, value []byte) bool {
+		require.LessOrEqual(t, len(value), 1)
+		count++
+		return count == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, count)
+}
+
+func TestIterateStreaming_ImmutableTree(t *testing.T) {
+	tree, mirror := getRandomizedTreeAndMirror(t)
+	mirrorKeys := getSortedMirrorKeys(mirror)
+
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	immutableTree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	start, end := []byte(mirrorKeys[len(mirrorKeys)/4]), []byte(mirrorKeys[3*len(mirrorKeys)/4])
+	var expected, actual [][]byte
+	_, err = immutableTree.Iterate(func(key, value []byte) bool {
+		if bytes.Compare(key, start) >= 0 && bytes.Compare(key, end) < 0 {
+			expected = append(expected, key, value)
+		}
+		return false
+	})
+	require.NoError(t, err)
+
+	stopped, err := immutableTree.IterateStreaming(start, end, func(key []byte, value io.Reader) bool {
+		bz, err := io.ReadAll(value)
+		require.NoError(t, err)
+		actual = append(actual, key, bz)
+		return false
+	})
+	require.NoError(t, err)
+	require.False(t, stopped)
+	require.NotEmpty(t, actual)
+	require.Equal(t, expected, actual)
+
+	var count int
+	stopped, err = immutableTree.IterateStreaming(nil, nil, func(key []byte, value io.Reader) bool {
+		// read a value in pieces
+		var bz []byte
+		buf := make([]byte, 3)
+		for {
+			n, err := value.Read(buf)
+			bz = append(bz, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+		}
+		require.Equal(t, mirror[string(key)], string(bz))
+		count++
+		return count == 3
+	})
+	require.NoError(t, err)
+	require.True(t, stopped)
+	require.Equal(t, 3, count)
+}
+
+func TestWalkStructure_ImmutableTree(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		_, err := tree.Set([]byte(key), []byte("v"+key))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	type innerNode struct {
+		hash, leftHash, rightHash []byte
+		height                    int8
+		size                      int64
+	}
+	var nodes []innerNode
+	require.NoError(t, itree.WalkStructure(func(hash []byte, height int8, size int64, leftHash, rightHash []byte) bool {
+		nodes = append(nodes, innerNode{hash, leftHash, rightHash, height, size})
+		return true
+	}))
+	// 5 leaves have 4 inner nodes, with the root first
+	require.Len(t, nodes, 4)
+	require.Equal(t, itree.Hash(), nodes[0].hash)
+	require.Equal(t, int8(3), nodes[0].height)
+	require.Equal(t, int64(5), nodes[0].size)
+	// the left subtree of the root, holding a and b, comes before the right one
+	require.Equal(t, nodes[0].leftHash, nodes[1].hash)
+	require.Equal(t, int64(2), nodes[1].size)
+	require.Equal(t, nodes[0].rightHash, nodes[2].hash)
+	require.Equal(t, int64(3), nodes[2].size)
+	require.Equal(t, nodes[2].rightHash, nodes[3].hash)
+	for _, node := range nodes {
+		require.Len(t, node.leftHash, hashSize)
+		require.Len(t, node.rightHash, hashSize)
+	}
+
+	// the working tree is walked the same way
+	var count int
+	require.NoError(t, tree.ImmutableTree.WalkStructure(func(hash []byte, _ int8, _ int64, _, _ []byte) bool {
+		require.Equal(t, nodes[count].hash, hash)
+		count++
+		return count < 2
+	}))
+	require.Equal(t, 2, count)
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	require.NoError(t, empty.ImmutableTree.WalkStructure(func([]byte, int8, int64, []byte, []byte) bool {
+		t.Fatal("no inner node expected")
+		return false
+	}))
+}
+
+func TestNodeHashes_ImmutableTree(t *testing.T) {
+	tree, _ := getRandomizedTreeAndMirror(t)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	count, err := itree.NodeHashes(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, 2*itree.Size()-1, count)
+	require.Len(t, buf.Bytes(), int(count)*hashSize)
+	hashes := make(map[string]bool)
+	for bz := buf.Bytes(); len(bz) > 0; bz = bz[hashSize:] {
+		hashes[string(bz[:hashSize])] = true
+	}
+
+	// the same set as the nodes read from the database
+	rootKey, err := tree.ndb.GetRoot(version)
+	require.NoError(t, err)
+	iter, err := NewNodeIterator(rootKey, tree.ndb)
+	require.NoError(t, err)
+	walked := make(map[string]bool)
+	for ; iter.Valid(); iter.Next(false) {
+		walked[string(iter.GetNode().hash)] = true
+	}
+	require.NoError(t, iter.Error())
+	require.Equal(t, walked, hashes)
+
+	// the working tree writes the same hashes in the same order
+	var working bytes.Buffer
+	_, err = tree.ImmutableTree.NodeHashes(&working)
+	require.NoError(t, err)
+	require.Equal(t, buf.Bytes(), working.Bytes())
+
+	count, err = NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger()).ImmutableTree.NodeHashes(&working)
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
 func TestGetByIndex_ImmutableTree(t *testing.T) {
 	tree, mirror := getRandomizedTreeAndMirror(t)
 	mirrorKeys := getSortedMirrorKeys(mirror)
@@ -1947,3 +2142,576 @@ func TestWorkingHashWithInitialVersion(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, commitHash1, commitHash)
 }
+
+func TestHasBatch_ImmutableTree(t *testing.T) {
+	tree, mirror := getRandomizedTreeAndMirror(t)
+	mirrorKeys := getSortedMirrorKeys(mirror)
+
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	immutableTree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	keys := make([][]byte, 0, 2*len(mirrorKeys)+3)
+	for i, key := range mirrorKeys {
+		keys = append(keys, []byte(key), []byte(key+"-absent"))
+		if i%10 == 0 {
+			// duplicates
+			keys = append(keys, []byte(key))
+		}
+	}
+	keys = append(keys, []byte{}, []byte{0x00}, []byte{0xff, 0xff})
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	result, err := immutableTree.HasBatch(keys)
+	require.NoError(t, err)
+	require.Len(t, result, len(keys))
+	for i, key := range keys {
+		expected, err := immutableTree.Has(key)
+		require.NoError(t, err)
+		require.Equal(t, expected, result[i], "key %X", key)
+	}
+
+	empty, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	empty.root = nil
+	result, err = empty.HasBatch(keys[:3])
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, false, false}, result)
+}
+
+func TestGetMany_ImmutableTree(t *testing.T) {
+	tree, mirror := getRandomizedTreeAndMirror(t)
+	mirrorKeys := getSortedMirrorKeys(mirror)
+
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	immutableTree, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+
+	keys := make([][]byte, 0, 2*len(mirrorKeys)+3)
+	for i, key := range mirrorKeys {
+		keys = append(keys, []byte(key), []byte(key+"-absent"))
+		if i%10 == 0 {
+			// duplicates
+			keys = append(keys, []byte(key))
+		}
+	}
+	keys = append(keys, []byte{}, []byte{0x00}, []byte{0xff, 0xff})
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	values, err := immutableTree.GetMany(keys)
+	require.NoError(t, err)
+	require.Len(t, values, len(keys))
+	for i, key := range keys {
+		if value, ok := mirror[string(key)]; ok {
+			require.Equal(t, value, string(values[i]), "key %X", key)
+		} else {
+			require.Nil(t, values[i], "key %X", key)
+		}
+		expected, err := immutableTree.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, expected, values[i], "key %X", key)
+	}
+
+	empty, err := tree.GetImmutable(1)
+	require.NoError(t, err)
+	empty.root = nil
+	values, err = empty.GetMany(keys[:3])
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{nil, nil, nil}, values)
+}
+
+func TestPrevNext_ImmutableTree(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	var keys []string
+	for i := 10; i < 100; i += 2 {
+		key := fmt.Sprintf("k%d", i)
+		keys = append(keys, key)
+		_, err := tree.Set([]byte(key), []byte("v"+key))
+		require.NoError(t, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	for i, key := range keys {
+		// the neighbors of a present key and of absent keys right before and after it
+		for _, query := range []string{key, key[:len(key)-1], key + "0"} {
+			prevIdx := sort.SearchStrings(keys, query) - 1
+			k, v, ok, err := itree.Prev([]byte(query))
+			require.NoError(t, err)
+			if prevIdx < 0 {
+				require.False(t, ok, "query %s", query)
+			} else {
+				require.True(t, ok, "query %s", query)
+				require.Equal(t, keys[prevIdx], string(k))
+				require.Equal(t, "v"+keys[prevIdx], string(v))
+			}
+
+			nextIdx := sort.Search(len(keys), func(j int) bool { return keys[j] > query })
+			k, v, ok, err = itree.Next([]byte(query))
+			require.NoError(t, err)
+			if nextIdx == len(keys) {
+				require.False(t, ok, "query %s", query)
+			} else {
+				require.True(t, ok, "query %s", query)
+				require.Equal(t, keys[nextIdx], string(k))
+				require.Equal(t, "v"+keys[nextIdx], string(v))
+			}
+		}
+
+		if i > 0 && i < len(keys)-1 {
+			k, _, _, err := itree.Prev([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, keys[i-1], string(k))
+			k, _, _, err = itree.Next([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, keys[i+1], string(k))
+		}
+	}
+
+	_, _, ok, err := itree.Prev([]byte(keys[0]))
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, _, ok, err = itree.Next([]byte(keys[len(keys)-1]))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, _, ok, err = empty.Prev([]byte("k"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, _, ok, err = empty.Next([]byte("k"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func Benchmark_HasBatch(b *testing.B) {
+	const (
+		numKeyVals = 100000
+		batchSize  = 200
+	)
+
+	t := NewMutableTree(dbm.NewMemDB(), numKeyVals, false, NewNopLogger())
+	keys := make([][]byte, 0, numKeyVals)
+	for i := 0; i < numKeyVals; i++ {
+		key := iavlrand.RandBytes(10)
+		keys = append(keys, key)
+		t.Set(key, iavlrand.RandBytes(10))
+	}
+	_, _, err := t.SaveVersion()
+	require.NoError(b, err)
+
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		if i%2 == 0 {
+			batch[i] = keys[rand.Intn(numKeyVals)]
+		} else {
+			batch[i] = iavlrand.RandBytes(10)
+		}
+	}
+
+	b.ReportAllocs()
+	runtime.GC()
+
+	b.Run("per-key", func(sub *testing.B) {
+		for i := 0; i < sub.N; i++ {
+			for _, key := range batch {
+				t.Has(key)
+			}
+		}
+	})
+
+	b.Run("batch", func(sub *testing.B) {
+		for i := 0; i < sub.N; i++ {
+			t.HasBatch(batch)
+		}
+	})
+}
+
+func Benchmark_GetMany(b *testing.B) {
+	const (
+		numKeyVals = 100000
+		batchSize  = 200
+	)
+
+	t := NewMutableTree(dbm.NewMemDB(), numKeyVals, false, NewNopLogger())
+	keys := make([][]byte, 0, numKeyVals)
+	for i := 0; i < numKeyVals; i++ {
+		key := iavlrand.RandBytes(10)
+		keys = append(keys, key)
+		t.Set(key, iavlrand.RandBytes(10))
+	}
+	_, version, err := t.SaveVersion()
+	require.NoError(b, err)
+	// Get would use the fast index of the latest version
+	itree, err := t.GetImmutable(version)
+	require.NoError(b, err)
+	itree.skipFastStorageUpgrade = true
+
+	batch := make([][]byte, batchSize)
+	for i := range batch {
+		if i%2 == 0 {
+			batch[i] = keys[rand.Intn(numKeyVals)]
+		} else {
+			batch[i] = iavlrand.RandBytes(10)
+		}
+	}
+
+	b.ReportAllocs()
+	runtime.GC()
+
+	b.Run("per-key", func(sub *testing.B) {
+		for i := 0; i < sub.N; i++ {
+			for _, key := range batch {
+				itree.Get(key)
+			}
+		}
+	})
+
+	b.Run("batch", func(sub *testing.B) {
+		for i := 0; i < sub.N; i++ {
+			itree.GetMany(batch)
+		}
+	})
+}
+
+func TestFirstLastKey_ImmutableTree(t *testing.T) {
+	tree, mirror := getRandomizedTreeAndMirror(t)
+	mirrorKeys := getSortedMirrorKeys(mirror)
+	_, version, err := tree.SaveVersion()
+	require.NoError(t, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+
+	k, v, ok, err := itree.FirstKey()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, mirrorKeys[0], string(k))
+	require.Equal(t, mirror[mirrorKeys[0]], string(v))
+
+	k, v, ok, err = itree.LastKey()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, mirrorKeys[len(mirrorKeys)-1], string(k))
+	require.Equal(t, mirror[mirrorKeys[len(mirrorKeys)-1]], string(v))
+
+	// a single leaf is both the first and the last key
+	single := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	_, err = single.Set([]byte("only"), []byte("one"))
+	require.NoError(t, err)
+	for _, extreme := range []func() ([]byte, []byte, bool, error){single.FirstKey, single.LastKey} {
+		k, v, ok, err := extreme()
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, []byte("only"), k)
+		require.Equal(t, []byte("one"), v)
+	}
+
+	empty := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	for _, extreme := range []func() ([]byte, []byte, bool, error){empty.FirstKey, empty.LastKey} {
+		k, v, ok, err := extreme()
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.Nil(t, k)
+		require.Nil(t, v)
+	}
+}
+
+func TestGetInto_ImmutableTree(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	sizes := []int{0, 1, 31, 32, 33, 1000, 1 << 16}
+	for _, size := range sizes {
+		_, err := tree.Set([]byte(fmt.Sprintf("key%d", size)), bytes.Repeat([]byte{byte(size)}, size))
+		require.NoError(t, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(t, err)
+
+	for _, itree := range []*ImmutableTree{tree.ImmutableTree, mustGetImmutable(t, tree, 1)} {
+		for _, bufSize := range []int{0, 32} {
+			var buf []byte
+			if bufSize > 0 {
+				buf = make([]byte, 0, bufSize)
+			}
+			for _, size := range sizes {
+				key := []byte(fmt.Sprintf("key%d", size))
+				value, found, err := itree.GetInto(key, buf)
+				require.NoError(t, err)
+				require.True(t, found)
+				require.NotNil(t, value)
+				require.Equal(t, bytes.Repeat([]byte{byte(size)}, size), value)
+				if size <= cap(buf) {
+					require.Equal(t, cap(buf), cap(value), "the buffer is reused")
+				}
+
+				// the value does not alias the tree
+				if size > 0 {
+					value[0]++
+					expected, err := itree.Get(key)
+					require.NoError(t, err)
+					require.Equal(t, byte(size), expected[0])
+				}
+				buf = value
+			}
+			value, found, err := itree.GetInto([]byte("missing"), buf)
+			require.NoError(t, err)
+			require.False(t, found)
+			require.Nil(t, value)
+		}
+	}
+}
+
+func mustGetImmutable(t *testing.T, tree *MutableTree, version int64) *ImmutableTree {
+	itree, err := tree.GetImmutable(version)
+	require.NoError(t, err)
+	return itree
+}
+
+func BenchmarkImmutableTree_GetInto(b *testing.B) {
+	tree := NewMutableTree(dbm.NewMemDB(), 10000, false, NewNopLogger())
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%04d", i))
+		_, err := tree.Set(keys[i], bytes.Repeat([]byte{byte(i)}, 256))
+		require.NoError(b, err)
+	}
+	_, _, err := tree.SaveVersion()
+	require.NoError(b, err)
+
+	b.Run("Get+Clone", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			value, err := tree.ImmutableTree.Get(keys[i%len(keys)])
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = bytes.Clone(value)
+		}
+	})
+	b.Run("GetInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			value, _, err := tree.ImmutableTree.GetInto(keys[i%len(keys)], buf)
+			if err != nil {
+				b.Fatal(err)
+			}
+			buf = value
+		}
+	})
+}
+
+func TestImmutableTree_Report(t *testing.T) {
+	tree := NewMutableTree(dbm.NewMemDB(), 0, false, NewNopLogger())
+	report, err := tree.Report([][]byte{[]byte("a")})
+	require.NoError(t, err)
+	require.Equal(t, &TreeReport{PrefixKeys: map[string]int64{"a": 0}}, report)
+
+	// 100 keys "a/00".."a/99" with 10-byte values and 50 keys "bb/00".."bb/49" with 1-byte values
+	for i := 0; i < 100; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("a/%02d", i)), bytes.Repeat([]byte{1}, 10))
+		require.NoError(t, err)
+	}
+	for i := 0; i < 50; i++ {
+		_, err := tree.Set([]byte(fmt.Sprintf("bb/%02d", i)), []byte{2})
+		require.NoError(t, err)
+	}
+	_, _, err = tree.SaveVersion()
+	require.NoError(t, err)
+
+	report, err = tree.Report([][]byte{[]byte("a/"), []byte("a/1"), []byte("bb/4"), []byte("c"), {}, []byte("a/")})
+	require.NoError(t, err)
+	require.Equal(t, int64(150), report.Keys)
+	require.Equal(t, int64(100*4+50*5), report.KeyBytes)
+	require.Equal(t, int64(100*10+50), report.ValueBytes)
+	require.InDelta(t, 650.0/150, report.AvgKeyLen, 1e-9)
+	require.InDelta(t, 1050.0/150, report.AvgValueLen, 1e-9)
+	require.Equal(t, 4.0, report.MedianKeyLen)
+	require.Equal(t, 10.0, report.MedianValueLen)
+	require.Equal(t, int(tree.Height()), report.Depth)
+	require.Equal(t, map[string]int64{"a/": 100, "a/1": 10, "bb/4": 10, "c": 0, "": 150}, report.PrefixKeys)
+
+	require.Equal(t, 2.5, medianLength(map[int]int64{1: 1, 2: 1, 3: 1, 4: 1}, 4))
+}
+
+func TestImmutableTree_GetValueOnly(t *testing.T) {
+	for _, opts := range [][]Option{nil, {ValueTransformOption(xorTransform(0x5a))}} {
+		// without a cache, so that the leaves are read from disk
+		tree := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger(), opts...)
+		value, err := tree.GetValueOnly([]byte("k"))
+		require.NoError(t, err)
+		require.Nil(t, value)
+
+		for version := 1; version <= 3; version++ {
+			for i := 0; i < 50; i++ {
+				_, err := tree.Set([]byte(fmt.Sprintf("k%02d", (i*version)%70)), []byte(fmt.Sprintf("value%d-%d", version, i)))
+				require.NoError(t, err)
+			}
+			_, err = tree.Set([]byte(fmt.Sprintf("empty%d", version)), []byte{})
+			require.NoError(t, err)
+			_, _, err := tree.SaveVersion()
+			require.NoError(t, err)
+		}
+		_, err = tree.Set([]byte("k00"), []byte("unsaved"))
+		require.NoError(t, err)
+
+		check := func(tr *ImmutableTree) {
+			for i := 0; i < 75; i++ {
+				for _, key := range [][]byte{[]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("k%02d-", i)), []byte(fmt.Sprintf("empty%d", i))} {
+					expected, err := tr.Get(key)
+					require.NoError(t, err)
+					value, err := tr.GetValueOnly(key)
+					require.NoError(t, err)
+					require.Equal(t, expected, value, "key %s", key)
+				}
+			}
+		}
+		check(tree.ImmutableTree)
+		for version := int64(1); version <= 3; version++ {
+			itree, err := tree.GetImmutable(version)
+			require.NoError(t, err)
+			check(itree)
+		}
+	}
+}
+
+func BenchmarkImmutableTree_GetValueOnly(b *testing.B) {
+	const numKeys = 1000
+	// without a cache or the fast index, so that Get reads the leaves from disk too
+	tree := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	keys := make([][]byte, numKeys)
+	for i := range keys {
+		keys[i] = iavlrand.RandBytes(16)
+		_, err := tree.Set(keys[i], iavlrand.RandBytes(16*1024))
+		require.NoError(b, err)
+	}
+	_, version, err := tree.SaveVersion()
+	require.NoError(b, err)
+	itree, err := tree.GetImmutable(version)
+	require.NoError(b, err)
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := itree.Get(keys[i%numKeys]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("GetValueOnly", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := itree.GetValueOnly(keys[i%numKeys]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNewImmutableTreeFromNodes(t *testing.T) {
+	// the root c has the inner node b, with the leaves a and b, and the leaf c as children
+	leafA := &Node{key: []byte("a"), value: []byte("1"), size: 1}
+	leafB := &Node{key: []byte("b"), value: []byte("2"), size: 1}
+	leafC := &Node{key: []byte("c"), value: []byte("3"), size: 1}
+	leafA._hash(1)
+	leafB._hash(2)
+	leafC._hash(1)
+	innerB := &Node{key: []byte("b"), subtreeHeight: 1, size: 2, leftNode: leafA, rightNode: leafB}
+	innerB._hash(2)
+	rootC := &Node{key: []byte("c"), subtreeHeight: 2, size: 3, leftNode: innerB, rightNode: leafC}
+	rootC._hash(3)
+	nodes := map[string]*ExportNode{
+		string(leafA.hash):  {Key: []byte("a"), Value: []byte("1"), Version: 1},
+		string(leafB.hash):  {Key: []byte("b"), Value: []byte("2"), Version: 2},
+		string(leafC.hash):  {Key: []byte("c"), Value: []byte("3"), Version: 1},
+		string(innerB.hash): {Key: []byte("b"), Version: 2, Height: 1},
+		string(rootC.hash):  {Key: []byte("c"), Version: 3, Height: 2},
+	}
+
+	tree, err := NewImmutableTreeFromNodes(rootC.hash, nodes)
+	require.NoError(t, err)
+	require.Equal(t, rootC.hash, tree.Hash())
+	require.Equal(t, int64(3), tree.Version())
+	require.Equal(t, int64(3), tree.Size())
+	for key, value := range map[string]string{"a": "1", "b": "2", "c": "3"} {
+		got, err := tree.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), got)
+	}
+	value, err := tree.Get([]byte("d"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	proof, err := tree.GetMembershipProof([]byte("b"))
+	require.NoError(t, err)
+	ok, err := tree.VerifyMembership(proof, []byte("b"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	var keys []string
+	_, err = tree.Iterate(func(key, _ []byte) bool {
+		keys = append(keys, string(key))
+		return false
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, keys)
+
+	empty, err := NewImmutableTreeFromNodes(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), empty.Size())
+
+	// an unused node
+	extra := &Node{key: []byte("d"), value: []byte("4"), size: 1}
+	extra._hash(1)
+	nodes[string(extra.hash)] = &ExportNode{Key: []byte("d"), Value: []byte("4"), Version: 1}
+	_, err = NewImmutableTreeFromNodes(rootC.hash, nodes)
+	require.Error(t, err)
+	delete(nodes, string(extra.hash))
+
+	// a leaf which does not match its hash
+	nodes[string(leafB.hash)].Value = []byte("changed")
+	_, err = NewImmutableTreeFromNodes(rootC.hash, nodes)
+	require.Error(t, err)
+	nodes[string(leafB.hash)].Value = []byte("2")
+
+	// an inner node with the wrong version
+	nodes[string(rootC.hash)].Version = 4
+	_, err = NewImmutableTreeFromNodes(rootC.hash, nodes)
+	require.Error(t, err)
+	nodes[string(rootC.hash)].Version = 3
+
+	_, err = NewImmutableTreeFromNodes([]byte("missing"), nodes)
+	require.Error(t, err)
+
+	// the nodes of a saved tree
+	saved := NewMutableTree(dbm.NewMemDB(), 0, true, NewNopLogger())
+	for version := 1; version <= 3; version++ {
+		for i := 0; i < 40; i++ {
+			_, err := saved.Set([]byte(fmt.Sprintf("k%02d", (i*version)%60)), []byte(fmt.Sprintf("v%d", version)))
+			require.NoError(t, err)
+		}
+		_, _, err := saved.SaveVersion()
+		require.NoError(t, err)
+	}
+	nodes = make(map[string]*ExportNode)
+	var walk func(node *Node)
+	walk = func(node *Node) {
+		nodes[string(node.hash)] = &ExportNode{Key: node.key, Value: node.value, Version: node.nodeKey.version, Height: node.subtreeHeight}
+		if !node.isLeaf() {
+			left, err := node.getLeftNode(saved.ImmutableTree)
+			require.NoError(t, err)
+			walk(left)
+			right, err := node.getRightNode(saved.ImmutableTree)
+			require.NoError(t, err)
+			walk(right)
+		}
+	}
+	walk(saved.root)
+	tree, err = NewImmutableTreeFromNodes(saved.Hash(), nodes)
+	require.NoError(t, err)
+	require.Equal(t, saved.Hash(), tree.Hash())
+	require.Equal(t, saved.Size(), tree.Size())
+}
@@ -0,0 +1,185 @@
+package iavl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// WAL records are framed as a 4-byte big-endian payload length, the 4-byte CRC32 (Castagnoli)
+// of the payload and the payload. The payload is the record type, the version as a varint and,
+// for walRecordChangeSet, the ChangeSet protobuf. A truncated or corrupt record ends the log,
+// so that a record torn by a crash is ignored.
+const (
+	walRecordChangeSet byte = 1 // the operations of a version, written before its nodes
+	walRecordCommit    byte = 2 // the version is committed
+	walRecordAbort     byte = 3 // the version was prepared with MutableTree.PrepareCommit and aborted
+
+	walHeaderSize = 8
+)
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrWALVersionMismatch is returned by RecoverFromWAL when the incomplete version of the WAL does
+// not follow the loaded version.
+var ErrWALVersionMismatch = errors.New("incomplete WAL version does not follow the loaded version")
+
+// recordWALOp appends a Set or Remove to the operations of the working version, with Options.WAL.
+func (tree *MutableTree) recordWALOp(pair *KVPair) {
+	if tree.ndb.opts.WAL != nil {
+		tree.walOps = append(tree.walOps, pair)
+	}
+}
+
+func (tree *MutableTree) writeWALChangeSet(version int64) error {
+	payload, err := (&ChangeSet{Pairs: tree.walOps}).Marshal()
+	if err != nil {
+		return err
+	}
+	return writeWALRecord(tree.ndb.opts.WAL, walRecordChangeSet, version, payload)
+}
+
+func writeWALRecord(w io.Writer, recordType byte, version int64, payload []byte) error {
+	buf := make([]byte, walHeaderSize, walHeaderSize+1+binary.MaxVarintLen64+len(payload))
+	buf = append(buf, recordType)
+	buf = binary.AppendVarint(buf, version)
+	buf = append(buf, payload...)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-walHeaderSize))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[walHeaderSize:], walCRCTable))
+	// a single write, so that a crash tears at most the last record
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("writing WAL record: %w", err)
+	}
+	return nil
+}
+
+type walRecord struct {
+	recordType byte
+	version    int64
+	changeSet  *ChangeSet
+}
+
+// readWALRecord reads the next record and its size, and returns io.EOF at the end of the log,
+// including a torn or corrupt record.
+func readWALRecord(r *bufio.Reader) (*walRecord, int64, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, 0, walEOF(err)
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	// copy incrementally, so that a torn length fails on the missing data instead of on memory
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r, size); err != nil {
+		return nil, 0, walEOF(err)
+	}
+	payload := buf.Bytes()
+	if crc32.Checksum(payload, walCRCTable) != binary.BigEndian.Uint32(header[4:8]) || len(payload) == 0 {
+		return nil, 0, io.EOF
+	}
+
+	record := &walRecord{recordType: payload[0]}
+	version, n := binary.Varint(payload[1:])
+	if n <= 0 {
+		return nil, 0, fmt.Errorf("decoding WAL record version, %d bytes", len(payload))
+	}
+	record.version = version
+	switch record.recordType {
+	case walRecordChangeSet:
+		record.changeSet = &ChangeSet{}
+		if err := record.changeSet.Unmarshal(payload[1+n:]); err != nil {
+			return nil, 0, fmt.Errorf("decoding WAL changeset of version %d: %w", version, err)
+		}
+	case walRecordCommit, walRecordAbort:
+	default:
+		return nil, 0, fmt.Errorf("unknown WAL record type %d", record.recordType)
+	}
+	return record, walHeaderSize + size, nil
+}
+
+func walEOF(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return io.EOF
+	}
+	return err
+}
+
+// truncatableWAL is implemented by WALs such as *os.File, whose torn final record can be removed.
+type truncatableWAL interface {
+	io.Seeker
+	Truncate(size int64) error
+}
+
+// RecoverFromWAL reads Options.WAL and replays the operations of the last version whose
+// SaveVersion did not complete, e.g. because of a crash, or whose prepared commit was neither
+// committed nor aborted, and returns it, or 0 if all the versions
+// are complete. The tree must be loaded at the version preceding the incomplete one, without
+// pending changes. The WAL is read to its end, so that the following records are appended. A torn
+// final record is removed if the WAL has Truncate and Seek methods like *os.File, and must be
+// removed by the caller otherwise.
+func (tree *MutableTree) RecoverFromWAL() (int64, error) {
+	if tree.closed.Load() {
+		return 0, ErrClosed
+	}
+	if tree.prepared {
+		return 0, ErrCommitPrepared
+	}
+	if tree.ndb.opts.WAL == nil {
+		return 0, errors.New("no WAL configured")
+	}
+
+	var (
+		incomplete *walRecord
+		validSize  int64
+	)
+	r := bufio.NewReader(tree.ndb.opts.WAL)
+	for {
+		record, size, err := readWALRecord(r)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		validSize += size
+		switch {
+		case record.recordType == walRecordChangeSet:
+			incomplete = record
+		case incomplete != nil && record.version == incomplete.version:
+			incomplete = nil
+		}
+	}
+	if wal, ok := tree.ndb.opts.WAL.(truncatableWAL); ok {
+		if err := wal.Truncate(validSize); err != nil {
+			return 0, fmt.Errorf("truncating WAL: %w", err)
+		}
+		if _, err := wal.Seek(validSize, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("seeking WAL: %w", err)
+		}
+	}
+	if incomplete == nil {
+		return 0, nil
+	}
+
+	if tree.VersionExists(incomplete.version) {
+		// the nodes were committed but not the completion record
+		return 0, writeWALRecord(tree.ndb.opts.WAL, walRecordCommit, incomplete.version, nil)
+	}
+	if tree.WorkingVersion() != incomplete.version {
+		return 0, fmt.Errorf("%w: WAL version %d, loaded version %d", ErrWALVersionMismatch, incomplete.version, tree.version)
+	}
+	if tree.root != tree.lastSaved.root {
+		return 0, errors.New("cannot recover from WAL with uncommitted changes")
+	}
+
+	if err := tree.SetBatch(incomplete.changeSet.Pairs); err != nil {
+		return 0, err
+	}
+	if _, _, err := tree.SaveVersion(); err != nil {
+		return 0, err
+	}
+	return incomplete.version, nil
+}